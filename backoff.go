@@ -0,0 +1,59 @@
+package duplex
+
+import (
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// BackoffPolicy decides how long to wait before a retry attempt. Attempts are
+// numbered from zero.
+type BackoffPolicy interface {
+	Delay(attempt int) time.Duration
+}
+
+// ConstantBackoff waits the same amount of time before every attempt.
+type ConstantBackoff time.Duration
+
+func (b ConstantBackoff) Delay(attempt int) time.Duration {
+	return time.Duration(b)
+}
+
+// ExponentialBackoff grows the delay by Multiplier on every attempt, capped at
+// Max. Jitter randomizes each delay by up to the given fraction in either
+// direction, so that many clients recovering from the same outage do not
+// retry in lockstep.
+type ExponentialBackoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	Jitter     float64
+}
+
+// DefaultBackoff returns the policy used when none is configured.
+func DefaultBackoff() *ExponentialBackoff {
+	return &ExponentialBackoff{
+		Initial:    time.Second,
+		Max:        time.Minute,
+		Multiplier: 2,
+		Jitter:     0.2,
+	}
+}
+
+func (b *ExponentialBackoff) Delay(attempt int) time.Duration {
+	multiplier := b.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	delay := float64(b.Initial) * math.Pow(multiplier, float64(attempt))
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+
+	if b.Jitter > 0 {
+		delay += delay * b.Jitter * (2*rand.Float64() - 1)
+	}
+
+	return time.Duration(max(delay, 0))
+}
@@ -0,0 +1,120 @@
+package duplex
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	b := &ExponentialBackoff{Initial: 100 * time.Millisecond, Max: time.Second, Multiplier: 2}
+	for attempt, want := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		if got := b.Delay(attempt); got != want*time.Millisecond {
+			t.Fatalf("attempt %d: %v, want %v", attempt, got, want*time.Millisecond)
+		}
+	}
+
+	b.Jitter = 0.5
+	for range 100 {
+		if d := b.Delay(0); d < 50*time.Millisecond || d > 150*time.Millisecond {
+			t.Fatalf("jittered delay %v out of range", d)
+		}
+	}
+}
+
+func TestRetrySettings(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	if i.MaxRetries != 5 || i.SetupTimeout != 15*time.Second {
+		t.Fatalf("defaults: %d retries, %v setup timeout", i.MaxRetries, i.SetupTimeout)
+	}
+	if _, ok := i.backoff().(*ExponentialBackoff); !ok {
+		t.Fatalf("default policy %T", i.backoff())
+	}
+
+	i = New("alpha", &Config{MaxRetries: -1, ReconnectPolicy: ConstantBackoff(time.Second), LogLevel: zerolog.Disabled})
+	if i.MaxRetries != 0 || i.backoff().Delay(7) != time.Second {
+		t.Fatalf("%d retries, policy %v", i.MaxRetries, i.backoff())
+	}
+}
+
+// unreachable returns an instance whose signaling server refuses connections.
+func unreachable(t *testing.T, args *Config) *Instance {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	args.Hostname = "127.0.0.1"
+	args.Port = l.Addr().(*net.TCPAddr).Port
+	args.LogLevel = zerolog.Disabled
+	return New("alpha", args)
+}
+
+func TestReconnectHooksAndGiveUp(t *testing.T) {
+	i := unreachable(t, &Config{MaxRetries: 3, ReconnectPolicy: ConstantBackoff(10 * time.Millisecond)})
+
+	var mu sync.Mutex
+	var attempts []int
+	var delays []time.Duration
+	gave_up := make(chan int, 1)
+	i.OnReconnecting = func(attempt int, delay time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts = append(attempts, attempt)
+		delays = append(delays, delay)
+	}
+	i.OnGiveUp = func(n int) { gave_up <- n }
+
+	i.AttemptReconnect()
+	select {
+	case n := <-gave_up:
+		if n != 3 {
+			t.Fatalf("gave up after %d attempts", n)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("never gave up")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(attempts) != 3 || attempts[0] != 1 || attempts[2] != 3 {
+		t.Fatalf("attempts %v", attempts)
+	}
+	if delays[0] != 0 || delays[1] != 10*time.Millisecond {
+		t.Fatalf("delays %v", delays)
+	}
+}
+
+func TestReconnectSkipsBackoff(t *testing.T) {
+	i := unreachable(t, &Config{MaxRetries: 5, ReconnectPolicy: ConstantBackoff(time.Hour)})
+
+	attempts := make(chan int, 8)
+	i.OnReconnecting = func(attempt int, delay time.Duration) { attempts <- attempt }
+
+	next := func() int {
+		t.Helper()
+		select {
+		case n := <-attempts:
+			return n
+		case <-time.After(10 * time.Second):
+			t.Fatal("no reconnect attempt")
+			return 0
+		}
+	}
+
+	i.AttemptReconnect()
+	next()
+	if n := next(); n != 2 {
+		t.Fatalf("attempt %d", n)
+	}
+
+	// The loop is now waiting out an hour of backoff
+	i.Reconnect()
+	if n := next(); n != 2 {
+		t.Fatalf("attempt %d after the counter was reset", n)
+	}
+}
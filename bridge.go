@@ -0,0 +1,403 @@
+package duplex
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/gorilla/websocket"
+)
+
+// CL4Packet is a message in the classic CloudLink 4 dialect.
+type CL4Packet struct {
+	Cmd      string          `json:"cmd"`
+	Val      json.RawMessage `json:"val,omitempty"`
+	Name     string          `json:"name,omitempty"`
+	Id       string          `json:"id,omitempty"`
+	Listener string          `json:"listener,omitempty"`
+	Origin   json.RawMessage `json:"origin,omitempty"`
+	Mode     string          `json:"mode,omitempty"`
+	Code     string          `json:"code,omitempty"`
+	Rooms    any             `json:"rooms,omitempty"`
+}
+
+type CL4User struct {
+	Id       string `json:"id,omitempty"`
+	Username string `json:"username"`
+	UUID     string `json:"uuid,omitempty"`
+}
+
+// MessageArgs is the payload of P_MSG.
+type MessageArgs struct {
+	Data any `json:"data,omitempty"`
+}
+
+type RxMessageArgs struct {
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// VariableArgs is the payload of G_VAR and P_VAR.
+type VariableArgs struct {
+	Name string `json:"name"`
+	Data any    `json:"data,omitempty"`
+}
+
+type RxVariableArgs struct {
+	Name string          `json:"name"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+type BridgeUsersArgs struct {
+	Users []string `json:"users"`
+}
+
+// bridge_link is a CloudLink 4 session opened on behalf of one duplex peer, so
+// that each duplex peer appears as its own user on the CloudLink 4 server.
+type bridge_link struct {
+	peer     *Peer
+	username string
+	ws       *websocket.Conn
+	mu       sync.Mutex
+	users    map[string]struct{}
+}
+
+// room returns the single room a CloudLink 4 packet is scoped to, if any.
+func (p *CL4Packet) room() string {
+	switch rooms := p.Rooms.(type) {
+	case string:
+		return rooms
+	case []any:
+		if len(rooms) == 1 {
+			if room, ok := rooms[0].(string); ok {
+				return room
+			}
+		}
+	}
+	return ""
+}
+
+// origin returns the CloudLink 4 username carried in a packet's origin field,
+// which is an object in current servers and a plain string in older ones.
+func (p *CL4Packet) origin() string {
+	if len(p.Origin) == 0 {
+		return ""
+	}
+	var user CL4User
+	if err := json.Unmarshal(p.Origin, &user); err == nil {
+		return user.Username
+	}
+	var name string
+	if err := json.Unmarshal(p.Origin, &name); err == nil {
+		return name
+	}
+	return ""
+}
+
+// bridgeUsername returns the name a duplex peer is given on the CloudLink 4 server.
+func (i *Instance) bridgeUsername(p *Peer) string {
+	if fn := i.BridgeUsername; fn != nil {
+		return fn(p)
+	}
+	return p.GetPeerID()
+}
+
+// BridgeUsers returns the CloudLink 4 users visible through a peer's link,
+// under their duplex-side names.
+func (i *Instance) BridgeUsers(p *Peer) []string {
+	link, ok := i.bridgeLink(p)
+	if !ok {
+		return nil
+	}
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	var users []string
+	for user := range link.users {
+		users = append(users, i.BridgePrefix+user)
+	}
+	return users
+}
+
+func (i *Instance) bridgeLink(p *Peer) (*bridge_link, bool) {
+	i.bridgesMu.Lock()
+	defer i.bridgesMu.Unlock()
+	link, ok := i.bridges[p]
+	return link, ok
+}
+
+// bridge opens a CloudLink 4 session for a negotiated client peer.
+func (i *Instance) bridge(p *Peer) {
+	if !i.IsBridge || i.BridgeURL == "" || !p.IsClient() {
+		return
+	}
+
+	// Give up on the dial if the peer leaves in the meantime
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	closed := p.Closed()
+	go func() {
+		select {
+		case <-closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// The handshake only watches the context while connecting, so the
+	// connection is closed to interrupt it afterwards
+	var stop func() bool
+	dialer := websocket.Dialer{
+		HandshakeTimeout: i.SetupTimeout,
+		NetDialContext: func(dial_ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := new(net.Dialer).DialContext(dial_ctx, network, addr)
+			if err == nil {
+				stop = context.AfterFunc(ctx, func() { conn.Close() })
+			}
+			return conn, err
+		},
+	}
+	ws, _, err := dialer.DialContext(ctx, i.BridgeURL, nil)
+	if err == nil && !stop() {
+		ws.Close()
+		err = ErrPeerClosed
+	}
+	if err != nil {
+		if !p.closed() {
+			p.Logger.Error().Err(err).Str("url", i.BridgeURL).Msg("failed to open bridge link")
+		}
+		return
+	}
+
+	link := &bridge_link{
+		peer:     p,
+		username: i.bridgeUsername(p),
+		ws:       ws,
+		users:    make(map[string]struct{}),
+	}
+
+	// unbridge runs after the peer closes, so a link added after that would
+	// never be closed
+	i.bridgesMu.Lock()
+	if _, exists := i.bridges[p]; exists || p.closed() {
+		i.bridgesMu.Unlock()
+		ws.Close()
+		return
+	}
+	i.bridges[p] = link
+	i.bridgesMu.Unlock()
+
+	p.Logger.Info().Str("username", link.username).Msg("bridge link opened")
+
+	link.send(&CL4Packet{Cmd: "handshake", Val: encodeValue(map[string]string{"language": "Go", "version": "duplex"})})
+	link.send(&CL4Packet{Cmd: "setid", Val: encodeValue(link.username)})
+
+	go i.readBridge(link)
+}
+
+// unbridge closes the CloudLink 4 session of a closed peer.
+func (i *Instance) unbridge(p *Peer) {
+	i.bridgesMu.Lock()
+	link, ok := i.bridges[p]
+	delete(i.bridges, p)
+	i.bridgesMu.Unlock()
+	if ok {
+		link.ws.Close()
+	}
+}
+
+func (l *bridge_link) send(packet *CL4Packet) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if err := l.ws.WriteJSON(packet); err != nil {
+		l.peer.Logger.Warn().Err(err).Str("cmd", packet.Cmd).Msg("failed to write to bridge link")
+	}
+}
+
+// encodeValue marshals a CloudLink 4 val, which is dropped if it cannot be encoded.
+func encodeValue(v any) json.RawMessage {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// readBridge translates CloudLink 4 messages into duplex packets for the linked peer.
+func (i *Instance) readBridge(link *bridge_link) {
+	defer i.unbridge(link.peer)
+
+	p := link.peer
+	prefix := i.BridgePrefix
+	for {
+		_, raw, err := link.ws.ReadMessage()
+		if err != nil {
+			select {
+			case <-p.Closed():
+			default:
+				p.Logger.Warn().Err(err).Msg("bridge link closed")
+			}
+			return
+		}
+
+		var packet CL4Packet
+		if err := json.Unmarshal(raw, &packet); err != nil {
+			p.Logger.Warn().Err(err).Msg("dropped malformed bridge packet")
+			continue
+		}
+
+		origin := packet.origin()
+		if origin == link.username {
+			// Our own broadcast echoed back
+			continue
+		}
+		if origin != "" {
+			origin = prefix + origin
+		}
+
+		switch packet.Cmd {
+		case "gmsg":
+			p.Write(&TxPacket{
+				Packet:  Packet{Opcode: "G_MSG", Origin: origin, TTL: 1},
+				Payload: RxRoomMessageArgs{Room: packet.room(), Data: packet.Val},
+			})
+
+		case "pmsg":
+			p.Write(&TxPacket{
+				Packet:  Packet{Opcode: "P_MSG", Origin: origin, Target: p.GetPeerID(), TTL: 1},
+				Payload: RxMessageArgs{Data: packet.Val},
+			})
+
+		case "gvar":
+			p.Write(&TxPacket{
+				Packet:  Packet{Opcode: "G_VAR", Origin: origin, TTL: 1},
+				Payload: RxVariableArgs{Name: packet.Name, Data: packet.Val},
+			})
+
+		case "pvar":
+			p.Write(&TxPacket{
+				Packet:  Packet{Opcode: "P_VAR", Origin: origin, Target: p.GetPeerID(), TTL: 1},
+				Payload: RxVariableArgs{Name: packet.Name, Data: packet.Val},
+			})
+
+		case "ulist":
+			link.updateUsers(&packet)
+			p.Write(&TxPacket{
+				Packet:  Packet{Opcode: "BRIDGE_USERS", TTL: 1},
+				Payload: BridgeUsersArgs{Users: i.BridgeUsers(p)},
+			})
+
+		case "statuscode":
+			if !strings.HasPrefix(packet.Code, "I:100") && packet.Code != "" {
+				p.Logger.Warn().Str("code", packet.Code).Msg("bridge server reported status")
+			}
+
+		default:
+			p.Logger.Debug().Str("cmd", packet.Cmd).Msg("ignored bridge packet")
+		}
+	}
+}
+
+// updateUsers applies a CloudLink 4 ulist update.
+func (l *bridge_link) updateUsers(packet *CL4Packet) {
+	names := func() []string {
+		var users []CL4User
+		if err := json.Unmarshal(packet.Val, &users); err == nil {
+			var names []string
+			for _, user := range users {
+				names = append(names, user.Username)
+			}
+			return names
+		}
+		var user CL4User
+		if err := json.Unmarshal(packet.Val, &user); err == nil && user.Username != "" {
+			return []string{user.Username}
+		}
+		// Legacy servers send a semicolon-separated string
+		var list string
+		if err := json.Unmarshal(packet.Val, &list); err == nil {
+			return strings.FieldsFunc(list, func(r rune) bool { return r == ';' })
+		}
+		return nil
+	}()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch packet.Mode {
+	case "add":
+		for _, name := range names {
+			l.users[name] = struct{}{}
+		}
+	case "remove":
+		for _, name := range names {
+			delete(l.users, name)
+		}
+	default:
+		l.users = make(map[string]struct{})
+		for _, name := range names {
+			l.users[name] = struct{}{}
+		}
+	}
+	delete(l.users, l.username)
+}
+
+// toBridge translates a packet from a linked duplex peer into the CloudLink 4
+// dialect. It returns true if the packet was consumed by the bridge.
+func (conn *Peer) toBridge(r *RxPacket) bool {
+	i := conn.Parent
+	link, ok := i.bridgeLink(conn)
+	if !ok {
+		return false
+	}
+
+	prefix := i.BridgePrefix
+	recipient, private := strings.CutPrefix(r.Target, prefix)
+
+	switch r.Opcode {
+	case "G_MSG":
+		var args RxRoomMessageArgs
+		if err := json.Unmarshal(r.Payload, &args); err != nil {
+			return false
+		}
+		packet := &CL4Packet{Cmd: "gmsg", Val: args.Data}
+		if args.Room != "" {
+			packet.Rooms = args.Room
+		}
+		link.send(packet)
+		return true
+
+	case "P_MSG":
+		if !private {
+			return false
+		}
+		var args RxMessageArgs
+		if err := json.Unmarshal(r.Payload, &args); err != nil {
+			return false
+		}
+		link.send(&CL4Packet{Cmd: "pmsg", Val: args.Data, Id: recipient})
+		return true
+
+	case "G_VAR":
+		var args RxVariableArgs
+		if err := json.Unmarshal(r.Payload, &args); err != nil {
+			return false
+		}
+		link.send(&CL4Packet{Cmd: "gvar", Name: args.Name, Val: args.Data})
+		return true
+
+	case "P_VAR":
+		if !private {
+			return false
+		}
+		var args RxVariableArgs
+		if err := json.Unmarshal(r.Payload, &args); err != nil {
+			return false
+		}
+		link.send(&CL4Packet{Cmd: "pvar", Name: args.Name, Val: args.Data, Id: recipient})
+		return true
+	}
+
+	return false
+}
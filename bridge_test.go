@@ -0,0 +1,231 @@
+package duplex
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+)
+
+func TestCL4PacketFields(t *testing.T) {
+	var packet CL4Packet
+	json.Unmarshal([]byte(`{"cmd":"gmsg","origin":{"id":"1","username":"bob"},"rooms":["lobby"]}`), &packet)
+	if packet.origin() != "bob" || packet.room() != "lobby" {
+		t.Fatalf("origin %q, room %q", packet.origin(), packet.room())
+	}
+
+	packet = CL4Packet{}
+	json.Unmarshal([]byte(`{"cmd":"gmsg","origin":"carol","rooms":["a","b"]}`), &packet)
+	if packet.origin() != "carol" || packet.room() != "" {
+		t.Fatalf("origin %q, room %q", packet.origin(), packet.room())
+	}
+}
+
+func TestBridgeUserList(t *testing.T) {
+	link := &bridge_link{username: "me", users: make(map[string]struct{})}
+	update := func(mode, val string) {
+		link.updateUsers(&CL4Packet{Cmd: "ulist", Mode: mode, Val: json.RawMessage(val)})
+	}
+	users := func() []string {
+		var names []string
+		for name := range link.users {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return names
+	}
+
+	update("set", `[{"username":"me"},{"username":"bob"},{"username":"carol"}]`)
+	if got := users(); !slices.Equal(got, []string{"bob", "carol"}) {
+		t.Fatalf("users %v", got)
+	}
+	update("add", `{"username":"dave"}`)
+	update("remove", `{"username":"bob"}`)
+	if got := users(); !slices.Equal(got, []string{"carol", "dave"}) {
+		t.Fatalf("users %v", got)
+	}
+	update("", `"erin;frank;"`)
+	if got := users(); !slices.Equal(got, []string{"erin", "frank"}) {
+		t.Fatalf("users from a legacy list %v", got)
+	}
+}
+
+// cl4Server accepts a single bridge link and records what it sends.
+type cl4Server struct {
+	url  string
+	conn chan *websocket.Conn
+	got  chan CL4Packet
+}
+
+func newCL4Server(t *testing.T) *cl4Server {
+	s := &cl4Server{conn: make(chan *websocket.Conn, 1), got: make(chan CL4Packet, 16)}
+	var upgrader websocket.Upgrader
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		s.conn <- ws
+		for {
+			var packet CL4Packet
+			if err := ws.ReadJSON(&packet); err != nil {
+				close(s.got)
+				return
+			}
+			s.got <- packet
+		}
+	}))
+	t.Cleanup(srv.Close)
+	s.url = "ws" + strings.TrimPrefix(srv.URL, "http")
+	return s
+}
+
+func (s *cl4Server) next(t *testing.T, cmd string) CL4Packet {
+	t.Helper()
+	select {
+	case packet, ok := <-s.got:
+		if !ok {
+			t.Fatalf("link closed while waiting for %s", cmd)
+		}
+		if packet.Cmd != cmd {
+			t.Fatalf("got %s, want %s", packet.Cmd, cmd)
+		}
+		return packet
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no %s sent", cmd)
+		return CL4Packet{}
+	}
+}
+
+func TestBridgeLink(t *testing.T) {
+	server := newCL4Server(t)
+	i := New("alpha", &Config{BridgeURL: server.url, LogLevel: zerolog.Disabled})
+	i.IsBridge = true
+	i.BridgeUsername = func(*Peer) string { return "alice" }
+	p := unopenedPeer(i)
+
+	i.bridge(p)
+	ws := <-server.conn
+	server.next(t, "handshake")
+	if setid := server.next(t, "setid"); string(setid.Val) != `"alice"` {
+		t.Fatalf("setid %s", setid.Val)
+	}
+
+	send := func(packet Packet, payload any) {
+		raw, _ := json.Marshal(payload)
+		packet.TTL = 1
+		p.HandlePacket(&RxPacket{Packet: packet, Payload: raw})
+	}
+	send(Packet{Opcode: "G_MSG"}, RoomMessageArgs{Room: "lobby", Data: "hi"})
+	if gmsg := server.next(t, "gmsg"); string(gmsg.Val) != `"hi"` || gmsg.Rooms != "lobby" {
+		t.Fatalf("gmsg %+v", gmsg)
+	}
+	send(Packet{Opcode: "P_MSG", Target: "cl4:bob"}, MessageArgs{Data: 1})
+	if pmsg := server.next(t, "pmsg"); pmsg.Id != "bob" {
+		t.Fatalf("pmsg to %q", pmsg.Id)
+	}
+	send(Packet{Opcode: "P_VAR", Target: "cl4:bob"}, VariableArgs{Name: "x", Data: 2})
+	if pvar := server.next(t, "pvar"); pvar.Id != "bob" || pvar.Name != "x" {
+		t.Fatalf("pvar %+v", pvar)
+	}
+
+	ws.WriteJSON(CL4Packet{Cmd: "ulist", Mode: "set", Val: json.RawMessage(`[{"username":"alice"},{"username":"bob"}]`)})
+	deadline := time.Now().Add(5 * time.Second)
+	for !slices.Equal(i.BridgeUsers(p), []string{"cl4:bob"}) {
+		if time.Now().After(deadline) {
+			t.Fatalf("bridge users %v", i.BridgeUsers(p))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	i.unbridge(p)
+	select {
+	case _, open := <-server.got:
+		if open {
+			t.Fatal("link still sending after unbridge")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("link not closed")
+	}
+}
+
+func TestBridgeOnlyLinksClients(t *testing.T) {
+	server := newCL4Server(t)
+	i := New("alpha", &Config{BridgeURL: server.url, LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+
+	i.bridge(p)
+	i.IsBridge = true
+	p.IsRelay = true
+	i.bridge(p)
+	if _, ok := i.bridgeLink(p); ok {
+		t.Fatal("linked a peer that is not a client")
+	}
+	if len(server.conn) != 0 {
+		t.Fatal("opened a link")
+	}
+}
+
+func TestBridgeDialEndsWithPeer(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { <-release }))
+	defer srv.Close()
+	defer close(release)
+
+	i := New("alpha", &Config{BridgeURL: "ws" + strings.TrimPrefix(srv.URL, "http"), SetupTimeout: 10000, LogLevel: zerolog.Disabled})
+	i.IsBridge = true
+	p := unopenedPeer(i)
+
+	time.AfterFunc(50*time.Millisecond, func() { close(p.Done) })
+	if !returnsWithin(func() { i.bridge(p) }, 2*time.Second) {
+		t.Fatal("bridge kept dialing for a closed peer")
+	}
+	if _, ok := i.bridgeLink(p); ok {
+		t.Fatal("linked a closed peer")
+	}
+}
+
+func TestBridgeSkipsClosedPeer(t *testing.T) {
+	server := newCL4Server(t)
+	i := New("alpha", &Config{BridgeURL: server.url, LogLevel: zerolog.Disabled})
+	i.IsBridge = true
+	p := unopenedPeer(i)
+
+	close(p.Done)
+	i.bridge(p)
+	if _, ok := i.bridgeLink(p); ok {
+		t.Fatal("linked a closed peer")
+	}
+}
+
+func TestRemappedHandlerPrecedesBridge(t *testing.T) {
+	server := newCL4Server(t)
+	i := New("alpha", &Config{BridgeURL: server.url, LogLevel: zerolog.Disabled})
+	i.IsBridge = true
+	var remapped int
+	i.Remap("G_MSG", func(*Peer, *RxPacket) { remapped++ })
+	p := unopenedPeer(i)
+
+	i.bridge(p)
+	server.next(t, "handshake")
+	server.next(t, "setid")
+
+	payload, _ := json.Marshal(RoomMessageArgs{Data: "yo"})
+	p.HandlePacket(&RxPacket{Packet: Packet{Opcode: "G_MSG", TTL: 1}, Payload: payload})
+	if remapped != 1 {
+		t.Fatal("remapped handler not called")
+	}
+
+	// Links write in order, so the G_MSG would have arrived first
+	payload, _ = json.Marshal(VariableArgs{Name: "x", Data: 1})
+	p.HandlePacket(&RxPacket{Packet: Packet{Opcode: "G_VAR", TTL: 1}, Payload: payload})
+	server.next(t, "gvar")
+	i.unbridge(p)
+}
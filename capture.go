@@ -0,0 +1,176 @@
+package duplex
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// CaptureOptions configures packet capture. Packets are appended to Path as
+// JSON lines, one CaptureRecord per line. Once the file reaches MaxSize it is
+// renamed to Path.1, older files move up by one, and files past MaxFiles are
+// removed.
+type CaptureOptions struct {
+	Path     string   `json:"path,omitempty"`
+	MaxSize  int64    `json:"max_size,omitempty"`  // Bytes written before the file is rotated (default 64 MiB)
+	MaxFiles int      `json:"max_files,omitempty"` // Rotated files kept besides the current one (default 5)
+	Opcodes  []string `json:"opcodes,omitempty"`   // Only capture these opcodes, if set
+	Peers    []string `json:"peers,omitempty"`     // Only capture packets to and from these peer IDs, if set
+}
+
+// CaptureRecord is a captured packet.
+type CaptureRecord struct {
+	Time      time.Time       `json:"time"`
+	Direction string          `json:"direction"` // "in" or "out"
+	Peer      string          `json:"peer"`
+	Opcode    string          `json:"opcode"`
+	Size      int             `json:"size"` // Size of the packet on the wire, in bytes
+	Packet    json.RawMessage `json:"packet"`
+}
+
+// packet_capture writes captured packets to a rotating file.
+type packet_capture struct {
+	opts CaptureOptions
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// StartCapture starts recording packets, replacing any capture in progress.
+func (i *Instance) StartCapture(opts CaptureOptions) error {
+	if opts.Path == "" {
+		return fmt.Errorf("capture path is empty")
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = 64 << 20
+	}
+	if opts.MaxFiles <= 0 {
+		opts.MaxFiles = 5
+	}
+
+	c := &packet_capture{opts: opts}
+	if err := c.open(); err != nil {
+		return err
+	}
+	if old := i.capture.Swap(c); old != nil {
+		old.close()
+	}
+	i.Logger.Info().Str("path", opts.Path).Msg("capturing packets")
+	return nil
+}
+
+// StopCapture stops recording packets and closes the capture file.
+func (i *Instance) StopCapture() error {
+	if c := i.capture.Swap(nil); c != nil {
+		return c.close()
+	}
+	return nil
+}
+
+// capturePacket records a packet if a capture is running and its filters
+// match. The packet must be a single JSON object.
+func (i *Instance) capturePacket(direction string, p *Peer, raw []byte) {
+	c := i.capture.Load()
+	if c == nil {
+		return
+	}
+
+	peer_id := p.GetPeerID()
+	if len(c.opts.Peers) > 0 && !slices.Contains(c.opts.Peers, peer_id) {
+		return
+	}
+	var header Packet
+	if err := json.Unmarshal(raw, &header); err != nil {
+		return
+	}
+	if len(c.opts.Opcodes) > 0 && !slices.Contains(c.opts.Opcodes, header.Opcode) {
+		return
+	}
+
+	line, err := json.Marshal(CaptureRecord{
+		Time:      time.Now(),
+		Direction: direction,
+		Peer:      peer_id,
+		Opcode:    header.Opcode,
+		Size:      len(raw),
+		Packet:    raw,
+	})
+	if err != nil {
+		return
+	}
+	if err := c.write(append(line, '\n')); err != nil {
+		i.Logger.Error().Err(err).Msg("packet capture failed, stopping")
+		if i.capture.CompareAndSwap(c, nil) {
+			c.close()
+		}
+	}
+}
+
+func (c *packet_capture) open() error {
+	file, err := os.OpenFile(c.opts.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	c.file = file
+	c.size = info.Size()
+	return nil
+}
+
+func (c *packet_capture) write(line []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil {
+		return nil
+	}
+
+	if c.size > 0 && c.size+int64(len(line)) > c.opts.MaxSize {
+		if err := c.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := c.file.Write(line)
+	c.size += int64(n)
+	return err
+}
+
+// rotate shifts Path.N to Path.N+1, dropping the oldest file, and starts a
+// new file at Path.
+func (c *packet_capture) rotate() error {
+	c.file.Close()
+
+	path := c.opts.Path
+	os.Remove(fmt.Sprintf("%s.%d", path, c.opts.MaxFiles))
+	for n := c.opts.MaxFiles - 1; n > 0; n-- {
+		os.Rename(fmt.Sprintf("%s.%d", path, n), fmt.Sprintf("%s.%d", path, n+1))
+	}
+	if err := os.Rename(path, path+".1"); err != nil {
+		c.file = nil
+		return err
+	}
+
+	if err := c.open(); err != nil {
+		c.file = nil
+		return err
+	}
+	return nil
+}
+
+func (c *packet_capture) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
@@ -0,0 +1,199 @@
+package duplex
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog"
+)
+
+func readCapture(t *testing.T, path string) []CaptureRecord {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var records []CaptureRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record CaptureRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid capture line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// pinger is a replayed peer that pings the instance and waits for the PONG.
+type pinger struct {
+	*Peer
+	t     *testing.T
+	pongs chan struct{}
+}
+
+func newPinger(t *testing.T, i *Instance, id string) *pinger {
+	pongs := make(chan struct{}, 16)
+	p := i.replayPeer(id, func(_ *Peer, raw []byte) {
+		var packet Packet
+		if json.Unmarshal(raw, &packet) == nil && packet.Opcode == "PONG" {
+			pongs <- struct{}{}
+		}
+	})
+	t.Cleanup(func() { p.Close() })
+	return &pinger{Peer: p, t: t, pongs: pongs}
+}
+
+func (p *pinger) ping(listener string) {
+	p.t.Helper()
+	raw, _ := json.Marshal(&TxPacket{Packet: Packet{Opcode: "PING", Listener: listener, TTL: 1}, Payload: PingRequest{T1: 1}})
+	p.Emit("data", raw)
+	select {
+	case <-p.pongs:
+	case <-time.After(time.Second):
+		p.t.Fatal("no PONG")
+	}
+}
+
+func TestCaptureRecordsBothDirections(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	if err := i.StartCapture(CaptureOptions{Path: path}); err != nil {
+		t.Fatal(err)
+	}
+	p := newPinger(t, i, "beta")
+
+	p.ping("x")
+	if err := i.StopCapture(); err != nil {
+		t.Fatal(err)
+	}
+	p.ping("y")
+
+	records := readCapture(t, path)
+	if len(records) != 2 {
+		t.Fatalf("%d records", len(records))
+	}
+	in, out := records[0], records[1]
+	if in.Direction != "in" || in.Opcode != "PING" || in.Peer != "beta" || in.Size != len(in.Packet) {
+		t.Fatalf("inbound record %+v", in)
+	}
+	if out.Direction != "out" || out.Opcode != "PONG" || out.Peer != "beta" || out.Time.Before(in.Time) {
+		t.Fatalf("outbound record %+v", out)
+	}
+}
+
+func TestCaptureFilters(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	if err := i.StartCapture(CaptureOptions{Path: path, Opcodes: []string{"PONG"}, Peers: []string{"beta"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer i.StopCapture()
+
+	newPinger(t, i, "beta").ping("x")
+	newPinger(t, i, "gamma").ping("x")
+
+	records := readCapture(t, path)
+	if len(records) != 1 || records[0].Opcode != "PONG" || records[0].Peer != "beta" {
+		t.Fatalf("records %+v", records)
+	}
+}
+
+func TestCaptureRotation(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	if err := i.StartCapture(CaptureOptions{Path: path, MaxSize: 512, MaxFiles: 2}); err != nil {
+		t.Fatal(err)
+	}
+	defer i.StopCapture()
+	p := newPinger(t, i, "beta")
+
+	for n := range 20 {
+		p.ping(fmt.Sprint(n))
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 512 {
+			t.Fatalf("%s is %d bytes", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("kept more than MaxFiles rotated files: %v", err)
+	}
+}
+
+func TestReplayCapture(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	if err := i.StartCapture(CaptureOptions{Path: path}); err != nil {
+		t.Fatal(err)
+	}
+	newPinger(t, i, "beta").ping("b")
+	newPinger(t, i, "gamma").ping("g")
+	i.StopCapture()
+
+	// Replay against a fresh instance, which should answer the captured pings again
+	replayed := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	var mu sync.Mutex
+	written := make(map[string][]string)
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	err = replayed.Replay(context.Background(), file, ReplayOptions{
+		Peers: []string{"beta"},
+		OnWrite: func(p *Peer, raw []byte) {
+			var packet Packet
+			json.Unmarshal(raw, &packet)
+			mu.Lock()
+			defer mu.Unlock()
+			written[p.GetPeerID()] = append(written[p.GetPeerID()], packet.Opcode+"/"+packet.Listener)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(written) != 1 || len(written["beta"]) != 1 || written["beta"][0] != "PONG/b" {
+		t.Fatalf("replay wrote %v", written)
+	}
+}
+
+func TestStartRunsCapture(t *testing.T) {
+	i := unreachable(t, &Config{ReconnectPolicy: ConstantBackoff(time.Hour)})
+	i.Capture = CaptureOptions{Path: filepath.Join(t.TempDir(), "missing", "capture.jsonl")}
+	if err := i.Start(context.Background()); err == nil {
+		t.Fatal("started with an unwritable capture path")
+	}
+
+	i.Capture.Path = filepath.Join(t.TempDir(), "capture.jsonl")
+	if err := i.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if i.capture.Load() == nil {
+		t.Fatal("capture not running")
+	}
+	i.Stop()
+	if err := waitFor(t, i); err != nil {
+		t.Fatal(err)
+	}
+	if i.capture.Load() != nil {
+		t.Fatal("capture still running after Stop")
+	}
+}
@@ -2,45 +2,51 @@ package duplex
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"time"
 	"unicode/utf8"
 
+	peer "github.com/cloudlink-delta/peerjs-go"
 	"github.com/goccy/go-json"
 )
 
 // Goroutine that writes messages to the peer.
 func (c *Peer) Write(packet *TxPacket) {
-	resp, err := json.Marshal(packet)
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+
+	resp, err := c.encode(packet)
 	if err != nil {
-		c.Logger.Error().Err(err).Msg("failed to marshal packet for writing")
+		c.Logger.Error().Err(err).Msg("failed to encode packet for writing")
 		return
 	}
-
-	c.Lock.Lock()
-	defer c.Lock.Unlock()
-	c.Logger.Debug().Str("direction", "out").RawJSON("packet", []byte(packet.String())).Msg("sending packet")
-	c.Send(resp, true)
+	c.packet_log.Debug().Str("direction", "out").RawJSON("packet", []byte(packet.String())).Msg("sending packet")
+	c.last_tx.Store(time.Now().UnixNano())
+	c.send(resp)
 }
 
 // WriteBlocking is a variant of Write that has a blocking mode that exits when
 // it has finished sending the entire message to the recipient.
 func (c *Peer) WriteBlocking(packet *TxPacket) {
-	resp, err := json.Marshal(packet)
+	c.Lock.Lock()
+	resp, err := c.encode(packet)
 	if err != nil {
-		c.Logger.Error().Err(err).Msg("failed to marshal packet for writing")
+		c.Lock.Unlock()
+		c.Logger.Error().Err(err).Msg("failed to encode packet for writing")
 		return
 	}
-
-	c.Lock.Lock()
-	c.Send(resp, true)
+	c.last_tx.Store(time.Now().UnixNano())
+	c.send(resp)
+	dc, done := c.DataChannel, c.Done
 	c.Lock.Unlock()
 
 	// Wait until the buffer is flushed (the message is fully sent)
-	if dc := c.DataChannel; dc != nil {
+	if dc != nil {
 		for dc.BufferedAmount() > 0 {
 			select {
-			case <-c.Done:
+			case <-done:
 				return
 			default:
 				time.Sleep(time.Millisecond)
@@ -49,6 +55,52 @@ func (c *Peer) WriteBlocking(packet *TxPacket) {
 	}
 }
 
+// send writes an encoded packet to the connection, or to the sink of a
+// replayed peer. The caller must hold c.Lock.
+func (c *Peer) send(raw []byte) {
+	c.Parent.capturePacket("out", c, raw)
+	if c.sink != nil {
+		c.sink(raw)
+		return
+	}
+	c.Send(raw, true)
+}
+
+// GetPeerID returns the ID of the remote peer.
+func (c *Peer) GetPeerID() string {
+	return c.id
+}
+
+// Closed returns a channel that is closed when the current connection to the
+// peer closes. Read it through Closed rather than Done when the peer may be
+// redialed, since redialing replaces the channel.
+func (c *Peer) Closed() <-chan bool {
+	return c.done()
+}
+
+// closed reports whether the current connection to the peer has closed.
+func (c *Peer) closed() bool {
+	select {
+	case <-c.Closed():
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Peer) done() chan bool {
+	c.bind.RLock()
+	defer c.bind.RUnlock()
+	return c.Done
+}
+
+// connection returns the current data connection of the peer.
+func (c *Peer) connection() *peer.DataConnection {
+	c.bind.RLock()
+	defer c.bind.RUnlock()
+	return c.DataConnection
+}
+
 // Goroutine that reads incoming messages from the peer.
 func (c *Peer) Read(data any) *RxPacket {
 	var raw []byte
@@ -61,7 +113,7 @@ func (c *Peer) Read(data any) *RxPacket {
 		// If it's already a struct/map, we trust it came from internal code
 		b, err := json.Marshal(v)
 		if err != nil {
-			c.Logger.Error().Err(err).Str("type", fmt.Sprintf("%T", v)).Msg("Unsupported data type")
+			c.packet_log.Error().Err(err).Str("type", fmt.Sprintf("%T", v)).Msg("Unsupported data type")
 			return nil
 		}
 		raw = b
@@ -71,14 +123,14 @@ func (c *Peer) Read(data any) *RxPacket {
 	// PeerJS signaling packets (SDP/ICE) are almost never > 64KB.
 	// This helps mitigate memory exhaustion before parsing.
 	if len(raw) > 1024*64 {
-		c.Logger.Warn().Int("size", len(raw)).Msg("Rejected oversized packet")
+		c.packet_log.Warn().Int("size", len(raw)).Msg("Rejected oversized packet")
 		return nil
 	}
 
 	// Fast UTF-8 Validation
 	// Validating UTF-8 is significantly faster than Unmarshaling JSON.
 	if !utf8.Valid(raw) {
-		c.Logger.Warn().Msg("Rejected binary frame (invalid UTF-8)")
+		c.packet_log.Warn().Msg("Rejected binary frame (invalid UTF-8)")
 		return nil
 	}
 
@@ -87,7 +139,7 @@ func (c *Peer) Read(data any) *RxPacket {
 	// or a double-encoded JSON String (starts with '"').
 	trimmed := bytes.TrimSpace(raw)
 	if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '"') {
-		c.Logger.Warn().Msg("Rejected packet: Not a valid JSON object or string")
+		c.packet_log.Warn().Msg("Rejected packet: Not a valid JSON object or string")
 		return nil
 	}
 
@@ -109,18 +161,23 @@ func (c *Peer) Read(data any) *RxPacket {
 	if err := json.Unmarshal(raw, &packet); err != nil {
 		// Log error but don't include the raw data if it's too large
 		// to prevent log-filling attacks
-		c.Logger.Error().Msg("Error unmarshaling inner packet")
+		c.packet_log.Error().Msg("Error unmarshaling inner packet")
 		return nil
 	}
 
+	c.Parent.capturePacket("in", c, raw)
 	return &packet
 }
 
-// Returns the peer's preferred ID.
+// Returns the peer's preferred ID, which is the username it claimed with us
+// if it has one.
 func (c *Peer) GiveName() string {
 	if c.GiveNameRemapper != nil {
 		return c.GiveNameRemapper()
 	}
+	if name, ok := c.Parent.NameOf(c); ok {
+		return name
+	}
 	return fmt.Sprintf("[%s]", c.GetPeerID())
 }
 
@@ -130,3 +187,32 @@ func (c *Peer) IsClient() bool {
 		!c.IsDiscovery &&
 		!c.IsBridge
 }
+
+// BindListener registers a callback for packets tagged with the given listener string.
+func (c *Peer) BindListener(tag string, listener Listener) {
+	c.ListenerLock.Lock()
+	defer c.ListenerLock.Unlock()
+	c.Listeners[tag] = listener
+}
+
+// UnbindListener removes the callback registered for the given listener string.
+func (c *Peer) UnbindListener(tag string) {
+	c.ListenerLock.Lock()
+	defer c.ListenerLock.Unlock()
+	delete(c.Listeners, tag)
+}
+
+// GetListener returns the callback registered for the given listener string, if any.
+func (c *Peer) GetListener(tag string) (Listener, bool) {
+	c.ListenerLock.Lock()
+	defer c.ListenerLock.Unlock()
+	listener, ok := c.Listeners[tag]
+	return listener, ok
+}
+
+// newRandomID returns a random 128-bit identifier encoded as hex.
+func newRandomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
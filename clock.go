@@ -0,0 +1,128 @@
+package duplex
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ClockSample is a single NTP-style offset measurement.
+type ClockSample struct {
+	Offset time.Duration // Remote clock minus local clock
+	Delay  time.Duration // Round-trip delay excluding time spent at the remote
+	At     time.Time     // Local time the sample was taken
+}
+
+// ClockEstimator estimates the offset between the local clock and a peer's clock
+// from PING/PONG timestamps. Like the NTP clock filter, it keeps a window of
+// recent samples and trusts the one with the lowest delay, since it is the
+// least affected by queuing. It is safe for concurrent use.
+type ClockEstimator struct {
+	mu      sync.Mutex
+	samples []ClockSample
+	size    int
+}
+
+// NewClockEstimator creates an estimator that keeps the given number of samples.
+func NewClockEstimator(size int) *ClockEstimator {
+	if size <= 0 {
+		size = 1
+	}
+	return &ClockEstimator{size: size}
+}
+
+// Record adds a sample from the four NTP timestamps, in Unix milliseconds:
+// t1 is when we sent the ping, t2 when the remote received it, t3 when the
+// remote replied and t4 when we received the reply. If the remote did not
+// report t3, it is assumed to have replied instantly.
+func (e *ClockEstimator) Record(t1, t2, t3, t4 int64) {
+	if t3 == 0 {
+		t3 = t2
+	}
+
+	offset := ((t2 - t1) + (t3 - t4)) / 2
+	delay := (t4 - t1) - (t3 - t2)
+	if delay < 0 {
+		delay = 0
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.samples = append(e.samples, ClockSample{
+		Offset: time.Duration(offset) * time.Millisecond,
+		Delay:  time.Duration(delay) * time.Millisecond,
+		At:     time.Now(),
+	})
+	if len(e.samples) > e.size {
+		e.samples = e.samples[len(e.samples)-e.size:]
+	}
+}
+
+// Best returns the sample with the lowest delay in the window.
+func (e *ClockEstimator) Best() (ClockSample, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.samples) == 0 {
+		return ClockSample{}, false
+	}
+	return slices.MinFunc(e.samples, func(a, b ClockSample) int {
+		return cmp.Compare(a.Delay, b.Delay)
+	}), true
+}
+
+// Offset returns the filtered clock offset, or zero if no samples were taken yet.
+func (e *ClockEstimator) Offset() time.Duration {
+	best, _ := e.Best()
+	return best.Offset
+}
+
+// Synced returns true once at least one sample was taken.
+func (e *ClockEstimator) Synced() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.samples) > 0
+}
+
+// ClockOffset returns how far ahead the peer's clock is of ours.
+func (c *Peer) ClockOffset() time.Duration {
+	return c.Clock.Offset()
+}
+
+// RemoteNow returns the current time on the peer's clock.
+func (c *Peer) RemoteNow() time.Time {
+	return time.Now().Add(c.Clock.Offset())
+}
+
+// TimeReference returns the ID of the peer whose clock is used as the network
+// time, and the offset of that clock relative to ours. If TimeSource is set,
+// that peer is used once it is connected and synced. Otherwise the lowest ID
+// among this instance and its synced peers is elected, so that every member of
+// a full mesh settles on the same reference. An empty ID means this instance
+// is the reference.
+func (i *Instance) TimeReference() (string, time.Duration) {
+	if i.TimeSource != "" {
+		if i.TimeSource == i.Name {
+			return "", 0
+		}
+		if p, ok := i.GetPeer(i.TimeSource); ok && p.Clock.Synced() {
+			return p.GetPeerID(), p.ClockOffset()
+		}
+	}
+
+	elected := ""
+	var offset time.Duration
+	lowest := i.Name
+	for _, p := range i.ConnectedPeers() {
+		if id := p.GetPeerID(); id < lowest && p.Clock.Synced() {
+			lowest, elected, offset = id, id, p.ClockOffset()
+		}
+	}
+	return elected, offset
+}
+
+// NetworkNow returns the current time on the mesh's shared timebase.
+func (i *Instance) NetworkNow() time.Time {
+	_, offset := i.TimeReference()
+	return time.Now().Add(offset)
+}
@@ -0,0 +1,94 @@
+package duplex
+
+import (
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog"
+)
+
+func TestClockEstimatorPrefersLowestDelay(t *testing.T) {
+	e := NewClockEstimator(4)
+	if e.Synced() {
+		t.Fatal("synced without samples")
+	}
+	e.Record(1000, 1600, 1600, 1200) // Offset 500ms, delay 200ms
+	e.Record(2000, 2520, 2520, 2040) // Offset 500ms, delay 40ms
+	e.Record(3000, 3900, 3900, 3600) // Offset 600ms, delay 600ms
+
+	best, ok := e.Best()
+	if !ok || best.Delay != 40*time.Millisecond || best.Offset != 500*time.Millisecond {
+		t.Fatalf("best %+v", best)
+	}
+
+	// Samples past the window are forgotten
+	for n := range 4 {
+		at := int64(10000 + 1000*n)
+		e.Record(at, at+100, at+100, at+100)
+	}
+	if offset := e.Offset(); offset != 50*time.Millisecond {
+		t.Fatalf("offset %v after the window moved", offset)
+	}
+}
+
+func TestClockEstimatorExcludesRemoteProcessing(t *testing.T) {
+	e := NewClockEstimator(1)
+	// The remote held the ping for 300ms before replying
+	e.Record(1000, 1050, 1350, 1400)
+	best, _ := e.Best()
+	if best.Delay != 100*time.Millisecond || best.Offset != 0 {
+		t.Fatalf("best %+v", best)
+	}
+
+	// Without t3 the remote is assumed to reply instantly
+	e.Record(1000, 1050, 0, 1100)
+	if best, _ := e.Best(); best.Delay != 100*time.Millisecond || best.Offset != 0 {
+		t.Fatalf("best %+v", best)
+	}
+}
+
+func TestPongUpdatesClock(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+
+	ahead := time.Now().Add(time.Hour).UnixMilli()
+	payload, _ := json.Marshal(PongReply{T1: time.Now().UnixMilli(), T2: ahead, T3: ahead})
+	p.HandlePacket(&RxPacket{Packet: Packet{Opcode: "PONG", TTL: 1}, Payload: payload})
+
+	if !p.Clock.Synced() {
+		t.Fatal("PONG did not produce a clock sample")
+	}
+	if offset := p.ClockOffset(); offset < time.Hour-time.Second || offset > time.Hour+time.Second {
+		t.Fatalf("offset %v", offset)
+	}
+	if p.Latency.Stats().Samples != 1 {
+		t.Fatal("PONG did not produce an RTT sample")
+	}
+}
+
+func TestTimeReferenceUsesConfiguredSource(t *testing.T) {
+	i := New("alpha", &Config{TimeSource: "beta", LogLevel: zerolog.Disabled})
+	if id, offset := i.TimeReference(); id != "" || offset != 0 {
+		t.Fatalf("referenced %q with offset %v and no peers", id, offset)
+	}
+
+	p := unopenedPeer(i)
+	i.Peers["beta"] = p
+	if _, offset := i.TimeReference(); offset != 0 {
+		t.Fatalf("used offset %v from an unsynced source", offset)
+	}
+
+	p.Clock.Record(0, 300, 300, 0)
+	if _, offset := i.TimeReference(); offset != 300*time.Millisecond {
+		t.Fatalf("offset %v", offset)
+	}
+	if drift := time.Until(i.NetworkNow()); drift < 250*time.Millisecond || drift > 350*time.Millisecond {
+		t.Fatalf("network time %v ahead", drift)
+	}
+
+	i.TimeSource = i.Name
+	if _, offset := i.TimeReference(); offset != 0 {
+		t.Fatalf("offset %v while we are the source", offset)
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudlink-delta/duplex"
+	"github.com/goccy/go-json"
+)
+
+var errQuit = errors.New("quit")
+
+// filter selects received packets by peer and opcode. Empty fields match
+// everything.
+type filter struct {
+	peer    string
+	opcodes []string
+}
+
+func (f *filter) match(p *duplex.Peer, r *duplex.RxPacket) bool {
+	return (f.peer == "" || f.peer == p.GetPeerID()) &&
+		(len(f.opcodes) == 0 || slices.Contains(f.opcodes, r.Opcode))
+}
+
+type waiter struct {
+	filter
+	packets chan received
+}
+
+type received struct {
+	peer   *duplex.Peer
+	packet *duplex.RxPacket
+}
+
+type ctl struct {
+	instance   *duplex.Instance
+	timeout    time.Duration
+	mu         sync.Mutex
+	current    *duplex.Peer
+	negotiated map[string]chan struct{}
+	tail       *filter
+	waiters    []*waiter
+}
+
+type command struct {
+	usage string
+	help  string
+	run   func(c *ctl, ctx context.Context, args string) error
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"connect":    {"connect <peer>", "connect to a peer and show its negotiation results and RTT", (*ctl).connect},
+		"use":        {"use <peer>", "select the connected peer that commands are sent to", (*ctl).use},
+		"peers":      {"peers", "list connected peers", (*ctl).peers},
+		"ping":       {"ping [count]", "measure the RTT of the current peer", (*ctl).ping},
+		"send":       {"send <opcode> [json]", "send a packet to the current peer", (*ctl).send},
+		"request":    {"request <opcode> [json]", "send a packet tagged with a listener and print the reply", (*ctl).request},
+		"tail":       {"tail [peer=<id>] [opcode...] | tail off", "print received packets, optionally filtered", (*ctl).setTail},
+		"wait":       {"wait [peer=<id>] [opcode...]", "wait for the next matching packet and print it", (*ctl).wait},
+		"sleep":      {"sleep <duration>", "pause, e.g. sleep 500ms", (*ctl).sleep},
+		"echo":       {"echo <text>", "print text", (*ctl).echo},
+		"run":        {"run <file>", "run the commands in a script file", (*ctl).run},
+		"disconnect": {"disconnect [reason]", "say goodbye to the current peer and close the connection", (*ctl).disconnect},
+		"help":       {"help", "list commands", (*ctl).help},
+		"quit":       {"quit", "exit", func(*ctl, context.Context, string) error { return errQuit }},
+	}
+}
+
+func newCtl(instance *duplex.Instance, timeout time.Duration) *ctl {
+	c := &ctl{
+		instance:   instance,
+		timeout:    timeout,
+		negotiated: make(map[string]chan struct{}),
+	}
+	instance.OnPacket = c.received
+	instance.AfterNegotiation = func(p *duplex.Peer) {
+		ch := c.negotiation(p.GetPeerID())
+		select {
+		case <-ch:
+		default:
+			close(ch)
+		}
+	}
+	instance.OnClose = func(p *duplex.Peer) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.negotiated, p.GetPeerID())
+		if c.current == p {
+			c.current = nil
+		}
+		fmt.Printf("%s disconnected\n", p.GetPeerID())
+	}
+	return c
+}
+
+// negotiation returns the channel closed once the peer has negotiated.
+func (c *ctl) negotiation(id string) chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch, ok := c.negotiated[id]
+	if !ok {
+		ch = make(chan struct{})
+		c.negotiated[id] = ch
+	}
+	return ch
+}
+
+// received prints tailed packets and hands packets to waiters.
+func (c *ctl) received(p *duplex.Peer, r *duplex.RxPacket) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tail != nil && c.tail.match(p, r) {
+		printPacket(p, r)
+	}
+	c.waiters = slices.DeleteFunc(c.waiters, func(w *waiter) bool {
+		if !w.match(p, r) {
+			return false
+		}
+		w.packets <- received{p, r}
+		return true
+	})
+}
+
+func (c *ctl) exec(ctx context.Context, line string) error {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+	name, args, _ := strings.Cut(line, " ")
+	cmd, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command %q, type help for the list", name)
+	}
+	return cmd.run(c, ctx, strings.TrimSpace(args))
+}
+
+func (c *ctl) runScript(ctx context.Context, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := c.exec(ctx, scanner.Text()); errors.Is(err, errQuit) {
+			return err
+		} else if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// peer returns the peer that commands are sent to.
+func (c *ctl) peer() (*duplex.Peer, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current == nil {
+		return nil, errors.New("not connected, use connect <peer> first")
+	}
+	return c.current, nil
+}
+
+func (c *ctl) connect(ctx context.Context, args string) error {
+	if args == "" {
+		return errors.New("usage: connect <peer>")
+	}
+	if _, ok := c.instance.GetPeer(args); ok {
+		return c.use(ctx, args)
+	}
+
+	negotiated := c.negotiation(args)
+	p := c.instance.Connect(args)
+	if p == nil {
+		return fmt.Errorf("failed to connect to %s", args)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	select {
+	case <-negotiated:
+	case <-p.Closed():
+		return duplex.ErrPeerClosed
+	case <-ctx.Done():
+		p.Close()
+		return fmt.Errorf("negotiating with %s: %w", args, ctx.Err())
+	}
+
+	c.mu.Lock()
+	c.current = p
+	c.mu.Unlock()
+
+	summary := describe(p)
+	if rtt, err := p.Ping(ctx); err == nil {
+		summary += fmt.Sprintf(", rtt %s", rtt.Round(time.Millisecond))
+	}
+	fmt.Println(summary)
+	return nil
+}
+
+func (c *ctl) use(ctx context.Context, args string) error {
+	p, ok := c.instance.GetPeer(args)
+	if !ok {
+		return fmt.Errorf("%s is not connected", args)
+	}
+	c.mu.Lock()
+	c.current = p
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *ctl) peers(ctx context.Context, args string) error {
+	current, _ := c.peer()
+	for _, p := range c.instance.ConnectedPeers() {
+		marker := " "
+		if p == current {
+			marker = "*"
+		}
+		fmt.Printf("%s %s, rtt %s\n", marker, describe(p), p.SmoothedRTT().Round(time.Millisecond))
+	}
+	return nil
+}
+
+func (c *ctl) ping(ctx context.Context, args string) error {
+	p, err := c.peer()
+	if err != nil {
+		return err
+	}
+	count := 1
+	if args != "" {
+		if count, err = strconv.Atoi(args); err != nil || count < 1 {
+			return errors.New("usage: ping [count]")
+		}
+	}
+
+	for n := range count {
+		ping_ctx, cancel := context.WithTimeout(ctx, c.timeout)
+		rtt, err := p.Ping(ping_ctx)
+		cancel()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("pong from %s: rtt %s\n", p.GetPeerID(), rtt.Round(time.Microsecond))
+		if n < count-1 {
+			time.Sleep(time.Second)
+		}
+	}
+
+	stats := p.Latency.Stats()
+	fmt.Printf("smoothed %s, jitter %s, min %s, max %s, missed %d\n",
+		stats.Smoothed.Round(time.Microsecond), stats.Jitter.Round(time.Microsecond),
+		stats.Min.Round(time.Microsecond), stats.Max.Round(time.Microsecond), stats.Missed)
+	return nil
+}
+
+func (c *ctl) send(ctx context.Context, args string) error {
+	p, err := c.peer()
+	if err != nil {
+		return err
+	}
+	packet, err := parsePacket(args)
+	if err != nil {
+		return err
+	}
+	p.Write(packet)
+	return nil
+}
+
+func (c *ctl) request(ctx context.Context, args string) error {
+	p, err := c.peer()
+	if err != nil {
+		return err
+	}
+	packet, err := parsePacket(args)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	reply, err := p.Request(ctx, packet)
+	if err != nil {
+		return err
+	}
+	printPacket(p, reply)
+	return nil
+}
+
+func (c *ctl) setTail(ctx context.Context, args string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if args == "off" {
+		c.tail = nil
+		return nil
+	}
+	c.tail = parseFilter(args)
+	return nil
+}
+
+func (c *ctl) wait(ctx context.Context, args string) error {
+	w := &waiter{filter: *parseFilter(args), packets: make(chan received, 1)}
+	c.mu.Lock()
+	c.waiters = append(c.waiters, w)
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.waiters = slices.DeleteFunc(c.waiters, func(other *waiter) bool { return other == w })
+		c.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	select {
+	case r := <-w.packets:
+		printPacket(r.peer, r.packet)
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for packet: %w", ctx.Err())
+	}
+}
+
+func (c *ctl) sleep(ctx context.Context, args string) error {
+	d, err := time.ParseDuration(args)
+	if err != nil {
+		return errors.New("usage: sleep <duration>")
+	}
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *ctl) echo(ctx context.Context, args string) error {
+	fmt.Println(args)
+	return nil
+}
+
+func (c *ctl) run(ctx context.Context, args string) error {
+	if args == "" {
+		return errors.New("usage: run <file>")
+	}
+	return c.runScript(ctx, args)
+}
+
+func (c *ctl) disconnect(ctx context.Context, args string) error {
+	p, err := c.peer()
+	if err != nil {
+		return err
+	}
+	if args == "" {
+		args = "disconnected by duplexctl"
+	}
+	p.Disconnect(args)
+	return nil
+}
+
+func (c *ctl) help(ctx context.Context, args string) error {
+	for _, name := range slices.Sorted(maps.Keys(commands)) {
+		fmt.Printf("  %-42s %s\n", commands[name].usage, commands[name].help)
+	}
+	return nil
+}
+
+// parsePacket parses "<opcode> [json payload]".
+func parsePacket(args string) (*duplex.TxPacket, error) {
+	opcode, payload, _ := strings.Cut(args, " ")
+	if opcode == "" {
+		return nil, errors.New("missing opcode")
+	}
+	packet := &duplex.TxPacket{Packet: duplex.Packet{Opcode: opcode, TTL: 1}}
+	if payload = strings.TrimSpace(payload); payload != "" {
+		if !json.Valid([]byte(payload)) {
+			return nil, fmt.Errorf("payload is not valid JSON: %s", payload)
+		}
+		packet.Payload = json.RawMessage(payload)
+	}
+	return packet, nil
+}
+
+// parseFilter parses "[peer=<id>] [opcode...]".
+func parseFilter(args string) *filter {
+	f := &filter{}
+	for _, field := range strings.Fields(args) {
+		if id, ok := strings.CutPrefix(field, "peer="); ok {
+			f.peer = id
+		} else {
+			f.opcodes = append(f.opcodes, field)
+		}
+	}
+	return f
+}
+
+// describe summarizes what a peer reported during negotiation.
+func describe(p *duplex.Peer) string {
+	v := p.Version
+	summary := fmt.Sprintf("%s: %s %d.%d.%d, spec %d", p.GetPeerID(), v.Type, v.Major, v.Minor, v.Patch, p.SpecVersion)
+	if len(p.Features) > 0 {
+		summary += ", features: " + strings.Join(p.Features, ", ")
+	}
+	if len(p.Plugins) > 0 {
+		summary += ", plugins: " + strings.Join(p.Plugins, ", ")
+	}
+	if p.Session() != nil {
+		summary += ", session resumable"
+	}
+	return summary
+}
+
+func printPacket(p *duplex.Peer, r *duplex.RxPacket) {
+	fmt.Printf("<- %s %s %s\n", p.GetPeerID(), r.Opcode, payloadOf(r))
+}
+
+func payloadOf(r *duplex.RxPacket) string {
+	if len(r.Payload) == 0 {
+		return "{}"
+	}
+	return string(r.Payload)
+}
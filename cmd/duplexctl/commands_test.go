@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloudlink-delta/duplex"
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog"
+)
+
+func newTestCtl(t *testing.T) *ctl {
+	t.Helper()
+	return newCtl(duplex.New("duplexctl-test", &duplex.Config{LogLevel: zerolog.Disabled}), time.Second)
+}
+
+func TestParsePacket(t *testing.T) {
+	packet, err := parsePacket(`PUBLISH {"topic": "news"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packet.Opcode != "PUBLISH" || packet.TTL != 1 || string(packet.Payload.(json.RawMessage)) != `{"topic": "news"}` {
+		t.Fatalf("packet %+v", packet)
+	}
+
+	if packet, err := parsePacket("PING"); err != nil || packet.Payload != nil {
+		t.Fatalf("packet %+v, err %v", packet, err)
+	}
+	if _, err := parsePacket(`PUBLISH {"topic":`); err == nil {
+		t.Fatal("parsed invalid JSON")
+	}
+	if _, err := parsePacket(""); err == nil {
+		t.Fatal("parsed a packet without an opcode")
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	f := parseFilter("peer=server PUBLISH PONG")
+	if f.peer != "server" || strings.Join(f.opcodes, ",") != "PUBLISH,PONG" {
+		t.Fatalf("filter %+v", f)
+	}
+	if f := parseFilter(""); f.peer != "" || len(f.opcodes) != 0 {
+		t.Fatalf("empty filter %+v", f)
+	}
+}
+
+func TestExec(t *testing.T) {
+	c := newTestCtl(t)
+	ctx := context.Background()
+	for _, line := range []string{"", "  # a comment", "echo hello", "sleep 1ms"} {
+		if err := c.exec(ctx, line); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+	}
+	if err := c.exec(ctx, "frobnicate"); err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Fatalf("unknown command: %v", err)
+	}
+	if err := c.exec(ctx, "send PING"); err == nil {
+		t.Fatal("sent without a current peer")
+	}
+	if err := c.exec(ctx, "quit"); err != errQuit {
+		t.Fatalf("quit returned %v", err)
+	}
+}
+
+func TestRunScriptReportsFailingLine(t *testing.T) {
+	c := newTestCtl(t)
+	path := filepath.Join(t.TempDir(), "script")
+	if err := os.WriteFile(path, []byte("# setup\necho one\nsleep soon\necho never\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err := c.runScript(context.Background(), path)
+	if err == nil || !strings.HasPrefix(err.Error(), path+":3:") {
+		t.Fatalf("script ended with %v", err)
+	}
+}
+
+func TestWaitReceivesMatchingPacket(t *testing.T) {
+	c := newTestCtl(t)
+
+	done := make(chan error, 1)
+	go func() { done <- c.exec(context.Background(), "wait peer=server PUBLISH") }()
+	for {
+		c.mu.Lock()
+		waiting := len(c.waiters) > 0
+		c.mu.Unlock()
+		if waiting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Packets from the capture are handled as if the server had sent them
+	var capture strings.Builder
+	for _, record := range []duplex.CaptureRecord{
+		{Direction: "in", Peer: "other", Opcode: "PUBLISH", Packet: json.RawMessage(`{"opcode":"PUBLISH","ttl":1}`)},
+		{Direction: "in", Peer: "server", Opcode: "PUBLISH", Packet: json.RawMessage(`{"opcode":"PUBLISH","ttl":1,"payload":{"topic":"news"}}`)},
+	} {
+		line, _ := json.Marshal(record)
+		capture.Write(append(line, '\n'))
+	}
+	if err := c.instance.Replay(context.Background(), strings.NewReader(capture.String()), duplex.ReplayOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,171 @@
+// Command duplexctl is an interactive client for poking at duplex peers. It
+// connects to the signaling server under its own peer ID, and then reads
+// commands from standard input:
+//
+//	$ duplexctl -id me server
+//	server: Go 1.0.1, spec 0, features: relay, discovery, rtt 38ms
+//	> request PING {"t1": 0}
+//	<- server PONG {"t1":0,"t2":1792394176694,"t3":1792394176694}
+//	> tail PUBLISH
+//
+// Commands can also be read from script files with -script or the run
+// command. Lines starting with # are comments, and a script stops at the
+// first command that fails. Type help for the list of commands.
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cloudlink-delta/duplex"
+	"github.com/rs/zerolog"
+)
+
+func main() {
+	id := flag.String("id", "", "peer ID to use (default random)")
+	config := flag.String("config", "", "YAML or JSON config file of the instance")
+	timeout := flag.Duration("timeout", 10*time.Second, "how long connects, requests and waits may take")
+	script := flag.String("script", "", "run the commands in this file and exit")
+	log_level := flag.String("log-level", "warn", "level of the log lines written to stderr")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: duplexctl [flags] [peer ID]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, *id, *config, *log_level, *timeout, *script, flag.Arg(0)); err != nil {
+		fmt.Fprintln(os.Stderr, "duplexctl:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, id, config, log_level string, timeout time.Duration, script, target string) error {
+	args := &duplex.Config{}
+	if config != "" {
+		var err error
+		if args, err = duplex.LoadConfig(config); err != nil {
+			return err
+		}
+	}
+
+	// Standard output is for packets, so logs go to standard error
+	level, err := zerolog.ParseLevel(log_level)
+	if err != nil {
+		return err
+	}
+	logger := zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339}).With().Timestamp().Logger().Level(level)
+	args.Logger = &logger
+	args.LogLevel = level
+
+	if id == "" {
+		id = "duplexctl-" + randomSuffix()
+	}
+
+	c := newCtl(duplex.New(id, args), timeout)
+	if err := c.start(ctx); err != nil {
+		return err
+	}
+	defer c.stop()
+
+	if target != "" {
+		if err := c.exec(ctx, "connect "+target); err != nil {
+			return err
+		}
+	}
+	if script != "" {
+		return c.runScript(ctx, script)
+	}
+	return c.repl(ctx)
+}
+
+// start runs the instance and waits until it is registered with the
+// signaling server.
+func (c *ctl) start(ctx context.Context) error {
+	ready := make(chan struct{})
+	var once sync.Once
+	c.instance.OnCreate = func() {
+		once.Do(func() { close(ready) })
+	}
+	if err := c.instance.Start(ctx); err != nil {
+		return err
+	}
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- c.instance.Wait()
+	}()
+
+	wait_ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	select {
+	case <-ready:
+		fmt.Printf("registered as %s\n", c.instance.Name)
+		return nil
+	case err := <-stopped:
+		if err == nil {
+			err = errors.New("instance stopped")
+		}
+		return err
+	case <-wait_ctx.Done():
+		return fmt.Errorf("signaling server: %w", wait_ctx.Err())
+	}
+}
+
+func (c *ctl) stop() {
+	c.instance.Stop()
+	c.instance.Wait()
+}
+
+// repl reads commands from standard input until it is closed or the context
+// ends. Failed commands are reported and do not stop the loop.
+func (c *ctl) repl(ctx context.Context) error {
+	info, _ := os.Stdin.Stat()
+	interactive := info != nil && info.Mode()&os.ModeCharDevice != 0
+
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	for {
+		if interactive {
+			fmt.Print("> ")
+		}
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return nil
+			}
+			if err := c.exec(ctx, line); errors.Is(err, errQuit) {
+				return nil
+			} else if err != nil {
+				fmt.Println("error:", err)
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func randomSuffix() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type generator struct {
+	protocol *Protocol
+	source   string
+	buf      bytes.Buffer
+	structs  []*gen_struct // Structs in the order they are emitted
+	patterns []string
+}
+
+type gen_struct struct {
+	name   string
+	doc    string
+	schema *Schema
+}
+
+func (g *generator) printf(format string, args ...any) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+// generate produces the Go source for a protocol.
+func generate(p *Protocol, source, pkg string) ([]byte, error) {
+	g := &generator{protocol: p, source: source}
+
+	// Collect every struct first, so that nested objects get stable names
+	for _, name := range sortedKeys(p.Types) {
+		doc := fmt.Sprintf("%s is a payload type shared between opcodes.", goName(name))
+		g.collect(goName(name), withDescription(doc, p.Types[name].Description), p.Types[name])
+	}
+	for _, op := range p.Opcodes {
+		if op.Payload != nil {
+			name := goName(op.Name) + "Payload"
+			doc := fmt.Sprintf("%s is the payload of %s.", name, op.Name)
+			g.collect(name, withDescription(doc, op.Description), op.Payload)
+		}
+	}
+
+	var body bytes.Buffer
+	g.buf, body = body, g.buf
+	g.opcodes()
+	for _, name := range sortedKeys(p.Types) {
+		if s := p.Types[name]; !g.isStruct(s) {
+			g.printf("// %s is a payload type shared between opcodes.\n", goName(name))
+			if s.Description != "" {
+				g.printf("// %s\n", s.Description)
+			}
+			g.printf("type %s %s\n\n", goName(name), g.goType(goName(name), s))
+		}
+	}
+	for _, s := range g.structs {
+		g.structType(s)
+	}
+	for _, s := range g.structs {
+		g.validate(s)
+	}
+	for _, op := range p.Opcodes {
+		check := g.payloadCheck(op)
+		g.bindHelper(op, check)
+		g.sendHelper(op, check)
+	}
+	body, g.buf = g.buf, body
+
+	g.printf("// Code generated by duplexgen from %s. DO NOT EDIT.\n\n", source)
+	g.printf("package %s\n\n", pkg)
+	g.printf("import (\n")
+	if bytes.Contains(body.Bytes(), []byte("errors.")) {
+		g.printf("\t\"errors\"\n")
+	}
+	if bytes.Contains(body.Bytes(), []byte("fmt.")) {
+		g.printf("\t\"fmt\"\n")
+	}
+	if len(g.patterns) > 0 {
+		g.printf("\t\"regexp\"\n")
+	}
+	if bytes.Contains(body.Bytes(), []byte("utf8.")) {
+		g.printf("\t\"unicode/utf8\"\n")
+	}
+	g.printf("\n\t\"github.com/cloudlink-delta/duplex\"\n")
+	if bytes.Contains(body.Bytes(), []byte("json.")) {
+		g.printf("\t\"github.com/goccy/go-json\"\n")
+	}
+	g.printf(")\n\n")
+	if len(g.patterns) > 0 {
+		g.printf("var (\n")
+		for n, pattern := range g.patterns {
+			g.printf("\tpattern_%d = regexp.MustCompile(%s)\n", n, strconv.Quote(pattern))
+		}
+		g.printf(")\n\n")
+	}
+	g.buf.Write(body.Bytes())
+
+	out, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		return g.buf.Bytes(), fmt.Errorf("generated code does not compile: %w", err)
+	}
+	return out, nil
+}
+
+// collect registers the struct for an object schema and any objects nested in it.
+func (g *generator) collect(name, doc string, s *Schema) {
+	switch {
+	case s.Ref != "":
+		return
+	case s.Type == "array":
+		g.collect(name+"Item", fmt.Sprintf("%sItem is an item of %s.", name, name), s.Items)
+	case s.Type == "object" && len(s.Properties) > 0:
+		g.structs = append(g.structs, &gen_struct{name: name, doc: doc, schema: s})
+		for _, prop := range s.propertyNames() {
+			nested := name + goName(prop)
+			g.collect(nested, fmt.Sprintf("%s is the %s property of %s.", nested, prop, name), s.Properties[prop])
+		}
+	}
+}
+
+func withDescription(doc, description string) string {
+	if description == "" {
+		return doc
+	}
+	return doc + "\n" + description
+}
+
+// goType returns the Go type of a schema used at the given struct name.
+func (g *generator) goType(name string, s *Schema) string {
+	if s.Ref != "" {
+		return goName(s.Ref)
+	}
+	switch s.Type {
+	case "string":
+		return "string"
+	case "integer":
+		return "int64"
+	case "number":
+		return "float64"
+	case "boolean":
+		return "bool"
+	case "array":
+		return "[]" + g.goType(name+"Item", s.Items)
+	case "object":
+		if len(s.Properties) > 0 {
+			return name
+		}
+		return "map[string]any"
+	}
+	return "any"
+}
+
+// resolve follows a reference to a shared type.
+func (g *generator) resolve(s *Schema) *Schema {
+	if s.Ref != "" {
+		return g.protocol.Types[s.Ref]
+	}
+	return s
+}
+
+// zeroValue returns the literal an absent scalar decodes to, or "" if the
+// schema is not a scalar.
+func zeroValue(s *Schema) string {
+	switch s.Type {
+	case "string":
+		return `""`
+	case "integer", "number":
+		return "0"
+	}
+	return ""
+}
+
+// isStruct returns true if values of the schema have a Validate method.
+func (g *generator) isStruct(s *Schema) bool {
+	if s.Ref != "" {
+		return g.isStruct(g.protocol.Types[s.Ref])
+	}
+	return s.Type == "object" && len(s.Properties) > 0
+}
+
+// isNumber returns true if values of the schema are integers or numbers.
+func (g *generator) isNumber(s *Schema) bool {
+	s = g.resolve(s)
+	return s.Type == "integer" || s.Type == "number"
+}
+
+func (g *generator) opcodes() {
+	g.printf("// Opcodes defined by %s.\n", g.source)
+	g.printf("const (\n")
+	for _, op := range g.protocol.Opcodes {
+		g.printf("\tOp%s = %q\n", goName(op.Name), op.Name)
+	}
+	g.printf(")\n\n")
+}
+
+func (g *generator) structType(s *gen_struct) {
+	for _, line := range strings.Split(s.doc, "\n") {
+		g.printf("// %s\n", line)
+	}
+	g.printf("type %s struct {\n", s.name)
+	for _, prop := range s.schema.propertyNames() {
+		schema := s.schema.Properties[prop]
+		tag := prop
+		field_type := g.goType(s.name+goName(prop), schema)
+		if !slices.Contains(s.schema.Required, prop) {
+			tag += ",omitempty"
+
+			// Optional objects and numbers are pointers, so that absent ones are
+			// not validated and zero can still be sent
+			if g.isStruct(schema) || g.isNumber(schema) {
+				field_type = "*" + field_type
+			}
+		}
+		g.printf("\t%s %s `json:%q`", goName(prop), field_type, tag)
+		if schema.Description != "" {
+			g.printf(" // %s", schema.Description)
+		}
+		g.printf("\n")
+	}
+	g.printf("}\n\n")
+
+	if len(s.schema.Required) == 0 {
+		return
+	}
+
+	// Required properties can only be told apart from zero values before decoding
+	required := make([]string, len(s.schema.Required))
+	for n, prop := range s.schema.Required {
+		required[n] = strconv.Quote(prop)
+	}
+	g.printf("func (p *%s) UnmarshalJSON(b []byte) error {\n", s.name)
+	g.printf("\ttype plain %s\n", s.name)
+	g.printf("\tvar fields map[string]json.RawMessage\n")
+	g.printf("\tif err := json.Unmarshal(b, &fields); err != nil {\n\t\treturn err\n\t}\n")
+	g.printf("\tfor _, name := range []string{%s} {\n", strings.Join(required, ", "))
+	g.printf("\t\tif _, ok := fields[name]; !ok {\n")
+	g.printf("\t\t\treturn fmt.Errorf(\"%s: missing required field %%q\", name)\n", s.name)
+	g.printf("\t\t}\n\t}\n")
+	g.printf("\treturn json.Unmarshal(b, (*plain)(p))\n")
+	g.printf("}\n\n")
+}
+
+func (g *generator) validate(s *gen_struct) {
+	g.printf("// Validate checks the constraints of the protocol definition.\n")
+	g.printf("func (p *%s) Validate() error {\n", s.name)
+	for _, prop := range s.schema.propertyNames() {
+		value := fmt.Sprintf("p.%s", goName(prop))
+		schema := s.schema.Properties[prop]
+
+		// Absent optional values decode to their zero value, which is not checked
+		zero := zeroValue(g.resolve(schema))
+		if g.isStruct(schema) || g.isNumber(schema) {
+			zero = "nil"
+		}
+		if slices.Contains(s.schema.Required, prop) || zero == "" {
+			g.constraints(value, s.name+"."+prop, schema, 1)
+			continue
+		}
+		checked := value
+		if g.isNumber(schema) {
+			checked = "*" + value
+		}
+		var checks bytes.Buffer
+		g.buf, checks = checks, g.buf
+		g.constraints(checked, s.name+"."+prop, schema, 2)
+		g.buf, checks = checks, g.buf
+		if checks.Len() > 0 {
+			g.printf("\tif %s != %s {\n", value, zero)
+			g.buf.Write(checks.Bytes())
+			g.printf("\t}\n")
+		}
+	}
+	g.printf("\treturn nil\n}\n\n")
+}
+
+// constraints emits the checks for one value.
+func (g *generator) constraints(value, where string, s *Schema, depth int) {
+	indent := strings.Repeat("\t", depth)
+	fail := func(format string, args ...any) {
+		g.printf("%s\treturn errors.New(%q)\n%s}\n", indent, where+": "+fmt.Sprintf(format, args...), indent)
+	}
+
+	if g.isStruct(s) {
+		g.printf("%sif err := %s.Validate(); err != nil {\n%s\treturn err\n%s}\n", indent, value, indent, indent)
+		return
+	}
+	if s.Ref != "" {
+		g.constraints(value, where, g.protocol.Types[s.Ref], depth)
+		return
+	}
+
+	switch s.Type {
+	case "string":
+		// Lengths are counted in characters, as in JSON Schema
+		if s.MinLength != nil {
+			g.printf("%sif utf8.RuneCountInString(string(%s)) < %d {\n", indent, value, *s.MinLength)
+			fail("shorter than %d", *s.MinLength)
+		}
+		if s.MaxLength != nil {
+			g.printf("%sif utf8.RuneCountInString(string(%s)) > %d {\n", indent, value, *s.MaxLength)
+			fail("longer than %d", *s.MaxLength)
+		}
+		if len(s.Enum) > 0 {
+			quoted := make([]string, len(s.Enum))
+			for n, v := range s.Enum {
+				quoted[n] = strconv.Quote(v)
+			}
+			g.printf("%sswitch %s {\n%scase %s:\n%sdefault:\n", indent, value, indent, strings.Join(quoted, ", "), indent)
+			g.printf("%s\treturn fmt.Errorf(%q, %s)\n%s}\n", indent, where+": unexpected value %q", value, indent)
+		}
+		if s.Pattern != "" {
+			n := slices.Index(g.patterns, s.Pattern)
+			if n < 0 {
+				n = len(g.patterns)
+				g.patterns = append(g.patterns, s.Pattern)
+			}
+			g.printf("%sif !pattern_%d.MatchString(string(%s)) {\n", indent, n, value)
+			fail("does not match %s", s.Pattern)
+		}
+
+	case "integer", "number":
+		// Integer bounds are rounded inwards, so that the literal fits an int64
+		if s.Minimum != nil {
+			bound := strconv.FormatFloat(*s.Minimum, 'g', -1, 64)
+			if s.Type == "integer" {
+				bound = strconv.FormatFloat(math.Ceil(*s.Minimum), 'f', 0, 64)
+			}
+			g.printf("%sif %s < %s {\n", indent, value, bound)
+			fail("less than %v", *s.Minimum)
+		}
+		if s.Maximum != nil {
+			bound := strconv.FormatFloat(*s.Maximum, 'g', -1, 64)
+			if s.Type == "integer" {
+				bound = strconv.FormatFloat(math.Floor(*s.Maximum), 'f', 0, 64)
+			}
+			g.printf("%sif %s > %s {\n", indent, value, bound)
+			fail("greater than %v", *s.Maximum)
+		}
+
+	case "array":
+		if s.MinItems != nil {
+			g.printf("%sif len(%s) < %d {\n", indent, value, *s.MinItems)
+			fail("fewer than %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil {
+			g.printf("%sif len(%s) > %d {\n", indent, value, *s.MaxItems)
+			fail("more than %d items", *s.MaxItems)
+		}
+		var items bytes.Buffer
+		g.buf, items = items, g.buf
+		g.constraints(fmt.Sprintf("item_%d", depth), where+"[]", s.Items, depth+1)
+		g.buf, items = items, g.buf
+		if items.Len() > 0 {
+			g.printf("%sfor _, item_%d := range %s {\n", indent, depth, value)
+			g.buf.Write(items.Bytes())
+			g.printf("%s}\n", indent)
+		}
+	}
+}
+
+// payloadCheck returns the call that validates the payload of an opcode, or
+// "" if it has no constraints. Payloads that are not structs get a validation
+// function of their own.
+func (g *generator) payloadCheck(op *Opcode) string {
+	if op.Payload == nil {
+		return ""
+	}
+	if g.isStruct(op.Payload) {
+		return "payload.Validate()"
+	}
+
+	name := goName(op.Name) + "Payload"
+	var checks bytes.Buffer
+	g.buf, checks = checks, g.buf
+	g.constraints("payload", name, op.Payload, 1)
+	g.buf, checks = checks, g.buf
+	if checks.Len() == 0 {
+		return ""
+	}
+	g.printf("// validate%s checks the constraints of the protocol definition.\n", name)
+	g.printf("func validate%s(payload %s) error {\n", name, g.goType(name, op.Payload))
+	g.buf.Write(checks.Bytes())
+	g.printf("\treturn nil\n}\n\n")
+	return fmt.Sprintf("validate%s(payload)", name)
+}
+
+func (g *generator) bindHelper(op *Opcode, check string) {
+	name := goName(op.Name)
+	features := ""
+	for _, feature := range op.Features {
+		features += ", " + strconv.Quote(feature)
+	}
+
+	g.printf("// Bind%s registers a handler for %s packets.", name, op.Name)
+	switch {
+	case check != "":
+		g.printf("\n// Packets whose payload does not decode or validate are dropped.")
+	case op.Payload != nil:
+		g.printf("\n// Packets whose payload does not decode are dropped.")
+	}
+	g.printf("\n")
+
+	if op.Payload == nil {
+		g.printf("func Bind%s(i *duplex.Instance, handler func(*duplex.Peer, *duplex.RxPacket)) {\n", name)
+		g.printf("\ti.Bind(Op%s, handler%s)\n}\n\n", name, features)
+		return
+	}
+
+	payload := g.goType(name+"Payload", op.Payload)
+	g.printf("func Bind%s(i *duplex.Instance, handler func(*duplex.Peer, %s)) {\n", name, pointerTo(payload, g.isStruct(op.Payload)))
+	g.printf("\ti.Bind(Op%s, func(p *duplex.Peer, r *duplex.RxPacket) {\n", name)
+	g.printf("\t\tvar payload %s\n", payload)
+	g.printf("\t\tif err := json.Unmarshal(r.Payload, &payload); err != nil {\n")
+	g.printf("\t\t\tp.Logger.Warn().Err(err).Str(\"opcode\", r.Opcode).Msg(\"dropped packet: malformed payload\")\n")
+	g.printf("\t\t\treturn\n\t\t}\n")
+	if check != "" {
+		g.printf("\t\tif err := %s; err != nil {\n", check)
+		g.printf("\t\t\tp.Logger.Warn().Err(err).Str(\"opcode\", r.Opcode).Msg(\"dropped packet: invalid payload\")\n")
+		g.printf("\t\t\treturn\n\t\t}\n")
+	}
+	if g.isStruct(op.Payload) {
+		g.printf("\t\thandler(p, &payload)\n")
+	} else {
+		g.printf("\t\thandler(p, payload)\n")
+	}
+	g.printf("\t}%s)\n}\n\n", features)
+}
+
+func (g *generator) sendHelper(op *Opcode, check string) {
+	name := goName(op.Name)
+	ttl := max(op.TTL, 1)
+
+	g.printf("// Send%s sends a %s packet to a peer.\n", name, op.Name)
+	if op.Payload == nil {
+		g.printf("func Send%s(p *duplex.Peer) {\n", name)
+		g.printf("\tp.Write(&duplex.TxPacket{\n")
+		g.printf("\t\tPacket: duplex.Packet{Opcode: Op%s, TTL: %d},\n", name, ttl)
+		g.printf("\t})\n}\n\n")
+		return
+	}
+
+	payload := pointerTo(g.goType(name+"Payload", op.Payload), g.isStruct(op.Payload))
+	g.printf("func Send%s(p *duplex.Peer, payload %s) error {\n", name, payload)
+	if check != "" {
+		g.printf("\tif err := %s; err != nil {\n\t\treturn err\n\t}\n", check)
+	}
+	g.printf("\tp.Write(&duplex.TxPacket{\n")
+	g.printf("\t\tPacket:  duplex.Packet{Opcode: Op%s, TTL: %d},\n", name, ttl)
+	g.printf("\t\tPayload: payload,\n")
+	g.printf("\t})\n\treturn nil\n}\n\n")
+}
+
+func pointerTo(t string, is_struct bool) string {
+	if is_struct {
+		return "*" + t
+	}
+	return t
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestGolden generates every protocol in testdata and compares the output with
+// its golden files. Run with -update after an intended change to the output.
+func TestGolden(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, in := range inputs {
+		name := strings.TrimSuffix(filepath.Base(in), ".json")
+		t.Run(name, func(t *testing.T) {
+			protocol, err := loadProtocol(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			source, err := generate(protocol, filepath.Base(in), protocol.Package)
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden(t, filepath.Join("testdata", name+".go.golden"), source)
+
+			schema, err := jsonSchema(protocol, "https://example.com/"+name+".schema.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden(t, filepath.Join("testdata", name+".schema.golden"), append(schema, '\n'))
+		})
+	}
+}
+
+func golden(t *testing.T, path string, got []byte) {
+	t.Helper()
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s is out of date, rerun with -update:\n%s", path, got)
+	}
+}
+
+func TestGoName(t *testing.T) {
+	for in, want := range map[string]string{
+		"G_MSG":     "GMsg",
+		"peer_id":   "PeerID",
+		"ttl":       "TTL",
+		"camelCase": "CamelCase",
+		"2fa_code":  "X2faCode",
+		"--":        "",
+	} {
+		if got := goName(in); got != want {
+			t.Errorf("goName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestCheckRejectsBrokenDefinitions(t *testing.T) {
+	for name, def := range map[string]string{
+		"unnamed opcode":      `{"opcodes": [{}]}`,
+		"duplicate opcode":    `{"opcodes": [{"name": "A"}, {"name": "A"}]}`,
+		"unknown ref":         `{"opcodes": [{"name": "A", "payload": {"$ref": "missing"}}]}`,
+		"array without items": `{"opcodes": [{"name": "A", "payload": {"type": "array"}}]}`,
+		"undefined required":  `{"opcodes": [{"name": "A", "payload": {"type": "object", "required": ["x"]}}]}`,
+		"unsupported type":    `{"opcodes": [{"name": "A", "payload": {"type": "date"}}]}`,
+		"unusable type name":  `{"types": {"--": {"type": "string"}}, "opcodes": []}`,
+	} {
+		path := filepath.Join(t.TempDir(), "protocol.json")
+		os.WriteFile(path, []byte(def), 0o644)
+		if _, err := loadProtocol(path); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+}
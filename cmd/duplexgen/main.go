@@ -0,0 +1,101 @@
+// Command duplexgen generates typed opcode APIs for duplex from a protocol
+// definition file. It is meant to be run with go generate:
+//
+//	//go:generate go run github.com/cloudlink-delta/duplex/cmd/duplexgen -in protocol.json -out protocol_gen.go -schema protocol.schema.json
+//
+// The definition lists opcodes, the JSON Schema subset describing each
+// payload, and the features a peer needs for the handler to run:
+//
+//	{
+//	  "types": {
+//	    "member": {"type": "object", "properties": {"id": {"type": "string"}}, "required": ["id"]}
+//	  },
+//	  "opcodes": [
+//	    {
+//	      "name": "CHAT_MSG",
+//	      "description": "A chat line sent to a room.",
+//	      "features": ["chat"],
+//	      "payload": {
+//	        "type": "object",
+//	        "properties": {
+//	          "room": {"type": "string", "minLength": 1},
+//	          "text": {"type": "string", "maxLength": 500},
+//	          "from": {"$ref": "member"}
+//	        },
+//	        "required": ["room", "text"]
+//	      }
+//	    }
+//	  ]
+//	}
+//
+// For every opcode it generates an Op constant, a payload struct with a
+// Validate method, a Bind helper that decodes and validates payloads before
+// calling a typed handler, and a Send helper. With -schema, it also writes a
+// JSON Schema document describing every packet.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func main() {
+	in := flag.String("in", "", "protocol definition file (required)")
+	out := flag.String("out", "", "generated Go file (default <in>_gen.go)")
+	pkg := flag.String("package", "", "package of the generated file (default $GOPACKAGE, or the definition's package)")
+	schema := flag.String("schema", "", "also write a JSON Schema document to this file")
+	schema_id := flag.String("schema-id", "", "$id of the JSON Schema document")
+	flag.Parse()
+
+	if *in == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(*in, *out, *pkg, *schema, *schema_id); err != nil {
+		fmt.Fprintln(os.Stderr, "duplexgen:", err)
+		os.Exit(1)
+	}
+}
+
+func run(in, out, pkg, schema, schema_id string) error {
+	protocol, err := loadProtocol(in)
+	if err != nil {
+		return err
+	}
+
+	if out == "" {
+		out = strings.TrimSuffix(in, filepath.Ext(in)) + "_gen.go"
+	}
+	if pkg == "" {
+		pkg = os.Getenv("GOPACKAGE")
+	}
+	if pkg == "" {
+		pkg = protocol.Package
+	}
+	if pkg == "" {
+		return fmt.Errorf("no package name: set -package, or run through go generate")
+	}
+
+	source, err := generate(protocol, filepath.Base(in), pkg)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(out, source, 0o644); err != nil {
+		return err
+	}
+
+	if schema != "" {
+		doc, err := jsonSchema(protocol, schema_id)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(schema, append(doc, '\n'), 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
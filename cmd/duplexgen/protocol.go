@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/goccy/go-json"
+)
+
+// Protocol is a protocol definition file.
+type Protocol struct {
+	Package string             `json:"package,omitempty"` // Go package of the generated file
+	Title   string             `json:"title,omitempty"`
+	Types   map[string]*Schema `json:"types,omitempty"` // Shared payload types, referenced with $ref
+	Opcodes []*Opcode          `json:"opcodes"`
+}
+
+// Opcode describes one opcode and the shape of its payload.
+type Opcode struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Payload     *Schema  `json:"payload,omitempty"`
+	Features    []string `json:"features,omitempty"` // The peer needs any one of these for the handler to run
+	TTL         int      `json:"ttl,omitempty"`      // TTL of packets sent with the generated helper (default 1)
+}
+
+// Schema is the subset of JSON Schema that payloads are described with.
+type Schema struct {
+	Ref         string             `json:"$ref,omitempty"` // Name of a shared type
+	Type        string             `json:"type,omitempty"` // string, integer, number, boolean, array, object or any
+	Description string             `json:"description,omitempty"`
+	Properties  map[string]*Schema `json:"properties,omitempty"`
+	Required    []string           `json:"required,omitempty"`
+	Items       *Schema            `json:"items,omitempty"`
+	Enum        []string           `json:"enum,omitempty"`
+	MinLength   *int               `json:"minLength,omitempty"`
+	MaxLength   *int               `json:"maxLength,omitempty"`
+	Pattern     string             `json:"pattern,omitempty"`
+	Minimum     *float64           `json:"minimum,omitempty"`
+	Maximum     *float64           `json:"maximum,omitempty"`
+	MinItems    *int               `json:"minItems,omitempty"`
+	MaxItems    *int               `json:"maxItems,omitempty"`
+}
+
+func loadProtocol(path string) (*Protocol, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p Protocol
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := p.check(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &p, nil
+}
+
+// check rejects definitions that would generate broken code.
+func (p *Protocol) check() error {
+	seen := make(map[string]bool)
+	for _, op := range p.Opcodes {
+		if op.Name == "" {
+			return fmt.Errorf("opcode without a name")
+		}
+		if seen[op.Name] {
+			return fmt.Errorf("opcode %s is defined twice", op.Name)
+		}
+		seen[op.Name] = true
+		if op.Payload != nil {
+			if err := p.checkSchema(op.Name, op.Payload); err != nil {
+				return err
+			}
+		}
+	}
+	for name, s := range p.Types {
+		if goName(name) == "" {
+			return fmt.Errorf("type %q has no usable Go name", name)
+		}
+		if err := p.checkSchema(name, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Protocol) checkSchema(where string, s *Schema) error {
+	if s.Ref != "" {
+		if _, ok := p.Types[s.Ref]; !ok {
+			return fmt.Errorf("%s: unknown type %q", where, s.Ref)
+		}
+		return nil
+	}
+	switch s.Type {
+	case "string", "integer", "number", "boolean", "any", "":
+	case "array":
+		if s.Items == nil {
+			return fmt.Errorf("%s: array without items", where)
+		}
+		return p.checkSchema(where+"[]", s.Items)
+	case "object":
+		for _, name := range s.Required {
+			if _, ok := s.Properties[name]; !ok {
+				return fmt.Errorf("%s: required property %q is not defined", where, name)
+			}
+		}
+		for name, prop := range s.Properties {
+			if err := p.checkSchema(where+"."+name, prop); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%s: unsupported type %q", where, s.Type)
+	}
+	return nil
+}
+
+// propertyNames returns an object's properties in a stable order.
+func (s *Schema) propertyNames() []string {
+	names := make([]string, 0, len(s.Properties))
+	for name := range s.Properties {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// goName turns an opcode or property name such as G_MSG or peer_id into an
+// exported Go identifier such as GMsg or PeerID.
+func goName(name string) string {
+	var b strings.Builder
+	for _, word := range strings.FieldsFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if upper := strings.ToUpper(word); upper == "ID" || upper == "URL" || upper == "TTL" || upper == "RTT" {
+			b.WriteString(upper)
+			continue
+		}
+		runes := []rune(word)
+		if isUpper(word) {
+			runes = []rune(strings.ToLower(word))
+		}
+		runes[0] = unicode.ToUpper(runes[0])
+		b.WriteString(string(runes))
+	}
+	out := b.String()
+	if out != "" && unicode.IsDigit([]rune(out)[0]) {
+		out = "X" + out
+	}
+	return out
+}
+
+func isUpper(s string) bool {
+	return strings.ToUpper(s) == s
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"github.com/goccy/go-json"
+)
+
+const schema_dialect = "https://json-schema.org/draft/2020-12/schema"
+
+// jsonSchema produces a JSON Schema document describing every packet of a
+// protocol, for clients that are not written in Go.
+func jsonSchema(p *Protocol, id string) ([]byte, error) {
+	defs := make(map[string]any)
+	for name, s := range p.Types {
+		defs[name] = schemaOf(s)
+	}
+
+	var packets []any
+	for _, op := range p.Opcodes {
+		properties := map[string]any{
+			"opcode":   map[string]any{"const": op.Name},
+			"origin":   map[string]any{"type": "string"},
+			"target":   map[string]any{"type": "string"},
+			"ttl":      map[string]any{"type": "integer", "minimum": 0},
+			"id":       map[string]any{"type": "string"},
+			"method":   map[string]any{"type": "string"},
+			"listener": map[string]any{"type": "string"},
+		}
+		packet := map[string]any{
+			"type":       "object",
+			"properties": properties,
+			"required":   []string{"opcode"},
+		}
+		if op.Description != "" {
+			packet["description"] = op.Description
+		}
+		if len(op.Features) > 0 {
+			packet["x-features"] = op.Features
+		}
+		if op.Payload != nil {
+			properties["payload"] = schemaOf(op.Payload)
+			packet["required"] = []string{"opcode", "payload"}
+		}
+
+		defs[op.Name] = packet
+		packets = append(packets, map[string]any{"$ref": "#/$defs/" + op.Name})
+	}
+
+	doc := map[string]any{
+		"$schema": schema_dialect,
+		"$defs":   defs,
+		"oneOf":   packets,
+	}
+	if id != "" {
+		doc["$id"] = id
+	}
+	if p.Title != "" {
+		doc["title"] = p.Title
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// schemaOf converts a payload schema to standard JSON Schema.
+func schemaOf(s *Schema) map[string]any {
+	out := make(map[string]any)
+	if s.Ref != "" {
+		out["$ref"] = "#/$defs/" + s.Ref
+		return out
+	}
+	if s.Description != "" {
+		out["description"] = s.Description
+	}
+
+	switch s.Type {
+	case "", "any":
+	case "object":
+		out["type"] = "object"
+		if len(s.Properties) > 0 {
+			properties := make(map[string]any)
+			for name, prop := range s.Properties {
+				properties[name] = schemaOf(prop)
+			}
+			out["properties"] = properties
+		}
+		if len(s.Required) > 0 {
+			out["required"] = s.Required
+		}
+	case "array":
+		out["type"] = "array"
+		out["items"] = schemaOf(s.Items)
+	default:
+		out["type"] = s.Type
+	}
+
+	if len(s.Enum) > 0 {
+		out["enum"] = s.Enum
+	}
+	if s.Pattern != "" {
+		out["pattern"] = s.Pattern
+	}
+	for key, value := range map[string]any{
+		"minLength": s.MinLength,
+		"maxLength": s.MaxLength,
+		"minimum":   s.Minimum,
+		"maximum":   s.Maximum,
+		"minItems":  s.MinItems,
+		"maxItems":  s.MaxItems,
+	} {
+		switch v := value.(type) {
+		case *int:
+			if v != nil {
+				out[key] = *v
+			}
+		case *float64:
+			if v != nil {
+				out[key] = *v
+			}
+		}
+	}
+	return out
+}
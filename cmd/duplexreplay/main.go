@@ -0,0 +1,101 @@
+// Command duplexreplay feeds a packet capture back into a duplex instance's
+// builtin handlers, and prints every packet the handlers write in reply as a
+// JSON line:
+//
+//	duplexreplay -in capture.jsonl -peer alice -opcode PING,NEGOTIATE
+//
+// Captures are written by an instance with Config.Capture or
+// Instance.StartCapture. Applications with custom handlers should call
+// Instance.Replay from their own code instead, so that their handlers run too.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudlink-delta/duplex"
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog"
+)
+
+type output struct {
+	Peer   string          `json:"peer"`
+	Packet json.RawMessage `json:"packet"`
+}
+
+func main() {
+	in := flag.String("in", "", "capture file (required)")
+	config := flag.String("config", "", "YAML or JSON config file of the instance")
+	name := flag.String("name", "replay", "peer ID of the instance")
+	peers := flag.String("peer", "", "comma-separated peer IDs to replay (default all)")
+	opcodes := flag.String("opcode", "", "comma-separated opcodes to replay (default all)")
+	timing := flag.Bool("timing", false, "wait between packets as long as the capture did")
+	flag.Parse()
+
+	if *in == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := run(ctx, *in, *config, *name, split(*peers), split(*opcodes), *timing); err != nil {
+		fmt.Fprintln(os.Stderr, "duplexreplay:", err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, in, config, name string, peers, opcodes []string, timing bool) error {
+	file, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	args := &duplex.Config{LogLevel: zerolog.InfoLevel}
+	if config != "" {
+		if args, err = duplex.LoadConfig(config); err != nil {
+			return err
+		}
+	}
+
+	// Replies go to stdout, so keep logs out of the way
+	if args.Logger == nil && args.LogHandler == nil {
+		var logger zerolog.Logger
+		if args.LogFormat == duplex.LogFormatJSON {
+			logger = zerolog.New(os.Stderr)
+		} else {
+			logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339})
+		}
+		logger = logger.With().Timestamp().Logger().Level(args.LogLevel)
+		args.Logger = &logger
+	}
+	instance := duplex.New(name, args)
+
+	var mu sync.Mutex
+	encoder := json.NewEncoder(os.Stdout)
+	return instance.Replay(ctx, file, duplex.ReplayOptions{
+		Peers:   peers,
+		Opcodes: opcodes,
+		Timing:  timing,
+		OnWrite: func(p *duplex.Peer, packet []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			encoder.Encode(output{Peer: p.GetPeerID(), Packet: packet})
+		},
+	})
+}
+
+func split(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
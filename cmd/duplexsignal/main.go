@@ -0,0 +1,60 @@
+// Command duplexsignal runs a standalone PeerJS compatible signaling server,
+// for deployments and LAN sessions that should not depend on a public one:
+//
+//	duplexsignal -listen :9000 -key peerjs
+//
+// Instances connect to it by setting Hostname, Port, Secure: false and, if
+// changed, Key and Path in their Config.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/cloudlink-delta/duplex/signaling"
+	"github.com/rs/zerolog"
+)
+
+func main() {
+	listen := flag.String("listen", ":9000", "address to listen on")
+	key := flag.String("key", "peerjs", "API key clients must present")
+	path := flag.String("path", "/", "path the server is mounted on")
+	alive := flag.Duration("alive-timeout", 60*time.Second, "drop peers that send no heartbeat for this long")
+	expire := flag.Duration("expire-timeout", 5*time.Second, "how long messages to absent peers are queued")
+	limit := flag.Int("limit", 5000, "peers that may be connected at once")
+	discovery := flag.Bool("discovery", false, "serve the list of connected peer IDs")
+	level := flag.String("log-level", "info", "log level")
+	flag.Parse()
+
+	log_level, err := zerolog.ParseLevel(*level)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "duplexsignal:", err)
+		os.Exit(2)
+	}
+	logger := zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339}).
+		With().Timestamp().Logger().Level(log_level)
+
+	server := signaling.New(signaling.Options{
+		Key:             *key,
+		Path:            *path,
+		AliveTimeout:    *alive,
+		ExpireTimeout:   *expire,
+		ConcurrentLimit: *limit,
+		AllowDiscovery:  *discovery,
+		Logger:          &logger,
+	})
+	defer server.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := server.Listen(*listen); err != nil {
+		fmt.Fprintln(os.Stderr, "duplexsignal:", err)
+		os.Exit(1)
+	}
+	<-ctx.Done()
+}
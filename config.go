@@ -0,0 +1,341 @@
+package duplex
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is the prefix of environment variables read by LoadConfig.
+const EnvPrefix = "DUPLEX_"
+
+// BackoffSpec describes a BackoffPolicy in a configuration file. Constant
+// selects a ConstantBackoff, otherwise the policy is an ExponentialBackoff
+// whose unset fields are taken from DefaultBackoff. Delays are in milliseconds.
+type BackoffSpec struct {
+	Constant   int64   `json:"constant,omitempty"`
+	Initial    int64   `json:"initial,omitempty"`
+	Max        int64   `json:"max,omitempty"`
+	Multiplier float64 `json:"multiplier,omitempty"`
+	Jitter     float64 `json:"jitter,omitempty"`
+}
+
+func (s *BackoffSpec) policy() BackoffPolicy {
+	if s.Constant > 0 {
+		return ConstantBackoff(time.Duration(s.Constant) * time.Millisecond)
+	}
+	b := DefaultBackoff()
+	if s.Initial > 0 {
+		b.Initial = time.Duration(s.Initial) * time.Millisecond
+	}
+	if s.Max > 0 {
+		b.Max = time.Duration(s.Max) * time.Millisecond
+	}
+	if s.Multiplier > 0 {
+		b.Multiplier = s.Multiplier
+	}
+	if s.Jitter > 0 {
+		b.Jitter = s.Jitter
+	}
+	return b
+}
+
+var backoff_policy_type = reflect.TypeFor[BackoffPolicy]()
+
+// LoadConfig reads a Config from a YAML or JSON file, chosen by extension,
+// applies DUPLEX_* environment overrides and validates the result. With an
+// empty path, only the environment is read.
+//
+// Keys are the snake_case names of the Config fields, e.g. max_retries or
+// ice_servers, and environment variables are the same names in upper case
+// with the DUPLEX_ prefix, e.g. DUPLEX_MAX_RETRIES. Environment values that
+// are not plain strings, numbers or booleans are JSON, such as
+//
+//	DUPLEX_ICE_SERVERS='[{"urls":["stun:stun.l.google.com:19302"]}]'
+//	DUPLEX_RECONNECT_POLICY='{"initial":500,"max":30000}'
+func LoadConfig(path string) (*Config, error) {
+	config := &Config{}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		values := make(map[string]any)
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml":
+			err = yaml.Unmarshal(data, &values)
+		case ".json":
+			err = json.Unmarshal(data, &values)
+		default:
+			return nil, fmt.Errorf("%s: unknown config format, expected .yaml, .yml or .json", path)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		if err := config.apply(values); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	if err := config.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// apply sets the fields named by the keys of a decoded configuration file.
+func (c *Config) apply(values map[string]any) error {
+	fields := configFields()
+	var errs []error
+	for _, key := range slices.Sorted(maps.Keys(values)) {
+		value := values[key]
+		index, ok := fields[key]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown option %q", key))
+			continue
+		}
+
+		raw, err := json.Marshal(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+			continue
+		}
+		if err := c.set(index, raw); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// applyEnv sets the fields that have a DUPLEX_* variable in the environment.
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	fields := configFields()
+	var errs []error
+	for _, key := range slices.Sorted(maps.Keys(fields)) {
+		index := fields[key]
+		name := EnvPrefix + strings.ToUpper(key)
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		if err := c.set(index, envValue(reflect.TypeFor[Config]().Field(index).Type, value)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// envValue turns an environment variable into the JSON for a field, so that
+// strings and log levels do not have to be quoted.
+func envValue(t reflect.Type, value string) []byte {
+	value = strings.TrimSpace(value)
+	switch {
+	case t.Kind() == reflect.String, t == reflect.TypeFor[zerolog.Level]() && !isNumber(value):
+		raw, _ := json.Marshal(value)
+		return raw
+	case t.Kind() == reflect.Bool:
+		if b, err := strconv.ParseBool(value); err == nil {
+			return []byte(strconv.FormatBool(b))
+		}
+	}
+	return []byte(value)
+}
+
+func isNumber(value string) bool {
+	_, err := strconv.ParseFloat(value, 64)
+	return err == nil
+}
+
+// set decodes a JSON value into the field with the given index.
+func (c *Config) set(index int, raw []byte) error {
+	field := reflect.ValueOf(c).Elem().Field(index)
+
+	if field.Type() == backoff_policy_type {
+		if bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+			field.SetZero()
+			return nil
+		}
+		var spec BackoffSpec
+		if err := decodeStrict(raw, &spec); err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(spec.policy()))
+		return nil
+	}
+
+	value := reflect.New(field.Type())
+	if err := decodeStrict(raw, value.Interface()); err != nil {
+		return err
+	}
+	field.Set(value.Elem())
+	return nil
+}
+
+func decodeStrict(raw []byte, v any) error {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// configFields maps the snake_case name of every Config field to its index.
+func configFields() map[string]int {
+	t := reflect.TypeFor[Config]()
+	fields := make(map[string]int, t.NumField())
+	for index := range t.NumField() {
+		field := t.Field(index)
+		if !loadable(field.Type) {
+			continue
+		}
+		fields[snakeCase(field.Name)] = index
+	}
+	return fields
+}
+
+// loadable reports whether a field can be read from a file. Loggers, handlers
+// and other values that only make sense in Go code are skipped.
+func loadable(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Pointer, reflect.Func, reflect.Chan:
+		return false
+	case reflect.Interface:
+		return t == backoff_policy_type
+	}
+	return true
+}
+
+// field returns the field with the given snake_case name.
+func (c *Config) field(name string) reflect.Value {
+	return reflect.ValueOf(c).Elem().Field(configFields()[name])
+}
+
+// snakeCase converts a Go field name such as ICEServers to ice_servers.
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for n, r := range runes {
+		if n > 0 && unicode.IsUpper(r) {
+			prev := runes[n-1]
+			next_lower := n+1 < len(runes) && unicode.IsLower(runes[n+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && next_lower) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// Validate reports every option that is out of range or inconsistent. It is
+// called by LoadConfig, which fails on any error, and by New, which logs them.
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.Port < 0 || c.Port > math.MaxUint16 {
+		fail("port %d is out of range", c.Port)
+	}
+	if c.Hostname == "" && (c.Port != 0 || c.Secure) {
+		fail("port and secure require a hostname")
+	}
+	for n, server := range c.ICEServers {
+		if len(server.URLs) == 0 {
+			fail("ice_servers[%d] has no urls", n)
+		}
+		for _, url := range server.URLs {
+			if !strings.HasPrefix(url, "stun:") && !strings.HasPrefix(url, "stuns:") &&
+				!strings.HasPrefix(url, "turn:") && !strings.HasPrefix(url, "turns:") {
+				fail("ice_servers[%d] has invalid url %q", n, url)
+			}
+		}
+	}
+	if c.LogLevel < zerolog.TraceLevel || c.LogLevel > zerolog.Disabled {
+		fail("log_level %d is out of range", c.LogLevel)
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.LogLevels)) {
+		level := c.LogLevels[name]
+		switch name {
+		case LogSignaling, LogNegotiation, LogPackets:
+		default:
+			fail("log_levels has unknown subsystem %q", name)
+		}
+		if level < zerolog.TraceLevel || level > zerolog.Disabled {
+			fail("log_levels.%s %d is out of range", name, level)
+		}
+	}
+	if c.LogFormat != "" && c.LogFormat != LogFormatConsole && c.LogFormat != LogFormatJSON {
+		fail("log_format %q is not %q or %q", c.LogFormat, LogFormatConsole, LogFormatJSON)
+	}
+
+	if c.EnablePinger && c.PingInterval <= 0 {
+		fail("enable_pinger requires a positive ping_interval")
+	}
+	if c.EnableIncomingPinger && c.IncomingPingInterval <= 0 && c.PingInterval <= 0 {
+		fail("enable_incoming_pinger requires a positive incoming_ping_interval or ping_interval")
+	}
+
+	for _, name := range []string{
+		"ping_interval", "incoming_ping_interval", "idle_timeout", "keepalive_interval",
+		"setup_timeout", "max_redials", "session_replay_size", "session_ack_interval",
+		"session_timeout", "delivery_timeout", "delivery_dedup_window", "clock_samples",
+		"max_subscriptions", "max_relay_clients", "mesh_degree", "mesh_max_degree",
+		"mesh_interval", "pex_interval", "pex_sample_size", "pex_max_age",
+		"max_known_peers", "shutdown_timeout", "packet_log_sample",
+	} {
+		if c.field(name).Int() < 0 {
+			fail("%s must not be negative", name)
+		}
+	}
+
+	if c.IdleTimeout > 0 && c.KeepaliveInterval >= c.IdleTimeout {
+		fail("keepalive_interval must be shorter than idle_timeout")
+	}
+	if c.MeshMaxDegree > 0 && c.MeshDegree > 0 && c.MeshMaxDegree < c.MeshDegree {
+		fail("mesh_max_degree must not be below mesh_degree")
+	}
+	if c.Capture.MaxSize < 0 || c.Capture.MaxFiles < 0 {
+		fail("capture max_size and max_files must not be negative")
+	}
+	if c.RelayQuota.PacketsPerSecond < 0 || c.RelayQuota.BytesPerSecond < 0 || c.RelayQuota.Burst < 0 {
+		fail("relay_quota must not be negative")
+	}
+
+	if c.BridgeURL != "" && !strings.HasPrefix(c.BridgeURL, "ws://") && !strings.HasPrefix(c.BridgeURL, "wss://") {
+		fail("bridge_url %q is not a ws:// or wss:// URL", c.BridgeURL)
+	}
+
+	for _, name := range []string{"reconnect_policy", "redial_policy", "delivery_retry_policy"} {
+		if b, ok := c.field(name).Interface().(*ExponentialBackoff); ok {
+			if b.Initial < 0 || b.Max < 0 || b.Multiplier < 0 {
+				fail("%s must not be negative", name)
+			}
+			if b.Jitter < 0 || b.Jitter > 1 {
+				fail("%s jitter must be between 0 and 1", name)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,168 @@
+package duplex
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/rs/zerolog"
+)
+
+func writeConfig(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSnakeCase(t *testing.T) {
+	for name, want := range map[string]string{
+		"Hostname":        "hostname",
+		"ICEServers":      "ice_servers",
+		"EnablePEX":       "enable_pex",
+		"PEXMaxAge":       "pex_max_age",
+		"MaxRetries":      "max_retries",
+		"PacketLogSample": "packet_log_sample",
+	} {
+		if got := snakeCase(name); got != want {
+			t.Errorf("snakeCase(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestLoadConfigYAML(t *testing.T) {
+	path := writeConfig(t, "duplex.yaml", `
+hostname: peerjs.example.com
+port: 9000
+secure: true
+max_retries: 10
+is_relay: true
+log_level: debug
+log_levels:
+  packets: trace
+ice_servers:
+  - urls: ["stun:stun.example.com:3478"]
+reconnect_policy:
+  constant: 250
+`)
+	t.Setenv("DUPLEX_PORT", "9443")
+	t.Setenv("DUPLEX_IS_DISCOVERY", "true")
+	t.Setenv("DUPLEX_RELAY_QUOTA", `{"packets_per_second": 50}`)
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Hostname != "peerjs.example.com" || !config.Secure || config.MaxRetries != 10 {
+		t.Fatalf("config %+v", config)
+	}
+	if config.Port != 9443 {
+		t.Fatalf("port %d, the environment should override the file", config.Port)
+	}
+	if !config.IsRelay || !config.IsDiscovery || config.RelayQuota.PacketsPerSecond != 50 {
+		t.Fatalf("roles %+v", config)
+	}
+	if config.LogLevel != zerolog.DebugLevel || config.LogLevels[LogPackets] != zerolog.TraceLevel {
+		t.Fatalf("log levels %v %v", config.LogLevel, config.LogLevels)
+	}
+	if len(config.ICEServers) != 1 || config.ICEServers[0].URLs[0] != "stun:stun.example.com:3478" {
+		t.Fatalf("ice servers %+v", config.ICEServers)
+	}
+	if config.ReconnectPolicy.Delay(3) != 250*time.Millisecond {
+		t.Fatalf("reconnect policy %+v", config.ReconnectPolicy)
+	}
+}
+
+func TestLoadConfigJSON(t *testing.T) {
+	path := writeConfig(t, "duplex.json", `{"enable_pinger": true, "ping_interval": 1000, "redial_policy": {"initial": 100, "max": 1000}}`)
+	t.Setenv("DUPLEX_LOG_LEVEL", "warn")
+
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !config.EnablePinger || config.PingInterval != 1000 || config.LogLevel != zerolog.WarnLevel {
+		t.Fatalf("config %+v", config)
+	}
+	if b, ok := config.RedialPolicy.(*ExponentialBackoff); !ok || b.Initial != 100*time.Millisecond || b.Max != time.Second {
+		t.Fatalf("redial policy %+v", config.RedialPolicy)
+	}
+}
+
+func TestLoadConfigRejectsUnknownOptions(t *testing.T) {
+	path := writeConfig(t, "duplex.yaml", "hostname: example.com\nmax_retry: 3\n")
+	if _, err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), `unknown option "max_retry"`) {
+		t.Fatalf("loaded with %v", err)
+	}
+
+	if _, err := LoadConfig(writeConfig(t, "duplex.toml", "")); err == nil {
+		t.Fatal("loaded an unknown format")
+	}
+}
+
+func TestLoadConfigBadEnvironment(t *testing.T) {
+	t.Setenv("DUPLEX_MAX_RETRIES", "many")
+	if _, err := LoadConfig(""); err == nil || !strings.Contains(err.Error(), "DUPLEX_MAX_RETRIES") {
+		t.Fatalf("loaded with %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := (&Config{}).Validate(); err != nil {
+		t.Fatalf("zero config: %v", err)
+	}
+
+	config := &Config{
+		Port:              70000,
+		ICEServers:        []webrtc.ICEServer{{URLs: []string{"http://example.com"}}},
+		EnablePinger:      true,
+		IdleTimeout:       1000,
+		KeepaliveInterval: 2000,
+		LogLevels:         map[string]zerolog.Level{"storage": zerolog.InfoLevel},
+		LogFormat:         "xml",
+		MeshDegree:        8,
+		MeshMaxDegree:     4,
+		BridgeURL:         "http://example.com",
+		ShutdownTimeout:   -1,
+	}
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("invalid config passed")
+	}
+	for _, want := range []string{
+		"port 70000 is out of range",
+		"port and secure require a hostname",
+		`invalid url "http://example.com"`,
+		"enable_pinger requires a positive ping_interval",
+		"keepalive_interval must be shorter than idle_timeout",
+		`unknown subsystem "storage"`,
+		`log_format "xml"`,
+		"mesh_max_degree must not be below mesh_degree",
+		"bridge_url",
+		"shutdown_timeout must not be negative",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("missing %q in:\n%v", want, err)
+		}
+	}
+}
+
+func TestNewLogsInvalidConfig(t *testing.T) {
+	var buf log_buffer
+	bufferedInstance(t, &buf, &Config{})
+	if lines := buf.lines(t, "invalid configuration"); len(lines) != 0 {
+		t.Fatalf("valid configuration reported: %v", lines)
+	}
+
+	bufferedInstance(t, &buf, &Config{MeshDegree: 8, MeshMaxDegree: 2})
+	lines := buf.lines(t, "invalid configuration")
+	if len(lines) != 1 || !strings.Contains(fmt.Sprint(lines[0]["error"]), "mesh_max_degree") {
+		t.Fatalf("invalid configuration logged as %v", lines)
+	}
+}
@@ -0,0 +1,219 @@
+package duplex
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+type DeliveryAck struct {
+	Id string `json:"id"`
+}
+
+// Delivery tracks a packet sent with SendReliable until its recipient
+// acknowledges it or the deadline passes.
+type Delivery struct {
+	Id     string
+	target string // Peer expected to acknowledge the delivery
+	done   chan struct{}
+	acked  chan struct{}
+	once   sync.Once
+	err    error
+}
+
+// Done returns a channel that is closed once the delivery is confirmed or has failed.
+func (d *Delivery) Done() <-chan struct{} {
+	return d.done
+}
+
+// Err returns nil if the delivery was confirmed, or the reason it failed.
+// It must only be called after Done is closed.
+func (d *Delivery) Err() error {
+	return d.err
+}
+
+// Wait blocks until the delivery is confirmed or has failed, or the context ends.
+func (d *Delivery) Wait(ctx context.Context) error {
+	select {
+	case <-d.done:
+		return d.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *Delivery) resolve(err error) {
+	d.once.Do(func() {
+		d.err = err
+		close(d.done)
+	})
+}
+
+// SendReliable sends a packet and keeps resending it with backoff until the
+// final recipient acknowledges its Id, the context ends or the peer closes. If
+// the context has no deadline, DeliveryTimeout applies. Receivers drop retries
+// they have already seen, so handlers run at most once per Id.
+func (c *Peer) SendReliable(ctx context.Context, packet *TxPacket) *Delivery {
+	i := c.Parent
+
+	reliable := *packet
+	reliable.Reliable = true
+	if reliable.Id == "" {
+		reliable.Id = newRandomID()
+	}
+	if reliable.Origin == "" {
+		reliable.Origin = i.Name
+	}
+
+	target := reliable.Target
+	if target == "" {
+		target = c.GetPeerID()
+	}
+
+	d := &Delivery{
+		Id:     reliable.Id,
+		target: target,
+		done:   make(chan struct{}),
+		acked:  make(chan struct{}),
+	}
+
+	i.deliveriesMu.Lock()
+	i.deliveries[d.Id] = d
+	i.deliveriesMu.Unlock()
+
+	if _, ok := ctx.Deadline(); !ok && i.DeliveryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, i.DeliveryTimeout)
+		go func() {
+			<-d.done
+			cancel()
+		}()
+	}
+
+	closed := c.Closed()
+	go func() {
+		defer func() {
+			i.deliveriesMu.Lock()
+			delete(i.deliveries, d.Id)
+			i.deliveriesMu.Unlock()
+		}()
+
+		for attempt := 0; ; attempt++ {
+			if attempt > 0 {
+				c.Logger.Debug().Str("id", d.Id).Int("attempt", attempt+1).Msg("resending unacknowledged packet")
+			}
+			c.Write(&reliable)
+
+			timer := time.NewTimer(i.DeliveryRetryPolicy.Delay(attempt))
+			select {
+			case <-d.acked:
+				timer.Stop()
+				d.resolve(nil)
+				return
+			case <-ctx.Done():
+				timer.Stop()
+				d.resolve(ctx.Err())
+				return
+			case <-closed:
+				timer.Stop()
+				d.resolve(ErrPeerClosed)
+				return
+			case <-timer.C:
+			}
+		}
+	}()
+
+	return d
+}
+
+// HandleDeliveryAck confirms a pending delivery. Only the recipient of the
+// delivery may confirm it, either directly or through a trusted relay.
+func (conn *Peer) HandleDeliveryAck(r *RxPacket) {
+	var ack DeliveryAck
+	if err := json.Unmarshal(r.Payload, &ack); err != nil {
+		conn.Logger.Error().Err(err).Msg("failed to unmarshal delivery ack")
+		return
+	}
+
+	i := conn.Parent
+	i.deliveriesMu.Lock()
+	d, ok := i.deliveries[ack.Id]
+	i.deliveriesMu.Unlock()
+	if !ok {
+		return
+	}
+
+	// Origin can be forged by any peer, so it only names the sender when the
+	// ack was forwarded by a relay we trust
+	sender := conn.GetPeerID()
+	if r.Origin != "" && r.Origin != sender {
+		i.relay.mu.Lock()
+		trusted := i.trustedRelay(conn)
+		i.relay.mu.Unlock()
+		if trusted {
+			sender = r.Origin
+		}
+	}
+	if sender != d.target {
+		conn.Logger.Warn().Str("id", ack.Id).Str("sender", sender).Str("target", d.target).Msg("ignored delivery ack from a peer other than the recipient")
+		return
+	}
+
+	select {
+	case <-d.acked:
+	default:
+		close(d.acked)
+	}
+}
+
+// acknowledgeDelivery acknowledges a reliable packet addressed to us. It
+// returns false if the packet must be dropped, because it has no Id to
+// deduplicate it by or is a retry that was already handled.
+func (conn *Peer) acknowledgeDelivery(r *RxPacket) bool {
+	i := conn.Parent
+
+	if r.Id == "" {
+		conn.Logger.Warn().Str("opcode", r.Opcode).Msg("dropped reliable packet without an id")
+		return false
+	}
+
+	origin := r.Origin
+	if origin == "" {
+		origin = conn.GetPeerID()
+	}
+
+	conn.Write(&TxPacket{
+		Packet: Packet{
+			Opcode: "DELIVERY_ACK",
+			Origin: i.Name,
+			Target: origin,
+			TTL:    max(r.TTL+1, 1),
+		},
+		Payload: DeliveryAck{Id: r.Id},
+	})
+
+	key := origin + "/" + r.Id
+	now := time.Now()
+
+	i.seenMu.Lock()
+	defer i.seenMu.Unlock()
+
+	// Forget Ids outside of the deduplication window
+	if now.Sub(i.seen_pruned) > i.DeliveryDedupWindow/2 {
+		for k, at := range i.seen {
+			if now.Sub(at) > i.DeliveryDedupWindow {
+				delete(i.seen, k)
+			}
+		}
+		i.seen_pruned = now
+	}
+
+	if _, dup := i.seen[key]; dup {
+		conn.Logger.Debug().Str("id", r.Id).Str("origin", origin).Msg("dropped duplicate reliable packet")
+		return false
+	}
+	i.seen[key] = now
+	return true
+}
@@ -0,0 +1,148 @@
+package duplex
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog"
+)
+
+func ackPacket(id string) *RxPacket {
+	payload, _ := json.Marshal(DeliveryAck{Id: id})
+	return &RxPacket{Packet: Packet{Opcode: "DELIVERY_ACK", TTL: 1}, Payload: payload}
+}
+
+func TestReliableDeliveryConfirmedByAck(t *testing.T) {
+	i := New("alpha", &Config{DeliveryRetryPolicy: ConstantBackoff(5 * time.Millisecond), LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+
+	d := p.SendReliable(context.Background(), &TxPacket{Packet: Packet{Opcode: "DATA"}})
+	if d.Id == "" {
+		t.Fatal("no Id assigned")
+	}
+
+	// Let a few resends go out before acknowledging
+	time.Sleep(20 * time.Millisecond)
+	p.HandlePacket(ackPacket(d.Id))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := d.Wait(ctx); err != nil {
+		t.Fatalf("delivery failed: %v", err)
+	}
+}
+
+func TestReliableDeliveryTimesOut(t *testing.T) {
+	i := New("alpha", &Config{DeliveryTimeout: 30, DeliveryRetryPolicy: ConstantBackoff(5 * time.Millisecond), LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+
+	d := p.SendReliable(context.Background(), &TxPacket{Packet: Packet{Opcode: "DATA", Id: "fixed"}})
+	select {
+	case <-d.Done():
+	case <-time.After(time.Second):
+		t.Fatal("delivery never gave up")
+	}
+	if !errors.Is(d.Err(), context.DeadlineExceeded) {
+		t.Fatalf("delivery error %v", d.Err())
+	}
+
+	// A late ack for a finished delivery is ignored
+	p.HandlePacket(ackPacket("fixed"))
+}
+
+func TestReliablePacketsDeduplicated(t *testing.T) {
+	i := New("alpha", &Config{DeliveryDedupWindow: 50, LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+
+	packet := func(origin string) *RxPacket {
+		return &RxPacket{Packet: Packet{Opcode: "DATA", Id: "42", Origin: origin, Reliable: true, TTL: 1}}
+	}
+	if !p.acknowledgeDelivery(packet("beta")) {
+		t.Fatal("first delivery dropped")
+	}
+	if p.acknowledgeDelivery(packet("beta")) {
+		t.Fatal("retry delivered twice")
+	}
+	if !p.acknowledgeDelivery(packet("gamma")) {
+		t.Fatal("same Id from another origin dropped")
+	}
+
+	// Ids are forgotten once the window has passed
+	time.Sleep(80 * time.Millisecond)
+	if !p.acknowledgeDelivery(packet("beta")) {
+		t.Fatal("Id remembered past the deduplication window")
+	}
+}
+
+func TestDeliveryAckOnlyFromRecipient(t *testing.T) {
+	i := New("alpha", &Config{DeliveryTimeout: 50, LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+
+	d := p.SendReliable(context.Background(), &TxPacket{Packet: Packet{Opcode: "DATA", Target: "beta"}})
+	forged := ackPacket(d.Id)
+	forged.Origin = "mallory"
+	p.HandlePacket(forged)
+	<-d.Done()
+	if d.Err() == nil {
+		t.Fatal("delivery confirmed by a peer other than the recipient")
+	}
+}
+
+func TestReliableDeliveryStopsOnClose(t *testing.T) {
+	i := New("alpha", &Config{DeliveryRetryPolicy: ConstantBackoff(time.Hour), LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+
+	d := p.SendReliable(context.Background(), &TxPacket{Packet: Packet{Opcode: "DATA"}})
+	close(p.Done)
+	select {
+	case <-d.Done():
+	case <-time.After(time.Second):
+		t.Fatal("delivery kept retrying a closed peer")
+	}
+	if !errors.Is(d.Err(), ErrPeerClosed) {
+		t.Fatalf("delivery error %v", d.Err())
+	}
+}
+
+func TestReliablePacketWithoutIdDropped(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+	if p.acknowledgeDelivery(&RxPacket{Packet: Packet{Opcode: "DATA", Reliable: true, TTL: 1}}) {
+		t.Fatal("reliable packet without an Id delivered")
+	}
+}
+
+func TestDeliveryAckOriginNeedsTrustedRelay(t *testing.T) {
+	i := New("alpha", &Config{DeliveryTimeout: 100, TrustedRelays: []string{"relay"}, LogLevel: zerolog.Disabled})
+	acked := func(from *Peer) bool {
+		d := from.SendReliable(context.Background(), &TxPacket{Packet: Packet{Opcode: "DATA", Target: "beta"}})
+		ack := ackPacket(d.Id)
+		ack.Origin = "beta"
+		from.HandlePacket(ack)
+		<-d.Done()
+		return d.Err() == nil
+	}
+
+	direct := unopenedPeer(i)
+	direct.id = "mallory"
+	if acked(direct) {
+		t.Fatal("direct peer confirmed a delivery by claiming to be the recipient")
+	}
+
+	relay := unopenedPeer(i)
+	relay.id = "relay"
+	relay.IsRelay = true
+	if !acked(relay) {
+		t.Fatal("ack forwarded by a trusted relay ignored")
+	}
+
+	untrusted := unopenedPeer(i)
+	untrusted.id = "other"
+	untrusted.IsRelay = true
+	if acked(untrusted) {
+		t.Fatal("ack forwarded by an untrusted relay accepted")
+	}
+}
@@ -0,0 +1,356 @@
+package duplex
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+var (
+	ErrNoDiscovery  = errors.New("no discovery peer connected")
+	ErrPeerNotFound = errors.New("peer not found")
+)
+
+// Role names used in discovery queries.
+const (
+	RoleClient    = "client"
+	RoleBridge    = "bridge"
+	RoleRelay     = "relay"
+	RoleDiscovery = "discovery"
+)
+
+// Announcement is what a peer publishes about itself to discovery peers.
+type Announcement struct {
+	Name     string         `json:"name"`
+	Features []string       `json:"features,omitempty"`
+	Metadata map[string]any `json:"metadata,omitempty"`
+}
+
+// DiscoveryRecord is a registry entry held by a discovery instance.
+type DiscoveryRecord struct {
+	Id          string         `json:"id"`
+	Name        string         `json:"name"`
+	Features    []string       `json:"features,omitempty"`
+	Metadata    map[string]any `json:"metadata,omitempty"`
+	IsBridge    bool           `json:"is_bridge"`
+	IsRelay     bool           `json:"is_relay"`
+	IsDiscovery bool           `json:"is_discovery"`
+	LastSeen    int64          `json:"last_seen"` // Unix milliseconds
+}
+
+// DiscoveryQuery selects registry entries. Empty fields match anything, and
+// every listed feature must be present.
+type DiscoveryQuery struct {
+	Name     string   `json:"name,omitempty"`
+	Features []string `json:"features,omitempty"`
+	Role     string   `json:"role,omitempty"`
+	Limit    int      `json:"limit,omitempty"`
+}
+
+type DiscoveryResult struct {
+	Peers []DiscoveryRecord `json:"peers"`
+	Error string            `json:"error,omitempty"`
+}
+
+type discovery_registry struct {
+	mu      sync.RWMutex
+	records map[*Peer]*DiscoveryRecord
+}
+
+// Roles returns the roles held by the peer described by the record.
+func (r *DiscoveryRecord) Roles() []string {
+	var roles []string
+	if r.IsBridge {
+		roles = append(roles, RoleBridge)
+	}
+	if r.IsRelay {
+		roles = append(roles, RoleRelay)
+	}
+	if r.IsDiscovery {
+		roles = append(roles, RoleDiscovery)
+	}
+	if len(roles) == 0 {
+		roles = append(roles, RoleClient)
+	}
+	return roles
+}
+
+// Matches returns true if the record satisfies the query.
+func (q *DiscoveryQuery) Matches(r *DiscoveryRecord) bool {
+	if q.Name != "" && q.Name != r.Name {
+		return false
+	}
+	for _, feature := range q.Features {
+		if !slices.Contains(r.Features, feature) {
+			return false
+		}
+	}
+	if q.Role != "" && !slices.Contains(r.Roles(), q.Role) {
+		return false
+	}
+	return true
+}
+
+// Lookup searches the local discovery registry.
+func (i *Instance) Lookup(query DiscoveryQuery) []DiscoveryRecord {
+	i.registry.mu.RLock()
+	defer i.registry.mu.RUnlock()
+
+	results := []DiscoveryRecord{}
+	for _, record := range i.registry.records {
+		if query.Limit > 0 && len(results) >= query.Limit {
+			break
+		}
+		if query.Matches(record) {
+			results = append(results, *record)
+		}
+	}
+	return results
+}
+
+// unregister removes a closed peer from the discovery registry.
+func (i *Instance) unregister(p *Peer) {
+	i.registry.mu.Lock()
+	defer i.registry.mu.Unlock()
+	delete(i.registry.records, p)
+}
+
+// Announce sets what this instance publishes about itself, and sends it to
+// every connected discovery peer. Discovery peers that connect later receive
+// it after negotiation.
+func (i *Instance) Announce(announcement Announcement) {
+	i.mu.Lock()
+	i.announcement = &announcement
+	i.mu.Unlock()
+	i.updateLANAdvertisement()
+
+	for _, p := range i.DiscoveryPeers() {
+		p.Announce(announcement)
+	}
+}
+
+// Withdraw removes this instance from every connected discovery peer's registry.
+func (i *Instance) Withdraw() {
+	i.mu.Lock()
+	i.announcement = nil
+	i.mu.Unlock()
+	i.updateLANAdvertisement()
+
+	for _, p := range i.DiscoveryPeers() {
+		p.Write(&TxPacket{
+			Packet: Packet{Opcode: "DISCOVERY_WITHDRAW", TTL: 1},
+		})
+	}
+}
+
+// DiscoveryPeers returns all connected peers that negotiated the discovery role.
+func (i *Instance) DiscoveryPeers() PeerSlice {
+	var peers PeerSlice
+	for _, p := range i.ConnectedPeers() {
+		if p.IsDiscovery {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+// FindPeers queries every connected discovery peer and merges the results.
+func (i *Instance) FindPeers(ctx context.Context, query DiscoveryQuery) ([]DiscoveryRecord, error) {
+	peers := i.DiscoveryPeers()
+	if len(peers) == 0 {
+		return nil, ErrNoDiscovery
+	}
+
+	type outcome struct {
+		records []DiscoveryRecord
+		err     error
+	}
+	// We may be among the results, so ask for one more than the limit and
+	// leave ourselves out before applying it
+	remote := query
+	if remote.Limit > 0 {
+		remote.Limit++
+	}
+
+	outcomes := make(chan outcome, len(peers))
+	for _, p := range peers {
+		go func() {
+			records, err := p.FindPeers(ctx, remote)
+			outcomes <- outcome{records, err}
+		}()
+	}
+
+	var results []DiscoveryRecord
+	var last_err error
+	var answered bool
+	for range peers {
+		o := <-outcomes
+		if o.err != nil {
+			last_err = o.err
+			continue
+		}
+		answered = true
+		for _, record := range o.records {
+			if record.Id == i.Name {
+				continue
+			}
+			if !slices.ContainsFunc(results, func(r DiscoveryRecord) bool { return r.Id == record.Id }) {
+				results = append(results, record)
+			}
+		}
+	}
+
+	if !answered {
+		return nil, last_err
+	}
+	if query.Limit > 0 && len(results) > query.Limit {
+		results = results[:query.Limit]
+	}
+	return results, nil
+}
+
+// ConnectByName looks up a peer by its announced name through the connected
+// discovery peers and connects to it. If already connected, the existing
+// connection is returned.
+func (i *Instance) ConnectByName(ctx context.Context, name string) (*Peer, error) {
+	records, err := i.FindPeers(ctx, DiscoveryQuery{Name: name, Limit: 1})
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, ErrPeerNotFound
+	}
+
+	id := records[0].Id
+	if p, ok := i.GetPeer(id); ok {
+		return p, nil
+	}
+
+	p := i.Connect(id)
+	if p == nil {
+		return nil, ErrPeerNotFound
+	}
+
+	opened := make(chan struct{})
+	var once sync.Once
+	p.On("open", func(data any) {
+		once.Do(func() { close(opened) })
+	})
+
+	// The connection may have opened before the listener was bound
+	if p.Open {
+		once.Do(func() { close(opened) })
+	}
+
+	select {
+	case <-opened:
+		return p, nil
+	case <-ctx.Done():
+		p.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// Announce publishes an announcement to this discovery peer.
+func (c *Peer) Announce(announcement Announcement) {
+	c.Write(&TxPacket{
+		Packet:  Packet{Opcode: "DISCOVERY_ANNOUNCE", TTL: 1},
+		Payload: announcement,
+	})
+}
+
+// FindPeers queries this discovery peer's registry.
+func (c *Peer) FindPeers(ctx context.Context, query DiscoveryQuery) ([]DiscoveryRecord, error) {
+	reply, err := c.Request(ctx, &TxPacket{
+		Packet:  Packet{Opcode: "DISCOVERY_QUERY", TTL: 1},
+		Payload: query,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var result DiscoveryResult
+	if err := json.Unmarshal(reply.Payload, &result); err != nil {
+		return nil, err
+	}
+	if result.Error != "" {
+		return nil, &RemoteError{Opcode: "DISCOVERY_QUERY", Message: result.Error}
+	}
+	return result.Peers, nil
+}
+
+// announceTo sends our announcement, if any, to a newly negotiated discovery peer.
+func (i *Instance) announceTo(p *Peer) {
+	i.mu.Lock()
+	announcement := i.announcement
+	i.mu.Unlock()
+	if announcement != nil {
+		p.Announce(*announcement)
+	}
+}
+
+func (conn *Peer) HandleDiscoveryAnnounce(r *RxPacket) {
+	i := conn.Parent
+	if !i.IsDiscovery {
+		conn.Logger.Warn().Msg("dropped announcement: not a discovery instance")
+		return
+	}
+
+	var announcement Announcement
+	if err := json.Unmarshal(r.Payload, &announcement); err != nil {
+		conn.Logger.Error().Err(err).Msg("failed to unmarshal announcement")
+		return
+	}
+
+	record := &DiscoveryRecord{
+		Id:          conn.GetPeerID(),
+		Name:        announcement.Name,
+		Features:    announcement.Features,
+		Metadata:    announcement.Metadata,
+		IsBridge:    conn.IsBridge,
+		IsRelay:     conn.IsRelay,
+		IsDiscovery: conn.IsDiscovery,
+		LastSeen:    time.Now().UnixMilli(),
+	}
+	if record.Name == "" {
+		record.Name = record.Id
+	}
+
+	i.registry.mu.Lock()
+	i.registry.records[conn] = record
+	i.registry.mu.Unlock()
+
+	conn.Logger.Debug().Str("name", record.Name).Strs("features", record.Features).Msg("peer announced")
+}
+
+func (conn *Peer) HandleDiscoveryWithdraw(r *RxPacket) {
+	conn.Parent.unregister(conn)
+}
+
+func (conn *Peer) HandleDiscoveryQuery(r *RxPacket) {
+	reply := &TxPacket{
+		Packet: Packet{Opcode: "DISCOVERY_RESULT", TTL: 1, Listener: r.Listener},
+	}
+
+	i := conn.Parent
+	if !i.IsDiscovery {
+		reply.Payload = DiscoveryResult{Peers: []DiscoveryRecord{}, Error: "not a discovery instance"}
+		conn.Write(reply)
+		return
+	}
+
+	var query DiscoveryQuery
+	if err := json.Unmarshal(r.Payload, &query); err != nil {
+		conn.Logger.Error().Err(err).Msg("failed to unmarshal discovery query")
+		reply.Payload = DiscoveryResult{Peers: []DiscoveryRecord{}, Error: "malformed query"}
+		conn.Write(reply)
+		return
+	}
+
+	reply.Payload = DiscoveryResult{Peers: i.Lookup(query)}
+	conn.Write(reply)
+}
@@ -0,0 +1,129 @@
+package duplex
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog"
+)
+
+func TestDiscoveryQueryMatches(t *testing.T) {
+	relay := &DiscoveryRecord{Name: "hub", Features: []string{"chat", "files"}, IsRelay: true}
+	client := &DiscoveryRecord{Name: "laptop", Features: []string{"chat"}}
+
+	if roles := client.Roles(); !slices.Equal(roles, []string{RoleClient}) {
+		t.Fatalf("client roles %v", roles)
+	}
+	cases := []struct {
+		query DiscoveryQuery
+		relay bool
+		other bool
+	}{
+		{DiscoveryQuery{}, true, true},
+		{DiscoveryQuery{Name: "hub"}, true, false},
+		{DiscoveryQuery{Features: []string{"chat", "files"}}, true, false},
+		{DiscoveryQuery{Role: RoleClient}, false, true},
+		{DiscoveryQuery{Role: RoleRelay, Features: []string{"chat"}}, true, false},
+	}
+	for _, c := range cases {
+		if c.query.Matches(relay) != c.relay || c.query.Matches(client) != c.other {
+			t.Errorf("query %+v", c.query)
+		}
+	}
+}
+
+func announce(p *Peer, a Announcement) {
+	payload, _ := json.Marshal(a)
+	p.HandlePacket(&RxPacket{Packet: Packet{Opcode: "DISCOVERY_ANNOUNCE", TTL: 1}, Payload: payload})
+}
+
+func TestDiscoveryRegistry(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	i.IsDiscovery = true
+	a, b, c := unopenedPeer(i), unopenedPeer(i), unopenedPeer(i)
+	c.IsBridge = true
+
+	announce(a, Announcement{Name: "a", Features: []string{"chat"}})
+	announce(b, Announcement{Name: "b", Features: []string{"chat", "voice"}})
+	announce(c, Announcement{Name: "c"})
+
+	if got := i.Lookup(DiscoveryQuery{Features: []string{"chat"}}); len(got) != 2 {
+		t.Fatalf("%d chat peers", len(got))
+	}
+	if got := i.Lookup(DiscoveryQuery{Features: []string{"chat"}, Limit: 1}); len(got) != 1 {
+		t.Fatalf("%d results past the limit", len(got))
+	}
+	if got := i.Lookup(DiscoveryQuery{Role: RoleBridge}); len(got) != 1 || got[0].Name != "c" {
+		t.Fatalf("bridges %v", got)
+	}
+
+	// Announcing again replaces the record
+	announce(a, Announcement{Name: "a2"})
+	if got := i.Lookup(DiscoveryQuery{Name: "a"}); len(got) != 0 {
+		t.Fatal("stale record kept")
+	}
+
+	b.HandlePacket(&RxPacket{Packet: Packet{Opcode: "DISCOVERY_WITHDRAW", TTL: 1}})
+	i.unregister(c)
+	if got := i.Lookup(DiscoveryQuery{}); len(got) != 1 || got[0].Name != "a2" {
+		t.Fatalf("registry %v", got)
+	}
+}
+
+func TestAnnouncementsNeedDiscoveryRole(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	announce(unopenedPeer(i), Announcement{Name: "a"})
+	if got := i.Lookup(DiscoveryQuery{}); len(got) != 0 {
+		t.Fatal("registered an announcement without the discovery role")
+	}
+
+	if _, err := i.FindPeers(context.Background(), DiscoveryQuery{}); !errors.Is(err, ErrNoDiscovery) {
+		t.Fatalf("FindPeers returned %v", err)
+	}
+	if _, err := i.ConnectByName(context.Background(), "a"); !errors.Is(err, ErrNoDiscovery) {
+		t.Fatalf("ConnectByName returned %v", err)
+	}
+}
+
+func TestFindPeersLeavesSelfOutBeforeLimit(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	queries := make(chan *RxPacket, 1)
+	disco := i.replayPeer("disco", func(_ *Peer, raw []byte) {
+		var packet RxPacket
+		if json.Unmarshal(raw, &packet) == nil && packet.Opcode == "DISCOVERY_QUERY" {
+			queries <- &packet
+		}
+	})
+	defer disco.Close()
+	disco.IsDiscovery = true
+
+	type outcome struct {
+		records []DiscoveryRecord
+		err     error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		records, err := i.FindPeers(context.Background(), DiscoveryQuery{Name: "shared", Limit: 1})
+		done <- outcome{records, err}
+	}()
+
+	query := <-queries
+	var args DiscoveryQuery
+	json.Unmarshal(query.Payload, &args)
+	if args.Limit != 2 {
+		t.Fatalf("asked for %d records", args.Limit)
+	}
+	payload, _ := json.Marshal(DiscoveryResult{Peers: []DiscoveryRecord{{Id: "alpha", Name: "shared"}, {Id: "beta", Name: "shared"}}})
+	disco.HandlePacket(&RxPacket{Packet: Packet{Opcode: "DISCOVERY_RESULT", Listener: query.Listener, TTL: 1}, Payload: payload})
+
+	o := <-done
+	if o.err != nil {
+		t.Fatal(o.err)
+	}
+	if len(o.records) != 1 || o.records[0].Id != "beta" {
+		t.Fatalf("found %+v", o.records)
+	}
+}
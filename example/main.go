@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/signal"
@@ -24,15 +25,12 @@ func main() {
 	i := duplex.New(name, nil)
 
 	// Graceful shutdown handler
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-c
-		i.Close <- true
-		<-i.Done
-		os.Exit(1)
-	}()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// Runner
-	i.Run()
+	if err := i.Run(ctx); err != nil {
+		fmt.Println("Instance stopped:", err)
+		os.Exit(1)
+	}
 }
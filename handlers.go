@@ -1,6 +1,7 @@
 package duplex
 
 import (
+	"context"
 	"slices"
 	"strings"
 	"time"
@@ -15,7 +16,17 @@ func (conn *Peer) HandlePacket(r *RxPacket) {
 
 	// Drop packet if TTL is < 0
 	if r.TTL < 0 {
-		conn.Logger.Warn().Str("opcode", r.Opcode).Msg("dropped packet: TTL expired")
+		conn.packet_log.Warn().Str("opcode", r.Opcode).Msg("dropped packet: TTL expired")
+		return
+	}
+
+	// Relays forward packets addressed to other peers
+	if r.Target != "" && r.Target != conn.Parent.Name && conn.Parent.IsRelay && conn.forward(r) {
+		return
+	}
+
+	// Acknowledge reliable packets addressed to us, and drop retries we have already seen
+	if r.Reliable && (r.Target == "" || r.Target == conn.Parent.Name) && !conn.acknowledgeDelivery(r) {
 		return
 	}
 
@@ -28,7 +39,7 @@ func (conn *Peer) HandlePacket(r *RxPacket) {
 			// Check if the peer has all the required features
 			for _, feature := range required_features {
 				if !slices.Contains(conn.Features, feature) {
-					conn.Logger.Warn().Str("opcode", r.Opcode).Str("feature", feature).Msg("dropped packet: missing required feature")
+					conn.packet_log.Warn().Str("opcode", r.Opcode).Str("feature", feature).Msg("dropped packet: missing required feature")
 					return
 				}
 			}
@@ -38,8 +49,13 @@ func (conn *Peer) HandlePacket(r *RxPacket) {
 		return
 	}
 
+	// Bridged peers talk to the CloudLink 4 server for messages and variables
+	if conn.toBridge(r) {
+		return
+	}
+
 	// Listener handlers take second priority
-	if listener, ok := conn.Listeners[r.Listener]; ok {
+	if listener, ok := conn.GetListener(r.Listener); ok {
 		listener(r)
 		return
 	}
@@ -57,12 +73,10 @@ func (conn *Peer) HandlePacket(r *RxPacket) {
 	case "NEGOTIATE":
 		conn.HandleNegotiate(r)
 
-	case "PING":
-
-		type PingRequest struct {
-			T1 int64 `json:"t1"`
-		}
+	case "GOODBYE":
+		conn.HandleGoodbye(r)
 
+	case "PING":
 		then := &PingRequest{}
 
 		err := json.Unmarshal(r.Payload, &then)
@@ -71,12 +85,7 @@ func (conn *Peer) HandlePacket(r *RxPacket) {
 			return
 		}
 
-		var now = time.Now().UnixNano() / 1000000
-
-		type PongReply struct {
-			T1 int64 `json:"t1"`
-			T2 int64 `json:"t2"`
-		}
+		var now = time.Now().UnixMilli()
 
 		conn.Write(&TxPacket{
 			Packet: Packet{
@@ -87,16 +96,11 @@ func (conn *Peer) HandlePacket(r *RxPacket) {
 			Payload: PongReply{
 				T1: then.T1,
 				T2: now,
+				T3: time.Now().UnixMilli(),
 			},
 		})
 
 	case "PONG":
-
-		type PongReply struct {
-			T1 int64 `json:"t1"`
-			T2 int64 `json:"t2"`
-		}
-
 		var reply PongReply
 		err := json.Unmarshal(r.Payload, &reply)
 		if err != nil {
@@ -104,48 +108,114 @@ func (conn *Peer) HandlePacket(r *RxPacket) {
 			return
 		}
 
-		now := time.Now().UnixNano() / 1000000
-		rtt := now - reply.T1
-		conn.RTT = rtt
+		conn.HandlePong(reply)
 
-		conn.Logger.Debug().Int64("rtt_ms", rtt).Msg("latency updated")
+	case "ROOM_JOIN":
+		conn.HandleRoomJoin(r)
 
-	default:
+	case "ROOM_LEAVE":
+		conn.HandleRoomLeave(r)
 
-		// Process custom opcodes if there are any
-		if handler, ok := conn.Parent.CustomHandlers[r.Opcode]; ok {
+	case "ROOM_MEMBERS":
+		conn.HandleRoomMembers(r)
 
-			// Verify if the custom handler requires any special features
-			if required_features := conn.Parent.CustomHandlersRequiredFeatures[r.Opcode]; len(required_features) > 0 {
+	case "G_MSG":
+		// Messages that name no room go to a bound G_MSG handler, if there is one
+		if _, bound := conn.Parent.CustomHandlers[r.Opcode]; bound && messageRoom(r) == "" {
+			conn.handleCustom(r)
+		} else {
+			conn.HandleRoomMessage(r)
+		}
 
-				// Check if the peer has all the required features
-				var match_found bool
-				for _, feature := range required_features {
-					if slices.Contains(conn.Features, feature) && !match_found {
-						match_found = true
-					}
-				}
+	case "DISCOVERY_ANNOUNCE":
+		conn.HandleDiscoveryAnnounce(r)
 
-				if !match_found {
-					conn.Logger.Warn().Str("opcode", r.Opcode).Strs("required_features", required_features).Msg("dropped packet: client is missing any of the required feature(s)")
-					return
-				}
+	case "DISCOVERY_WITHDRAW":
+		conn.HandleDiscoveryWithdraw(r)
+
+	case "DISCOVERY_QUERY":
+		conn.HandleDiscoveryQuery(r)
+
+	case "RELAY_REGISTER":
+		conn.HandleRelayRegister(r)
+
+	case "RELAY_UNREGISTER":
+		conn.HandleRelayUnregister(r)
+
+	case "NAME_CLAIM":
+		conn.HandleNameClaim(r)
+
+	case "NAME_RELEASE":
+		conn.HandleNameRelease(r)
+
+	case "NAME_RESOLVE":
+		conn.HandleNameResolve(r)
+
+	case "RPC_CALL":
+		conn.HandleRPCCall(r)
+
+	case "RPC_CANCEL":
+		conn.HandleRPCCancel(r)
+
+	case "PEX":
+		conn.HandlePex(r)
+
+	case "SUBSCRIBE":
+		conn.HandleSubscribe(r)
+
+	case "UNSUBSCRIBE":
+		conn.HandleUnsubscribe(r)
+
+	case "PUBLISH":
+		conn.HandlePublish(r)
+
+	case "DELIVERY_ACK":
+		conn.HandleDeliveryAck(r)
+
+	case "SESSION_ACK":
+		conn.HandleSessionAck(r)
+
+	default:
+		conn.handleCustom(r)
+	}
+}
+
+// handleCustom passes a packet to the handler bound to its opcode, if any.
+func (conn *Peer) handleCustom(r *RxPacket) {
+	handler, ok := conn.Parent.CustomHandlers[r.Opcode]
+	if !ok {
+		return
+	}
+
+	// Verify if the custom handler requires any special features
+	if required_features := conn.Parent.CustomHandlersRequiredFeatures[r.Opcode]; len(required_features) > 0 {
+
+		// Check if the peer has all the required features
+		var match_found bool
+		for _, feature := range required_features {
+			if slices.Contains(conn.Features, feature) && !match_found {
+				match_found = true
 			}
+		}
 
-			handler(conn, r)
+		if !match_found {
+			conn.packet_log.Warn().Str("opcode", r.Opcode).Strs("required_features", required_features).Msg("dropped packet: client is missing any of the required feature(s)")
+			return
 		}
 	}
+
+	handler(conn, r)
 }
 
 func (conn *Peer) HandleNegotiate(reader *RxPacket) {
 	var arguments NegotiationArgs
 	err := json.Unmarshal(reader.Payload, &arguments)
 	if err != nil {
-		conn.Logger.Error().Err(err).Msg("failed to unmarshal negotiation arguments")
+		conn.negotiation_log.Error().Err(err).Msg("failed to unmarshal negotiation arguments")
 		return
 	}
 
-	conn.Logger.Info().
+	conn.negotiation_log.Info().
 		Int("spec_version", arguments.SpecVersion).
 		Str("client_type", arguments.Version.Type).
 		Int("major", arguments.Version.Major).
@@ -153,6 +223,10 @@ func (conn *Peer) HandleNegotiate(reader *RxPacket) {
 		Int("patch", arguments.Version.Patch).
 		Msg("peer using dialect")
 
+	conn.Version = arguments.Version
+	conn.SpecVersion = arguments.SpecVersion
+	conn.Plugins = arguments.Plugins
+
 	var advertised_features []string
 	if arguments.IsBridge {
 		advertised_features = append(advertised_features, "bridge")
@@ -168,7 +242,7 @@ func (conn *Peer) HandleNegotiate(reader *RxPacket) {
 	}
 
 	if len(advertised_features) > 0 {
-		conn.Logger.Info().Str("features", strings.Join(advertised_features, ", ")).Msg("peer advertises features")
+		conn.negotiation_log.Info().Str("features", strings.Join(advertised_features, ", ")).Msg("peer advertises features")
 	}
 
 	// Store our advertised features
@@ -176,7 +250,17 @@ func (conn *Peer) HandleNegotiate(reader *RxPacket) {
 
 	// Reply with our capabilities and version if we are the responder
 	if !conn.IsInitiator {
-		conn.SendNegotiate(reader)
+		var reply *SessionArgs
+		var session *Session
+		if arguments.Session != nil && conn.Parent.EnableSessions {
+			reply, session = conn.acceptSession(arguments.Session)
+		}
+		conn.sendNegotiate(reader, reply)
+		if session != nil {
+			session.attach(conn, arguments.Session.Received)
+		}
+	} else if arguments.Session != nil && conn.Parent.EnableSessions {
+		conn.completeSession(arguments.Session).attach(conn, arguments.Session.Received)
 	}
 
 	// Run callbacks
@@ -192,10 +276,44 @@ func (conn *Peer) HandleNegotiate(reader *RxPacket) {
 	if fn := conn.Parent.OnDiscoveryConnected; fn != nil && arguments.IsDiscovery {
 		go fn(conn)
 	}
+
+	// Publish ourselves to discovery peers
+	if arguments.IsDiscovery {
+		go conn.Parent.announceTo(conn)
+	}
+
+	// Claim our username with name service peers
+	if arguments.IsDiscovery || arguments.IsRelay {
+		go conn.Parent.claimTo(conn)
+	}
+
+	// Give clients their own CloudLink 4 session if we are a bridge
+	if conn.IsClient() {
+		go conn.Parent.bridge(conn)
+	}
+
+	// Register with relays if asked to
+	if arguments.IsRelay && conn.Parent.AutoRegisterRelays {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), conn.Parent.SetupTimeout)
+			defer cancel()
+			if _, err := conn.RegisterRelay(ctx); err != nil {
+				conn.negotiation_log.Warn().Err(err).Msg("failed to register with relay")
+			}
+		}()
+	}
 }
 
 // SendNegotiate sends a NEGOTIATE packet to a newly connected peer.
 func (conn *Peer) SendNegotiate(r *RxPacket) {
+	var session *SessionArgs
+	if conn.IsInitiator {
+		session = conn.sessionOffer()
+	}
+	conn.sendNegotiate(r, session)
+}
+
+func (conn *Peer) sendNegotiate(r *RxPacket, session *SessionArgs) {
 	conn.WriteBlocking(&TxPacket{
 		Packet: Packet{
 			Opcode:   "NEGOTIATE",
@@ -214,6 +332,7 @@ func (conn *Peer) SendNegotiate(r *RxPacket) {
 			IsBridge:    conn.Parent.IsBridge,
 			IsRelay:     conn.Parent.IsRelay,
 			IsDiscovery: conn.Parent.IsDiscovery,
+			Session:     session,
 		},
 	})
 }
@@ -240,14 +359,14 @@ func (conn *Peer) SendAndWaitForReply(request *TxPacket) *RxPacket {
 	listener_func := func(r *RxPacket) {
 
 		// Unbind the listener
-		delete(conn.Listeners, request.Listener)
+		conn.UnbindListener(request.Listener)
 
 		// Return the callback
 		response <- r
 	}
 
 	// Bind the listener
-	conn.Listeners[request.Listener] = listener_func
+	conn.BindListener(request.Listener, listener_func)
 
 	// Send the packet
 	go conn.Write(request)
@@ -256,6 +375,35 @@ func (conn *Peer) SendAndWaitForReply(request *TxPacket) *RxPacket {
 	return <-response
 }
 
+// Request is a variant of SendAndWaitForReply that gives up when the context
+// ends or the connection closes. If the packet is not tagged with a listener
+// string, a random one is assigned.
+func (conn *Peer) Request(ctx context.Context, request *TxPacket) (*RxPacket, error) {
+	if request.Listener == "" {
+		tagged := *request
+		tagged.Listener = newRandomID()
+		request = &tagged
+	}
+
+	response := make(chan *RxPacket, 1)
+	conn.BindListener(request.Listener, func(r *RxPacket) {
+		conn.UnbindListener(request.Listener)
+		response <- r
+	})
+	defer conn.UnbindListener(request.Listener)
+
+	go conn.Write(request)
+
+	select {
+	case r := <-response:
+		return r, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-conn.Closed():
+		return nil, ErrPeerClosed
+	}
+}
+
 // Creates a callback that fires whenever a specific connection receives a specific packet opcode.
 func (conn *Peer) WaitForMatchedPacket(opcodes ...string) *RxPacket {
 
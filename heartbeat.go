@@ -0,0 +1,123 @@
+package duplex
+
+import (
+	"time"
+)
+
+// Lower bound for the watchdog polling interval.
+const min_watchdog_interval = 100 * time.Millisecond
+
+// SpawnTicker periodically pings a peer and closes the connection once too many
+// pings go unanswered. Peers we connected to and peers that connected to us
+// are governed by separate settings.
+func (i *Instance) SpawnTicker(conn *Peer) {
+	interval := i.tickerInterval(conn)
+	if interval <= 0 {
+		return
+	}
+
+	done := conn.Closed()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !conn.heartbeat() {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// tickerInterval returns how often SpawnTicker pings the peer, or 0 if it does not.
+func (i *Instance) tickerInterval(conn *Peer) time.Duration {
+	enabled, interval := i.Pinger, i.PingInterval
+	if !conn.IsInitiator {
+		enabled, interval = i.IncomingPinger, i.IncomingPingInterval
+	}
+	if !enabled {
+		return 0
+	}
+	return interval
+}
+
+// SpawnWatchdog closes a peer that has been silent for longer than the idle
+// timeout, and sends keepalive pings whenever we have not written anything to
+// the peer within the keepalive interval.
+func (i *Instance) SpawnWatchdog(conn *Peer) {
+	if i.IdleTimeout <= 0 && i.KeepaliveInterval <= 0 {
+		return
+	}
+
+	// Poll at half the shortest configured period
+	interval := i.IdleTimeout
+	if interval <= 0 || (i.KeepaliveInterval > 0 && i.KeepaliveInterval < interval) {
+		interval = i.KeepaliveInterval
+	}
+	interval = max(interval/2, min_watchdog_interval)
+
+	now := time.Now().UnixNano()
+	conn.last_rx.CompareAndSwap(0, now)
+	conn.last_tx.CompareAndSwap(0, now)
+
+	pinged := i.tickerInterval(conn) > 0
+	done := conn.Closed()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if i.IdleTimeout > 0 && conn.IdleFor() >= i.IdleTimeout {
+				conn.Logger.Warn().Dur("idle", conn.IdleFor()).Msg("peer idle timeout reached, closing connection")
+				conn.Close()
+				return
+			}
+			if i.KeepaliveInterval > 0 && time.Since(time.Unix(0, conn.last_tx.Load())) >= i.KeepaliveInterval {
+
+				// Leave a ping sent by the ticker for the ticker to judge, so that
+				// it is not counted as missed twice
+				if pinged && conn.Latency.pending() {
+					continue
+				}
+				if !conn.heartbeat() {
+					return
+				}
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// heartbeat sends a single PING. It returns false if the peer was closed
+// because too many previous pings went unanswered.
+func (c *Peer) heartbeat() bool {
+	missed := c.Latency.sent()
+	if missed > 0 {
+		c.Logger.Warn().Int("missed", missed).Msg("ping went unanswered")
+	}
+	if limit := c.Parent.MaxMissedPings; limit > 0 && missed >= limit {
+		c.Logger.Warn().Int("missed", missed).Msg("peer is not responding, closing connection")
+		c.Close()
+		return false
+	}
+	c.Write(&TxPacket{
+		Packet: Packet{
+			Opcode: "PING",
+			TTL:    1,
+		},
+		Payload: PingRequest{T1: time.Now().UnixMilli()},
+	})
+	return true
+}
+
+// IdleFor returns how long it has been since the peer last sent us anything.
+func (c *Peer) IdleFor() time.Duration {
+	last := c.last_rx.Load()
+	if last == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(0, last))
+}
@@ -0,0 +1,118 @@
+package duplex
+
+import (
+	"testing"
+	"time"
+
+	peer "github.com/cloudlink-delta/peerjs-go"
+	"github.com/cloudlink-delta/peerjs-go/emitter"
+	"github.com/rs/zerolog"
+)
+
+// returnsWithin reports whether fn returns before the timeout.
+func returnsWithin(fn func(), timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func TestIncomingPingIntervalDefault(t *testing.T) {
+	i := New("alpha", &Config{EnableIncomingPinger: true, PingInterval: 250, LogLevel: zerolog.Disabled})
+	if !i.IncomingPinger || i.IncomingPingInterval != 250*time.Millisecond {
+		t.Fatalf("incoming pinger %v every %v", i.IncomingPinger, i.IncomingPingInterval)
+	}
+	if i.Pinger {
+		t.Fatal("outgoing pinger enabled by the incoming setting")
+	}
+}
+
+func TestIncomingTickerUsesOwnSettings(t *testing.T) {
+	i := New("alpha", &Config{EnablePinger: true, PingInterval: 5, LogLevel: zerolog.Disabled})
+	conn := &peer.DataConnection{BaseConnection: peer.BaseConnection{Emitter: emitter.NewEmitter()}}
+	incoming := i.newPeer(conn, false)
+	if !returnsWithin(func() { i.SpawnTicker(incoming) }, time.Second) {
+		t.Fatal("incoming peer pinged with the outgoing settings")
+	}
+	if s := incoming.Latency.Stats(); s.TotalMissed != 0 {
+		t.Fatalf("incoming peer pinged: %+v", s)
+	}
+
+	i = New("alpha", &Config{EnableIncomingPinger: true, IncomingPingInterval: 5, MaxMissedPings: 1, LogLevel: zerolog.Disabled})
+	incoming = i.newPeer(conn, false)
+	if !returnsWithin(func() { i.SpawnTicker(incoming) }, 2*time.Second) {
+		t.Fatal("incoming ticker kept pinging a silent peer")
+	}
+	if s := incoming.Latency.Stats(); s.Missed != 1 {
+		t.Fatalf("gave up after %d missed pings", s.Missed)
+	}
+}
+
+func TestIdleTimeoutClosesSilentPeer(t *testing.T) {
+	i := New("alpha", &Config{IdleTimeout: 150, LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+	if !returnsWithin(func() { i.SpawnWatchdog(p) }, 2*time.Second) {
+		t.Fatal("watchdog left an idle peer open")
+	}
+	if idle := p.IdleFor(); idle < 150*time.Millisecond {
+		t.Fatalf("closed after only %v idle", idle)
+	}
+}
+
+func TestKeepaliveOnlyWhenQuiet(t *testing.T) {
+	i := New("alpha", &Config{KeepaliveInterval: 200, MaxMissedPings: 1, LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+
+	// The first keepalive goes unanswered and the second one closes the peer,
+	// so the watchdog only returns once we stop writing.
+	watchdog := make(chan struct{})
+	go func() {
+		i.SpawnWatchdog(p)
+		close(watchdog)
+	}()
+
+	busy := time.After(600 * time.Millisecond)
+	for writing := true; writing; {
+		select {
+		case <-busy:
+			writing = false
+		case <-watchdog:
+			t.Fatal("keepalive sent while we were writing")
+		case <-time.After(30 * time.Millisecond):
+			p.Write(&TxPacket{Packet: Packet{Opcode: "NOOP"}})
+		}
+	}
+	if s := p.Latency.Stats(); s.TotalMissed != 0 {
+		t.Fatalf("keepalive sent while busy: %+v", s)
+	}
+
+	select {
+	case <-watchdog:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no keepalive once the peer went quiet")
+	}
+}
+
+func TestKeepaliveLeavesTickerPingsAlone(t *testing.T) {
+	i := New("alpha", &Config{EnablePinger: true, PingInterval: 250, KeepaliveInterval: 100, MaxMissedPings: -1, LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+
+	start := time.Now()
+	go i.SpawnTicker(p)
+	go i.SpawnWatchdog(p)
+	time.Sleep(1100 * time.Millisecond)
+	close(p.Done)
+
+	// Each unanswered ping is counted once, when the ticker sends the next one
+	ticks := uint64(time.Since(start) / (250 * time.Millisecond))
+	if s := p.Latency.Stats(); s.TotalMissed > ticks {
+		t.Fatalf("%d pings counted as missed after %d ticks", s.TotalMissed, ticks)
+	}
+}
@@ -1,7 +1,8 @@
 package duplex
 
 import (
-	"os"
+	"context"
+	"log/slog"
 	"slices"
 	"sync"
 	"time"
@@ -13,45 +14,145 @@ import (
 )
 
 type Config struct {
-	Hostname     string
-	Secure       bool
-	Port         int
-	ICEServers   []webrtc.ICEServer
-	EnablePinger bool
-	PingInterval int64 // in milliseconds
-	LogLevel     zerolog.Level
+	Hostname             string
+	Secure               bool
+	Port                 int
+	ICEServers           []webrtc.ICEServer
+	EnablePinger         bool   // Ping peers we connected to
+	EnableIncomingPinger bool   // Ping peers that connected to us
+	PingInterval         int64  // in milliseconds
+	IncomingPingInterval int64  // in milliseconds, defaults to PingInterval
+	MaxMissedPings       int    // Consecutive unanswered pings before a peer is closed (default 3, negative disables)
+	IdleTimeout          int64  // in milliseconds, closes peers that have sent nothing for this long (0 disables)
+	KeepaliveInterval    int64  // in milliseconds, pings peers we have not written to for this long (0 disables)
+	ClockSamples         int    // Number of samples kept by each peer's clock filter (default 8)
+	TimeSource           string // Peer ID used as the network time reference, elected if empty
+	LogLevel             zerolog.Level
+	LogLevels            map[string]zerolog.Level // Levels of the LogSignaling, LogNegotiation and LogPackets subsystems, defaults to LogLevel
+	LogFormat            string                   // LogFormatConsole (default) or LogFormatJSON, written to stdout
+	LogHandler           slog.Handler             // Send logs to a slog handler instead of stdout
+	Logger               *zerolog.Logger          // Use this logger instead, overrides LogFormat and LogHandler
+	PacketLogSample      int                      // Log only one in every N per-packet debug lines (0 logs all)
+	MaxRetries           int                      // Reconnect attempts before giving up (default 5, negative retries forever)
+	SetupTimeout         int64                    // in milliseconds, how long a reconnect attempt may take (default 15000)
+	ReconnectPolicy      BackoffPolicy            // Delay between reconnect attempts (default DefaultBackoff)
+	RedialPolicy         BackoffPolicy            // Delay between redials of persistent peers (default DefaultBackoff)
+	MaxRedials           int                      // Redial attempts per outage before a persistent peer is dropped (0 retries forever)
+	EnableSessions       bool                     // Sequence packets and resume sessions across reconnects
+	SessionReplaySize    int                      // Unacknowledged packets kept for replay per session (default 256), the session fails if either side falls further behind
+	SessionAckInterval   int64                    // in milliseconds, interval between session acknowledgements (default 1000)
+	SessionTimeout       int64                    // in milliseconds, how long a dropped session may be resumed (default 60000)
+	DeliveryRetryPolicy  BackoffPolicy            // Delay between resends of unacknowledged reliable packets
+	DeliveryTimeout      int64                    // in milliseconds, default deadline for reliable packets (default 30000)
+	DeliveryDedupWindow  int64                    // in milliseconds, how long received reliable packet Ids are remembered (default 300000)
+	MaxSubscriptions     int                      // Topic subscriptions allowed per peer (0 is unlimited)
+	MaxRelayClients      int                      // Clients a relay accepts (0 is unlimited)
+	RelayQuota           RelayQuota               // Per-client forwarding quota applied by a relay
+	AutoRegisterRelays   bool                     // Register with every relay peer after negotiation
+	TrustedRelays        []string                 // Relay peer IDs allowed to forward packets through us on behalf of others, keeping their origin
+	BridgeURL            string                   // CloudLink 4 server that client peers are bridged to, if IsBridge is set
+	BridgePrefix         string                   // Prefix given to CloudLink 4 users on the duplex side (default "cl4:")
+	EnableMesh           bool                     // Maintain connections to candidate peers automatically
+	MeshDegree           int                      // Client connections the mesh manager dials up to (default 8)
+	MeshMaxDegree        int                      // Client connections above which the slowest are closed (default twice MeshDegree)
+	MeshInterval         int64                    // in milliseconds, interval between mesh refreshes (default 5000)
+	EnablePEX            bool                     // Periodically exchange known peers with connected peers
+	PEXInterval          int64                    // in milliseconds, interval between peer exchanges (default 30000)
+	PEXSampleSize        int                      // Known peers sent in each exchange (default 16)
+	PEXMaxAge            int64                    // in milliseconds, how long a peer nobody has seen stays known (default 600000)
+	MaxKnownPeers        int                      // Size of the known peers table and of the mesh candidate list (default 1024)
+	ShutdownTimeout      int64                    // in milliseconds, how long Run and Disconnect wait for peers to drain (default 5000)
+	Capture              CaptureOptions           // Capture packets from Start until the instance stops, if Path is set
+	SignalingListen      string                   // Run an embedded signaling server on this address, e.g. ":9000", and connect to it instead of Hostname
+	LANAdvertise         bool                     // Advertise the instance on the local network over mDNS while it runs
+	LANInterfaces        []string                 // Network interfaces used for LAN discovery (default every multicast interface)
+	IsBridge             bool                     // Bridge client peers to BridgeURL and advertise the bridge role
+	IsRelay              bool                     // Forward packets for other peers and advertise the relay role
+	IsDiscovery          bool                     // Keep a discovery registry and advertise the discovery role
 }
 
 type Peers map[string]*Peer
 type PeerSlice []*Peer
 
+// New creates an instance with the given peer ID. Since it cannot fail, problems
+// found by Config.Validate are only logged; use LoadConfig to reject them.
 func New(ID string, args *Config) *Instance {
 	i := &Instance{
-		Name:                             ID,
-		Close:                            make(chan bool),
-		Done:                             make(chan bool),
-		RetryCounter:                     0,
-		MaxRetries:                       5,
+		Name:               ID,
+		Close:              make(chan bool),
+		Done:               make(chan bool, 1),
+		RetryCounter:       0,
+		MaxRetries:         5,
+		RedialPolicy:       DefaultBackoff(),
+		SessionReplaySize:  256,
+		SessionAckInterval: time.Second,
+		SessionTimeout:     time.Minute,
+		sessions:           make(map[string]*Session),
+		DeliveryRetryPolicy: &ExponentialBackoff{
+			Initial:    500 * time.Millisecond,
+			Max:        8 * time.Second,
+			Multiplier: 2,
+			Jitter:     0.1,
+		},
+		DeliveryTimeout:     30 * time.Second,
+		DeliveryDedupWindow: 5 * time.Minute,
+		deliveries:          make(map[string]*Delivery),
+		seen:                make(map[string]time.Time),
+		SetupTimeout:        15 * time.Second,
+		reconnect_now:       make(chan struct{}, 1),
+		MaxMissedPings:      3,
+		BridgePrefix:        "cl4:",
+		MeshDegree:          8,
+		MeshInterval:        5 * time.Second,
+		mesh: mesh_state{
+			candidates: make(map[string]*mesh_candidate),
+			wake:       make(chan struct{}, 1),
+		},
+		PEXInterval:     30 * time.Second,
+		ShutdownTimeout: 5 * time.Second,
+		PEXSampleSize:   16,
+		PEXMaxAge:       10 * time.Minute,
+		MaxKnownPeers:   1024,
+		known:           known_peers{records: make(map[string]*DiscoveryRecord)},
+		rpc: rpc_state{
+			methods:  make(map[string]*rpc_method),
+			calls:    make(map[string]context.CancelFunc),
+			canceled: make(map[string]time.Time),
+		},
+		bridges: make(map[*Peer]*bridge_link),
+		names: name_registry{
+			owners: make(map[string]*Peer),
+			names:  make(map[*Peer]string),
+		},
+		ClockSamples:                     8,
 		Peers:                            make(Peers),
 		CustomHandlersRequiredFeatures:   make(map[string][]string),
 		CustomHandlers:                   make(map[string]func(*Peer, *RxPacket)),
 		RemappedHandlersRequiredFeatures: make(map[string][]string),
 		RemappedHandlers:                 make(map[string]func(*Peer, *RxPacket)),
+		topics: subscriptions{
+			peers:  make(map[*Peer]map[string]struct{}),
+			locals: make(map[string]TopicHandler),
+		},
+		rooms:    make(map[string]*Room),
+		registry: discovery_registry{records: make(map[*Peer]*DiscoveryRecord)},
+		relay: relay_state{
+			clients:    make(map[*Peer]*relay_client),
+			forwarders: make(map[*Peer]*relay_client),
+			relays:     make(map[*Peer]struct{}),
+		},
 	}
 
 	i.configure(args)
+	if args != nil {
+		if err := args.Validate(); err != nil {
+			i.Logger.Error().Err(err).Msg("invalid configuration")
+		}
+	}
 
 	return i
 }
 
-func (i *Instance) default_logger(level zerolog.Level) *zerolog.Logger {
-	// Configure zerolog
-	output := zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}
-	logger := zerolog.New(output).With().Timestamp().Logger().Level(level)
-	logger = logger.With().Str("instance", i.Name).Logger()
-	return &logger
-}
-
 func (i *Instance) configure(args *Config) {
 	config := peer.NewOptions()
 
@@ -64,7 +165,115 @@ func (i *Instance) configure(args *Config) {
 		i.PingInterval = time.Duration(args.PingInterval) * time.Millisecond
 	}
 
-	i.Logger = i.default_logger(args.LogLevel)
+	if args.EnableIncomingPinger {
+		i.IncomingPinger = true
+		i.IncomingPingInterval = time.Duration(args.IncomingPingInterval) * time.Millisecond
+		if i.IncomingPingInterval <= 0 {
+			i.IncomingPingInterval = time.Duration(args.PingInterval) * time.Millisecond
+		}
+	}
+
+	i.IdleTimeout = time.Duration(args.IdleTimeout) * time.Millisecond
+	i.KeepaliveInterval = time.Duration(args.KeepaliveInterval) * time.Millisecond
+
+	if args.MaxRetries > 0 {
+		i.MaxRetries = args.MaxRetries
+	} else if args.MaxRetries < 0 {
+		i.MaxRetries = 0
+	}
+	if args.SetupTimeout > 0 {
+		i.SetupTimeout = time.Duration(args.SetupTimeout) * time.Millisecond
+	}
+	i.ReconnectPolicy = args.ReconnectPolicy
+	if args.RedialPolicy != nil {
+		i.RedialPolicy = args.RedialPolicy
+	}
+	i.MaxRedials = args.MaxRedials
+
+	i.EnableSessions = args.EnableSessions
+	if args.SessionReplaySize > 0 {
+		i.SessionReplaySize = args.SessionReplaySize
+	}
+	if args.SessionAckInterval > 0 {
+		i.SessionAckInterval = time.Duration(args.SessionAckInterval) * time.Millisecond
+	}
+	if args.SessionTimeout > 0 {
+		i.SessionTimeout = time.Duration(args.SessionTimeout) * time.Millisecond
+	}
+
+	i.MaxSubscriptions = args.MaxSubscriptions
+	i.MaxRelayClients = args.MaxRelayClients
+	i.RelayQuota = args.RelayQuota
+	i.AutoRegisterRelays = args.AutoRegisterRelays
+	i.TrustedRelays = args.TrustedRelays
+
+	i.Capture = args.Capture
+	i.SignalingListen = args.SignalingListen
+	i.LANAdvertise = args.LANAdvertise
+	i.LANInterfaces = args.LANInterfaces
+
+	i.IsBridge = args.IsBridge
+	i.IsRelay = args.IsRelay
+	i.IsDiscovery = args.IsDiscovery
+
+	i.BridgeURL = args.BridgeURL
+	if args.BridgePrefix != "" {
+		i.BridgePrefix = args.BridgePrefix
+	}
+
+	i.EnableMesh = args.EnableMesh
+	if args.MeshDegree > 0 {
+		i.MeshDegree = args.MeshDegree
+	}
+	i.MeshMaxDegree = args.MeshMaxDegree
+	if i.MeshMaxDegree < i.MeshDegree {
+		i.MeshMaxDegree = 2 * i.MeshDegree
+	}
+	if args.MeshInterval > 0 {
+		i.MeshInterval = time.Duration(args.MeshInterval) * time.Millisecond
+	}
+
+	i.EnablePEX = args.EnablePEX
+	if args.PEXInterval > 0 {
+		i.PEXInterval = time.Duration(args.PEXInterval) * time.Millisecond
+	}
+	if args.PEXSampleSize > 0 {
+		i.PEXSampleSize = args.PEXSampleSize
+	}
+	if args.PEXMaxAge > 0 {
+		i.PEXMaxAge = time.Duration(args.PEXMaxAge) * time.Millisecond
+	}
+	if args.MaxKnownPeers > 0 {
+		i.MaxKnownPeers = args.MaxKnownPeers
+	}
+	if args.ShutdownTimeout > 0 {
+		i.ShutdownTimeout = time.Duration(args.ShutdownTimeout) * time.Millisecond
+	}
+
+	if args.DeliveryRetryPolicy != nil {
+		i.DeliveryRetryPolicy = args.DeliveryRetryPolicy
+	}
+	if args.DeliveryTimeout > 0 {
+		i.DeliveryTimeout = time.Duration(args.DeliveryTimeout) * time.Millisecond
+	}
+	if args.DeliveryDedupWindow > 0 {
+		i.DeliveryDedupWindow = time.Duration(args.DeliveryDedupWindow) * time.Millisecond
+	}
+
+	if args.ClockSamples > 0 {
+		i.ClockSamples = args.ClockSamples
+	}
+	i.TimeSource = args.TimeSource
+
+	if args.MaxMissedPings > 0 {
+		i.MaxMissedPings = args.MaxMissedPings
+	} else if args.MaxMissedPings < 0 {
+		i.MaxMissedPings = 0
+	}
+
+	i.logs.levels = args.LogLevels
+	i.logs.sample = uint32(max(args.PacketLogSample, 0))
+	i.SetLogger(i.newLogger(args))
 	config.LogLevel = args.LogLevel
 
 	if len(args.Hostname) > 0 {
@@ -120,6 +329,20 @@ func (i *Instance) configure(args *Config) {
 	i.peerjs_config = &config
 }
 
+// Exclude returns the peers that are not in the exclusion list.
+func (p PeerSlice) Exclude(exclusions ...*Peer) PeerSlice {
+	if len(exclusions) == 0 {
+		return p
+	}
+	var peers PeerSlice
+	for _, peer := range p {
+		if !slices.Contains(exclusions, peer) {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
 func (p *Peers) ToSlice(exclusions ...*Peer) PeerSlice {
 	var peers PeerSlice
 	for _, peer := range *p {
@@ -131,14 +354,18 @@ func (p *Peers) ToSlice(exclusions ...*Peer) PeerSlice {
 }
 
 func (i *Instance) AttemptReconnect() {
+	if i.Closing() {
+		return
+	}
 	i.mu.Lock()
 	if i.isReconnecting {
 		i.mu.Unlock()
 		return
 	}
-	if i.RetryCounter >= i.MaxRetries {
-		i.Logger.Warn().Msgf("Max retries (%d) reached. Giving up.", i.MaxRetries)
+	if i.MaxRetries > 0 && i.RetryCounter >= i.MaxRetries {
+		i.logs.signaling.Warn().Msgf("Max retries (%d) reached. Giving up.", i.MaxRetries)
 		i.mu.Unlock()
+		go i.fail(ErrRetriesExhausted)
 		return
 	}
 	i.isReconnecting = true
@@ -156,9 +383,29 @@ func (i *Instance) AttemptReconnect() {
 			currentRetry := i.RetryCounter
 			i.mu.Unlock()
 
-			i.Logger.Info().Msgf("Re-initialization attempt #%d...", currentRetry+1)
+			// 1. Back off before every attempt but the first
+			var delay time.Duration
+			if currentRetry > 0 {
+				delay = i.backoff().Delay(currentRetry - 1)
+			}
+			if fn := i.OnReconnecting; fn != nil {
+				fn(currentRetry+1, delay)
+			}
+			if delay > 0 {
+				i.logs.signaling.Info().Dur("delay", delay).Msgf("Waiting before re-initialization attempt #%d...", currentRetry+1)
+				select {
+				case <-time.After(delay):
+				case <-i.reconnect_now:
+				}
+			}
+
+			i.mu.Lock()
+			currentRetry = i.RetryCounter
+			i.mu.Unlock()
+
+			i.logs.signaling.Info().Msgf("Re-initialization attempt #%d...", currentRetry+1)
 
-			// 1. Create a channel to catch the setup result
+			// 2. Create a channel to catch the setup result
 			type setupResult struct {
 				err error
 			}
@@ -169,34 +416,63 @@ func (i *Instance) AttemptReconnect() {
 				done <- setupResult{err}
 			}()
 
-			// 2. Wait for setup or a timeout
+			// 3. Wait for setup or a timeout
 			select {
 			case res := <-done:
 				if res.err == nil {
 					// setup() handles resetting i.isReconnecting on "open"
 					return
 				}
-				i.Logger.Error().Err(res.err).Msg("Setup failed")
-			case <-time.After(15 * time.Second):
-				i.Logger.Warn().Msg("Setup timed out (network still unreachable)")
+				i.logs.signaling.Error().Err(res.err).Msg("Setup failed")
+			case <-time.After(i.SetupTimeout):
+				i.logs.signaling.Warn().Msg("Setup timed out (network still unreachable)")
 			}
 
-			// 3. Prepare for next loop
+			// 4. Prepare for next loop
 			i.mu.Lock()
 			i.RetryCounter++
-			if i.RetryCounter >= i.MaxRetries {
+			attempts := i.RetryCounter
+			if i.MaxRetries > 0 && attempts >= i.MaxRetries {
 				i.isReconnecting = false
 				i.mu.Unlock()
+				i.logs.signaling.Warn().Msgf("Max retries (%d) reached. Giving up.", i.MaxRetries)
+				if fn := i.OnGiveUp; fn != nil {
+					fn(attempts)
+				}
+				i.fail(ErrRetriesExhausted)
 				return
 			}
 			i.mu.Unlock()
-
-			// 4. Backoff
-			time.Sleep(5 * time.Second)
 		}
 	}()
 }
 
+// Reconnect resets the retry counter and reconnects to the signaling server.
+// If a reconnect loop is already waiting out its backoff, the next attempt is
+// made immediately.
+func (i *Instance) Reconnect() {
+	i.mu.Lock()
+	i.RetryCounter = 0
+	reconnecting := i.isReconnecting
+	i.mu.Unlock()
+
+	if reconnecting {
+		select {
+		case i.reconnect_now <- struct{}{}:
+		default:
+		}
+		return
+	}
+	i.AttemptReconnect()
+}
+
+func (i *Instance) backoff() BackoffPolicy {
+	if i.ReconnectPolicy != nil {
+		return i.ReconnectPolicy
+	}
+	return DefaultBackoff()
+}
+
 func (i *Instance) setup() error {
 
 	// 1. Create the Peer
@@ -208,19 +484,11 @@ func (i *Instance) setup() error {
 	// 2. Bind Connection Listener
 	p.On("connection", func(data any) {
 		if c, ok := data.(*peer.DataConnection); ok {
-			p := &Peer{
-				DataConnection: c,
-				Parent:         i,
-				Lock:           &sync.Mutex{},
-				KeyStore:       make(map[string]any),
-				KeyLock:        &sync.Mutex{},
-				OpcodeMatchers: make(map[*Peer]*OpcodeMatcher),
-				Listeners:      make(map[string]Listener),
-				IsInitiator:    false,
-				Done:           make(chan bool),
-				Logger:         i.Logger.With().Str("peer_id", c.GetPeerID()).Logger(),
+			if i.Closing() {
+				c.Close()
+				return
 			}
-			i.PeerHandler(p)
+			i.PeerHandler(i.newPeer(c, false))
 		}
 	})
 
@@ -235,47 +503,44 @@ func (i *Instance) setup() error {
 		case enums.PeerErrorTypeNetwork, enums.PeerErrorTypeServerError,
 			enums.PeerErrorTypeSocketError, enums.PeerErrorTypeSocketClosed,
 			enums.PeerErrorTypeDisconnected:
-			i.Logger.Warn().Str("error_type", errMsg.Type).Msg("Recoverable error. Triggering reconnect...")
+			i.logs.signaling.Warn().Str("error_type", errMsg.Type).Msg("Recoverable error. Triggering reconnect...")
 			i.AttemptReconnect()
 
-		case enums.PeerErrorTypeUnavailableID:
-			i.Logger.Error().Msg("ID already in use. Try again later.")
-			go func() {
-				i.Close <- true
-			}()
-			return
-
-		case enums.PeerErrorTypeSslUnavailable,
+		case enums.PeerErrorTypeUnavailableID,
+			enums.PeerErrorTypeSslUnavailable,
 			enums.PeerErrorTypeBrowserIncompatible,
 			enums.PeerErrorTypeInvalidID,
 			enums.PeerErrorTypeInvalidKey:
-			i.Logger.Fatal().Str("error_type", errMsg.Type).Msg("Fatal error. Manual intervention required.")
-			go func() {
-				i.Close <- true
-			}()
+			i.logs.signaling.Error().Str("error_type", errMsg.Type).Msg("Fatal error. Manual intervention required.")
+			go i.fail(terminalError(errMsg.Type))
 			return
 		default:
-			i.Logger.Warn().Str("error_type", errMsg.Type).Msg("Non-critical or unhandled peer error")
+			i.logs.signaling.Warn().Str("error_type", errMsg.Type).Msg("Non-critical or unhandled peer error")
 		}
 	})
 
 	// 4. Bind Open Listener
 	p.On("open", func(data any) {
 		i.mu.Lock()
+		reconnected := i.isReconnecting
+		attempts := i.RetryCounter + 1
 		i.isReconnecting = false
 		i.RetryCounter = 0
 		i.active_time_start = time.Now()
 		i.mu.Unlock()
 
-		i.Logger.Info().Msgf("Peer opened successfully as %s", i.Name)
+		i.logs.signaling.Info().Msgf("Peer opened successfully as %s", i.Name)
 		if i.OnCreate != nil {
 			i.OnCreate()
 		}
+		if fn := i.OnReconnected; fn != nil && reconnected {
+			fn(attempts)
+		}
 	})
 
 	// 5. Bind Close Listener
 	p.On("close", func(data any) {
-		i.Logger.Info().Msg("Peer connection closed.")
+		i.logs.signaling.Info().Msg("Peer connection closed.")
 		i.mu.Lock()
 		i.active_time_start = time.Time{}
 		i.mu.Unlock()
@@ -291,25 +556,6 @@ func (i *Instance) setup() error {
 	return nil
 }
 
-func (i *Instance) Run() {
-	i.Logger.Info().Msg("Initializing peer...")
-
-	// Start the connection process
-	if err := i.setup(); err != nil {
-		i.Logger.Error().Err(err).Msg("Initial connection failed. Reconnect loop will take over.")
-		i.AttemptReconnect()
-	}
-
-	i.Logger.Info().Msg("Peer instance is running...")
-	<-i.Close
-
-	i.Logger.Info().Msg("Shutting down peer instance...")
-	if i.Handler != nil {
-		i.Handler.Destroy()
-	}
-	i.Done <- true
-}
-
 func (i *Instance) GetPeerState() PeerState {
 	i.mu.Lock()
 	defer i.mu.Unlock()
@@ -325,6 +571,28 @@ func (i *Instance) GetPeerState() PeerState {
 }
 
 func (i *Instance) Connect(id string) *Peer {
+	if i.Closing() {
+		return nil
+	}
+	i.mu.Lock()
+	handler := i.Handler
+	i.mu.Unlock()
+	if handler == nil || handler.GetDestroyed() {
+		i.Logger.Warn().Msgf("Cannot connect to peer %s: not connected to the signaling server", id)
+		return nil
+	}
+	conn, err := handler.Connect(id, i.connectionOptions())
+	if err != nil {
+		i.Logger.Error().Err(err).Msgf("Failed to connect to peer %s", id)
+		return nil
+	}
+
+	p := i.newPeer(conn, true)
+	i.PeerHandler(p)
+	return p
+}
+
+func (i *Instance) connectionOptions() *peer.ConnectionOptions {
 	options := peer.NewConnectionOptions()
 	options.Label = "default"
 	options.Reliable = true
@@ -334,13 +602,11 @@ func (i *Instance) Connect(id string) *Peer {
 		"protocol": "delta",
 		"name":     i.Name,
 	}
+	return options
+}
 
-	conn, err := i.Handler.Connect(id, options)
-	if err != nil {
-		i.Logger.Error().Err(err).Msgf("Failed to connect to peer %s", id)
-		return nil
-	}
-
+// newPeer wraps a data connection into a Peer owned by this instance.
+func (i *Instance) newPeer(conn *peer.DataConnection, initiator bool) *Peer {
 	p := &Peer{
 		DataConnection: conn,
 		Parent:         i,
@@ -349,50 +615,65 @@ func (i *Instance) Connect(id string) *Peer {
 		KeyLock:        &sync.Mutex{},
 		OpcodeMatchers: make(map[*Peer]*OpcodeMatcher),
 		Listeners:      make(map[string]Listener),
-		IsInitiator:    true,
+		ListenerLock:   &sync.Mutex{},
+		Latency:        &LatencyTracker{},
+		Clock:          NewClockEstimator(i.ClockSamples),
+		IsInitiator:    initiator,
 		Done:           make(chan bool),
-		Logger:         i.Logger.With().Str("peer_id", conn.GetPeerID()).Logger(),
+		id:             conn.GetPeerID(),
 	}
-
-	i.PeerHandler(p)
+	p.initLoggers()
 	return p
 }
 
-func (i *Instance) SpawnTicker(conn *Peer) {
-	if !i.Pinger {
-		return
-	}
-	ticker := time.NewTicker(i.PingInterval)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-ticker.C:
-			conn.Write(&TxPacket{
-				Packet: Packet{
-					Opcode: "PING",
-					TTL:    1,
-				},
-				Payload: map[string]int64{"t1": time.Now().UnixNano() / 1000000},
-			})
-		case <-conn.Done:
-			return
-		}
-	}
+// initLoggers derives the peer's loggers from the instance's.
+func (c *Peer) initLoggers() {
+	id := c.GetPeerID()
+	c.Logger = c.Parent.Logger.With().Str("peer_id", id).Logger()
+	c.negotiation_log = c.Parent.logs.negotiation.With().Str("peer_id", id).Logger()
+	c.packet_log = c.Parent.logs.packets.With().Str("peer_id", id).Logger()
+}
+
+// GetPeer returns the connected peer with the given ID, if any.
+func (i *Instance) GetPeer(id string) (*Peer, bool) {
+	i.peersMu.RLock()
+	defer i.peersMu.RUnlock()
+	p, ok := i.Peers[id]
+	return p, ok
+}
+
+// ConnectedPeers returns a snapshot of all connected peers.
+func (i *Instance) ConnectedPeers(exclusions ...*Peer) PeerSlice {
+	i.peersMu.RLock()
+	defer i.peersMu.RUnlock()
+	return i.Peers.ToSlice(exclusions...)
 }
 
 func (i *Instance) PeerHandler(conn *Peer) {
 	conn.On("open", func(data any) {
 		conn.Logger.Info().Msg("connected")
 		conn.Logger.Debug().Interface("metadata", conn.Metadata).Msg("metadata")
-		i.Peers[conn.GetPeerID()] = conn
+		if i.EnableMesh {
+			if !i.resolveGlare(conn) {
+				return
+			}
+			i.meshOpened(conn)
+		} else {
+			i.peersMu.Lock()
+			i.Peers[conn.GetPeerID()] = conn
+			i.peersMu.Unlock()
+		}
+
+		conn.redialed()
 
 		if conn.IsInitiator {
 			conn.SendNegotiate(&RxPacket{})
-
-			// Start periodic ping
-			go i.SpawnTicker(conn)
 		}
 
+		// Start periodic ping and idle monitoring
+		go i.SpawnTicker(conn)
+		go i.SpawnWatchdog(conn)
+
 		if fn := i.OnOpen; fn != nil {
 			fn(conn)
 		}
@@ -400,15 +681,40 @@ func (i *Instance) PeerHandler(conn *Peer) {
 
 	conn.On("close", func(data any) {
 		conn.Logger.Info().Msg("disconnected")
-		delete(i.Peers, conn.GetPeerID())
+		i.peersMu.Lock()
+		if i.Peers[conn.GetPeerID()] == conn {
+			delete(i.Peers, conn.GetPeerID())
+		}
+		i.peersMu.Unlock()
+		done := conn.done()
 		select {
-		case <-conn.Done:
+		case <-done:
 		default:
-			close(conn.Done) // Signal all goroutines tied to this peer to cleanly exit
+			close(done) // Signal all goroutines tied to this peer to cleanly exit
+		}
+		if conn.duplicate {
+			return
+		}
+		if s := conn.Session(); s != nil {
+			s.detach(conn)
 		}
+		i.dropSubscriptions(conn)
+		i.leaveAllRooms(conn)
+		i.unregister(conn)
+		i.dropRelay(conn)
+		i.unbridge(conn)
+		i.releaseName(conn)
+		i.meshClosed(conn)
+		if i.EnablePEX {
+			i.rememberPeer(conn)
+		}
+		redial := conn.startRedial()
 		if fn := i.OnClose; fn != nil {
 			fn(conn)
 		}
+		if redial {
+			go i.redial(conn)
+		}
 	})
 
 	conn.On("error", func(data any) {
@@ -416,12 +722,27 @@ func (i *Instance) PeerHandler(conn *Peer) {
 	})
 
 	conn.On("data", func(data any) {
+		conn.last_rx.Store(time.Now().UnixNano())
 		packet := conn.Read(data)
 		if packet == nil {
 			return
 		}
-		conn.Logger.Debug().Str("direction", "in").RawJSON("packet", []byte(packet.String())).Msg("packet received")
-		go conn.HandlePacket(packet)
+		conn.packet_log.Debug().Str("direction", "in").RawJSON("packet", []byte(packet.String())).Msg("packet received")
+		if fn := i.OnPacket; fn != nil {
+			fn(conn, packet)
+		}
+
+		// Negotiation is handled in order, since it sets up the session
+		// that later packets are accounted against
+		if packet.Opcode == "NEGOTIATE" {
+			conn.handle(packet)
+			return
+		}
+		if s := conn.Session(); s != nil && packet.Seq > 0 {
+			conn.receiveSequenced(s, packet)
+			return
+		}
+		conn.handleAsync(packet)
 	})
 }
 
@@ -0,0 +1,199 @@
+package duplex
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/cloudlink-delta/duplex/lan"
+)
+
+var ErrNoLANSignaling = errors.New("peer runs no signaling server")
+
+// LANPeer is a duplex instance found on the local network by BrowseLAN.
+type LANPeer struct {
+	Id            string   `json:"id"`
+	Name          string   `json:"name,omitempty"` // Name from the peer's Announcement, if any
+	Features      []string `json:"features,omitempty"`
+	IsBridge      bool     `json:"is_bridge"`
+	IsRelay       bool     `json:"is_relay"`
+	IsDiscovery   bool     `json:"is_discovery"`
+	Addrs         []net.IP `json:"addrs"`
+	SignalingPort int      `json:"signaling_port,omitempty"` // Port of the signaling server the peer runs, 0 if none
+	SignalingKey  string   `json:"signaling_key,omitempty"`
+	SignalingPath string   `json:"signaling_path,omitempty"`
+}
+
+// StartLANAdvertising advertises the instance on the local network over
+// mDNS, with its roles, the name and features of its Announcement, and the
+// signaling server it runs, if any. Announce and Withdraw update the
+// advertisement.
+func (i *Instance) StartLANAdvertising() error {
+	a, err := lan.Advertise(i.lanService(), lan.Options{
+		Interfaces: i.LANInterfaces,
+		Logger:     i.Logger,
+	})
+	if err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	old := i.lan_advertiser
+	i.lan_advertiser = a
+	i.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// StopLANAdvertising withdraws the instance from the local network.
+func (i *Instance) StopLANAdvertising() error {
+	i.mu.Lock()
+	a := i.lan_advertiser
+	i.lan_advertiser = nil
+	i.mu.Unlock()
+	if a != nil {
+		return a.Close()
+	}
+	return nil
+}
+
+// updateLANAdvertisement publishes changes to the announcement, if the
+// instance is advertised.
+func (i *Instance) updateLANAdvertisement() {
+	i.mu.Lock()
+	a := i.lan_advertiser
+	i.mu.Unlock()
+	if a != nil {
+		a.Update(i.lanService().Text)
+	}
+}
+
+func (i *Instance) lanService() lan.Service {
+	text := map[string]string{"txtvers": "1"}
+
+	var roles []string
+	if i.IsBridge {
+		roles = append(roles, RoleBridge)
+	}
+	if i.IsRelay {
+		roles = append(roles, RoleRelay)
+	}
+	if i.IsDiscovery {
+		roles = append(roles, RoleDiscovery)
+	}
+	if len(roles) == 0 {
+		roles = append(roles, RoleClient)
+	}
+	text["roles"] = strings.Join(roles, ",")
+
+	i.mu.Lock()
+	announcement := i.announcement
+	s := i.Signaling
+	i.mu.Unlock()
+	if announcement != nil {
+		text["name"] = announcement.Name
+		if len(announcement.Features) > 0 {
+			text["features"] = strings.Join(announcement.Features, ",")
+		}
+	}
+
+	service := lan.Service{Instance: i.Name, Text: text}
+	if s != nil {
+		if _, port, ok := s.Endpoint(); ok {
+			service.Port = port
+			text["key"] = s.Key()
+			text["path"] = s.Path()
+		}
+	}
+	return service
+}
+
+// BrowseLAN returns the duplex instances advertised on the local network,
+// except this one. It listens for answers until the context ends, or for
+// two seconds if the context has no deadline. The instance does not need to
+// be running.
+func (i *Instance) BrowseLAN(ctx context.Context) ([]LANPeer, error) {
+	services, err := lan.Browse(ctx, lan.Options{
+		Interfaces: i.LANInterfaces,
+		Logger:     i.Logger,
+	})
+
+	var peers []LANPeer
+	for _, service := range services {
+		if service.Instance == i.Name {
+			continue
+		}
+		peers = append(peers, lanPeer(service))
+	}
+	return peers, err
+}
+
+func lanPeer(service lan.Service) LANPeer {
+	p := LANPeer{
+		Id:    service.Instance,
+		Name:  service.Text["name"],
+		Addrs: service.Addrs,
+	}
+	if features := service.Text["features"]; features != "" {
+		p.Features = strings.Split(features, ",")
+	}
+	for role := range strings.SplitSeq(service.Text["roles"], ",") {
+		switch role {
+		case RoleBridge:
+			p.IsBridge = true
+		case RoleRelay:
+			p.IsRelay = true
+		case RoleDiscovery:
+			p.IsDiscovery = true
+		}
+	}
+	if service.Port > 0 {
+		p.SignalingPort = service.Port
+		p.SignalingKey = service.Text["key"]
+		p.SignalingPath = service.Text["path"]
+	}
+	return p
+}
+
+// UseLANSignaling points the instance at the signaling server of a peer found
+// with BrowseLAN, so that instances on the local network can connect to each
+// other without internet access. Of the peer's addresses, the first one on a
+// network shared with our LANInterfaces is used. Call it before Start.
+func (i *Instance) UseLANSignaling(p LANPeer) error {
+	if p.SignalingPort == 0 || len(p.Addrs) == 0 {
+		return ErrNoLANSignaling
+	}
+
+	networks, err := lan.Networks(lan.Options{Interfaces: i.LANInterfaces})
+	if err != nil {
+		i.Logger.Debug().Err(err).Msg("failed to list local networks")
+	}
+	addr := lanAddress(p.Addrs, networks)
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.setSignalingEndpoint(addr.String(), p.SignalingPort, p.SignalingKey, p.SignalingPath)
+	return nil
+}
+
+// lanAddress picks the address of a peer to connect to: the first one on one
+// of our networks, or else the first one that is not link-local, which may
+// not be reachable from here.
+func lanAddress(addrs []net.IP, networks []*net.IPNet) net.IP {
+	for _, addr := range addrs {
+		for _, network := range networks {
+			if network.Contains(addr) {
+				return addr
+			}
+		}
+	}
+	for _, addr := range addrs {
+		if !addr.IsLinkLocalUnicast() {
+			return addr
+		}
+	}
+	return addrs[0]
+}
@@ -0,0 +1,606 @@
+// Package lan advertises and browses duplex instances on the local network
+// with multicast DNS service discovery (RFC 6762 and RFC 6763), so that
+// instances can find each other without a signaling server on the internet.
+//
+// Only IPv4 is supported. Instance names are not probed for conflicts, so
+// they must already be unique, which duplex peer IDs are.
+package lan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	ServiceType = "_duplex._tcp" // DNS-SD service type of duplex instances
+	Domain      = "local."
+
+	// DefaultBrowseTimeout is how long Browse collects responses when its
+	// context has no deadline.
+	DefaultBrowseTimeout = 2 * time.Second
+
+	mdns_port = 5353
+	ttl       = 120 // seconds, for every record we publish
+)
+
+var (
+	ErrNoInterfaces    = errors.New("no multicast network interface")
+	ErrInvalidInstance = errors.New("invalid instance name")
+
+	group        = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: mdns_port}
+	service_name = ServiceType + "." + Domain
+	enum_name    = "_services._dns-sd._udp." + Domain
+)
+
+// Service is an advertised duplex instance.
+type Service struct {
+	Instance string            // Instance name, the duplex peer ID
+	Host     string            // Host name without the domain, defaults to the system host name
+	Port     int               // Port of the instance's signaling server, 0 if it runs none
+	Text     map[string]string // TXT record
+	Addrs    []net.IP          // IPv4 addresses of the host, filled in by Browse
+}
+
+type Options struct {
+	Interfaces []string        // Names of the network interfaces to use (default every multicast interface that is up)
+	Logger     *zerolog.Logger // Defaults to a disabled logger
+}
+
+// conn is an mDNS socket joined to the multicast group on some interfaces.
+type conn struct {
+	udp    *net.UDPConn
+	pc     *ipv4.PacketConn
+	ifaces []net.Interface
+	mu     sync.Mutex // Serializes SetMulticastInterface and writes
+}
+
+// interfaces returns the named interfaces, or every multicast interface that
+// is up if no names are given.
+func interfaces(names []string) ([]net.Interface, error) {
+	var ifaces []net.Interface
+	if len(names) == 0 {
+		all, err := net.Interfaces()
+		if err != nil {
+			return nil, err
+		}
+		for _, iface := range all {
+			if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagMulticast != 0 {
+				ifaces = append(ifaces, iface)
+			}
+		}
+	}
+	for _, name := range names {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, err
+		}
+		ifaces = append(ifaces, *iface)
+	}
+	if len(ifaces) == 0 {
+		return nil, ErrNoInterfaces
+	}
+	return ifaces, nil
+}
+
+// Networks returns the networks the interfaces selected by opts are on.
+func Networks(opts Options) ([]*net.IPNet, error) {
+	ifaces, err := interfaces(opts.Interfaces)
+	if err != nil {
+		return nil, err
+	}
+	var networks []*net.IPNet
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if network, ok := addr.(*net.IPNet); ok {
+				networks = append(networks, network)
+			}
+		}
+	}
+	return networks, nil
+}
+
+func listen(names []string) (*conn, error) {
+	ifaces, err := interfaces(names)
+	if err != nil {
+		return nil, err
+	}
+
+	udp, err := net.ListenMulticastUDP("udp4", &ifaces[0], group)
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{udp: udp, pc: ipv4.NewPacketConn(udp), ifaces: ifaces[:1]}
+	for _, iface := range ifaces[1:] {
+		if err := c.pc.JoinGroup(&iface, group); err == nil {
+			c.ifaces = append(c.ifaces, iface)
+		}
+	}
+
+	// ListenMulticastUDP turns loopback off, but instances on the same host
+	// must see each other
+	c.pc.SetMulticastLoopback(true)
+	c.pc.SetMulticastTTL(255)
+	c.pc.SetControlMessage(ipv4.FlagInterface, true)
+	return c, nil
+}
+
+// read returns the next datagram and the index of the interface it arrived
+// on, or 0 if the platform does not tell.
+func (c *conn) read(buf []byte) (int, int, *net.UDPAddr, error) {
+	n, cm, src, err := c.pc.ReadFrom(buf)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	ifindex := 0
+	if cm != nil {
+		ifindex = cm.IfIndex
+	}
+	addr, _ := src.(*net.UDPAddr)
+	return n, ifindex, addr, nil
+}
+
+// multicast sends a message to the group on the given interface, or on every
+// interface if ifindex is 0.
+func (c *conn) multicast(msg *dnsmessage.Message, ifindex int) error {
+	raw, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var errs []error
+	for _, iface := range c.ifaces {
+		if ifindex != 0 && iface.Index != ifindex {
+			continue
+		}
+		if err := c.pc.SetMulticastInterface(&iface); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if _, err := c.pc.WriteTo(raw, nil, group); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", iface.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c *conn) unicast(msg *dnsmessage.Message, dst *net.UDPAddr) error {
+	raw, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = c.udp.WriteToUDP(raw, dst)
+	return err
+}
+
+// addrs returns the IPv4 addresses of the given interface, or of every
+// interface if ifindex is 0.
+func (c *conn) addrs(ifindex int) []net.IP {
+	var ips []net.IP
+	for _, iface := range c.ifaces {
+		if ifindex != 0 && iface.Index != ifindex {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ip, ok := addr.(*net.IPNet); ok && ip.IP.To4() != nil {
+				ips = append(ips, ip.IP.To4())
+			}
+		}
+	}
+	return ips
+}
+
+func (c *conn) close() error {
+	return c.udp.Close()
+}
+
+// Advertiser answers mDNS queries for a service until it is closed.
+type Advertiser struct {
+	conn    *conn
+	logger  zerolog.Logger
+	mu      sync.Mutex
+	service Service
+	name    string // Fully qualified instance name
+	host    string // Fully qualified host name
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// Advertise starts answering queries for a service, and announces it on
+// the network. The instance name must be a single DNS label: at most 63
+// bytes and without dots.
+func Advertise(service Service, opts Options) (*Advertiser, error) {
+	if service.Instance == "" || len(service.Instance) > 63 || strings.Contains(service.Instance, ".") {
+		return nil, ErrInvalidInstance
+	}
+	if service.Host == "" {
+		service.Host, _ = os.Hostname()
+	}
+	service.Host, _, _ = strings.Cut(service.Host, ".")
+	if service.Host == "" {
+		service.Host = service.Instance
+	}
+
+	conn, err := listen(opts.Interfaces)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Advertiser{
+		conn:    conn,
+		logger:  zerolog.Nop(),
+		service: service,
+		name:    service.Instance + "." + service_name,
+		host:    service.Host + "." + Domain,
+		done:    make(chan struct{}),
+	}
+	if opts.Logger != nil {
+		a.logger = opts.Logger.With().Str("component", "lan").Logger()
+	}
+
+	a.wg.Add(2)
+	go a.serve()
+	go a.announce()
+
+	a.logger.Info().Str("instance", service.Instance).Int("port", service.Port).Msg("advertising on the local network")
+	return a, nil
+}
+
+// Update replaces the TXT record of the service and announces the change.
+func (a *Advertiser) Update(text map[string]string) {
+	a.mu.Lock()
+	a.service.Text = text
+	a.mu.Unlock()
+
+	msg := &dnsmessage.Message{Header: dnsmessage.Header{Response: true, Authoritative: true}}
+	msg.Answers = a.records(ttl, 0, false, false, true, false)
+	if err := a.conn.multicast(msg, 0); err != nil {
+		a.logger.Warn().Err(err).Msg("failed to announce update")
+	}
+}
+
+// Close sends a goodbye, so that browsers forget the service at once, and
+// stops answering queries.
+func (a *Advertiser) Close() error {
+	select {
+	case <-a.done:
+		return nil
+	default:
+	}
+	close(a.done)
+
+	msg := &dnsmessage.Message{Header: dnsmessage.Header{Response: true, Authoritative: true}}
+	msg.Answers = a.records(0, 0, true, true, true, false)
+	a.conn.multicast(msg, 0)
+
+	err := a.conn.close()
+	a.wg.Wait()
+	return err
+}
+
+// announce sends unsolicited responses, twice one second apart as RFC 6762
+// asks.
+func (a *Advertiser) announce() {
+	defer a.wg.Done()
+	for n := range 2 {
+		if n > 0 {
+			select {
+			case <-time.After(time.Second):
+			case <-a.done:
+				return
+			}
+		}
+		msg := &dnsmessage.Message{Header: dnsmessage.Header{Response: true, Authoritative: true}}
+		msg.Answers = a.records(ttl, 0, true, true, true, true)
+		if err := a.conn.multicast(msg, 0); err != nil {
+			a.logger.Warn().Err(err).Msg("failed to announce")
+		}
+	}
+}
+
+func (a *Advertiser) serve() {
+	defer a.wg.Done()
+	buf := make([]byte, 9000)
+	for {
+		n, ifindex, src, err := a.conn.read(buf)
+		if err != nil {
+			select {
+			case <-a.done:
+			default:
+				a.logger.Error().Err(err).Msg("mDNS socket failed")
+			}
+			return
+		}
+
+		var query dnsmessage.Message
+		if err := query.Unpack(buf[:n]); err != nil || query.Header.Response {
+			continue
+		}
+		response := a.answer(query.Questions, ifindex)
+		if response == nil {
+			continue
+		}
+
+		// Legacy resolvers that do not query from port 5353 expect a
+		// unicast reply that repeats the question, and plain DNS records
+		if src != nil && src.Port != mdns_port {
+			response.Header.ID = query.Header.ID
+			response.Questions = query.Questions
+			for _, records := range [][]dnsmessage.Resource{response.Answers, response.Additionals} {
+				for n := range records {
+					records[n].Header.Class = dnsmessage.ClassINET
+					records[n].Header.TTL = min(records[n].Header.TTL, 10)
+				}
+			}
+			err = a.conn.unicast(response, src)
+		} else {
+			err = a.conn.multicast(response, ifindex)
+		}
+		if err != nil {
+			a.logger.Debug().Err(err).Msg("failed to answer query")
+		}
+	}
+}
+
+// answer builds the response to a query, or returns nil if no question is
+// about our service.
+func (a *Advertiser) answer(questions []dnsmessage.Question, ifindex int) *dnsmessage.Message {
+	var ptr, enum, srv, txt, host bool
+	for _, q := range questions {
+		name := q.Name.String()
+		any_type := q.Type == dnsmessage.TypeALL
+		switch {
+		case strings.EqualFold(name, service_name):
+			ptr = ptr || q.Type == dnsmessage.TypePTR || any_type
+		case strings.EqualFold(name, enum_name):
+			enum = enum || q.Type == dnsmessage.TypePTR || any_type
+		case strings.EqualFold(name, a.name):
+			srv = srv || q.Type == dnsmessage.TypeSRV || any_type
+			txt = txt || q.Type == dnsmessage.TypeTXT || any_type
+		case strings.EqualFold(name, a.host):
+			host = host || q.Type == dnsmessage.TypeA || any_type
+		}
+	}
+	if !ptr && !enum && !srv && !txt && !host {
+		return nil
+	}
+
+	msg := &dnsmessage.Message{Header: dnsmessage.Header{Response: true, Authoritative: true}}
+	msg.Answers = a.records(ttl, ifindex, ptr, srv, txt, host)
+	if enum {
+		msg.Answers = append(msg.Answers, ptrRecord(enum_name, service_name, ttl))
+	}
+
+	// Browsers need the rest to connect, so save them another query
+	if ptr || srv {
+		msg.Additionals = a.records(ttl, ifindex, false, ptr && !srv, ptr && !txt, !host)
+	}
+	return msg
+}
+
+// records returns the selected records of the service, with the addresses of
+// the given interface.
+func (a *Advertiser) records(ttl uint32, ifindex int, ptr, srv, txt, host bool) []dnsmessage.Resource {
+	a.mu.Lock()
+	service := a.service
+	a.mu.Unlock()
+
+	var records []dnsmessage.Resource
+	if ptr {
+		records = append(records, ptrRecord(service_name, a.name, ttl))
+	}
+	if srv {
+		records = append(records, dnsmessage.Resource{
+			Header: header(a.name, dnsmessage.TypeSRV, ttl, true),
+			Body:   &dnsmessage.SRVResource{Target: dnsmessage.MustNewName(a.host), Port: uint16(service.Port)},
+		})
+	}
+	if txt {
+		records = append(records, dnsmessage.Resource{
+			Header: header(a.name, dnsmessage.TypeTXT, ttl, true),
+			Body:   &dnsmessage.TXTResource{TXT: encodeText(service.Text)},
+		})
+	}
+	if host {
+		for _, ip := range a.conn.addrs(ifindex) {
+			records = append(records, dnsmessage.Resource{
+				Header: header(a.host, dnsmessage.TypeA, ttl, true),
+				Body:   &dnsmessage.AResource{A: [4]byte(ip)},
+			})
+		}
+	}
+	return records
+}
+
+// Browse queries the network for duplex instances and returns those that
+// answered until the context ended, or for DefaultBrowseTimeout if it has no
+// deadline. Only a cancelled context is an error.
+func Browse(ctx context.Context, opts Options) ([]Service, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultBrowseTimeout)
+		defer cancel()
+	}
+
+	conn, err := listen(opts.Interfaces)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.close()
+	stop := context.AfterFunc(ctx, func() {
+		conn.udp.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	query := &dnsmessage.Message{Questions: []dnsmessage.Question{{
+		Name:  dnsmessage.MustNewName(service_name),
+		Type:  dnsmessage.TypePTR,
+		Class: dnsmessage.ClassINET,
+	}}}
+	if err := conn.multicast(query, 0); err != nil {
+		return nil, err
+	}
+
+	// Ask again in case the first query or its answers were lost
+	retry := time.AfterFunc(time.Second, func() {
+		conn.multicast(query, 0)
+	})
+	defer retry.Stop()
+
+	found := newBrowseResults()
+	buf := make([]byte, 9000)
+	for {
+		n, _, _, err := conn.read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return nil, err
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buf[:n]); err != nil || !msg.Header.Response {
+			continue
+		}
+		found.add(msg.Answers)
+		found.add(msg.Additionals)
+	}
+
+	services := found.services()
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return services, ctx.Err()
+	}
+	return services, nil
+}
+
+// browse_results collects records from responses.
+type browse_results struct {
+	instances map[string]bool // Lower case instance names, false once they said goodbye
+	names     map[string]string
+	srv       map[string]*dnsmessage.SRVResource
+	txt       map[string][]string
+	addrs     map[string][]net.IP
+}
+
+func newBrowseResults() *browse_results {
+	return &browse_results{
+		instances: make(map[string]bool),
+		names:     make(map[string]string),
+		srv:       make(map[string]*dnsmessage.SRVResource),
+		txt:       make(map[string][]string),
+		addrs:     make(map[string][]net.IP),
+	}
+}
+
+func (r *browse_results) add(records []dnsmessage.Resource) {
+	for _, record := range records {
+		name := strings.ToLower(record.Header.Name.String())
+		alive := record.Header.TTL > 0
+		switch body := record.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if name != service_name {
+				continue
+			}
+			instance := body.PTR.String()
+			key := strings.ToLower(instance)
+			r.instances[key] = alive
+			r.names[key] = strings.TrimSuffix(instance, "."+service_name)
+		case *dnsmessage.SRVResource:
+			if alive {
+				r.srv[name] = body
+			}
+		case *dnsmessage.TXTResource:
+			if alive {
+				r.txt[name] = body.TXT
+			}
+		case *dnsmessage.AResource:
+			ip := net.IP(body.A[:])
+			if alive && !slices.ContainsFunc(r.addrs[name], ip.Equal) {
+				r.addrs[name] = append(r.addrs[name], ip)
+			}
+		}
+	}
+}
+
+// services returns the instances that are still advertised and whose SRV
+// record arrived, sorted by name.
+func (r *browse_results) services() []Service {
+	var services []Service
+	for key, alive := range r.instances {
+		srv := r.srv[key]
+		if !alive || srv == nil {
+			continue
+		}
+		host := strings.ToLower(srv.Target.String())
+		services = append(services, Service{
+			Instance: r.names[key],
+			Host:     strings.TrimSuffix(host, "."+Domain),
+			Port:     int(srv.Port),
+			Text:     decodeText(r.txt[key]),
+			Addrs:    r.addrs[host],
+		})
+	}
+	slices.SortFunc(services, func(a, b Service) int {
+		return strings.Compare(a.Instance, b.Instance)
+	})
+	return services
+}
+
+func header(name string, t dnsmessage.Type, ttl uint32, unique bool) dnsmessage.ResourceHeader {
+	class := dnsmessage.ClassINET
+	if unique {
+		class |= 1 << 15 // Cache flush: this record replaces any other with the same name
+	}
+	return dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: t, Class: class, TTL: ttl}
+}
+
+func ptrRecord(name, target string, ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: header(name, dnsmessage.TypePTR, ttl, false),
+		Body:   &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(target)},
+	}
+}
+
+// encodeText turns a TXT map into key=value strings, sorted by key.
+func encodeText(text map[string]string) []string {
+	var entries []string
+	for key, value := range text {
+		entries = append(entries, key+"="+value)
+	}
+	slices.Sort(entries)
+	if len(entries) == 0 {
+		return []string{""} // A TXT record may not be empty
+	}
+	return entries
+}
+
+func decodeText(entries []string) map[string]string {
+	text := make(map[string]string)
+	for _, entry := range entries {
+		if entry == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(entry, "=")
+		text[strings.ToLower(key)] = value
+	}
+	return text
+}
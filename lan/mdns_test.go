@@ -0,0 +1,122 @@
+package lan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// advertise starts advertising a service, or skips the test on machines
+// without a multicast interface.
+func advertise(t *testing.T, service Service) *Advertiser {
+	t.Helper()
+	a, err := Advertise(service, Options{})
+	if errors.Is(err, ErrNoInterfaces) {
+		t.Skip("no multicast network interface")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// browseFor browses until the instance shows up, or returns nil.
+func browseFor(t *testing.T, instance string) *Service {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	services, err := Browse(ctx, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := slices.IndexFunc(services, func(s Service) bool { return s.Instance == instance }); n >= 0 {
+		return &services[n]
+	}
+	return nil
+}
+
+func TestAdvertiseAndBrowse(t *testing.T) {
+	instance := fmt.Sprintf("duplex-test-%d", os.Getpid())
+	a := advertise(t, Service{
+		Instance: instance,
+		Host:     "duplex-test-host.local",
+		Port:     9000,
+		Text:     map[string]string{"roles": "relay", "features": "chat"},
+	})
+
+	found := browseFor(t, instance)
+	if found == nil {
+		a.Close()
+		t.Fatalf("%s not found", instance)
+	}
+	if found.Host != "duplex-test-host" || found.Port != 9000 {
+		t.Fatalf("service %+v", found)
+	}
+	if found.Text["roles"] != "relay" || found.Text["features"] != "chat" {
+		t.Fatalf("text %v", found.Text)
+	}
+	if len(found.Addrs) == 0 {
+		t.Fatal("no addresses")
+	}
+
+	// Closing says goodbye, so the service is gone at once
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if found := browseFor(t, instance); found != nil {
+		t.Fatalf("closed service still found: %+v", found)
+	}
+}
+
+func TestAdvertiseRejectsInvalidInstances(t *testing.T) {
+	for _, instance := range []string{"", "a.b", string(make([]byte, 64))} {
+		if _, err := Advertise(Service{Instance: instance}, Options{}); !errors.Is(err, ErrInvalidInstance) {
+			t.Errorf("%q: %v", instance, err)
+		}
+	}
+}
+
+func TestBrowseResultsForgetGoodbyes(t *testing.T) {
+	name := "alpha." + service_name
+	r := newBrowseResults()
+	r.add([]dnsmessage.Resource{
+		ptrRecord(service_name, name, ttl),
+		{
+			Header: header(name, dnsmessage.TypeSRV, ttl, true),
+			Body:   &dnsmessage.SRVResource{Target: dnsmessage.MustNewName("host.local."), Port: 9000},
+		},
+		{
+			Header: header(name, dnsmessage.TypeTXT, ttl, true),
+			Body:   &dnsmessage.TXTResource{TXT: encodeText(map[string]string{"Roles": "relay"})},
+		},
+	})
+	services := r.services()
+	if len(services) != 1 || services[0].Instance != "alpha" || services[0].Host != "host" || services[0].Text["roles"] != "relay" {
+		t.Fatalf("services %+v", services)
+	}
+
+	r.add([]dnsmessage.Resource{ptrRecord(service_name, name, 0)})
+	if services := r.services(); len(services) != 0 {
+		t.Fatalf("services after goodbye %+v", services)
+	}
+}
+
+func TestNetworks(t *testing.T) {
+	networks, err := Networks(Options{Interfaces: []string{"lo"}})
+	if err != nil {
+		t.Skip("no loopback interface named lo:", err)
+	}
+	if !slices.ContainsFunc(networks, func(n *net.IPNet) bool { return n.Contains(net.IPv4(127, 0, 0, 1)) }) {
+		t.Fatalf("loopback networks %v", networks)
+	}
+	if _, err := Networks(Options{Interfaces: []string{"missing0"}}); err == nil {
+		t.Fatal("listed the networks of a missing interface")
+	}
+}
@@ -0,0 +1,96 @@
+package duplex
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestLANServiceRoundTrip(t *testing.T) {
+	i := New("alpha", &Config{SignalingListen: "127.0.0.1:0", IsRelay: true, LogLevel: zerolog.Disabled})
+	i.Announce(Announcement{Name: "hub", Features: []string{"chat", "files"}})
+	if err := i.startSignaling(); err != nil {
+		t.Fatal(err)
+	}
+	defer i.stopSignaling()
+
+	service := i.lanService()
+	service.Addrs = []net.IP{net.IPv4(192, 168, 1, 20)}
+	p := lanPeer(service)
+	if p.Id != "alpha" || p.Name != "hub" || !slices.Equal(p.Features, []string{"chat", "files"}) {
+		t.Fatalf("peer %+v", p)
+	}
+	if !p.IsRelay || p.IsBridge || p.IsDiscovery {
+		t.Fatalf("roles %+v", p)
+	}
+	if p.SignalingPort == 0 || p.SignalingKey == "" {
+		t.Fatalf("signaling %+v", p)
+	}
+
+	other := New("beta", &Config{LogLevel: zerolog.Disabled})
+	if err := other.UseLANSignaling(p); err != nil {
+		t.Fatal(err)
+	}
+	if other.peerjs_config.Host != "192.168.1.20" || other.peerjs_config.Port != p.SignalingPort {
+		t.Fatalf("signaling endpoint %s:%d", other.peerjs_config.Host, other.peerjs_config.Port)
+	}
+}
+
+func TestUseLANSignalingNeedsServer(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	p := lanPeer(New("beta", &Config{LogLevel: zerolog.Disabled}).lanService())
+	if p.SignalingPort != 0 {
+		t.Fatalf("advertised a signaling port without a server: %d", p.SignalingPort)
+	}
+	if err := i.UseLANSignaling(p); err != ErrNoLANSignaling {
+		t.Fatalf("UseLANSignaling returned %v", err)
+	}
+}
+
+func TestLANAdvertisingFollowsAnnouncement(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	if err := i.StartLANAdvertising(); err != nil {
+		t.Skip("cannot advertise here:", err)
+	}
+	defer i.StopLANAdvertising()
+	i.Announce(Announcement{Name: "renamed"})
+
+	browser := New("beta", &Config{LogLevel: zerolog.Disabled})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	peers, err := browser.BrowseLAN(ctx)
+	if err != nil {
+		t.Skip("cannot browse here:", err)
+	}
+	for _, p := range peers {
+		if p.Id == "alpha" && p.Name == "renamed" {
+			return
+		}
+	}
+	t.Fatalf("announcement not advertised: %+v", peers)
+}
+
+func TestLANAddressPrefersSharedNetwork(t *testing.T) {
+	_, home, _ := net.ParseCIDR("192.168.1.0/24")
+	_, office, _ := net.ParseCIDR("10.0.0.0/8")
+	docker, lan, linklocal := net.ParseIP("172.17.0.2"), net.ParseIP("192.168.1.20"), net.ParseIP("fe80::1")
+
+	for _, test := range []struct {
+		addrs    []net.IP
+		networks []*net.IPNet
+		want     net.IP
+	}{
+		{[]net.IP{docker, lan}, []*net.IPNet{office, home}, lan},
+		{[]net.IP{docker, lan}, nil, docker},
+		{[]net.IP{linklocal, docker}, []*net.IPNet{office}, docker},
+		{[]net.IP{linklocal}, nil, linklocal},
+	} {
+		if got := lanAddress(test.addrs, test.networks); !got.Equal(test.want) {
+			t.Errorf("lanAddress(%v, %v) = %v, want %v", test.addrs, test.networks, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package duplex
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// Weights used for smoothing, as per RFC 6298.
+const (
+	rtt_alpha = 0.125
+	rtt_beta  = 0.25
+)
+
+var ping_counter atomic.Uint64
+
+// LatencyStats is a snapshot of the round-trip statistics of a peer.
+type LatencyStats struct {
+	Last        time.Duration `json:"last"`         // Most recent round-trip sample
+	Smoothed    time.Duration `json:"smoothed"`     // Exponentially weighted moving average of the round-trip time
+	Min         time.Duration `json:"min"`          // Lowest round-trip sample observed
+	Max         time.Duration `json:"max"`          // Highest round-trip sample observed
+	Jitter      time.Duration `json:"jitter"`       // Smoothed mean deviation of the round-trip time
+	Samples     uint64        `json:"samples"`      // Number of samples collected
+	Missed      int           `json:"missed"`       // Consecutive pings that went unanswered
+	TotalMissed uint64        `json:"total_missed"` // Total pings that went unanswered
+	LastPong    time.Time     `json:"last_pong"`    // Time the last reply was received
+}
+
+// LatencyTracker accumulates round-trip samples for a peer. It is safe for concurrent use.
+type LatencyTracker struct {
+	mu          sync.Mutex
+	stats       LatencyStats
+	outstanding bool
+}
+
+// Stats returns a copy of the current statistics.
+func (l *LatencyTracker) Stats() LatencyStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stats
+}
+
+// Record adds a round-trip sample and resets the consecutive missed counter.
+func (l *LatencyTracker) Record(rtt time.Duration) {
+	if rtt < 0 {
+		rtt = 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s := &l.stats
+	if s.Samples == 0 {
+		s.Smoothed = rtt
+		s.Jitter = rtt / 2
+		s.Min = rtt
+		s.Max = rtt
+	} else {
+		delta := s.Smoothed - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		s.Jitter = time.Duration((1-rtt_beta)*float64(s.Jitter) + rtt_beta*float64(delta))
+		s.Smoothed = time.Duration((1-rtt_alpha)*float64(s.Smoothed) + rtt_alpha*float64(rtt))
+		s.Min = min(s.Min, rtt)
+		s.Max = max(s.Max, rtt)
+	}
+
+	s.Last = rtt
+	s.Samples++
+	s.Missed = 0
+	s.LastPong = time.Now()
+	l.outstanding = false
+}
+
+// sent marks a periodic ping as in flight. If the previous ping was never answered,
+// it is counted as missed. Returns the number of consecutive missed pings.
+func (l *LatencyTracker) sent() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.outstanding {
+		l.stats.Missed++
+		l.stats.TotalMissed++
+	}
+	l.outstanding = true
+	return l.stats.Missed
+}
+
+// pending reports whether a periodic ping is in flight.
+func (l *LatencyTracker) pending() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.outstanding
+}
+
+// SmoothedRTT returns the smoothed round-trip time of the peer. Unlike the RTT
+// field, it is safe to call while PONGs are being handled.
+func (c *Peer) SmoothedRTT() time.Duration {
+	return c.Latency.Stats().Smoothed
+}
+
+// Ping sends a PING to the peer and blocks until the matching PONG arrives,
+// the context is cancelled, or the peer disconnects. The sample is added to
+// the peer's latency statistics.
+func (c *Peer) Ping(ctx context.Context) (time.Duration, error) {
+	tag := fmt.Sprintf("ping-%d", ping_counter.Add(1))
+	response := make(chan *RxPacket, 1)
+
+	c.BindListener(tag, func(r *RxPacket) {
+		c.UnbindListener(tag)
+		response <- r
+	})
+	defer c.UnbindListener(tag)
+
+	c.Write(&TxPacket{
+		Packet: Packet{
+			Opcode:   "PING",
+			TTL:      1,
+			Listener: tag,
+		},
+		Payload: PingRequest{T1: time.Now().UnixMilli()},
+	})
+
+	select {
+	case r := <-response:
+		var reply PongReply
+		if err := json.Unmarshal(r.Payload, &reply); err != nil {
+			return 0, err
+		}
+		return c.HandlePong(reply), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-c.Closed():
+		return 0, ErrPeerClosed
+	}
+}
+
+// HandlePong records the round-trip time and clock offset sample carried by a
+// PONG reply, and returns the round-trip time.
+func (c *Peer) HandlePong(reply PongReply) time.Duration {
+	t4 := time.Now().UnixMilli()
+	rtt := time.Duration(t4-reply.T1) * time.Millisecond
+	c.Latency.Record(rtt)
+	c.Clock.Record(reply.T1, reply.T2, reply.T3, t4)
+
+	stats := c.Latency.Stats()
+	c.RTT = stats.Smoothed.Milliseconds()
+	c.Logger.Debug().
+		Dur("rtt", rtt).
+		Dur("smoothed", stats.Smoothed).
+		Dur("jitter", stats.Jitter).
+		Dur("clock_offset", c.ClockOffset()).
+		Msg("latency updated")
+
+	return rtt
+}
+
+// reset forgets any ping in flight, so that pings lost with a previous
+// connection are not counted as missed.
+func (l *LatencyTracker) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.outstanding = false
+	l.stats.Missed = 0
+}
@@ -0,0 +1,97 @@
+package duplex
+
+import (
+	"testing"
+	"time"
+
+	peer "github.com/cloudlink-delta/peerjs-go"
+	"github.com/cloudlink-delta/peerjs-go/emitter"
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog"
+)
+
+// unopenedPeer wraps a data connection that never opened, so that writes to
+// it are dropped.
+func unopenedPeer(i *Instance) *Peer {
+	conn := &peer.DataConnection{BaseConnection: peer.BaseConnection{Emitter: emitter.NewEmitter()}}
+	return i.newPeer(conn, true)
+}
+
+func TestLatencyTrackerSmoothing(t *testing.T) {
+	var l LatencyTracker
+	l.Record(100 * time.Millisecond)
+	s := l.Stats()
+	if s.Smoothed != 100*time.Millisecond || s.Jitter != 50*time.Millisecond || s.Samples != 1 {
+		t.Fatalf("first sample %+v", s)
+	}
+
+	l.Record(200 * time.Millisecond)
+	s = l.Stats()
+	if s.Last != 200*time.Millisecond || s.Min != 100*time.Millisecond || s.Max != 200*time.Millisecond {
+		t.Fatalf("bounds %+v", s)
+	}
+	// RFC 6298: srtt = 7/8 * 100 + 1/8 * 200, rttvar = 3/4 * 50 + 1/4 * 100
+	if s.Smoothed != 112500*time.Microsecond || s.Jitter != 62500*time.Microsecond {
+		t.Fatalf("smoothed %v, jitter %v", s.Smoothed, s.Jitter)
+	}
+
+	l.Record(-time.Second)
+	if s := l.Stats(); s.Min != 0 {
+		t.Fatalf("negative sample recorded as %v", s.Min)
+	}
+}
+
+func TestLatencyTrackerCountsMissedPings(t *testing.T) {
+	var l LatencyTracker
+	if missed := l.sent(); missed != 0 {
+		t.Fatalf("first ping counted %d missed", missed)
+	}
+	l.sent()
+	if missed := l.sent(); missed != 2 {
+		t.Fatalf("%d missed after two unanswered pings", missed)
+	}
+
+	l.Record(10 * time.Millisecond)
+	s := l.Stats()
+	if s.Missed != 0 || s.TotalMissed != 2 {
+		t.Fatalf("after a reply %+v", s)
+	}
+	if missed := l.sent(); missed != 0 {
+		t.Fatalf("answered ping counted as missed: %d", missed)
+	}
+}
+
+func TestPongRecordsSample(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+
+	payload, _ := json.Marshal(PongReply{T1: time.Now().Add(-30 * time.Millisecond).UnixMilli()})
+	p.HandlePacket(&RxPacket{Packet: Packet{Opcode: "PONG", TTL: 1}, Payload: payload})
+
+	s := p.Latency.Stats()
+	if s.Samples != 1 || s.Last < 30*time.Millisecond || p.SmoothedRTT() != s.Smoothed {
+		t.Fatalf("stats %+v", s)
+	}
+	if p.RTT != s.Smoothed.Milliseconds() {
+		t.Fatalf("RTT field %d, want %d", p.RTT, s.Smoothed.Milliseconds())
+	}
+}
+
+func TestTickerGivesUpOnSilentPeer(t *testing.T) {
+	i := New("alpha", &Config{EnablePinger: true, PingInterval: 5, MaxMissedPings: 2, LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+
+	done := make(chan struct{})
+	go func() {
+		i.SpawnTicker(p)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("ticker kept pinging a silent peer")
+	}
+	if s := p.Latency.Stats(); s.Missed != 2 {
+		t.Fatalf("gave up after %d missed pings", s.Missed)
+	}
+}
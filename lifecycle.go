@@ -0,0 +1,194 @@
+package duplex
+
+import (
+	"context"
+	"errors"
+
+	"github.com/cloudlink-delta/peerjs-go/enums"
+)
+
+// Terminal errors, returned by Run and Wait when the instance cannot go on.
+var (
+	ErrAlreadyRunning     = errors.New("instance is already running")
+	ErrUnavailableID      = errors.New("peer ID is already in use")
+	ErrInvalidID          = errors.New("invalid peer ID")
+	ErrInvalidKey         = errors.New("invalid API key")
+	ErrSSLUnavailable     = errors.New("signaling server requires SSL")
+	ErrRetriesExhausted   = errors.New("reconnect retries exhausted")
+	ErrUnsupportedBrowser = errors.New("incompatible WebRTC implementation")
+)
+
+// terminalError returns the terminal error for a PeerJS error type, or nil if
+// the error is recoverable.
+func terminalError(error_type string) error {
+	switch error_type {
+	case enums.PeerErrorTypeUnavailableID:
+		return ErrUnavailableID
+	case enums.PeerErrorTypeInvalidID:
+		return ErrInvalidID
+	case enums.PeerErrorTypeInvalidKey:
+		return ErrInvalidKey
+	case enums.PeerErrorTypeSslUnavailable:
+		return ErrSSLUnavailable
+	case enums.PeerErrorTypeBrowserIncompatible:
+		return ErrUnsupportedBrowser
+	}
+	return nil
+}
+
+// Start connects to the signaling server and returns without waiting. The
+// instance runs until the context ends, Stop is called, or a terminal error
+// occurs; Wait reports which. A stopped instance may be started again.
+func (i *Instance) Start(ctx context.Context) error {
+	// Claim the instance before starting anything, so that concurrent Starts
+	// cannot both start the side resources
+	i.mu.Lock()
+	if i.running {
+		i.mu.Unlock()
+		return ErrAlreadyRunning
+	}
+	run_ctx, cancel := context.WithCancelCause(ctx)
+	i.running = true
+	i.stop = cancel
+	i.stopped = make(chan struct{})
+	i.run_err = nil
+	i.RetryCounter = 0
+	i.isReconnecting = false
+	i.closing.Store(false)
+	i.closing_signal = nil
+	stopped := i.stopped
+	i.mu.Unlock()
+
+	if err := i.startResources(); err != nil {
+		cancel(err)
+		i.mu.Lock()
+		i.running = false
+		i.run_err = err
+		i.mu.Unlock()
+		close(stopped)
+		return err
+	}
+
+	i.Logger.Info().Msg("Initializing peer...")
+	if err := i.setup(); err != nil {
+		i.Logger.Error().Err(err).Msg("Initial connection failed. Reconnect loop will take over.")
+		i.AttemptReconnect()
+	}
+
+	if i.EnableMesh {
+		i.StartMesh()
+	}
+	if i.EnablePEX {
+		i.StartPEX()
+	}
+	i.Logger.Info().Msg("Peer instance is running...")
+
+	go func() {
+		select {
+		case <-run_ctx.Done():
+		case <-i.Close:
+			cancel(nil)
+		}
+
+		i.StopLANAdvertising()
+		shutdown_ctx, shutdown_cancel := context.WithTimeout(context.Background(), i.ShutdownTimeout)
+		i.Shutdown(shutdown_ctx)
+		shutdown_cancel()
+		i.StopCapture()
+		i.stopSignaling()
+
+		// Ending the caller's context is a clean stop, not a failure
+		err := context.Cause(run_ctx)
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			err = nil
+		}
+
+		i.mu.Lock()
+		i.running = false
+		i.run_err = err
+		i.mu.Unlock()
+		close(stopped)
+
+		select {
+		case i.Done <- true:
+		default:
+		}
+	}()
+	return nil
+}
+
+// startResources starts the embedded signaling server, the capture and LAN
+// advertising, as configured. If one fails, those already started are stopped.
+func (i *Instance) startResources() error {
+	// The embedded signaling server must be up before we connect to it
+	if err := i.startSignaling(); err != nil {
+		return err
+	}
+	if i.Capture.Path != "" {
+		if err := i.StartCapture(i.Capture); err != nil {
+			i.stopSignaling()
+			return err
+		}
+	}
+	if i.LANAdvertise {
+		if err := i.StartLANAdvertising(); err != nil {
+			i.StopCapture()
+			i.stopSignaling()
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop shuts the instance down without waiting. Use Wait to block until it
+// has stopped. It does not block, so it is safe to call from handlers. An
+// instance that was not started with Start is shut down in the background,
+// within ShutdownTimeout.
+func (i *Instance) Stop() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.running {
+		i.stop(nil)
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), i.ShutdownTimeout)
+		defer cancel()
+		i.Shutdown(ctx)
+	}()
+}
+
+// Wait blocks until the instance has stopped, and returns the terminal error
+// that stopped it, if any.
+func (i *Instance) Wait() error {
+	i.mu.Lock()
+	stopped := i.stopped
+	i.mu.Unlock()
+	if stopped == nil {
+		return nil
+	}
+	<-stopped
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.run_err
+}
+
+// Run starts the instance and blocks until it stops. It returns nil when the
+// context ends or Stop is called, and the terminal error otherwise.
+func (i *Instance) Run(ctx context.Context) error {
+	if err := i.Start(ctx); err != nil {
+		return err
+	}
+	return i.Wait()
+}
+
+// fail stops the instance with a terminal error.
+func (i *Instance) fail(err error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.running {
+		i.Logger.Error().Err(err).Msg("Terminal error, stopping")
+		i.stop(err)
+	}
+}
@@ -0,0 +1,144 @@
+package duplex
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudlink-delta/peerjs-go/enums"
+)
+
+func TestTerminalErrors(t *testing.T) {
+	if err := terminalError(enums.PeerErrorTypeUnavailableID); err != ErrUnavailableID {
+		t.Fatalf("unavailable ID mapped to %v", err)
+	}
+	if err := terminalError(enums.PeerErrorTypeNetwork); err != nil {
+		t.Fatalf("network error treated as terminal: %v", err)
+	}
+}
+
+// waitFor returns the result of Wait, failing the test if it blocks.
+func waitFor(t *testing.T, i *Instance) error {
+	t.Helper()
+	result := make(chan error, 1)
+	go func() { result <- i.Wait() }()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("instance did not stop")
+		return nil
+	}
+}
+
+func TestStartStopRestart(t *testing.T) {
+	i := unreachable(t, &Config{ReconnectPolicy: ConstantBackoff(time.Hour)})
+	if err := i.Wait(); err != nil {
+		t.Fatalf("Wait before Start returned %v", err)
+	}
+
+	if err := i.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Start(context.Background()); err != ErrAlreadyRunning {
+		t.Fatalf("second Start returned %v", err)
+	}
+	i.Stop()
+	if err := waitFor(t, i); err != nil {
+		t.Fatalf("Wait after Stop returned %v", err)
+	}
+	select {
+	case <-i.Done:
+	default:
+		t.Fatal("Done not signalled")
+	}
+
+	if err := i.Start(context.Background()); err != nil {
+		t.Fatalf("restart failed: %v", err)
+	}
+	if i.Closing() {
+		t.Fatal("restarted instance still closing")
+	}
+	i.Close <- true
+	if err := waitFor(t, i); err != nil {
+		t.Fatalf("Wait after Close returned %v", err)
+	}
+}
+
+func TestRunEndsWithContext(t *testing.T) {
+	i := unreachable(t, &Config{ReconnectPolicy: ConstantBackoff(time.Hour)})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if !returnsWithin(func() {
+		if err := i.Run(ctx); err != nil {
+			t.Errorf("Run returned %v", err)
+		}
+	}, 5*time.Second) {
+		t.Fatal("Run outlived its context")
+	}
+}
+
+func TestRetriesExhaustedStopsInstance(t *testing.T) {
+	i := unreachable(t, &Config{MaxRetries: 2, ReconnectPolicy: ConstantBackoff(time.Millisecond)})
+	if err := i.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := waitFor(t, i); err != ErrRetriesExhausted {
+		t.Fatalf("Wait returned %v", err)
+	}
+}
+
+func TestConcurrentStartsClaimOnce(t *testing.T) {
+	i := unreachable(t, &Config{ReconnectPolicy: ConstantBackoff(time.Hour)})
+	i.Capture = CaptureOptions{Path: filepath.Join(t.TempDir(), "capture.jsonl")}
+	defer func() {
+		i.Stop()
+		waitFor(t, i)
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for range 8 {
+		wg.Go(func() { errs <- i.Start(context.Background()) })
+	}
+	wg.Wait()
+	close(errs)
+
+	started := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			started++
+		case !errors.Is(err, ErrAlreadyRunning):
+			t.Fatalf("start failed: %v", err)
+		}
+	}
+	if started != 1 {
+		t.Fatalf("started %d times", started)
+	}
+}
+
+func TestFailedStartCanBeRetried(t *testing.T) {
+	i := unreachable(t, &Config{ReconnectPolicy: ConstantBackoff(time.Hour)})
+	i.Capture = CaptureOptions{Path: filepath.Join(t.TempDir(), "missing", "capture.jsonl")}
+
+	err := i.Start(context.Background())
+	if err == nil {
+		t.Fatal("started with an unwritable capture path")
+	}
+	if werr := waitFor(t, i); werr != err {
+		t.Fatalf("Wait returned %v, want %v", werr, err)
+	}
+
+	i.Capture = CaptureOptions{}
+	if err := i.Start(context.Background()); err != nil {
+		t.Fatalf("retry failed: %v", err)
+	}
+	i.Stop()
+	if err := waitFor(t, i); err != nil {
+		t.Fatalf("Wait returned %v", err)
+	}
+}
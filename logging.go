@@ -0,0 +1,143 @@
+package duplex
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog"
+)
+
+// Log subsystems, whose levels can be set separately with Config.LogLevels.
+const (
+	LogSignaling   = "signaling"   // Signaling server connection and reconnects
+	LogNegotiation = "negotiation" // NEGOTIATE exchanges with peers
+	LogPackets     = "packets"     // Every packet sent and received, and dropped packets
+)
+
+// Log formats for Config.LogFormat.
+const (
+	LogFormatConsole = "console"
+	LogFormatJSON    = "json"
+)
+
+// instance_logs holds the subsystem loggers derived from Instance.Logger.
+type instance_logs struct {
+	levels      map[string]zerolog.Level
+	sample      uint32
+	signaling   zerolog.Logger
+	negotiation zerolog.Logger
+	packets     zerolog.Logger
+}
+
+// newLogger builds the instance logger from the logging options of a Config.
+// A supplied zerolog logger wins over a slog handler, which wins over the
+// output format.
+func (i *Instance) newLogger(args *Config) *zerolog.Logger {
+	var logger zerolog.Logger
+	switch {
+	case args.Logger != nil:
+		logger = *args.Logger
+	case args.LogHandler != nil:
+		logger = zerolog.New(&slog_writer{handler: args.LogHandler}).Level(args.LogLevel)
+	case args.LogFormat == LogFormatJSON:
+		logger = zerolog.New(os.Stdout).With().Timestamp().Logger().Level(args.LogLevel)
+	default:
+		output := zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}
+		logger = zerolog.New(output).With().Timestamp().Logger().Level(args.LogLevel)
+	}
+	logger = logger.With().Str("instance", i.Name).Logger()
+	return &logger
+}
+
+// SetLogger replaces the instance logger. Subsystem levels and sampling set in
+// the Config still apply. Peers that are already connected keep the logger
+// they were created with.
+func (i *Instance) SetLogger(logger *zerolog.Logger) {
+	i.Logger = logger
+	i.logs.signaling = i.subsystemLogger(LogSignaling)
+	i.logs.negotiation = i.subsystemLogger(LogNegotiation)
+	i.logs.packets = i.subsystemLogger(LogPackets)
+	if i.logs.sample > 1 {
+		i.logs.packets = i.logs.packets.Sample(zerolog.LevelSampler{
+			TraceSampler: &zerolog.BasicSampler{N: i.logs.sample},
+			DebugSampler: &zerolog.BasicSampler{N: i.logs.sample},
+		})
+	}
+}
+
+func (i *Instance) subsystemLogger(name string) zerolog.Logger {
+	logger := i.Logger.With().Str("subsystem", name).Logger()
+	if level, ok := i.logs.levels[name]; ok {
+		logger = logger.Level(level)
+	}
+	return logger
+}
+
+// slog_writer forwards zerolog events to a slog.Handler.
+type slog_writer struct {
+	handler slog.Handler
+}
+
+func (w *slog_writer) Write(p []byte) (int, error) {
+	return w.WriteLevel(zerolog.NoLevel, p)
+}
+
+func (w *slog_writer) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	ctx := context.Background()
+	slog_level := slogLevel(level)
+	if !w.handler.Enabled(ctx, slog_level) {
+		return len(p), nil
+	}
+
+	var fields map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(p))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil && err != io.EOF {
+		return 0, fmt.Errorf("decoding log event: %w", err)
+	}
+
+	message, _ := fields[zerolog.MessageFieldName].(string)
+	delete(fields, zerolog.MessageFieldName)
+	delete(fields, zerolog.LevelFieldName)
+
+	timestamp := time.Now()
+	if value, ok := fields[zerolog.TimestampFieldName].(string); ok {
+		if t, err := time.Parse(zerolog.TimeFieldFormat, value); err == nil {
+			timestamp = t
+		}
+		delete(fields, zerolog.TimestampFieldName)
+	}
+
+	record := slog.NewRecord(timestamp, slog_level, message, 0)
+	for _, key := range slices.Sorted(maps.Keys(fields)) {
+		record.AddAttrs(slog.Any(key, fields[key]))
+	}
+	if err := w.handler.Handle(ctx, record); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func slogLevel(level zerolog.Level) slog.Level {
+	switch level {
+	case zerolog.TraceLevel:
+		return slog.LevelDebug - 4
+	case zerolog.DebugLevel:
+		return slog.LevelDebug
+	case zerolog.WarnLevel:
+		return slog.LevelWarn
+	case zerolog.ErrorLevel:
+		return slog.LevelError
+	case zerolog.FatalLevel, zerolog.PanicLevel:
+		return slog.LevelError + 4
+	}
+	return slog.LevelInfo
+}
@@ -0,0 +1,125 @@
+package duplex
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog"
+)
+
+// log_buffer collects JSON log lines written from any goroutine.
+type log_buffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *log_buffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// lines returns the decoded lines whose message is msg.
+func (b *log_buffer) lines(t *testing.T, msg string) []map[string]any {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var lines []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var fields map[string]any
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			t.Fatalf("invalid log line %q: %v", line, err)
+		}
+		if fields["message"] == msg || fields["msg"] == msg {
+			lines = append(lines, fields)
+		}
+	}
+	return lines
+}
+
+func bufferedInstance(t *testing.T, buf *log_buffer, args *Config) *Instance {
+	t.Helper()
+	logger := zerolog.New(buf).Level(zerolog.DebugLevel)
+	args.Logger = &logger
+	return New("alpha", args)
+}
+
+func TestPacketLogs(t *testing.T) {
+	var buf log_buffer
+	i := bufferedInstance(t, &buf, &Config{})
+	p := unopenedPeer(i)
+
+	p.Write(&TxPacket{Packet: Packet{Opcode: "PING", TTL: 1}})
+	lines := buf.lines(t, "sending packet")
+	if len(lines) != 1 {
+		t.Fatalf("%d packet lines", len(lines))
+	}
+	if line := lines[0]; line["subsystem"] != LogPackets || line["instance"] != "alpha" || line["packet"] == nil {
+		t.Fatalf("line %v", line)
+	}
+}
+
+func TestSubsystemLevels(t *testing.T) {
+	var buf log_buffer
+	i := bufferedInstance(t, &buf, &Config{LogLevels: map[string]zerolog.Level{LogPackets: zerolog.InfoLevel}})
+	p := unopenedPeer(i)
+
+	p.Write(&TxPacket{Packet: Packet{Opcode: "PING", TTL: 1}})
+	if lines := buf.lines(t, "sending packet"); len(lines) != 0 {
+		t.Fatalf("packet debug lines logged at info: %v", lines)
+	}
+
+	i.logs.signaling.Debug().Msg("still debugging signaling")
+	if lines := buf.lines(t, "still debugging signaling"); len(lines) != 1 || lines[0]["subsystem"] != LogSignaling {
+		t.Fatalf("signaling lines %v", lines)
+	}
+}
+
+func TestPacketLogSampling(t *testing.T) {
+	var buf log_buffer
+	i := bufferedInstance(t, &buf, &Config{PacketLogSample: 3})
+	p := unopenedPeer(i)
+
+	for range 6 {
+		p.Write(&TxPacket{Packet: Packet{Opcode: "PING", TTL: 1}})
+	}
+	if lines := buf.lines(t, "sending packet"); len(lines) != 2 {
+		t.Fatalf("%d of 6 packet lines logged", len(lines))
+	}
+
+	// Warnings are never sampled
+	for range 3 {
+		i.logs.packets.Warn().Msg("dropped")
+	}
+	if lines := buf.lines(t, "dropped"); len(lines) != 3 {
+		t.Fatalf("%d of 3 warnings logged", len(lines))
+	}
+}
+
+func TestSlogHandler(t *testing.T) {
+	var buf log_buffer
+	handler := slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})
+	i := New("alpha", &Config{LogHandler: handler, LogLevel: zerolog.DebugLevel})
+
+	i.Logger.Debug().Msg("below the handler level")
+	i.Logger.Warn().Str("peer_id", "beta").Int("attempt", 2).Msg("hello")
+
+	if lines := buf.lines(t, "below the handler level"); len(lines) != 0 {
+		t.Fatalf("debug line reached the handler: %v", lines)
+	}
+	lines := buf.lines(t, "hello")
+	if len(lines) != 1 {
+		t.Fatalf("%d lines", len(lines))
+	}
+	line := lines[0]
+	if line["level"] != "WARN" || line["peer_id"] != "beta" || line["instance"] != "alpha" || line["attempt"] != float64(2) {
+		t.Fatalf("line %v", line)
+	}
+}
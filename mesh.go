@@ -0,0 +1,333 @@
+package duplex
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// mesh_candidate is a peer the mesh manager may connect to.
+type mesh_candidate struct {
+	id           string
+	rtt          time.Duration // Last known round-trip time, zero if never measured
+	failures     int           // Consecutive failed dials
+	next_attempt time.Time
+	dialing      time.Time // When the current dial started, zero if not dialing
+}
+
+type mesh_state struct {
+	mu         sync.Mutex
+	candidates map[string]*mesh_candidate
+	running    bool
+	stop       chan struct{}
+	wake       chan struct{}
+}
+
+// MeshPeers returns the connected peers counted towards the mesh degree,
+// which are plain clients. Relays, bridges and discovery peers are left alone.
+func (i *Instance) MeshPeers() PeerSlice {
+	var peers PeerSlice
+	for _, p := range i.ConnectedPeers() {
+		if p.IsClient() {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+// AddMeshCandidates tells the mesh manager about peers it may connect to. At
+// most MaxKnownPeers candidates are kept.
+func (i *Instance) AddMeshCandidates(ids ...string) {
+	i.mesh.mu.Lock()
+	var added bool
+	for _, id := range ids {
+		if id == "" || id == i.Name {
+			continue
+		}
+		if _, ok := i.mesh.candidates[id]; ok {
+			continue
+		}
+		if len(i.mesh.candidates) >= i.MaxKnownPeers {
+			i.Logger.Debug().Int("limit", i.MaxKnownPeers).Msg("mesh candidate table full")
+			break
+		}
+		i.mesh.candidates[id] = &mesh_candidate{id: id}
+		added = true
+	}
+	i.mesh.mu.Unlock()
+	if added {
+		i.wakeMesh()
+	}
+}
+
+// RemoveMeshCandidate stops the mesh manager from connecting to a peer. An
+// existing connection is left open.
+func (i *Instance) RemoveMeshCandidate(id string) {
+	i.mesh.mu.Lock()
+	defer i.mesh.mu.Unlock()
+	delete(i.mesh.candidates, id)
+}
+
+// StartMesh starts maintaining connections to MeshDegree candidate peers.
+// Candidates are learned from discovery peers and from AddMeshCandidates.
+// Mesh peers are pinged until their round-trip time is known; above
+// MeshMaxDegree the slowest are closed, and candidates that were measured
+// before are redialed fastest first.
+func (i *Instance) StartMesh() {
+	i.mesh.mu.Lock()
+	defer i.mesh.mu.Unlock()
+	if i.mesh.running {
+		return
+	}
+	i.mesh.running = true
+	i.mesh.stop = make(chan struct{})
+	go i.maintainMesh(i.mesh.stop)
+}
+
+// StopMesh stops the mesh manager. Existing connections are left open.
+func (i *Instance) StopMesh() {
+	i.mesh.mu.Lock()
+	defer i.mesh.mu.Unlock()
+	if !i.mesh.running {
+		return
+	}
+	i.mesh.running = false
+	close(i.mesh.stop)
+}
+
+func (i *Instance) wakeMesh() {
+	select {
+	case i.mesh.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (i *Instance) maintainMesh(stop chan struct{}) {
+	ticker := time.NewTicker(i.MeshInterval)
+	defer ticker.Stop()
+
+	i.Logger.Info().Int("degree", i.MeshDegree).Msg("mesh manager started")
+	for {
+		i.refreshMesh()
+		select {
+		case <-stop:
+			i.Logger.Info().Msg("mesh manager stopped")
+			return
+		case <-ticker.C:
+			i.discoverMeshCandidates()
+		case <-i.mesh.wake:
+		}
+	}
+}
+
+// discoverMeshCandidates adds every client known to our discovery peers.
+func (i *Instance) discoverMeshCandidates() {
+	if len(i.DiscoveryPeers()) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), i.MeshInterval)
+	defer cancel()
+
+	records, err := i.FindPeers(ctx, DiscoveryQuery{Role: RoleClient})
+	if err != nil {
+		i.Logger.Debug().Err(err).Msg("failed to discover mesh candidates")
+		return
+	}
+	var ids []string
+	for _, record := range records {
+		ids = append(ids, record.Id)
+	}
+	i.AddMeshCandidates(ids...)
+}
+
+// refreshMesh dials candidates while we are below the target degree, and
+// closes the slowest peers while we are above the maximum. Nothing is done
+// while the signaling connection is down.
+func (i *Instance) refreshMesh() {
+	i.mu.Lock()
+	reconnecting := i.isReconnecting
+	i.mu.Unlock()
+	if reconnecting {
+		return
+	}
+
+	peers := i.MeshPeers()
+	now := time.Now()
+	i.measureMesh(peers)
+
+	i.mesh.mu.Lock()
+	var dialing int
+	var ready []*mesh_candidate
+	for _, c := range i.mesh.candidates {
+		if !c.dialing.IsZero() {
+			if now.Sub(c.dialing) < i.SetupTimeout {
+				dialing++
+				continue
+			}
+			// The dial never opened
+			if !i.meshCandidateFailed(c, now) {
+				continue
+			}
+		}
+		if p, connected := i.GetPeer(c.id); connected {
+			if rtt := p.SmoothedRTT(); rtt > 0 {
+				c.rtt = rtt
+			}
+			continue
+		}
+		if now.Before(c.next_attempt) {
+			continue
+		}
+		ready = append(ready, c)
+	}
+
+	// Measured peers first, fastest first
+	slices.SortFunc(ready, func(a, b *mesh_candidate) int {
+		if (a.rtt == 0) != (b.rtt == 0) {
+			if a.rtt == 0 {
+				return 1
+			}
+			return -1
+		}
+		return cmp.Compare(a.rtt, b.rtt)
+	})
+
+	deficit := i.MeshDegree - len(peers) - dialing
+	var dials []string
+	for _, c := range ready {
+		if deficit <= 0 {
+			break
+		}
+		c.dialing = now
+		dials = append(dials, c.id)
+		deficit--
+	}
+	i.mesh.mu.Unlock()
+
+	for _, id := range dials {
+		i.Logger.Debug().Str("peer_id", id).Msg("mesh dialing candidate")
+		if i.Connect(id) == nil {
+			i.meshDialFailed(id)
+		}
+	}
+
+	if excess := len(peers) - i.MeshMaxDegree; excess > 0 {
+		slices.SortFunc(peers, func(a, b *Peer) int {
+			return cmp.Compare(b.SmoothedRTT(), a.SmoothedRTT())
+		})
+		for _, p := range peers {
+			if excess == 0 {
+				break
+			}
+			if p.IsPersistent() {
+				continue
+			}
+			p.Logger.Info().Dur("rtt", p.SmoothedRTT()).Msg("mesh closing peer above maximum degree")
+			p.Close()
+			excess--
+		}
+	}
+}
+
+// measureMesh pings mesh peers whose round-trip time is not known yet. The
+// PONG is recorded like any other.
+func (i *Instance) measureMesh(peers PeerSlice) {
+	for _, p := range peers {
+		if p.Latency.Stats().Samples > 0 {
+			continue
+		}
+		p.Write(&TxPacket{
+			Packet:  Packet{Opcode: "PING", TTL: 1},
+			Payload: PingRequest{T1: time.Now().UnixMilli()},
+		})
+	}
+}
+
+func (i *Instance) meshDialFailed(id string) {
+	i.mesh.mu.Lock()
+	defer i.mesh.mu.Unlock()
+	if c, ok := i.mesh.candidates[id]; ok {
+		i.meshCandidateFailed(c, time.Now())
+	}
+}
+
+// meshCandidateFailed schedules the next dial of a candidate after a failed
+// one. Once MaxRedials dials in a row have failed, the candidate is forgotten
+// and false is returned. Must be called with i.mesh.mu held.
+func (i *Instance) meshCandidateFailed(c *mesh_candidate, now time.Time) bool {
+	c.dialing = time.Time{}
+	c.failures++
+	if i.MaxRedials > 0 && c.failures >= i.MaxRedials {
+		i.Logger.Debug().Str("peer_id", c.id).Int("failures", c.failures).Msg("mesh giving up on candidate")
+		delete(i.mesh.candidates, c.id)
+		return false
+	}
+	c.next_attempt = now.Add(i.RedialPolicy.Delay(c.failures))
+	return true
+}
+
+// meshOpened marks a candidate as connected.
+func (i *Instance) meshOpened(p *Peer) {
+	i.mesh.mu.Lock()
+	defer i.mesh.mu.Unlock()
+	if c, ok := i.mesh.candidates[p.GetPeerID()]; ok {
+		c.dialing = time.Time{}
+		c.failures = 0
+	}
+}
+
+// meshClosed remembers a dropped peer's latency and has the mesh manager
+// replace it.
+func (i *Instance) meshClosed(p *Peer) {
+	i.mesh.mu.Lock()
+	if c, ok := i.mesh.candidates[p.GetPeerID()]; ok {
+		c.dialing = time.Time{}
+		if rtt := p.SmoothedRTT(); rtt > 0 {
+			c.rtt = rtt
+		}
+	}
+	running := i.mesh.running
+	i.mesh.mu.Unlock()
+	if running {
+		i.wakeMesh()
+	}
+}
+
+// resolveGlare settles two connections between the same pair of peers that
+// were dialed at the same time. Both sides keep the connection initiated by
+// the peer with the lower ID, and close the other. It returns false if conn
+// lost and was closed.
+func (i *Instance) resolveGlare(conn *Peer) bool {
+	id := conn.GetPeerID()
+
+	i.peersMu.Lock()
+	existing, ok := i.Peers[id]
+	if !ok || existing == conn {
+		i.Peers[id] = conn
+		i.peersMu.Unlock()
+		return true
+	}
+
+	keep_initiated := i.Name < id
+	loser := existing
+	if conn.IsInitiator != keep_initiated {
+		loser = conn
+	} else {
+		i.Peers[id] = conn
+	}
+	i.peersMu.Unlock()
+
+	if loser == conn {
+		loser.duplicate = true
+	} else {
+		if existing.IsPersistent() {
+			conn.setPersistent(true)
+			existing.StopRedial()
+		}
+	}
+	loser.Logger.Info().Bool("initiator", loser.IsInitiator).Msg("closing duplicate connection")
+	loser.Close()
+	return loser != conn
+}
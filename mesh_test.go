@@ -0,0 +1,210 @@
+package duplex
+
+import (
+	"testing"
+	"time"
+
+	peer "github.com/cloudlink-delta/peerjs-go"
+	"github.com/cloudlink-delta/peerjs-go/emitter"
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog"
+)
+
+// openedPeer wraps a data connection that claims to be open but has no data
+// channel, so that closing it can be observed. Nothing may be written to it.
+func openedPeer(i *Instance, initiator bool) (*Peer, chan struct{}) {
+	conn := &peer.DataConnection{BaseConnection: peer.BaseConnection{Emitter: emitter.NewEmitter(), Open: true}}
+	p := i.newPeer(conn, initiator)
+	closed := make(chan struct{})
+	p.On("close", func(any) { close(closed) })
+	return p, closed
+}
+
+func isClosed(closed chan struct{}) bool {
+	select {
+	case <-closed:
+		return true
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+func TestMeshCandidates(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	i.AddMeshCandidates("", "alpha", "beta", "gamma", "beta")
+	if len(i.mesh.candidates) != 2 {
+		t.Fatalf("%d candidates", len(i.mesh.candidates))
+	}
+	i.RemoveMeshCandidate("beta")
+	if _, ok := i.mesh.candidates["beta"]; ok {
+		t.Fatal("candidate not removed")
+	}
+
+	// Failed dials back off, and a connection resets the count
+	i.RedialPolicy = ConstantBackoff(time.Hour)
+	i.meshDialFailed("gamma")
+	i.meshDialFailed("gamma")
+	c := i.mesh.candidates["gamma"]
+	if c.failures != 2 || time.Until(c.next_attempt) < 59*time.Minute {
+		t.Fatalf("candidate %+v after two failures", c)
+	}
+	i.refreshMesh()
+	if !c.dialing.IsZero() {
+		t.Fatal("dialed a candidate that is backing off")
+	}
+}
+
+func TestMeshCandidatesBounded(t *testing.T) {
+	i := New("alpha", &Config{MaxKnownPeers: 2, LogLevel: zerolog.Disabled})
+	i.AddMeshCandidates("beta", "gamma", "delta")
+	i.AddMeshCandidates("epsilon")
+	if len(i.mesh.candidates) != 2 {
+		t.Fatalf("%d candidates past the limit of 2", len(i.mesh.candidates))
+	}
+}
+
+func TestMeshForgetsUnreachableCandidates(t *testing.T) {
+	i := New("alpha", &Config{MaxRedials: 2, LogLevel: zerolog.Disabled})
+	i.RedialPolicy = ConstantBackoff(0)
+	i.AddMeshCandidates("beta")
+
+	// Without signaling every dial fails
+	i.refreshMesh()
+	if _, ok := i.mesh.candidates["beta"]; !ok {
+		t.Fatal("candidate dropped after one failure")
+	}
+	i.refreshMesh()
+	if _, ok := i.mesh.candidates["beta"]; ok {
+		t.Fatal("candidate kept after the redial policy gave up")
+	}
+}
+
+func TestMeshRemembersLatency(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+	i.mesh.candidates[p.GetPeerID()] = &mesh_candidate{failures: 3, dialing: time.Now()}
+
+	i.meshOpened(p)
+	if c := i.mesh.candidates[""]; c.failures != 0 || !c.dialing.IsZero() {
+		t.Fatalf("candidate %+v after opening", c)
+	}
+	p.Latency.Record(40 * time.Millisecond)
+	i.meshClosed(p)
+	if c := i.mesh.candidates[""]; c.rtt != 40*time.Millisecond {
+		t.Fatalf("remembered rtt %v", c.rtt)
+	}
+}
+
+func TestMeshClosesSlowestAboveMaximum(t *testing.T) {
+	i := New("alpha", &Config{MeshDegree: 1, MeshMaxDegree: 2, LogLevel: zerolog.Disabled})
+	fast, fast_closed := openedPeer(i, true)
+	slow, slow_closed := openedPeer(i, true)
+	slowest, slowest_closed := openedPeer(i, true)
+	fast.Latency.Record(10 * time.Millisecond)
+	slow.Latency.Record(50 * time.Millisecond)
+	slowest.Latency.Record(90 * time.Millisecond)
+	slowest.setPersistent(true)
+	i.Peers["fast"], i.Peers["slow"], i.Peers["slowest"] = fast, slow, slowest
+
+	i.refreshMesh()
+	if !isClosed(slow_closed) {
+		t.Fatal("slowest non-persistent peer left open")
+	}
+	select {
+	case <-fast_closed:
+		t.Fatal("fast peer closed")
+	case <-slowest_closed:
+		t.Fatal("persistent peer closed")
+	default:
+	}
+}
+
+func TestResolveGlare(t *testing.T) {
+	// Our ID sorts after the remote's, so both sides keep the connection the
+	// remote initiated
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	ours, ours_closed := openedPeer(i, true)
+	ours.setPersistent(true)
+	theirs, _ := openedPeer(i, false)
+
+	if !i.resolveGlare(ours) {
+		t.Fatal("first connection rejected")
+	}
+	if !i.resolveGlare(theirs) {
+		t.Fatal("kept the connection we initiated")
+	}
+	if !isClosed(ours_closed) || i.Peers[""] != theirs {
+		t.Fatal("losing connection not replaced")
+	}
+	if !theirs.IsPersistent() || ours.IsPersistent() {
+		t.Fatal("persistence not handed to the surviving connection")
+	}
+
+	late, late_closed := openedPeer(i, true)
+	if i.resolveGlare(late) || !late.duplicate || !isClosed(late_closed) {
+		t.Fatal("late duplicate kept")
+	}
+}
+
+func TestConnectWithoutSignaling(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	if p := i.Connect("beta"); p != nil {
+		t.Fatal("connected without a signaling connection")
+	}
+}
+
+func TestMeshWaitsOutReconnects(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	i.AddMeshCandidates("beta")
+	candidate := i.mesh.candidates["beta"]
+
+	i.mu.Lock()
+	i.isReconnecting = true
+	i.mu.Unlock()
+	i.refreshMesh()
+	if candidate.failures != 0 || !candidate.dialing.IsZero() {
+		t.Fatal("mesh dialed while reconnecting")
+	}
+
+	i.mu.Lock()
+	i.isReconnecting = false
+	i.mu.Unlock()
+	i.refreshMesh()
+	if candidate.failures != 1 {
+		t.Fatalf("failures %d after a dial without signaling", candidate.failures)
+	}
+}
+
+func TestMeshMeasuresPeers(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	i.AddMeshCandidates("beta")
+	pings := make(chan PingRequest, 4)
+	p := i.replayPeer("beta", func(_ *Peer, raw []byte) {
+		var packet RxPacket
+		json.Unmarshal(raw, &packet)
+		if packet.Opcode == "PING" {
+			var ping PingRequest
+			json.Unmarshal(packet.Payload, &ping)
+			pings <- ping
+		}
+	})
+	defer p.Close()
+
+	i.refreshMesh()
+	var ping PingRequest
+	select {
+	case ping = <-pings:
+	case <-time.After(time.Second):
+		t.Fatal("unmeasured mesh peer not pinged")
+	}
+
+	payload, _ := json.Marshal(PongReply{T1: ping.T1 - 20, T2: ping.T1, T3: ping.T1})
+	p.HandlePacket(&RxPacket{Packet: Packet{Opcode: "PONG", TTL: 1}, Payload: payload})
+	i.refreshMesh()
+	if len(pings) > 0 {
+		t.Fatal("measured mesh peer pinged again")
+	}
+	if rtt := i.mesh.candidates["beta"].rtt; rtt < 20*time.Millisecond {
+		t.Fatalf("candidate rtt %v", rtt)
+	}
+}
@@ -0,0 +1,426 @@
+package duplex
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/goccy/go-json"
+)
+
+var (
+	ErrNameTaken      = errors.New("name is already taken")
+	ErrInvalidName    = errors.New("invalid name")
+	ErrNoNameService  = errors.New("no name service peer connected")
+	ErrNameNotFound   = errors.New("name not found")
+	ErrNotNameService = errors.New("not a name service")
+)
+
+// Longest username that can be claimed.
+const MaxNameLength = 32
+
+// How long a name service waits for the others to confirm a name is free.
+const name_check_timeout = 2 * time.Second
+
+type NameArgs struct {
+	Name string `json:"name"`
+}
+
+type NameReply struct {
+	Name  string `json:"name"`
+	Id    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type name_registry struct {
+	mu     sync.RWMutex
+	owners map[string]*Peer // Folded name to the peer that claimed it
+	names  map[*Peer]string // Peer to the name it claimed, as written
+}
+
+// ValidName returns true if a username may be claimed. Names are 1 to
+// MaxNameLength letters, digits, '_', '-' or '.', and are compared
+// case-insensitively.
+func ValidName(name string) bool {
+	if name == "" || len(name) > MaxNameLength {
+		return false
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '-' && r != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func fold_name(name string) string {
+	return strings.ToLower(name)
+}
+
+// nameError turns a name service error reply back into its sentinel error.
+func nameError(opcode, message string) error {
+	for _, err := range []error{ErrNameTaken, ErrInvalidName, ErrNameNotFound, ErrNotNameService} {
+		if message == err.Error() {
+			return err
+		}
+	}
+	return &RemoteError{Opcode: opcode, Message: message}
+}
+
+// claimName records a name claimed by a peer, replacing any name it held before.
+func (i *Instance) claimName(p *Peer, name string) error {
+	if !ValidName(name) {
+		return ErrInvalidName
+	}
+	folded := fold_name(name)
+
+	i.names.mu.Lock()
+	defer i.names.mu.Unlock()
+	if owner, ok := i.names.owners[folded]; ok && owner != p {
+		return ErrNameTaken
+	}
+	if previous, ok := i.names.names[p]; ok {
+		delete(i.names.owners, fold_name(previous))
+	}
+	i.names.owners[folded] = p
+	i.names.names[p] = name
+	return nil
+}
+
+// releaseName frees the name claimed by a peer, if any.
+func (i *Instance) releaseName(p *Peer) {
+	i.names.mu.Lock()
+	defer i.names.mu.Unlock()
+	if name, ok := i.names.names[p]; ok {
+		delete(i.names.owners, fold_name(name))
+		delete(i.names.names, p)
+	}
+}
+
+// NameOf returns the name a connected peer claimed with this instance.
+func (i *Instance) NameOf(p *Peer) (string, bool) {
+	i.names.mu.RLock()
+	defer i.names.mu.RUnlock()
+	name, ok := i.names.names[p]
+	return name, ok
+}
+
+// PeerByName returns the connected peer that claimed a name with this instance.
+func (i *Instance) PeerByName(name string) (*Peer, bool) {
+	i.names.mu.RLock()
+	defer i.names.mu.RUnlock()
+	p, ok := i.names.owners[fold_name(name)]
+	return p, ok
+}
+
+// Username returns the name this instance claims with name service peers.
+func (i *Instance) Username() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.username
+}
+
+// NameServicePeers returns the connected peers that hold a name registry for
+// the mesh, which are discovery peers and relays.
+func (i *Instance) NameServicePeers() PeerSlice {
+	var peers PeerSlice
+	for _, p := range i.ConnectedPeers() {
+		if p.IsDiscovery || p.IsRelay {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+// ClaimName claims a username with every connected name service peer. Name
+// service peers that connect later are claimed with after negotiation. If any
+// peer rejects the name, the peers that accepted it go back to our previous
+// name, or release it if we had none, and the error is returned.
+func (i *Instance) ClaimName(ctx context.Context, name string) error {
+	if !ValidName(name) {
+		return ErrInvalidName
+	}
+	peers := i.NameServicePeers()
+	if len(peers) == 0 {
+		return ErrNoNameService
+	}
+
+	type outcome struct {
+		peer *Peer
+		err  error
+	}
+	outcomes := make(chan outcome, len(peers))
+	for _, p := range peers {
+		go func() {
+			outcomes <- outcome{p, p.ClaimName(ctx, name)}
+		}()
+	}
+
+	var claimed PeerSlice
+	var claim_err error
+	for range peers {
+		o := <-outcomes
+		if o.err == nil {
+			claimed = append(claimed, o.peer)
+		} else if claim_err == nil {
+			claim_err = o.err
+		}
+	}
+	if claim_err != nil {
+		i.restoreName(claimed)
+		return claim_err
+	}
+
+	i.mu.Lock()
+	i.username = name
+	i.mu.Unlock()
+	return nil
+}
+
+// restoreName undoes a failed claim on the peers that accepted it.
+func (i *Instance) restoreName(peers PeerSlice) {
+	previous := i.Username()
+	if previous == "" {
+		for _, p := range peers {
+			p.ReleaseName()
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), i.SetupTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, p := range peers {
+		wg.Go(func() {
+			if err := p.ClaimName(ctx, previous); err != nil {
+				p.Logger.Warn().Err(err).Str("name", previous).Msg("failed to restore name")
+			}
+		})
+	}
+	wg.Wait()
+}
+
+// ReleaseName gives up our username on every connected name service peer.
+func (i *Instance) ReleaseName() {
+	i.mu.Lock()
+	i.username = ""
+	i.mu.Unlock()
+
+	for _, p := range i.NameServicePeers() {
+		p.ReleaseName()
+	}
+}
+
+// ResolveName returns the peer ID that owns a username. Names claimed with
+// this instance are answered locally, otherwise every connected name service
+// peer is asked.
+func (i *Instance) ResolveName(ctx context.Context, name string) (string, error) {
+	if p, ok := i.PeerByName(name); ok {
+		return p.GetPeerID(), nil
+	}
+
+	peers := i.NameServicePeers()
+	if len(peers) == 0 {
+		return "", ErrNoNameService
+	}
+
+	type outcome struct {
+		id  string
+		err error
+	}
+	outcomes := make(chan outcome, len(peers))
+	for _, p := range peers {
+		go func() {
+			id, err := p.ResolveName(ctx, name)
+			outcomes <- outcome{id, err}
+		}()
+	}
+
+	last_err := ErrNameNotFound
+	for range peers {
+		o := <-outcomes
+		if o.err == nil {
+			return o.id, nil
+		}
+		if !errors.Is(o.err, ErrNameNotFound) {
+			last_err = o.err
+		}
+	}
+	return "", last_err
+}
+
+// claimTo claims our username, if any, with a newly negotiated name service peer.
+func (i *Instance) claimTo(p *Peer) {
+	name := i.Username()
+	if name == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), i.SetupTimeout)
+	defer cancel()
+	if err := p.ClaimName(ctx, name); err != nil {
+		p.Logger.Warn().Err(err).Str("name", name).Msg("failed to claim name")
+	}
+}
+
+// ClaimName claims a username with this peer.
+func (c *Peer) ClaimName(ctx context.Context, name string) error {
+	reply, err := c.Request(ctx, &TxPacket{
+		Packet:  Packet{Opcode: "NAME_CLAIM", TTL: 1},
+		Payload: NameArgs{Name: name},
+	})
+	if err != nil {
+		return err
+	}
+
+	var result NameReply
+	if err := json.Unmarshal(reply.Payload, &result); err != nil {
+		return err
+	}
+	if result.Error != "" {
+		return nameError("NAME_CLAIM", result.Error)
+	}
+	return nil
+}
+
+// ReleaseName gives up the username claimed with this peer.
+func (c *Peer) ReleaseName() {
+	c.Write(&TxPacket{
+		Packet: Packet{Opcode: "NAME_RELEASE", TTL: 1},
+	})
+}
+
+// ResolveName asks this peer which peer ID owns a username.
+func (c *Peer) ResolveName(ctx context.Context, name string) (string, error) {
+	reply, err := c.Request(ctx, &TxPacket{
+		Packet:  Packet{Opcode: "NAME_RESOLVE", TTL: 1},
+		Payload: NameArgs{Name: name},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var result NameReply
+	if err := json.Unmarshal(reply.Payload, &result); err != nil {
+		return "", err
+	}
+	if result.Error != "" {
+		return "", nameError("NAME_RESOLVE", result.Error)
+	}
+	return result.Id, nil
+}
+
+// nameHeldElsewhere returns true if one of the given name service peers has
+// given the name to a peer other than the claimant, which keeps names unique
+// across the mesh rather than per name service. Peers that do not answer
+// within name_check_timeout are assumed not to hold it.
+func (i *Instance) nameHeldElsewhere(claimant *Peer, peers PeerSlice, name string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), min(name_check_timeout, i.SetupTimeout))
+	defer cancel()
+	held := make(chan bool, len(peers))
+	for _, p := range peers {
+		go func() {
+			id, err := p.ResolveName(ctx, name)
+			held <- err == nil && id != claimant.GetPeerID()
+		}()
+	}
+	for range peers {
+		if <-held {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleNameClaim grants a name if no other peer holds it, either here or on
+// the other name service peers we are connected to. Only discovery and relay
+// instances keep a name registry.
+func (conn *Peer) HandleNameClaim(r *RxPacket) {
+	reply := &TxPacket{
+		Packet: Packet{Opcode: "NAME_CLAIMED", TTL: 1, Listener: r.Listener},
+	}
+
+	i := conn.Parent
+	if !i.IsDiscovery && !i.IsRelay {
+		reply.Payload = NameReply{Error: ErrNotNameService.Error()}
+		conn.Write(reply)
+		return
+	}
+
+	var args NameArgs
+	if err := json.Unmarshal(r.Payload, &args); err != nil {
+		conn.Logger.Error().Err(err).Msg("failed to unmarshal name claim")
+		reply.Payload = NameReply{Error: ErrInvalidName.Error()}
+		conn.Write(reply)
+		return
+	}
+
+	peers := i.NameServicePeers().Exclude(conn)
+	if !ValidName(args.Name) || len(peers) == 0 {
+		conn.grantName(reply, args.Name, false)
+		return
+	}
+
+	// Asking the other name services takes a round trip, so answer from a
+	// goroutine rather than holding up the packets queued behind this one
+	conn.inflight.add()
+	i.inflight.add()
+	go func() {
+		defer i.inflight.done()
+		defer conn.inflight.done()
+		conn.grantName(reply, args.Name, i.nameHeldElsewhere(conn, peers, args.Name))
+	}()
+}
+
+// grantName registers a claimed name, unless it is invalid or held elsewhere,
+// and sends the reply.
+func (conn *Peer) grantName(reply *TxPacket, name string, held bool) {
+	err := ErrNameTaken
+	switch {
+	case !ValidName(name):
+		err = ErrInvalidName
+	case !held:
+		err = conn.Parent.claimName(conn, name)
+	}
+	if err != nil {
+		conn.Logger.Debug().Err(err).Str("name", name).Msg("rejected name claim")
+		reply.Payload = NameReply{Name: name, Error: err.Error()}
+		conn.Write(reply)
+		return
+	}
+
+	conn.Logger.Info().Str("name", name).Msg("peer claimed name")
+	reply.Payload = NameReply{Name: name, Id: conn.GetPeerID()}
+	conn.Write(reply)
+}
+
+func (conn *Peer) HandleNameRelease(r *RxPacket) {
+	conn.Parent.releaseName(conn)
+}
+
+func (conn *Peer) HandleNameResolve(r *RxPacket) {
+	reply := &TxPacket{
+		Packet: Packet{Opcode: "NAME_RESOLVED", TTL: 1, Listener: r.Listener},
+	}
+
+	var args NameArgs
+	if err := json.Unmarshal(r.Payload, &args); err != nil {
+		conn.Logger.Error().Err(err).Msg("failed to unmarshal name query")
+		reply.Payload = NameReply{Error: ErrInvalidName.Error()}
+		conn.Write(reply)
+		return
+	}
+
+	owner, ok := conn.Parent.PeerByName(args.Name)
+	if !ok {
+		reply.Payload = NameReply{Name: args.Name, Error: ErrNameNotFound.Error()}
+		conn.Write(reply)
+		return
+	}
+
+	name, _ := conn.Parent.NameOf(owner)
+	reply.Payload = NameReply{Name: name, Id: owner.GetPeerID()}
+	conn.Write(reply)
+}
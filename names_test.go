@@ -0,0 +1,243 @@
+package duplex
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog"
+)
+
+func TestValidName(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"alice":                 true,
+		"Zoë_2.0-beta":          true,
+		"":                      false,
+		"two words":             false,
+		"semi;colon":            false,
+		strings.Repeat("x", 32): true,
+		strings.Repeat("x", 33): false,
+	} {
+		if ValidName(name) != valid {
+			t.Errorf("ValidName(%q) = %v", name, !valid)
+		}
+	}
+}
+
+func TestNameRegistry(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	a, b := unopenedPeer(i), unopenedPeer(i)
+
+	if err := i.claimName(a, "Alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.claimName(b, "alice"); !errors.Is(err, ErrNameTaken) {
+		t.Fatalf("claimed a taken name with different case: %v", err)
+	}
+	if err := i.claimName(a, "alice"); err != nil {
+		t.Fatalf("reclaiming our own name: %v", err)
+	}
+	if name, _ := i.NameOf(a); name != "alice" || a.GiveName() != "alice" {
+		t.Fatalf("name %q, GiveName %q", name, a.GiveName())
+	}
+
+	// Claiming a new name frees the old one
+	i.claimName(a, "alison")
+	if err := i.claimName(b, "ALICE"); err != nil {
+		t.Fatalf("old name not freed: %v", err)
+	}
+	if p, ok := i.PeerByName("Alison"); !ok || p != a {
+		t.Fatal("lookup is case sensitive")
+	}
+
+	i.releaseName(a)
+	if _, ok := i.PeerByName("alison"); ok {
+		t.Fatal("name kept after release")
+	}
+	if _, ok := i.NameOf(a); ok {
+		t.Fatal("peer still has a name after release")
+	}
+}
+
+func TestNamePackets(t *testing.T) {
+	i := New("alpha", &Config{IsRelay: true, LogLevel: zerolog.Disabled})
+	a, b := unopenedPeer(i), unopenedPeer(i)
+	claim := func(p *Peer, name string) {
+		payload, _ := json.Marshal(NameArgs{Name: name})
+		p.HandlePacket(&RxPacket{Packet: Packet{Opcode: "NAME_CLAIM", TTL: 1}, Payload: payload})
+	}
+
+	claim(a, "bob")
+	claim(b, "Bob")
+	claim(b, "not valid")
+	if p, _ := i.PeerByName("bob"); p != a {
+		t.Fatal("claim not registered for the first claimant")
+	}
+	if _, ok := i.NameOf(b); ok {
+		t.Fatal("rejected claims registered")
+	}
+
+	// Names are routable like peer IDs
+	i.Peers["gamma"] = b
+	if target, ok := i.resolveTarget("BOB"); !ok || target != a {
+		t.Fatal("name does not resolve to its owner")
+	}
+	if err := i.SendTo("bob", &TxPacket{Packet: Packet{Opcode: "DATA"}}); err != nil {
+		t.Fatalf("SendTo a claimed name returned %v", err)
+	}
+
+	a.HandlePacket(&RxPacket{Packet: Packet{Opcode: "NAME_RELEASE", TTL: 1}})
+	if _, ok := i.PeerByName("bob"); ok {
+		t.Fatal("NAME_RELEASE ignored")
+	}
+}
+
+func TestNameServiceRequired(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	if err := i.ClaimName(context.Background(), "x y"); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("claimed an invalid name: %v", err)
+	}
+	if err := i.ClaimName(context.Background(), "carol"); !errors.Is(err, ErrNoNameService) {
+		t.Fatalf("ClaimName without a name service returned %v", err)
+	}
+	if i.Username() != "" {
+		t.Fatal("username set after a failed claim")
+	}
+
+	// Names claimed with us are answered without asking anyone
+	p := unopenedPeer(i)
+	i.claimName(p, "dave")
+	if _, err := i.ResolveName(context.Background(), "dave"); err != nil {
+		t.Fatalf("local name not resolved: %v", err)
+	}
+	if _, err := i.ResolveName(context.Background(), "erin"); !errors.Is(err, ErrNoNameService) {
+		t.Fatalf("ResolveName without a name service returned %v", err)
+	}
+}
+
+func TestNameErrorsRoundTrip(t *testing.T) {
+	for _, err := range []error{ErrNameTaken, ErrInvalidName, ErrNameNotFound, ErrNotNameService} {
+		if got := nameError("NAME_CLAIM", err.Error()); got != err {
+			t.Errorf("%v came back as %v", err, got)
+		}
+	}
+	var remote *RemoteError
+	if err := nameError("NAME_CLAIM", "boom"); !errors.As(err, &remote) {
+		t.Fatalf("unknown error %v", err)
+	}
+}
+
+// nameService connects a fake name service peer that answers requests with
+// reply and reports every packet it receives on the returned channel.
+func nameService(t *testing.T, i *Instance, id string, reply func(opcode, name string) NameReply) (*Peer, chan string) {
+	got := make(chan string, 16)
+	var p *Peer
+	p = i.replayPeer(id, func(_ *Peer, raw []byte) {
+		var packet RxPacket
+		json.Unmarshal(raw, &packet)
+		var args NameArgs
+		json.Unmarshal(packet.Payload, &args)
+		got <- packet.Opcode + " " + args.Name
+		if packet.Listener == "" {
+			return
+		}
+		payload, _ := json.Marshal(reply(packet.Opcode, args.Name))
+		opcode := map[string]string{"NAME_CLAIM": "NAME_CLAIMED", "NAME_RESOLVE": "NAME_RESOLVED"}[packet.Opcode]
+		go p.HandlePacket(&RxPacket{Packet: Packet{Opcode: opcode, Listener: packet.Listener, TTL: 1}, Payload: payload})
+	})
+	p.IsRelay = true
+	t.Cleanup(func() { p.Close() })
+	return p, got
+}
+
+func TestNameClaimsNeedRegistry(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+	payload, _ := json.Marshal(NameArgs{Name: "bob"})
+	p.HandlePacket(&RxPacket{Packet: Packet{Opcode: "NAME_CLAIM", TTL: 1}, Payload: payload})
+	if _, ok := i.PeerByName("bob"); ok {
+		t.Fatal("plain client registered a name")
+	}
+}
+
+func TestNamesUniqueAcrossServices(t *testing.T) {
+	i := New("alpha", &Config{IsRelay: true, LogLevel: zerolog.Disabled})
+	nameService(t, i, "disco", func(_, name string) NameReply {
+		if name == "bob" {
+			return NameReply{Name: name, Id: "zed"}
+		}
+		return NameReply{Name: name, Error: ErrNameNotFound.Error()}
+	})
+
+	claimant := unopenedPeer(i)
+	for _, name := range []string{"bob", "carol"} {
+		payload, _ := json.Marshal(NameArgs{Name: name})
+		claimant.HandlePacket(&RxPacket{Packet: Packet{Opcode: "NAME_CLAIM", TTL: 1}, Payload: payload})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := claimant.inflight.wait(ctx); err != nil {
+		t.Fatal("claims still pending")
+	}
+	if _, ok := i.PeerByName("bob"); ok {
+		t.Fatal("granted a name held on another name service")
+	}
+	if p, _ := i.PeerByName("carol"); p != claimant {
+		t.Fatal("free name not granted")
+	}
+}
+
+func TestNameClaimDoesNotWaitOnSilentService(t *testing.T) {
+	i := New("alpha", &Config{IsRelay: true, LogLevel: zerolog.Disabled})
+	silent := i.replayPeer("silent", nil)
+	silent.IsRelay = true
+	t.Cleanup(func() { silent.Close() })
+
+	claimant := unopenedPeer(i)
+	payload, _ := json.Marshal(NameArgs{Name: "bob"})
+	claim := &RxPacket{Packet: Packet{Opcode: "NAME_CLAIM", TTL: 1}, Payload: payload}
+	if !returnsWithin(func() { claimant.HandlePacket(claim) }, 100*time.Millisecond) {
+		t.Fatal("handler waited on the other name service")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), name_check_timeout+time.Second)
+	defer cancel()
+	if err := claimant.inflight.wait(ctx); err != nil {
+		t.Fatal("claim still waiting past the deadline")
+	}
+	if p, _ := i.PeerByName("bob"); p != claimant {
+		t.Fatal("name not granted once the other name service timed out")
+	}
+}
+
+func TestFailedClaimRestoresPreviousName(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	_, accepted := nameService(t, i, "relay-1", func(_, name string) NameReply { return NameReply{Name: name} })
+	nameService(t, i, "relay-2", func(_, name string) NameReply {
+		if name == "taken" {
+			return NameReply{Name: name, Error: ErrNameTaken.Error()}
+		}
+		return NameReply{Name: name}
+	})
+
+	ctx := context.Background()
+	if err := i.ClaimName(ctx, "first"); err != nil {
+		t.Fatal(err)
+	}
+	<-accepted
+	if err := i.ClaimName(ctx, "taken"); !errors.Is(err, ErrNameTaken) {
+		t.Fatalf("claim returned %v", err)
+	}
+	if i.Username() != "first" {
+		t.Fatalf("username %q after a failed claim", i.Username())
+	}
+	if got := <-accepted; got != "NAME_CLAIM taken" {
+		t.Fatalf("sent %q", got)
+	}
+	if got := <-accepted; got != "NAME_CLAIM first" {
+		t.Fatalf("previous name not restored, sent %q", got)
+	}
+}
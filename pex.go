@@ -0,0 +1,272 @@
+package duplex
+
+import (
+	"cmp"
+	"context"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+type PexArgs struct {
+	Peers []DiscoveryRecord `json:"peers"`
+	Error string            `json:"error,omitempty"` // Set in replies from peers that refused the exchange
+}
+
+// known_peers is the table of peers learned through peer exchange.
+type known_peers struct {
+	mu      sync.Mutex
+	records map[string]*DiscoveryRecord
+	running bool
+	stop    chan struct{}
+}
+
+// KnownPeers returns the peers learned through peer exchange, most recently
+// seen first.
+func (i *Instance) KnownPeers() []DiscoveryRecord {
+	i.known.mu.Lock()
+	defer i.known.mu.Unlock()
+	records := make([]DiscoveryRecord, 0, len(i.known.records))
+	for _, record := range i.known.records {
+		records = append(records, *record)
+	}
+	slices.SortFunc(records, func(a, b DiscoveryRecord) int {
+		return cmp.Compare(b.LastSeen, a.LastSeen)
+	})
+	return records
+}
+
+// StartPEX starts periodically exchanging known peers with a random connected peer.
+func (i *Instance) StartPEX() {
+	i.known.mu.Lock()
+	defer i.known.mu.Unlock()
+	if i.known.running {
+		return
+	}
+	i.known.running = true
+	i.known.stop = make(chan struct{})
+	go i.gossip(i.known.stop)
+}
+
+// StopPEX stops peer exchange. The known peers table is kept.
+func (i *Instance) StopPEX() {
+	i.known.mu.Lock()
+	defer i.known.mu.Unlock()
+	if !i.known.running {
+		return
+	}
+	i.known.running = false
+	close(i.known.stop)
+}
+
+func (i *Instance) gossip(stop chan struct{}) {
+	ticker := time.NewTicker(i.PEXInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		i.agePeers()
+		peers := i.ConnectedPeers()
+		if len(peers) == 0 {
+			continue
+		}
+		p := peers[rand.IntN(len(peers))]
+
+		ctx, cancel := context.WithTimeout(context.Background(), i.PEXInterval)
+		if err := p.ExchangePeers(ctx); err != nil {
+			p.Logger.Debug().Err(err).Msg("peer exchange failed")
+		}
+		cancel()
+	}
+}
+
+// ExchangePeers sends this peer a sample of our known peers, and merges the
+// sample it replies with.
+func (c *Peer) ExchangePeers(ctx context.Context) error {
+	reply, err := c.Request(ctx, &TxPacket{
+		Packet:  Packet{Opcode: "PEX", TTL: 1},
+		Payload: PexArgs{Peers: c.Parent.samplePeers(c)},
+	})
+	if err != nil {
+		return err
+	}
+
+	var args PexArgs
+	if err := json.Unmarshal(reply.Payload, &args); err != nil {
+		return err
+	}
+	if args.Error != "" {
+		return &RemoteError{Opcode: "PEX", Message: args.Error}
+	}
+	c.Parent.mergePeers(args.Peers)
+	return nil
+}
+
+// recordOf describes a directly connected peer as a peer exchange entry.
+func recordOf(p *Peer, now int64) DiscoveryRecord {
+	record := DiscoveryRecord{
+		Id:          p.GetPeerID(),
+		Name:        p.GetPeerID(),
+		Features:    p.Features,
+		IsBridge:    p.IsBridge,
+		IsRelay:     p.IsRelay,
+		IsDiscovery: p.IsDiscovery,
+		LastSeen:    now,
+	}
+	if name, ok := p.Parent.NameOf(p); ok {
+		record.Name = name
+	}
+	return record
+}
+
+// samplePeers picks up to PEXSampleSize entries to send to a peer. Peers we
+// are connected to are always fresh, so they are included as seen now.
+func (i *Instance) samplePeers(to *Peer) []DiscoveryRecord {
+	now := time.Now().UnixMilli()
+	exclude := func(id string) bool {
+		return id == to.GetPeerID() || id == i.Name
+	}
+
+	var pool []DiscoveryRecord
+	for _, p := range i.ConnectedPeers(to) {
+		pool = append(pool, recordOf(p, now))
+	}
+	i.known.mu.Lock()
+	for id, record := range i.known.records {
+		if exclude(id) || slices.ContainsFunc(pool, func(r DiscoveryRecord) bool { return r.Id == id }) {
+			continue
+		}
+		pool = append(pool, *record)
+	}
+	i.known.mu.Unlock()
+
+	rand.Shuffle(len(pool), func(a, b int) {
+		pool[a], pool[b] = pool[b], pool[a]
+	})
+	if len(pool) > i.PEXSampleSize {
+		pool = pool[:i.PEXSampleSize]
+	}
+	return pool
+}
+
+// mergePeers adds a received sample to the known peers table, keeping the
+// freshest entry for each peer. Samples larger than PEXSampleSize are cut
+// short, and only clients that made it into the table become mesh candidates.
+func (i *Instance) mergePeers(records []DiscoveryRecord) {
+	if len(records) > i.PEXSampleSize {
+		i.Logger.Debug().Int("size", len(records)).Int("limit", i.PEXSampleSize).Msg("truncated oversized peer exchange sample")
+		records = records[:i.PEXSampleSize]
+	}
+
+	now := time.Now()
+	oldest := now.Add(-i.PEXMaxAge).UnixMilli()
+
+	var merged []*DiscoveryRecord
+	i.known.mu.Lock()
+	for _, record := range records {
+		if record.Id == "" || record.Id == i.Name || record.LastSeen < oldest {
+			continue
+		}
+
+		// Do not trust timestamps from the future
+		record.LastSeen = min(record.LastSeen, now.UnixMilli())
+		if existing, ok := i.known.records[record.Id]; ok && existing.LastSeen >= record.LastSeen {
+			continue
+		}
+		i.known.records[record.Id] = &record
+		if record.Roles()[0] == RoleClient {
+			merged = append(merged, &record)
+		}
+	}
+	i.evictPeers()
+
+	// Records older than everything else in a full table are evicted straight away
+	var candidates []string
+	for _, record := range merged {
+		if i.known.records[record.Id] == record {
+			candidates = append(candidates, record.Id)
+		}
+	}
+	i.known.mu.Unlock()
+
+	if i.EnableMesh && len(candidates) > 0 {
+		i.AddMeshCandidates(candidates...)
+	}
+}
+
+// rememberPeer records a peer we were directly connected to as seen now.
+func (i *Instance) rememberPeer(p *Peer) {
+	record := recordOf(p, time.Now().UnixMilli())
+	i.known.mu.Lock()
+	defer i.known.mu.Unlock()
+	i.known.records[record.Id] = &record
+	i.evictPeers()
+}
+
+// agePeers forgets peers that nobody has reported seeing for PEXMaxAge.
+func (i *Instance) agePeers() {
+	oldest := time.Now().Add(-i.PEXMaxAge).UnixMilli()
+	i.known.mu.Lock()
+	defer i.known.mu.Unlock()
+	for id, record := range i.known.records {
+		if record.LastSeen < oldest {
+			delete(i.known.records, id)
+		}
+	}
+}
+
+// evictPeers drops the least recently seen peers above MaxKnownPeers. The
+// caller must hold the known peers lock.
+func (i *Instance) evictPeers() {
+	excess := len(i.known.records) - i.MaxKnownPeers
+	if excess <= 0 {
+		return
+	}
+	records := make([]*DiscoveryRecord, 0, len(i.known.records))
+	for _, record := range i.known.records {
+		records = append(records, record)
+	}
+	slices.SortFunc(records, func(a, b *DiscoveryRecord) int {
+		return cmp.Compare(a.LastSeen, b.LastSeen)
+	})
+	for _, record := range records[:excess] {
+		delete(i.known.records, record.Id)
+	}
+}
+
+func (conn *Peer) HandlePex(r *RxPacket) {
+	reply := &TxPacket{
+		Packet: Packet{Opcode: "PEX_REPLY", TTL: 1, Listener: r.Listener},
+	}
+
+	i := conn.Parent
+	if !i.EnablePEX {
+		conn.Logger.Debug().Msg("refused peer exchange: not enabled")
+		reply.Payload = PexArgs{Peers: []DiscoveryRecord{}, Error: "peer exchange not enabled"}
+		conn.Write(reply)
+		return
+	}
+
+	var args PexArgs
+	if err := json.Unmarshal(r.Payload, &args); err != nil {
+		conn.Logger.Error().Err(err).Msg("failed to unmarshal peer exchange")
+		reply.Payload = PexArgs{Peers: []DiscoveryRecord{}, Error: "malformed peer exchange"}
+		conn.Write(reply)
+		return
+	}
+
+	// Sample before merging, so that the sender does not get its own entries back
+	sample := i.samplePeers(conn)
+	i.mergePeers(args.Peers)
+
+	reply.Payload = PexArgs{Peers: sample}
+	conn.Write(reply)
+}
@@ -0,0 +1,218 @@
+package duplex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog"
+)
+
+func TestMergePeersKeepsFreshest(t *testing.T) {
+	i := New("alpha", &Config{PEXMaxAge: 60000, LogLevel: zerolog.Disabled})
+	now := time.Now().UnixMilli()
+
+	i.mergePeers([]DiscoveryRecord{
+		{Id: "beta", Name: "old", LastSeen: now - 1000},
+		{Id: "alpha", LastSeen: now},
+		{Id: "", LastSeen: now},
+		{Id: "stale", LastSeen: now - 120000},
+		{Id: "future", LastSeen: now + 3600000},
+	})
+	i.mergePeers([]DiscoveryRecord{
+		{Id: "beta", Name: "new", LastSeen: now},
+		{Id: "future", Name: "replaced", LastSeen: now + 7200000},
+	})
+	i.mergePeers([]DiscoveryRecord{{Id: "beta", Name: "older", LastSeen: now - 5000}})
+
+	known := map[string]DiscoveryRecord{}
+	for _, record := range i.KnownPeers() {
+		known[record.Id] = record
+	}
+	if len(known) != 2 {
+		t.Fatalf("known peers %v", known)
+	}
+	if known["beta"].Name != "new" {
+		t.Fatalf("kept %q instead of the freshest entry", known["beta"].Name)
+	}
+	if seen := known["future"].LastSeen; seen > time.Now().UnixMilli() {
+		t.Fatal("trusted a timestamp from the future")
+	}
+}
+
+func TestKnownPeersBounded(t *testing.T) {
+	i := New("alpha", &Config{MaxKnownPeers: 3, PEXMaxAge: 60000, LogLevel: zerolog.Disabled})
+	now := time.Now().UnixMilli()
+
+	var records []DiscoveryRecord
+	for n := range 5 {
+		records = append(records, DiscoveryRecord{Id: fmt.Sprint("peer", n), LastSeen: now - int64(1000*n)})
+	}
+	i.mergePeers(records)
+	known := i.KnownPeers()
+	if len(known) != 3 || known[0].Id != "peer0" || known[2].Id != "peer2" {
+		t.Fatalf("known peers %v", known)
+	}
+
+	// Entries age out once nobody has seen them for PEXMaxAge
+	i.PEXMaxAge = 1500 * time.Millisecond
+	i.agePeers()
+	if known := i.KnownPeers(); len(known) != 2 {
+		t.Fatalf("%d peers left after aging", len(known))
+	}
+}
+
+func TestMergePeersCapsSample(t *testing.T) {
+	i := New("alpha", &Config{PEXSampleSize: 4, EnableMesh: true, LogLevel: zerolog.Disabled})
+	now := time.Now().UnixMilli()
+
+	var records []DiscoveryRecord
+	for n := range 10 {
+		records = append(records, DiscoveryRecord{Id: fmt.Sprint("peer", n), LastSeen: now})
+	}
+	i.mergePeers(records)
+	if known := i.KnownPeers(); len(known) != 4 {
+		t.Fatalf("%d peers merged from a sample limited to 4", len(known))
+	}
+	if len(i.mesh.candidates) != 4 {
+		t.Fatalf("%d mesh candidates", len(i.mesh.candidates))
+	}
+}
+
+func TestEvictedPeersNotMeshCandidates(t *testing.T) {
+	i := New("alpha", &Config{MaxKnownPeers: 2, EnableMesh: true, LogLevel: zerolog.Disabled})
+	now := time.Now().UnixMilli()
+
+	i.mergePeers([]DiscoveryRecord{{Id: "beta", LastSeen: now}, {Id: "gamma", LastSeen: now}})
+	i.RemoveMeshCandidate("beta")
+	i.RemoveMeshCandidate("gamma")
+
+	// Older than everything in the full table, so evicted as soon as it is merged
+	i.mergePeers([]DiscoveryRecord{{Id: "delta", LastSeen: now - 1000}})
+	if _, ok := i.mesh.candidates["delta"]; ok {
+		t.Fatal("evicted peer became a mesh candidate")
+	}
+}
+
+func TestSamplePeers(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	to, other := unopenedPeer(i), unopenedPeer(i)
+	i.Peers["to"], i.Peers["other"] = to, other
+	other.Features = []string{"chat"}
+
+	now := time.Now().UnixMilli()
+	var records []DiscoveryRecord
+	for n := range 10 {
+		records = append(records, DiscoveryRecord{Id: fmt.Sprint("peer", n), LastSeen: now})
+	}
+	i.mergePeers(records)
+
+	i.PEXSampleSize = 4
+	sample := i.samplePeers(to)
+	if len(sample) != 4 {
+		t.Fatalf("sample of %d", len(sample))
+	}
+
+	i.PEXSampleSize = 100
+	sample = i.samplePeers(to)
+	if len(sample) != 11 {
+		t.Fatalf("sample of %d from 10 known peers and one other connection", len(sample))
+	}
+	var connected int
+	for _, record := range sample {
+		if record.Id == "alpha" {
+			t.Fatal("sampled ourselves")
+		}
+		if len(record.Features) > 0 {
+			connected++
+		}
+	}
+	if connected != 1 {
+		t.Fatal("connected peer missing from the sample")
+	}
+}
+
+func TestPexFeedsMesh(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+	exchange := func() {
+		payload, _ := json.Marshal(PexArgs{Peers: []DiscoveryRecord{
+			{Id: "client", LastSeen: time.Now().UnixMilli()},
+			{Id: "relay", IsRelay: true, LastSeen: time.Now().UnixMilli()},
+		}})
+		p.HandlePacket(&RxPacket{Packet: Packet{Opcode: "PEX", TTL: 1}, Payload: payload})
+	}
+
+	exchange()
+	if len(i.KnownPeers()) != 0 {
+		t.Fatal("merged peer exchange while disabled")
+	}
+
+	i.EnablePEX, i.EnableMesh = true, true
+	exchange()
+	if len(i.KnownPeers()) != 2 {
+		t.Fatalf("known peers %v", i.KnownPeers())
+	}
+	if _, ok := i.mesh.candidates["client"]; !ok {
+		t.Fatal("client not offered to the mesh")
+	}
+	if _, ok := i.mesh.candidates["relay"]; ok {
+		t.Fatal("relay offered to the mesh")
+	}
+
+	before := time.Now().UnixMilli()
+	i.rememberPeer(p)
+	if record, ok := i.known.records[p.GetPeerID()]; !ok || record.LastSeen < before {
+		t.Fatal("connected peer not remembered as seen now")
+	}
+}
+
+// exchangePeer connects a fake peer whose PEX and PEX_REPLY packets arrive on
+// the returned channel.
+func exchangePeer(t *testing.T, i *Instance, id string) (*Peer, chan *RxPacket) {
+	got := make(chan *RxPacket, 4)
+	p := i.replayPeer(id, func(_ *Peer, raw []byte) {
+		var packet RxPacket
+		json.Unmarshal(raw, &packet)
+		if packet.Opcode == "PEX" || packet.Opcode == "PEX_REPLY" {
+			got <- &packet
+		}
+	})
+	t.Cleanup(func() { p.Close() })
+	return p, got
+}
+
+func TestPexRefusedWhenDisabled(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	p, got := exchangePeer(t, i, "beta")
+
+	p.HandlePacket(&RxPacket{Packet: Packet{Opcode: "PEX", Listener: "x", TTL: 1}, Payload: []byte(`{"peers":[]}`)})
+	reply := <-got
+	var args PexArgs
+	json.Unmarshal(reply.Payload, &args)
+	if reply.Opcode != "PEX_REPLY" || reply.Listener != "x" || args.Error == "" || len(args.Peers) != 0 {
+		t.Fatalf("reply %s", reply)
+	}
+}
+
+func TestExchangePeersReportsRefusal(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	p, got := exchangePeer(t, i, "beta")
+
+	done := make(chan error, 1)
+	go func() { done <- p.ExchangePeers(context.Background()) }()
+	request := <-got
+	payload, _ := json.Marshal(PexArgs{Peers: []DiscoveryRecord{}, Error: "peer exchange not enabled"})
+	p.HandlePacket(&RxPacket{Packet: Packet{Opcode: "PEX_REPLY", Listener: request.Listener, TTL: 1}, Payload: payload})
+
+	var remote *RemoteError
+	if err := <-done; !errors.As(err, &remote) {
+		t.Fatalf("exchange ended with %v", err)
+	}
+	if len(i.KnownPeers()) != 0 {
+		t.Fatal("refused exchange merged peers")
+	}
+}
@@ -0,0 +1,273 @@
+package duplex
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/goccy/go-json"
+)
+
+// Topics are dot-separated. In subscription patterns, "*" matches exactly one
+// segment and a trailing "#" matches any number of remaining segments,
+// including none.
+const (
+	topic_separator       = "."
+	topic_wildcard_single = "*"
+	topic_wildcard_multi  = "#"
+)
+
+// TopicHandler receives messages published to a topic this instance subscribed to locally.
+type TopicHandler func(peer *Peer, topic string, data json.RawMessage)
+
+type TopicArgs struct {
+	Topic string `json:"topic"`
+}
+
+type PublishArgs struct {
+	Topic string `json:"topic"`
+	Data  any    `json:"data,omitempty"`
+}
+
+type RxPublishArgs struct {
+	Topic string          `json:"topic"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+type subscriptions struct {
+	mu     sync.RWMutex
+	peers  map[*Peer]map[string]struct{}
+	locals map[string]TopicHandler
+}
+
+// MatchTopic returns true if the topic matches the subscription pattern.
+func MatchTopic(pattern, topic string) bool {
+	patterns := strings.Split(pattern, topic_separator)
+	topics := strings.Split(topic, topic_separator)
+	for n, segment := range patterns {
+		if segment == topic_wildcard_multi && n == len(patterns)-1 {
+			return true
+		}
+		if n >= len(topics) {
+			return false
+		}
+		if segment != topic_wildcard_single && segment != topics[n] {
+			return false
+		}
+	}
+	return len(patterns) == len(topics)
+}
+
+// ValidTopicPattern returns true if the pattern is usable for subscriptions.
+func ValidTopicPattern(pattern string) bool {
+	if pattern == "" {
+		return false
+	}
+	segments := strings.Split(pattern, topic_separator)
+	for n, segment := range segments {
+		if segment == "" {
+			return false
+		}
+		if strings.Contains(segment, topic_wildcard_multi) && (segment != topic_wildcard_multi || n != len(segments)-1) {
+			return false
+		}
+		if strings.Contains(segment, topic_wildcard_single) && segment != topic_wildcard_single {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidTopic returns true if the topic can be published to.
+func ValidTopic(topic string) bool {
+	return ValidTopicPattern(topic) &&
+		!strings.Contains(topic, topic_wildcard_single) &&
+		!strings.Contains(topic, topic_wildcard_multi)
+}
+
+// Subscribe registers a local handler for messages published to topics matching the pattern.
+func (i *Instance) Subscribe(pattern string, handler TopicHandler) {
+	if !ValidTopicPattern(pattern) {
+		i.Logger.Warn().Str("pattern", pattern).Msg("Invalid topic pattern")
+		return
+	}
+	i.topics.mu.Lock()
+	defer i.topics.mu.Unlock()
+	i.topics.locals[pattern] = handler
+}
+
+// Unsubscribe removes a local topic handler.
+func (i *Instance) Unsubscribe(pattern string) {
+	i.topics.mu.Lock()
+	defer i.topics.mu.Unlock()
+	delete(i.topics.locals, pattern)
+}
+
+// Subscribers returns all peers subscribed to patterns matching the topic.
+func (i *Instance) Subscribers(topic string, exclusions ...*Peer) PeerSlice {
+	i.topics.mu.RLock()
+	defer i.topics.mu.RUnlock()
+
+	var peers PeerSlice
+	for p, patterns := range i.topics.peers {
+		for pattern := range patterns {
+			if MatchTopic(pattern, topic) {
+				peers = append(peers, p)
+				break
+			}
+		}
+	}
+	return peers.Exclude(exclusions...)
+}
+
+// Subscriptions returns the patterns a peer is subscribed to.
+func (i *Instance) Subscriptions(p *Peer) []string {
+	i.topics.mu.RLock()
+	defer i.topics.mu.RUnlock()
+
+	var patterns []string
+	for pattern := range i.topics.peers[p] {
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// Publish sends a message to every peer subscribed to the topic, and returns
+// the number of peers it was sent to.
+func (i *Instance) Publish(topic string, data any) int {
+	return i.publish(topic, data, 1)
+}
+
+func (i *Instance) publish(topic string, data any, ttl int, exclusions ...*Peer) int {
+	peers := i.Subscribers(topic, exclusions...)
+	if len(peers) == 0 {
+		return 0
+	}
+	i.Broadcast(&TxPacket{
+		Packet: Packet{
+			Opcode: "PUBLISH",
+			Origin: i.Name,
+			TTL:    ttl,
+		},
+		Payload: PublishArgs{Topic: topic, Data: data},
+	}, peers)
+	return len(peers)
+}
+
+// dropSubscriptions removes all subscriptions held by a peer.
+func (i *Instance) dropSubscriptions(p *Peer) {
+	i.topics.mu.Lock()
+	defer i.topics.mu.Unlock()
+	delete(i.topics.peers, p)
+}
+
+// Subscribe asks the remote to forward messages published to topics matching the pattern.
+func (c *Peer) Subscribe(pattern string) {
+	c.Write(&TxPacket{
+		Packet:  Packet{Opcode: "SUBSCRIBE", TTL: 1},
+		Payload: TopicArgs{Topic: pattern},
+	})
+}
+
+// Unsubscribe cancels a subscription made with Subscribe.
+func (c *Peer) Unsubscribe(pattern string) {
+	c.Write(&TxPacket{
+		Packet:  Packet{Opcode: "UNSUBSCRIBE", TTL: 1},
+		Payload: TopicArgs{Topic: pattern},
+	})
+}
+
+// Publish sends a message to the remote, which forwards it to its subscribers.
+func (c *Peer) Publish(topic string, data any) {
+	c.Write(&TxPacket{
+		Packet: Packet{
+			Opcode: "PUBLISH",
+			Origin: c.Parent.Name,
+			TTL:    2,
+		},
+		Payload: PublishArgs{Topic: topic, Data: data},
+	})
+}
+
+func (conn *Peer) HandleSubscribe(r *RxPacket) {
+	var args TopicArgs
+	if err := json.Unmarshal(r.Payload, &args); err != nil {
+		conn.Logger.Error().Err(err).Msg("failed to unmarshal subscribe arguments")
+		return
+	}
+	if !ValidTopicPattern(args.Topic) {
+		conn.Logger.Warn().Str("topic", args.Topic).Msg("rejected invalid topic pattern")
+		return
+	}
+
+	i := conn.Parent
+	i.topics.mu.Lock()
+	defer i.topics.mu.Unlock()
+
+	// The peer closes before its subscriptions are dropped, so a subscribe
+	// handled after that must not add them back
+	if conn.closed() {
+		return
+	}
+
+	patterns, ok := i.topics.peers[conn]
+	if !ok {
+		patterns = make(map[string]struct{})
+		i.topics.peers[conn] = patterns
+	}
+	if _, exists := patterns[args.Topic]; !exists && i.MaxSubscriptions > 0 && len(patterns) >= i.MaxSubscriptions {
+		conn.Logger.Warn().Str("topic", args.Topic).Int("limit", i.MaxSubscriptions).Msg("rejected subscription: limit reached")
+		return
+	}
+	patterns[args.Topic] = struct{}{}
+	conn.Logger.Debug().Str("topic", args.Topic).Msg("subscribed")
+}
+
+func (conn *Peer) HandleUnsubscribe(r *RxPacket) {
+	var args TopicArgs
+	if err := json.Unmarshal(r.Payload, &args); err != nil {
+		conn.Logger.Error().Err(err).Msg("failed to unmarshal unsubscribe arguments")
+		return
+	}
+
+	i := conn.Parent
+	i.topics.mu.Lock()
+	defer i.topics.mu.Unlock()
+	delete(i.topics.peers[conn], args.Topic)
+	if len(i.topics.peers[conn]) == 0 {
+		delete(i.topics.peers, conn)
+	}
+	conn.Logger.Debug().Str("topic", args.Topic).Msg("unsubscribed")
+}
+
+// HandlePublish delivers a message to matching local handlers, and forwards
+// it to other subscribers while its TTL allows.
+func (conn *Peer) HandlePublish(r *RxPacket) {
+	var args RxPublishArgs
+	if err := json.Unmarshal(r.Payload, &args); err != nil {
+		conn.Logger.Error().Err(err).Msg("failed to unmarshal publish arguments")
+		return
+	}
+	if !ValidTopic(args.Topic) {
+		conn.Logger.Warn().Str("topic", args.Topic).Msg("dropped publish to invalid topic")
+		return
+	}
+
+	i := conn.Parent
+
+	i.topics.mu.RLock()
+	var handlers []TopicHandler
+	for pattern, handler := range i.topics.locals {
+		if MatchTopic(pattern, args.Topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	i.topics.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(conn, args.Topic, args.Data)
+	}
+
+	if r.TTL > 0 {
+		i.publish(args.Topic, args.Data, r.TTL, conn)
+	}
+}
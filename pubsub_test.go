@@ -0,0 +1,132 @@
+package duplex
+
+import (
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog"
+)
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		pattern, topic string
+		match          bool
+	}{
+		{"game.score", "game.score", true},
+		{"game.score", "game.scores", false},
+		{"game.*", "game.score", true},
+		{"game.*", "game.score.red", false},
+		{"*.score", "game.score", true},
+		{"game.#", "game", true},
+		{"game.#", "game.score.red", true},
+		{"#", "anything.at.all", true},
+		{"game.*.red", "game.score.blue", false},
+	}
+	for _, c := range cases {
+		if got := MatchTopic(c.pattern, c.topic); got != c.match {
+			t.Errorf("MatchTopic(%q, %q) = %v", c.pattern, c.topic, got)
+		}
+	}
+}
+
+func TestValidTopics(t *testing.T) {
+	for pattern, valid := range map[string]bool{
+		"game.score": true,
+		"game.*":     true,
+		"game.#":     true,
+		"":           false,
+		"game..x":    false,
+		"game.#.x":   false,
+		"game.sc*":   false,
+		"game.#x":    false,
+	} {
+		if got := ValidTopicPattern(pattern); got != valid {
+			t.Errorf("ValidTopicPattern(%q) = %v", pattern, got)
+		}
+	}
+	if ValidTopic("game.*") || !ValidTopic("game.score") {
+		t.Error("wildcards accepted as a topic")
+	}
+}
+
+func topicPacket(opcode, topic string) *RxPacket {
+	payload, _ := json.Marshal(TopicArgs{Topic: topic})
+	return &RxPacket{Packet: Packet{Opcode: opcode, TTL: 1}, Payload: payload}
+}
+
+func TestSubscriptionTable(t *testing.T) {
+	i := New("alpha", &Config{MaxSubscriptions: 2, LogLevel: zerolog.Disabled})
+	a, b := unopenedPeer(i), unopenedPeer(i)
+
+	a.HandlePacket(topicPacket("SUBSCRIBE", "game.*"))
+	a.HandlePacket(topicPacket("SUBSCRIBE", "chat.#"))
+	a.HandlePacket(topicPacket("SUBSCRIBE", "news"))
+	a.HandlePacket(topicPacket("SUBSCRIBE", "bad..pattern"))
+	b.HandlePacket(topicPacket("SUBSCRIBE", "game.score"))
+
+	if got := len(i.Subscriptions(a)); got != 2 {
+		t.Fatalf("%d subscriptions past the limit of 2", got)
+	}
+	if got := i.Subscribers("game.score"); len(got) != 2 {
+		t.Fatalf("%d subscribers of game.score", len(got))
+	}
+	if got := i.Subscribers("game.score", b); len(got) != 1 || got[0] != a {
+		t.Fatal("exclusion ignored")
+	}
+	if got := i.Publish("news", nil); got != 0 {
+		t.Fatalf("published to %d peers without subscribers", got)
+	}
+	if got := i.Publish("chat.lobby", "hi"); got != 1 {
+		t.Fatalf("published to %d peers", got)
+	}
+
+	a.HandlePacket(topicPacket("UNSUBSCRIBE", "game.*"))
+	if got := i.Subscribers("game.score"); len(got) != 1 || got[0] != b {
+		t.Fatal("unsubscribe ignored")
+	}
+
+	i.dropSubscriptions(a)
+	if got := i.Subscribers("chat.lobby"); len(got) != 0 {
+		t.Fatal("subscriptions kept after the peer left")
+	}
+}
+
+func TestPublishReachesLocalHandlers(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+
+	var got []string
+	i.Subscribe("game.#", func(_ *Peer, topic string, data json.RawMessage) {
+		got = append(got, topic+"="+string(data))
+	})
+	i.Subscribe("game.*.*", func(*Peer, string, json.RawMessage) {})
+
+	publish := func(topic string) {
+		payload, _ := json.Marshal(PublishArgs{Topic: topic, Data: 7})
+		p.HandlePacket(&RxPacket{Packet: Packet{Opcode: "PUBLISH", TTL: 1}, Payload: payload})
+	}
+	publish("game.score")
+	publish("chat.lobby")
+	publish("game.*")
+	if len(got) != 1 || got[0] != "game.score=7" {
+		t.Fatalf("delivered %v", got)
+	}
+
+	i.Unsubscribe("game.#")
+	publish("game.score")
+	if len(got) != 1 {
+		t.Fatal("delivered after Unsubscribe")
+	}
+}
+
+func TestSubscribeAfterCloseIgnored(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+
+	close(p.Done)
+	i.dropSubscriptions(p)
+	p.HandleSubscribe(topicPacket("SUBSCRIBE", "game.*"))
+	if got := i.Subscribers("game.score"); len(got) != 0 {
+		t.Fatal("closed peer subscribed after its subscriptions were dropped")
+	}
+}
@@ -0,0 +1,149 @@
+package duplex
+
+import (
+	"time"
+
+	peer "github.com/cloudlink-delta/peerjs-go"
+)
+
+// ConnectPersistent connects to a peer and keeps redialing it whenever the
+// connection drops. The returned Peer, along with its KeyStore, stays the same
+// across reconnects. Inside OnClose, Peer.Redialing() tells whether a redial
+// will follow; inside OnOpen, Peer.Reconnects() is non-zero for a reconnect.
+func (i *Instance) ConnectPersistent(id string) *Peer {
+	p := i.Connect(id)
+	if p != nil {
+		p.setPersistent(true)
+	}
+	return p
+}
+
+// StopRedial stops a persistent peer from being redialed. If a redial is in
+// progress, it is abandoned at the next attempt.
+func (c *Peer) StopRedial() {
+	c.setPersistent(false)
+}
+
+// IsPersistent returns true if the peer is redialed when its connection drops.
+func (c *Peer) IsPersistent() bool {
+	c.KeyLock.Lock()
+	defer c.KeyLock.Unlock()
+	return c.persistent
+}
+
+// Redialing returns true while a persistent peer is waiting to be redialed.
+func (c *Peer) Redialing() bool {
+	c.KeyLock.Lock()
+	defer c.KeyLock.Unlock()
+	return c.redialing
+}
+
+// Reconnects returns the number of times a persistent peer was successfully
+// redialed.
+func (c *Peer) Reconnects() int {
+	c.KeyLock.Lock()
+	defer c.KeyLock.Unlock()
+	return c.reconnects
+}
+
+func (c *Peer) setPersistent(persistent bool) {
+	c.KeyLock.Lock()
+	defer c.KeyLock.Unlock()
+	c.persistent = persistent
+}
+
+// startRedial marks a closed peer as redialing if it is persistent, and
+// returns whether it is.
+func (c *Peer) startRedial() bool {
+	c.KeyLock.Lock()
+	defer c.KeyLock.Unlock()
+	c.redialing = c.persistent
+	return c.redialing
+}
+
+// redialed counts a successful redial when a redialing peer opens.
+func (c *Peer) redialed() {
+	c.KeyLock.Lock()
+	defer c.KeyLock.Unlock()
+	if c.redialing {
+		c.redialing = false
+		c.reconnects++
+	}
+}
+
+func (c *Peer) stopRedialing() {
+	c.KeyLock.Lock()
+	defer c.KeyLock.Unlock()
+	c.redialing = false
+}
+
+// redial reconnects a persistent peer using the instance's redial policy.
+func (i *Instance) redial(conn *Peer) {
+	id := conn.GetPeerID()
+	closing := i.closingSignal()
+
+	for attempt := 0; i.MaxRedials <= 0 || attempt < i.MaxRedials; attempt++ {
+		delay := i.RedialPolicy.Delay(attempt)
+		conn.Logger.Info().Dur("delay", delay).Msgf("Redialing peer (attempt #%d)...", attempt+1)
+		select {
+		case <-time.After(delay):
+		case <-closing:
+		}
+
+		if !conn.IsPersistent() || i.Closing() {
+			conn.Logger.Info().Msg("Redial cancelled")
+			conn.stopRedialing()
+			return
+		}
+
+		i.mu.Lock()
+		handler := i.Handler
+		i.mu.Unlock()
+		if handler == nil || handler.GetDestroyed() {
+			continue
+		}
+
+		dc, err := handler.Connect(id, i.connectionOptions())
+		if err != nil {
+			conn.Logger.Warn().Err(err).Msg("Redial failed")
+			continue
+		}
+
+		opened := make(chan struct{}, 1)
+		dc.On("open", func(data any) {
+			select {
+			case opened <- struct{}{}:
+			default:
+			}
+		})
+
+		conn.rebind(dc)
+		i.PeerHandler(conn)
+
+		select {
+		case <-opened:
+			return
+		case <-time.After(i.SetupTimeout):
+			conn.Logger.Warn().Msg("Redial timed out")
+			dc.Close()
+		case <-closing:
+			dc.Close()
+		}
+	}
+
+	conn.Logger.Warn().Msgf("Giving up on redialing after %d attempts", i.MaxRedials)
+	conn.stopRedialing()
+}
+
+// rebind swaps the underlying data connection of a peer for a new one.
+func (c *Peer) rebind(dc *peer.DataConnection) {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+	c.bind.Lock()
+	c.DataConnection = dc
+	c.Done = make(chan bool)
+	c.bind.Unlock()
+	c.last_rx.Store(0)
+	c.last_tx.Store(0)
+	c.Latency.reset()
+}
@@ -0,0 +1,110 @@
+package duplex
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	peer "github.com/cloudlink-delta/peerjs-go"
+	"github.com/cloudlink-delta/peerjs-go/emitter"
+	"github.com/rs/zerolog"
+)
+
+func TestPersistentPeerRedialState(t *testing.T) {
+	i := New("alpha", &Config{RedialPolicy: ConstantBackoff(time.Hour), LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+	p.setPersistent(true)
+	i.PeerHandler(p)
+
+	redialing := make(chan bool, 1)
+	i.OnClose = func(c *Peer) { redialing <- c.Redialing() }
+	p.Emit("close", nil)
+	if !<-redialing {
+		t.Fatal("Redialing false inside OnClose of a persistent peer")
+	}
+
+	p = unopenedPeer(i)
+	p.StopRedial()
+	i.PeerHandler(p)
+	p.Emit("close", nil)
+	if <-redialing {
+		t.Fatal("peer redialed after StopRedial")
+	}
+}
+
+func TestRedialCountsReconnects(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+
+	// Stand in for a successful redial
+	p.setPersistent(true)
+	p.startRedial()
+	old := p.Closed()
+	p.rebind(&peer.DataConnection{BaseConnection: peer.BaseConnection{Emitter: emitter.NewEmitter()}})
+	if p.Closed() == old {
+		t.Fatal("Closed still returns the channel of the old connection")
+	}
+
+	opened := make(chan *Peer, 1)
+	i.OnOpen = func(c *Peer) { opened <- c }
+	i.PeerHandler(p)
+	p.Emit("open", nil)
+	if c := <-opened; c.Redialing() || c.Reconnects() != 1 {
+		t.Fatalf("redialing %v, reconnects %d", c.Redialing(), c.Reconnects())
+	}
+}
+
+func TestRedialGivesUp(t *testing.T) {
+	i := New("alpha", &Config{RedialPolicy: ConstantBackoff(time.Millisecond), MaxRedials: 3, LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+	p.setPersistent(true)
+	p.startRedial()
+
+	// Without a signaling connection every attempt fails
+	if !returnsWithin(func() { i.redial(p) }, time.Second) {
+		t.Fatal("redial did not give up")
+	}
+	if p.Redialing() {
+		t.Fatal("still redialing after giving up")
+	}
+}
+
+func TestShutdownInterruptsRedialBackoff(t *testing.T) {
+	i := New("alpha", &Config{RedialPolicy: ConstantBackoff(time.Hour), LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+	p.setPersistent(true)
+	p.startRedial()
+
+	done := make(chan struct{})
+	go func() {
+		i.redial(p)
+		close(done)
+	}()
+	if err := i.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("redial kept waiting out its backoff after shutdown")
+	}
+	if p.Redialing() {
+		t.Fatal("still redialing after shutdown")
+	}
+}
+
+func TestRebindForgetsMissedPings(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+	p.Latency.sent()
+	p.Latency.sent()
+	p.last_rx.Store(time.Now().UnixNano())
+
+	p.rebind(&peer.DataConnection{BaseConnection: peer.BaseConnection{Emitter: emitter.NewEmitter()}})
+	if missed := p.Latency.sent(); missed != 0 {
+		t.Fatalf("%d pings from the old connection counted as missed", missed)
+	}
+	if p.IdleFor() != 0 {
+		t.Fatal("idle time carried over from the old connection")
+	}
+}
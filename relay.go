@@ -0,0 +1,329 @@
+package duplex
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+var (
+	ErrNoRoute       = errors.New("no route to peer")
+	ErrNotRelay      = errors.New("peer is not a relay")
+	ErrRelayFull     = errors.New("relay has no free client slots")
+	ErrRelayRejected = errors.New("relay rejected registration")
+)
+
+// RelayQuota limits how much a single client may send through a relay.
+// Zero values are unlimited.
+type RelayQuota struct {
+	PacketsPerSecond float64 `json:"packets_per_second,omitempty"`
+	BytesPerSecond   float64 `json:"bytes_per_second,omitempty"`
+	Burst            float64 `json:"burst,omitempty"` // Seconds worth of traffic that may be sent at once (default 1)
+}
+
+type RelayRegistration struct {
+	Quota RelayQuota `json:"quota"`
+	Error string     `json:"error,omitempty"`
+}
+
+type RelayErrorArgs struct {
+	Target string `json:"target"`
+	Id     string `json:"id,omitempty"`
+	Error  string `json:"error"`
+}
+
+// token_bucket is a simple rate limiter refilled continuously at rate per second.
+type token_bucket struct {
+	rate     float64
+	capacity float64
+	tokens   float64
+	updated  time.Time
+}
+
+func new_token_bucket(rate, burst float64) *token_bucket {
+	if burst <= 0 {
+		burst = 1
+	}
+	return &token_bucket{
+		rate:     rate,
+		capacity: rate * burst,
+		tokens:   rate * burst,
+		updated:  time.Now(),
+	}
+}
+
+func (b *token_bucket) take(n float64) bool {
+	if b == nil || b.rate <= 0 {
+		return true
+	}
+	now := time.Now()
+	b.tokens = min(b.capacity, b.tokens+now.Sub(b.updated).Seconds()*b.rate)
+	b.updated = now
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+type relay_client struct {
+	packets *token_bucket
+	bytes   *token_bucket
+	dropped uint64
+}
+
+type relay_state struct {
+	mu         sync.Mutex
+	clients    map[*Peer]*relay_client // Clients registered with us, if we are a relay
+	forwarders map[*Peer]*relay_client // Trusted relays forwarding packets through us
+	relays     map[*Peer]struct{}      // Relays we registered with
+}
+
+func (i *Instance) newRelayClient() *relay_client {
+	return &relay_client{
+		packets: new_token_bucket(i.RelayQuota.PacketsPerSecond, i.RelayQuota.Burst),
+		bytes:   new_token_bucket(i.RelayQuota.BytesPerSecond, i.RelayQuota.Burst),
+	}
+}
+
+// trustedRelay returns true if a peer may forward packets on behalf of others:
+// it negotiated the relay role and is either listed in TrustedRelays or a
+// relay we registered with. Must be called with i.relay.mu held.
+func (i *Instance) trustedRelay(p *Peer) bool {
+	if !p.IsRelay {
+		return false
+	}
+	if _, ok := i.relay.relays[p]; ok {
+		return true
+	}
+	return slices.Contains(i.TrustedRelays, p.GetPeerID())
+}
+
+// RelayClients returns the peers registered with this relay.
+func (i *Instance) RelayClients() PeerSlice {
+	i.relay.mu.Lock()
+	defer i.relay.mu.Unlock()
+	var peers PeerSlice
+	for p := range i.relay.clients {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// Relays returns the relays this instance is registered with.
+func (i *Instance) Relays() PeerSlice {
+	i.relay.mu.Lock()
+	defer i.relay.mu.Unlock()
+	var peers PeerSlice
+	for p := range i.relay.relays {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// dropRelay forgets a closed peer, both as a relay client and as a relay.
+func (i *Instance) dropRelay(p *Peer) {
+	i.relay.mu.Lock()
+	defer i.relay.mu.Unlock()
+	delete(i.relay.clients, p)
+	delete(i.relay.forwarders, p)
+	delete(i.relay.relays, p)
+}
+
+// SendTo sends a packet to a peer by ID or claimed username. If we are
+// directly connected, it is written to that connection. Otherwise, it goes through the first relay we
+// are registered with.
+func (i *Instance) SendTo(target string, packet *TxPacket) error {
+	if p, ok := i.resolveTarget(target); ok {
+		p.Write(packet)
+		return nil
+	}
+
+	relays := i.Relays()
+	if len(relays) == 0 {
+		return ErrNoRoute
+	}
+
+	routed := *packet
+	routed.Target = target
+	if routed.Origin == "" {
+		routed.Origin = i.Name
+	}
+	routed.TTL = max(routed.TTL, 2)
+	relays[0].Write(&routed)
+	return nil
+}
+
+// RegisterRelay registers with a relay peer, so that it forwards our packets
+// to peers we cannot reach directly. It returns the quota the relay applies.
+func (c *Peer) RegisterRelay(ctx context.Context) (RelayQuota, error) {
+	if !c.IsRelay {
+		return RelayQuota{}, ErrNotRelay
+	}
+
+	reply, err := c.Request(ctx, &TxPacket{
+		Packet: Packet{Opcode: "RELAY_REGISTER", TTL: 1},
+	})
+	if err != nil {
+		return RelayQuota{}, err
+	}
+
+	var registration RelayRegistration
+	if err := json.Unmarshal(reply.Payload, &registration); err != nil {
+		return RelayQuota{}, err
+	}
+	if registration.Error != "" {
+		return RelayQuota{}, &RemoteError{Opcode: "RELAY_REGISTER", Message: registration.Error}
+	}
+
+	i := c.Parent
+	i.relay.mu.Lock()
+	i.relay.relays[c] = struct{}{}
+	i.relay.mu.Unlock()
+
+	return registration.Quota, nil
+}
+
+// UnregisterRelay stops using a relay.
+func (c *Peer) UnregisterRelay() {
+	i := c.Parent
+	i.relay.mu.Lock()
+	delete(i.relay.relays, c)
+	i.relay.mu.Unlock()
+
+	c.Write(&TxPacket{
+		Packet: Packet{Opcode: "RELAY_UNREGISTER", TTL: 1},
+	})
+}
+
+func (conn *Peer) HandleRelayRegister(r *RxPacket) {
+	i := conn.Parent
+	reply := &TxPacket{
+		Packet: Packet{Opcode: "RELAY_REGISTERED", TTL: 1, Listener: r.Listener},
+	}
+
+	if !i.IsRelay {
+		reply.Payload = RelayRegistration{Error: ErrNotRelay.Error()}
+		conn.Write(reply)
+		return
+	}
+
+	if fn := i.AuthorizeRelayClient; fn != nil && !fn(conn) {
+		conn.Logger.Warn().Msg("rejected relay registration")
+		reply.Payload = RelayRegistration{Error: ErrRelayRejected.Error()}
+		conn.Write(reply)
+		return
+	}
+
+	i.relay.mu.Lock()
+	_, registered := i.relay.clients[conn]
+	if !registered && i.MaxRelayClients > 0 && len(i.relay.clients) >= i.MaxRelayClients {
+		i.relay.mu.Unlock()
+		conn.Logger.Warn().Int("limit", i.MaxRelayClients).Msg("rejected relay registration: client limit reached")
+		reply.Payload = RelayRegistration{Error: ErrRelayFull.Error()}
+		conn.Write(reply)
+		return
+	}
+	if !registered {
+		i.relay.clients[conn] = i.newRelayClient()
+	}
+	i.relay.mu.Unlock()
+
+	conn.Logger.Info().Msg("registered relay client")
+	reply.Payload = RelayRegistration{Quota: i.RelayQuota}
+	conn.Write(reply)
+}
+
+func (conn *Peer) HandleRelayUnregister(r *RxPacket) {
+	i := conn.Parent
+	i.relay.mu.Lock()
+	delete(i.relay.clients, conn)
+	i.relay.mu.Unlock()
+	conn.Logger.Info().Msg("unregistered relay client")
+}
+
+// forward relays a packet addressed to another peer. It returns true if the
+// packet was consumed, whether it was forwarded or dropped. Registered clients
+// and trusted relays may send through us, within the relay quota.
+func (conn *Peer) forward(r *RxPacket) bool {
+	i := conn.Parent
+
+	i.relay.mu.Lock()
+	client, registered := i.relay.clients[conn]
+	trusted := i.trustedRelay(conn)
+	if !registered && trusted {
+		client = i.relay.forwarders[conn]
+		if client == nil {
+			client = i.newRelayClient()
+			i.relay.forwarders[conn] = client
+		}
+	}
+	allowed := client != nil
+	if allowed {
+		size := float64(len(r.Opcode) + len(r.Payload))
+		if !client.packets.take(1) || !client.bytes.take(size) {
+			client.dropped++
+			allowed = false
+		}
+	}
+	i.relay.mu.Unlock()
+
+	if client == nil {
+		conn.Logger.Warn().Str("target", r.Target).Msg("dropped relayed packet: sender is not registered")
+		conn.relayError(r, "not registered")
+		return true
+	}
+	if !allowed {
+		conn.Logger.Warn().Str("target", r.Target).Msg("dropped relayed packet: quota exceeded")
+		conn.relayError(r, "quota exceeded")
+		return true
+	}
+
+	// TTL was already decremented on receipt, so nothing is left for the next hop
+	if r.TTL <= 0 {
+		conn.Logger.Warn().Str("target", r.Target).Msg("dropped relayed packet: TTL expired")
+		conn.relayError(r, "ttl expired")
+		return true
+	}
+
+	target, ok := i.resolveTarget(r.Target)
+	if !ok || target == conn {
+		conn.Logger.Debug().Str("target", r.Target).Msg("dropped relayed packet: target unreachable")
+		conn.relayError(r, "unreachable")
+		return true
+	}
+
+	forwarded := TxPacket{Packet: r.Packet, Payload: r.Payload}
+	forwarded.Seq = 0
+	if forwarded.Origin == "" || !trusted {
+		// Stamp the origin ourselves, so that peers cannot impersonate each other
+		forwarded.Origin = conn.GetPeerID()
+	}
+
+	conn.Logger.Debug().Str("target", r.Target).Str("opcode", r.Opcode).Msg("relaying packet")
+	target.Write(&forwarded)
+	return true
+}
+
+// resolveTarget finds the connected peer a packet is addressed to, by peer ID
+// or by a username claimed with us.
+func (i *Instance) resolveTarget(target string) (*Peer, bool) {
+	if p, ok := i.GetPeer(target); ok {
+		return p, true
+	}
+	return i.PeerByName(target)
+}
+
+func (conn *Peer) relayError(r *RxPacket, reason string) {
+	if r.Opcode == "RELAY_ERROR" {
+		return
+	}
+	conn.Write(&TxPacket{
+		Packet:  Packet{Opcode: "RELAY_ERROR", TTL: 1, Listener: r.Listener},
+		Payload: RelayErrorArgs{Target: r.Target, Id: r.Id, Error: reason},
+	})
+}
@@ -0,0 +1,154 @@
+package duplex
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := new_token_bucket(10, 0.5)
+	for n := range 5 {
+		if !b.take(1) {
+			t.Fatalf("burst exhausted after %d", n)
+		}
+	}
+	if b.take(1) {
+		t.Fatal("took more than the burst")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if !b.take(1) {
+		t.Fatal("bucket did not refill")
+	}
+
+	var unlimited *token_bucket
+	if !unlimited.take(1e9) || !new_token_bucket(0, 1).take(1e9) {
+		t.Fatal("zero rate limited traffic")
+	}
+}
+
+func TestRelayRegistration(t *testing.T) {
+	i := New("alpha", &Config{MaxRelayClients: 2, LogLevel: zerolog.Disabled})
+	a, b, c := unopenedPeer(i), unopenedPeer(i), unopenedPeer(i)
+	register := func(p *Peer) {
+		p.HandlePacket(&RxPacket{Packet: Packet{Opcode: "RELAY_REGISTER", TTL: 1}})
+	}
+
+	register(a)
+	if len(i.RelayClients()) != 0 {
+		t.Fatal("registered a client without the relay role")
+	}
+
+	i.IsRelay = true
+	i.AuthorizeRelayClient = func(p *Peer) bool { return p != c }
+	register(a)
+	register(a)
+	register(c)
+	register(b)
+	if len(i.RelayClients()) != 2 {
+		t.Fatalf("%d clients registered", len(i.RelayClients()))
+	}
+
+	// Full, so nobody new gets in until someone leaves
+	i.AuthorizeRelayClient = nil
+	register(c)
+	if len(i.RelayClients()) != 2 {
+		t.Fatal("registered past the client limit")
+	}
+	a.HandlePacket(&RxPacket{Packet: Packet{Opcode: "RELAY_UNREGISTER", TTL: 1}})
+	i.dropRelay(b)
+	register(c)
+	if clients := i.RelayClients(); len(clients) != 1 || clients[0] != c {
+		t.Fatal("slots not freed")
+	}
+}
+
+func TestRelayForwardingQuota(t *testing.T) {
+	i := New("alpha", &Config{RelayQuota: RelayQuota{PacketsPerSecond: 2}, LogLevel: zerolog.Disabled})
+	i.IsRelay = true
+	client, stranger, target := unopenedPeer(i), unopenedPeer(i), unopenedPeer(i)
+	i.Peers["gamma"] = target
+
+	routed := func() *RxPacket {
+		return &RxPacket{Packet: Packet{Opcode: "DATA", Target: "gamma", TTL: 2}}
+	}
+	stranger.HandlePacket(routed())
+
+	client.HandlePacket(&RxPacket{Packet: Packet{Opcode: "RELAY_REGISTER", TTL: 1}})
+	for range 3 {
+		client.HandlePacket(routed())
+	}
+	if dropped := i.relay.clients[client].dropped; dropped != 1 {
+		t.Fatalf("%d packets dropped by a quota of 2", dropped)
+	}
+	if _, ok := i.relay.clients[stranger]; ok {
+		t.Fatal("unregistered sender became a client")
+	}
+}
+
+func TestSendToRoutes(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	if err := i.SendTo("gamma", &TxPacket{Packet: Packet{Opcode: "DATA"}}); !errors.Is(err, ErrNoRoute) {
+		t.Fatalf("SendTo without a route returned %v", err)
+	}
+
+	i.Peers["gamma"] = unopenedPeer(i)
+	if err := i.SendTo("gamma", &TxPacket{Packet: Packet{Opcode: "DATA"}}); err != nil {
+		t.Fatalf("SendTo a direct peer returned %v", err)
+	}
+
+	relay := unopenedPeer(i)
+	i.relay.relays[relay] = struct{}{}
+	if err := i.SendTo("delta", &TxPacket{Packet: Packet{Opcode: "DATA"}}); err != nil {
+		t.Fatalf("SendTo through a relay returned %v", err)
+	}
+	relay.UnregisterRelay()
+	if len(i.Relays()) != 0 {
+		t.Fatal("relay kept after UnregisterRelay")
+	}
+
+	if _, err := unopenedPeer(i).RegisterRelay(context.Background()); !errors.Is(err, ErrNotRelay) {
+		t.Fatalf("registered with a plain peer: %v", err)
+	}
+}
+
+func TestOnlyTrustedRelaysForward(t *testing.T) {
+	i := New("alpha", &Config{IsRelay: true, TrustedRelays: []string{"relay-1"}, LogLevel: zerolog.Disabled})
+	origins := make(chan string, 4)
+	target := i.replayPeer("gamma", func(_ *Peer, raw []byte) {
+		var packet Packet
+		json.Unmarshal(raw, &packet)
+		origins <- packet.Origin
+	})
+	defer target.Close()
+
+	trusted, untrusted := i.replayPeer("relay-1", nil), i.replayPeer("relay-2", nil)
+	defer trusted.Close()
+	defer untrusted.Close()
+	trusted.IsRelay, untrusted.IsRelay = true, true
+
+	routed := func() *RxPacket {
+		return &RxPacket{Packet: Packet{Opcode: "DATA", Target: "gamma", Origin: "beta", TTL: 2}}
+	}
+	untrusted.HandlePacket(routed())
+	trusted.HandlePacket(routed())
+
+	select {
+	case origin := <-origins:
+		if origin != "beta" {
+			t.Fatalf("forwarded with origin %q", origin)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("trusted relay's packet not forwarded")
+	}
+	if len(origins) > 0 {
+		t.Fatalf("forwarded for an untrusted relay as %q", <-origins)
+	}
+	if _, ok := i.relay.forwarders[untrusted]; ok {
+		t.Fatal("untrusted relay given a forwarding quota")
+	}
+}
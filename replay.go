@@ -0,0 +1,104 @@
+package duplex
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	peer "github.com/cloudlink-delta/peerjs-go"
+	"github.com/cloudlink-delta/peerjs-go/emitter"
+	"github.com/goccy/go-json"
+)
+
+// ReplayOptions configures Replay.
+type ReplayOptions struct {
+	Peers   []string                        // Only replay packets from these peer IDs, if set
+	Opcodes []string                        // Only replay these opcodes, if set
+	Timing  bool                            // Wait between packets as long as the capture did
+	OnWrite func(peer *Peer, packet []byte) // Receives every packet the handlers write to a replayed peer
+}
+
+// Replay feeds the inbound packets of a capture to the instance's handlers.
+// Every captured peer is played by a fake peer that goes through the same
+// open, data and close events as a real connection, but whose writes go to
+// OnWrite instead of the network. The instance does not need to be running.
+// Replay returns once every packet has been handled and the fake peers are
+// closed.
+func (i *Instance) Replay(ctx context.Context, r io.Reader, opts ReplayOptions) error {
+	peers := make(map[string]*Peer)
+	defer func() {
+		for _, p := range peers {
+			p.Close()
+		}
+	}()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	var last time.Time
+	for line := 1; scanner.Scan(); line++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var record CaptureRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if record.Direction != "in" ||
+			(len(opts.Peers) > 0 && !slices.Contains(opts.Peers, record.Peer)) ||
+			(len(opts.Opcodes) > 0 && !slices.Contains(opts.Opcodes, record.Opcode)) {
+			continue
+		}
+
+		if opts.Timing && !last.IsZero() {
+			select {
+			case <-time.After(record.Time.Sub(last)):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		last = record.Time
+
+		p, ok := peers[record.Peer]
+		if !ok {
+			p = i.replayPeer(record.Peer, opts.OnWrite)
+			peers[record.Peer] = p
+		}
+		p.Emit("data", []byte(record.Packet))
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return i.inflight.wait(ctx)
+}
+
+// replayPeer connects a fake peer with the given ID.
+func (i *Instance) replayPeer(id string, on_write func(*Peer, []byte)) *Peer {
+	conn := &peer.DataConnection{
+		BaseConnection: peer.BaseConnection{
+			Emitter: emitter.NewEmitter(),
+			Open:    true,
+		},
+	}
+
+	p := i.newPeer(conn, false)
+	p.id = id
+	p.initLoggers()
+	p.sink = func(raw []byte) {
+		if on_write != nil {
+			on_write(p, raw)
+		}
+	}
+
+	i.PeerHandler(p)
+	p.Emit("open", nil)
+	return p
+}
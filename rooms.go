@@ -0,0 +1,443 @@
+package duplex
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"sync"
+
+	"github.com/goccy/go-json"
+)
+
+var (
+	ErrRoomFull        = errors.New("room is full")
+	ErrRoomPassword    = errors.New("incorrect room password")
+	ErrRoomNotFound    = errors.New("room not found")
+	ErrRoomInvalidName = errors.New("invalid room name")
+)
+
+// RoomOptions configure a room created with CreateRoom.
+type RoomOptions struct {
+	Limit      int    // Maximum number of members (0 is unlimited)
+	Password   string // Required to join, if set
+	Persistent bool   // Keep the room around after the last member leaves
+}
+
+// Room is a named group of peers that can be broadcast to as a whole.
+type Room struct {
+	Name string
+	RoomOptions
+
+	mu      sync.RWMutex
+	parent  *Instance
+	members map[*Peer]struct{}
+}
+
+type RoomArgs struct {
+	Room     string `json:"room"`
+	Password string `json:"password,omitempty"`
+}
+
+type RoomMember struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type RoomMembersArgs struct {
+	Room    string       `json:"room"`
+	Members []RoomMember `json:"members"`
+}
+
+type RoomMemberArgs struct {
+	Room   string     `json:"room"`
+	Member RoomMember `json:"member"`
+}
+
+type RoomErrorArgs struct {
+	Room  string `json:"room"`
+	Error string `json:"error"`
+}
+
+type RoomMessageArgs struct {
+	Room string `json:"room,omitempty"`
+	Data any    `json:"data,omitempty"`
+}
+
+type RxRoomMessageArgs struct {
+	Room string          `json:"room,omitempty"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// Members returns the current members of the room.
+func (r *Room) Members() PeerSlice {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var peers PeerSlice
+	for p := range r.members {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// Has returns true if the peer is a member of the room.
+func (r *Room) Has(p *Peer) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.members[p]
+	return ok
+}
+
+// Len returns the number of members in the room.
+func (r *Room) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.members)
+}
+
+// Broadcast sends a packet to every member of the room.
+func (r *Room) Broadcast(packet *TxPacket, exclusions ...*Peer) {
+	r.parent.Broadcast(packet, r.Members().Exclude(exclusions...))
+}
+
+func (r *Room) roster() []RoomMember {
+	members := []RoomMember{}
+	for _, p := range r.Members() {
+		members = append(members, RoomMember{Id: p.GetPeerID(), Name: p.GiveName()})
+	}
+	return members
+}
+
+// CreateRoom creates a room, or updates the options of an existing one.
+func (i *Instance) CreateRoom(name string, options RoomOptions) (*Room, error) {
+	if name == "" {
+		return nil, ErrRoomInvalidName
+	}
+
+	i.roomsMu.Lock()
+	defer i.roomsMu.Unlock()
+
+	if room, ok := i.rooms[name]; ok {
+		room.mu.Lock()
+		room.RoomOptions = options
+		room.mu.Unlock()
+		return room, nil
+	}
+
+	room := &Room{
+		Name:        name,
+		RoomOptions: options,
+		parent:      i,
+		members:     make(map[*Peer]struct{}),
+	}
+	i.rooms[name] = room
+	return room, nil
+}
+
+// DeleteRoom removes every member from a room and deletes it.
+func (i *Instance) DeleteRoom(name string) {
+	room, ok := i.Room(name)
+	if !ok {
+		return
+	}
+	for _, p := range room.Members() {
+		i.LeaveRoom(p, name)
+	}
+	i.roomsMu.Lock()
+	delete(i.rooms, name)
+	i.roomsMu.Unlock()
+}
+
+// Room returns the room with the given name.
+func (i *Instance) Room(name string) (*Room, bool) {
+	i.roomsMu.Lock()
+	defer i.roomsMu.Unlock()
+	room, ok := i.rooms[name]
+	return room, ok
+}
+
+// Rooms returns all rooms.
+func (i *Instance) Rooms() []*Room {
+	i.roomsMu.Lock()
+	defer i.roomsMu.Unlock()
+	rooms := make([]*Room, 0, len(i.rooms))
+	for _, room := range i.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// RoomsOf returns the rooms a peer is a member of.
+func (i *Instance) RoomsOf(p *Peer) []*Room {
+	var rooms []*Room
+	for _, room := range i.Rooms() {
+		if room.Has(p) {
+			rooms = append(rooms, room)
+		}
+	}
+	return rooms
+}
+
+// JoinRoom adds a peer to a room, creating it if it does not exist, and
+// notifies the other members.
+func (i *Instance) JoinRoom(p *Peer, name string, password string) (*Room, error) {
+	if name == "" {
+		return nil, ErrRoomInvalidName
+	}
+
+	i.roomsMu.Lock()
+
+	// The peer closes before it leaves its rooms, so a join handled after
+	// that must not add it back
+	if p.closed() {
+		i.roomsMu.Unlock()
+		return nil, ErrPeerClosed
+	}
+
+	room, ok := i.rooms[name]
+	if !ok {
+		room = &Room{
+			Name:    name,
+			parent:  i,
+			members: make(map[*Peer]struct{}),
+		}
+		i.rooms[name] = room
+	}
+
+	room.mu.Lock()
+	if _, joined := room.members[p]; joined {
+		room.mu.Unlock()
+		i.roomsMu.Unlock()
+		return room, nil
+	}
+	if room.Password != "" && subtle.ConstantTimeCompare([]byte(room.Password), []byte(password)) != 1 {
+		room.mu.Unlock()
+		i.roomsMu.Unlock()
+		return nil, ErrRoomPassword
+	}
+	if room.Limit > 0 && len(room.members) >= room.Limit {
+		room.mu.Unlock()
+		i.roomsMu.Unlock()
+		return nil, ErrRoomFull
+	}
+	room.members[p] = struct{}{}
+	room.mu.Unlock()
+	i.roomsMu.Unlock()
+
+	p.Logger.Debug().Str("room", name).Msg("joined room")
+
+	room.Broadcast(&TxPacket{
+		Packet:  Packet{Opcode: "ROOM_MEMBER_JOINED", TTL: 1},
+		Payload: RoomMemberArgs{Room: name, Member: RoomMember{Id: p.GetPeerID(), Name: p.GiveName()}},
+	}, p)
+
+	if fn := i.OnRoomJoin; fn != nil {
+		fn(room, p)
+	}
+	return room, nil
+}
+
+// LeaveRoom removes a peer from a room and notifies the remaining members.
+// Unless the room is persistent, it is deleted once empty.
+func (i *Instance) LeaveRoom(p *Peer, name string) {
+	i.roomsMu.Lock()
+	room, ok := i.rooms[name]
+	if !ok {
+		i.roomsMu.Unlock()
+		return
+	}
+
+	room.mu.Lock()
+	_, joined := room.members[p]
+	delete(room.members, p)
+	empty := len(room.members) == 0
+	room.mu.Unlock()
+
+	if empty && !room.Persistent {
+		delete(i.rooms, name)
+	}
+	i.roomsMu.Unlock()
+
+	if !joined {
+		return
+	}
+
+	p.Logger.Debug().Str("room", name).Msg("left room")
+
+	room.Broadcast(&TxPacket{
+		Packet:  Packet{Opcode: "ROOM_MEMBER_LEFT", TTL: 1},
+		Payload: RoomMemberArgs{Room: name, Member: RoomMember{Id: p.GetPeerID(), Name: p.GiveName()}},
+	})
+
+	if fn := i.OnRoomLeave; fn != nil {
+		fn(room, p)
+	}
+}
+
+// leaveAllRooms removes a closed peer from every room it was in.
+func (i *Instance) leaveAllRooms(p *Peer) {
+	for _, room := range i.RoomsOf(p) {
+		i.LeaveRoom(p, room.Name)
+	}
+}
+
+// JoinRoom asks the remote to add us to a room, and returns its member list.
+func (c *Peer) JoinRoom(ctx context.Context, room string, password string) ([]RoomMember, error) {
+	reply, err := c.Request(ctx, &TxPacket{
+		Packet:  Packet{Opcode: "ROOM_JOIN", TTL: 1},
+		Payload: RoomArgs{Room: room, Password: password},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return parseRoomReply(reply)
+}
+
+// LeaveRoom asks the remote to remove us from a room.
+func (c *Peer) LeaveRoom(room string) {
+	c.Write(&TxPacket{
+		Packet:  Packet{Opcode: "ROOM_LEAVE", TTL: 1},
+		Payload: RoomArgs{Room: room},
+	})
+}
+
+// RoomMembers asks the remote for the member list of a room we are in.
+func (c *Peer) RoomMembers(ctx context.Context, room string) ([]RoomMember, error) {
+	reply, err := c.Request(ctx, &TxPacket{
+		Packet:  Packet{Opcode: "ROOM_MEMBERS", TTL: 1},
+		Payload: RoomArgs{Room: room},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return parseRoomReply(reply)
+}
+
+// SendToRoom sends a G_MSG to every other member of a room. If room is
+// empty, it goes to every room we are a member of, unless the remote bound
+// its own G_MSG handler.
+func (c *Peer) SendToRoom(room string, data any) {
+	c.Write(&TxPacket{
+		Packet:  Packet{Opcode: "G_MSG", TTL: 1},
+		Payload: RoomMessageArgs{Room: room, Data: data},
+	})
+}
+
+// messageRoom returns the room a G_MSG is addressed to, if any.
+func messageRoom(r *RxPacket) string {
+	var args RxRoomMessageArgs
+	if err := json.Unmarshal(r.Payload, &args); err != nil {
+		return ""
+	}
+	return args.Room
+}
+
+func parseRoomReply(reply *RxPacket) ([]RoomMember, error) {
+	switch reply.Opcode {
+	case "ROOM_MEMBERS":
+		var args RoomMembersArgs
+		if err := json.Unmarshal(reply.Payload, &args); err != nil {
+			return nil, err
+		}
+		return args.Members, nil
+	case "ROOM_ERROR":
+		var args RoomErrorArgs
+		if err := json.Unmarshal(reply.Payload, &args); err != nil {
+			return nil, err
+		}
+		return nil, &RemoteError{Opcode: reply.Opcode, Message: args.Error}
+	default:
+		return nil, &RemoteError{Opcode: reply.Opcode, Message: "unexpected reply"}
+	}
+}
+
+func (conn *Peer) replyRoomError(r *RxPacket, room string, err error) {
+	conn.Write(&TxPacket{
+		Packet:  Packet{Opcode: "ROOM_ERROR", TTL: 1, Listener: r.Listener},
+		Payload: RoomErrorArgs{Room: room, Error: err.Error()},
+	})
+}
+
+func (conn *Peer) replyRoomMembers(r *RxPacket, room *Room) {
+	conn.Write(&TxPacket{
+		Packet:  Packet{Opcode: "ROOM_MEMBERS", TTL: 1, Listener: r.Listener},
+		Payload: RoomMembersArgs{Room: room.Name, Members: room.roster()},
+	})
+}
+
+func (conn *Peer) HandleRoomJoin(r *RxPacket) {
+	var args RoomArgs
+	if err := json.Unmarshal(r.Payload, &args); err != nil {
+		conn.Logger.Error().Err(err).Msg("failed to unmarshal room join arguments")
+		return
+	}
+
+	room, err := conn.Parent.JoinRoom(conn, args.Room, args.Password)
+	if err != nil {
+		conn.Logger.Warn().Err(err).Str("room", args.Room).Msg("rejected room join")
+		conn.replyRoomError(r, args.Room, err)
+		return
+	}
+	conn.replyRoomMembers(r, room)
+}
+
+func (conn *Peer) HandleRoomLeave(r *RxPacket) {
+	var args RoomArgs
+	if err := json.Unmarshal(r.Payload, &args); err != nil {
+		conn.Logger.Error().Err(err).Msg("failed to unmarshal room leave arguments")
+		return
+	}
+	conn.Parent.LeaveRoom(conn, args.Room)
+}
+
+func (conn *Peer) HandleRoomMembers(r *RxPacket) {
+	var args RoomArgs
+	if err := json.Unmarshal(r.Payload, &args); err != nil {
+		conn.Logger.Error().Err(err).Msg("failed to unmarshal room members arguments")
+		return
+	}
+
+	room, ok := conn.Parent.Room(args.Room)
+	if !ok || !room.Has(conn) {
+		conn.replyRoomError(r, args.Room, ErrRoomNotFound)
+		return
+	}
+	conn.replyRoomMembers(r, room)
+}
+
+// HandleRoomMessage passes a G_MSG to OnRoomMessage, and relays it to the
+// other members, once for each of the sender's rooms it is addressed to.
+func (conn *Peer) HandleRoomMessage(r *RxPacket) {
+	var args RxRoomMessageArgs
+	if err := json.Unmarshal(r.Payload, &args); err != nil {
+		conn.Logger.Error().Err(err).Msg("failed to unmarshal room message arguments")
+		return
+	}
+
+	i := conn.Parent
+	var rooms []*Room
+	if args.Room != "" {
+		if room, ok := i.Room(args.Room); ok && room.Has(conn) {
+			rooms = []*Room{room}
+		}
+	} else {
+		rooms = i.RoomsOf(conn)
+	}
+	if len(rooms) == 0 {
+		conn.Logger.Debug().Str("room", args.Room).Msg("dropped room message from a peer outside the room")
+		return
+	}
+
+	for _, room := range rooms {
+		if fn := i.OnRoomMessage; fn != nil {
+			fn(conn, room.Name, args.Data)
+		}
+		room.Broadcast(&TxPacket{
+			Packet: Packet{
+				Opcode: "G_MSG",
+				Origin: conn.GetPeerID(),
+				TTL:    1,
+			},
+			Payload: RoomMessageArgs{Room: room.Name, Data: args.Data},
+		}, conn)
+	}
+}
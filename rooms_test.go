@@ -0,0 +1,196 @@
+package duplex
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog"
+)
+
+func TestJoinRoomRules(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	a, b, c := unopenedPeer(i), unopenedPeer(i), unopenedPeer(i)
+
+	if _, err := i.JoinRoom(a, "", ""); !errors.Is(err, ErrRoomInvalidName) {
+		t.Fatalf("joined a room without a name: %v", err)
+	}
+	if _, err := i.CreateRoom("lobby", RoomOptions{Limit: 2, Password: "hunter2"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.JoinRoom(a, "lobby", "wrong"); !errors.Is(err, ErrRoomPassword) {
+		t.Fatalf("joined with the wrong password: %v", err)
+	}
+	i.JoinRoom(a, "lobby", "hunter2")
+	i.JoinRoom(b, "lobby", "hunter2")
+	if _, err := i.JoinRoom(c, "lobby", "hunter2"); !errors.Is(err, ErrRoomFull) {
+		t.Fatalf("joined a full room: %v", err)
+	}
+
+	// Joining twice is not an error, even once the room is full
+	room, err := i.JoinRoom(a, "lobby", "hunter2")
+	if err != nil || room.Len() != 2 {
+		t.Fatalf("rejoin: %v, %d members", err, room.Len())
+	}
+}
+
+func TestRoomsLifetime(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	a, b := unopenedPeer(i), unopenedPeer(i)
+
+	var joined, left int
+	i.OnRoomJoin = func(*Room, *Peer) { joined++ }
+	i.OnRoomLeave = func(*Room, *Peer) { left++ }
+
+	i.CreateRoom("hall", RoomOptions{Persistent: true})
+	i.JoinRoom(a, "hall", "")
+	i.JoinRoom(a, "game", "")
+	i.JoinRoom(b, "game", "")
+	if rooms := i.RoomsOf(a); len(rooms) != 2 {
+		t.Fatalf("a is in %d rooms", len(rooms))
+	}
+
+	i.leaveAllRooms(a)
+	if len(i.RoomsOf(a)) != 0 {
+		t.Fatal("closed peer still in a room")
+	}
+	if _, ok := i.Room("hall"); !ok {
+		t.Fatal("empty persistent room deleted")
+	}
+
+	i.LeaveRoom(b, "game")
+	i.LeaveRoom(b, "game")
+	if _, ok := i.Room("game"); ok {
+		t.Fatal("empty room kept")
+	}
+	if joined != 3 || left != 3 {
+		t.Fatalf("%d joins and %d leaves reported", joined, left)
+	}
+
+	i.JoinRoom(b, "hall", "")
+	i.DeleteRoom("hall")
+	if _, ok := i.Room("hall"); ok || len(i.RoomsOf(b)) != 0 {
+		t.Fatal("deleted room still around")
+	}
+}
+
+func roomPacket(opcode string, payload any) *RxPacket {
+	raw, _ := json.Marshal(payload)
+	return &RxPacket{Packet: Packet{Opcode: opcode, TTL: 1}, Payload: raw}
+}
+
+func TestRoomPackets(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	a, b := unopenedPeer(i), unopenedPeer(i)
+	i.CreateRoom("vip", RoomOptions{Password: "secret"})
+
+	a.HandlePacket(roomPacket("ROOM_JOIN", RoomArgs{Room: "vip"}))
+	a.HandlePacket(roomPacket("ROOM_JOIN", RoomArgs{Room: "lobby"}))
+	b.HandlePacket(roomPacket("ROOM_JOIN", RoomArgs{Room: "vip", Password: "secret"}))
+	if room, _ := i.Room("vip"); room.Has(a) || !room.Has(b) {
+		t.Fatal("password ignored")
+	}
+
+	type message struct{ from, room, data string }
+	var got []message
+	i.OnRoomMessage = func(p *Peer, room string, data json.RawMessage) {
+		got = append(got, message{p.GetPeerID(), room, string(data)})
+	}
+	b.HandlePacket(roomPacket("G_MSG", RoomMessageArgs{Room: "vip", Data: "hi"}))
+	if len(got) != 1 || got[0].room != "vip" || got[0].data != `"hi"` {
+		t.Fatalf("messages %v", got)
+	}
+
+	a.HandlePacket(roomPacket("ROOM_LEAVE", RoomArgs{Room: "lobby"}))
+	if _, ok := i.Room("lobby"); ok {
+		t.Fatal("ROOM_LEAVE ignored")
+	}
+}
+
+func TestRoomlessMessageGoesToBoundHandler(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+	p.HandlePacket(roomPacket("ROOM_JOIN", RoomArgs{Room: "lobby"}))
+
+	var rooms []string
+	i.OnRoomMessage = func(_ *Peer, room string, _ json.RawMessage) { rooms = append(rooms, room) }
+	var bound int
+	i.Bind("G_MSG", func(*Peer, *RxPacket) { bound++ })
+
+	p.HandlePacket(roomPacket("G_MSG", map[string]any{"val": "hello"}))
+	if bound != 1 || len(rooms) != 0 {
+		t.Fatalf("bound handler ran %d times, rooms got %v", bound, rooms)
+	}
+	p.HandlePacket(roomPacket("G_MSG", RoomMessageArgs{Room: "lobby", Data: "hi"}))
+	if bound != 1 || len(rooms) != 1 {
+		t.Fatalf("room message went to the bound handler: %d, %v", bound, rooms)
+	}
+}
+
+func TestRoomMessageNeedsMembership(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	member, outsider := unopenedPeer(i), unopenedPeer(i)
+	member.HandlePacket(roomPacket("ROOM_JOIN", RoomArgs{Room: "lobby"}))
+	member.HandlePacket(roomPacket("ROOM_JOIN", RoomArgs{Room: "vip"}))
+
+	var rooms []string
+	i.OnRoomMessage = func(_ *Peer, room string, _ json.RawMessage) { rooms = append(rooms, room) }
+
+	outsider.HandlePacket(roomPacket("G_MSG", RoomMessageArgs{Room: "lobby", Data: "hi"}))
+	outsider.HandlePacket(roomPacket("G_MSG", RoomMessageArgs{Room: "missing", Data: "hi"}))
+	if len(rooms) != 0 {
+		t.Fatalf("messages from outside the room reached %v", rooms)
+	}
+
+	// A message without a room goes to each of the sender's rooms
+	member.HandlePacket(roomPacket("G_MSG", RoomMessageArgs{Data: "hi"}))
+	slices.Sort(rooms)
+	if !slices.Equal(rooms, []string{"lobby", "vip"}) {
+		t.Fatalf("message delivered to %v", rooms)
+	}
+}
+
+func TestJoinAfterCloseIgnored(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+
+	close(p.Done)
+	i.leaveAllRooms(p)
+	if _, err := i.JoinRoom(p, "lobby", ""); !errors.Is(err, ErrPeerClosed) {
+		t.Fatalf("JoinRoom for a closed peer returned %v", err)
+	}
+	p.HandleRoomJoin(roomPacket("ROOM_JOIN", RoomArgs{Room: "lobby"}))
+	if _, ok := i.Room("lobby"); ok || len(i.RoomsOf(p)) != 0 {
+		t.Fatal("closed peer joined a room")
+	}
+}
+
+func TestRoomRequestsGiveUp(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := p.JoinRoom(ctx, "lobby", ""); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("JoinRoom returned %v", err)
+	}
+
+	close(p.Done)
+	if _, err := p.RoomMembers(context.Background(), "lobby"); !errors.Is(err, ErrPeerClosed) {
+		t.Fatalf("RoomMembers on a closed peer returned %v", err)
+	}
+}
+
+func TestParseRoomReply(t *testing.T) {
+	members, err := parseRoomReply(roomPacket("ROOM_MEMBERS", RoomMembersArgs{Room: "a", Members: []RoomMember{{Id: "x", Name: "X"}}}))
+	if err != nil || len(members) != 1 || members[0].Id != "x" {
+		t.Fatalf("members %v, %v", members, err)
+	}
+	var remote *RemoteError
+	if _, err := parseRoomReply(roomPacket("ROOM_ERROR", RoomErrorArgs{Room: "a", Error: "room is full"})); !errors.As(err, &remote) || remote.Message != "room is full" {
+		t.Fatalf("error %v", err)
+	}
+}
@@ -0,0 +1,480 @@
+package duplex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// RPC error codes.
+const (
+	CodeNotFound         = "not_found"
+	CodeInvalidArgument  = "invalid_argument"
+	CodeCanceled         = "canceled"
+	CodeDeadlineExceeded = "deadline_exceeded"
+	CodeInternal         = "internal"
+)
+
+var ErrStreamClosed = errors.New("stream closed")
+
+// How long a cancel that arrives before its call is remembered. Packets are
+// handled concurrently, so an RPC_CANCEL may overtake its RPC_CALL.
+const rpc_early_cancel_window = 30 * time.Second
+
+// RPCError is an error returned by a remote method. Handlers may return one to
+// choose the code the caller sees; any other error is reported as internal.
+type RPCError struct {
+	Method  string `json:"method,omitempty"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Method, e.Message)
+}
+
+// Is lets canceled and expired calls match the context errors.
+func (e *RPCError) Is(target error) bool {
+	switch e.Code {
+	case CodeCanceled:
+		return target == context.Canceled
+	case CodeDeadlineExceeded:
+		return target == context.DeadlineExceeded
+	}
+	return false
+}
+
+type RPCCall struct {
+	Args    json.RawMessage `json:"args,omitempty"`
+	Timeout int64           `json:"timeout,omitempty"` // in milliseconds, zero if the caller has no deadline
+}
+
+type RPCResult struct {
+	Result any       `json:"result,omitempty"`
+	Error  *RPCError `json:"error,omitempty"`
+	Count  uint64    `json:"count,omitempty"` // Number of stream items sent before the result
+}
+
+type RxRPCResult struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *RPCError       `json:"error,omitempty"`
+	Count  uint64          `json:"count,omitempty"`
+}
+
+type RPCStreamItem struct {
+	Index uint64 `json:"index"`
+	Data  any    `json:"data"`
+}
+
+type RxRPCStreamItem struct {
+	Index uint64          `json:"index"`
+	Data  json.RawMessage `json:"data"`
+}
+
+type rpc_method struct {
+	unary  func(ctx context.Context, p *Peer, args json.RawMessage) (any, error)
+	stream func(ctx context.Context, p *Peer, args json.RawMessage, send func(any) error) error
+}
+
+type rpc_state struct {
+	mu       sync.Mutex
+	methods  map[string]*rpc_method
+	calls    map[string]context.CancelFunc // Calls being served, by peer ID and call Id
+	canceled map[string]time.Time          // Cancels that arrived before their call, by peer ID and call Id
+}
+
+// RegisterMethod registers a method that remote peers can invoke with Call.
+func RegisterMethod[A, R any](i *Instance, method string, fn func(ctx context.Context, p *Peer, args A) (R, error)) {
+	i.rpc.mu.Lock()
+	defer i.rpc.mu.Unlock()
+	i.rpc.methods[method] = &rpc_method{
+		unary: func(ctx context.Context, p *Peer, raw json.RawMessage) (any, error) {
+			var args A
+			if err := decodeArgs(raw, &args); err != nil {
+				return nil, &RPCError{Code: CodeInvalidArgument, Message: err.Error()}
+			}
+			return fn(ctx, p, args)
+		},
+	}
+}
+
+// RegisterStream registers a method that sends any number of results, which
+// remote peers receive through CallStream.
+func RegisterStream[A, R any](i *Instance, method string, fn func(ctx context.Context, p *Peer, args A, send func(R) error) error) {
+	i.rpc.mu.Lock()
+	defer i.rpc.mu.Unlock()
+	i.rpc.methods[method] = &rpc_method{
+		stream: func(ctx context.Context, p *Peer, raw json.RawMessage, send func(any) error) error {
+			var args A
+			if err := decodeArgs(raw, &args); err != nil {
+				return &RPCError{Code: CodeInvalidArgument, Message: err.Error()}
+			}
+			return fn(ctx, p, args, func(item R) error {
+				return send(item)
+			})
+		},
+	}
+}
+
+// UnregisterMethod removes a method registered with RegisterMethod or RegisterStream.
+func (i *Instance) UnregisterMethod(method string) {
+	i.rpc.mu.Lock()
+	defer i.rpc.mu.Unlock()
+	delete(i.rpc.methods, method)
+}
+
+func decodeArgs(raw json.RawMessage, args any) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	return json.Unmarshal(raw, args)
+}
+
+// rpcCall sends an RPC_CALL and binds a listener for everything sent back.
+func (c *Peer) rpcCall(ctx context.Context, method string, args any, listener Listener) (string, error) {
+	raw, err := json.Marshal(args)
+	if err != nil {
+		return "", err
+	}
+
+	call := RPCCall{Args: raw}
+	if deadline, ok := ctx.Deadline(); ok {
+		call.Timeout = max(time.Until(deadline).Milliseconds(), 1)
+	}
+
+	id := newRandomID()
+	c.BindListener(id, listener)
+	c.Write(&TxPacket{
+		Packet:  Packet{Opcode: "RPC_CALL", TTL: 1, Id: id, Method: method, Listener: id},
+		Payload: call,
+	})
+	return id, nil
+}
+
+// cancelCall tells the remote side to stop serving a call.
+func (c *Peer) cancelCall(id string) {
+	c.UnbindListener(id)
+	c.Write(&TxPacket{
+		Packet: Packet{Opcode: "RPC_CANCEL", TTL: 1, Id: id},
+	})
+}
+
+// Call invokes a remote method and decodes its result into result, which may
+// be nil if the result is not needed. The context's deadline is sent to the
+// remote side, and the call is canceled there if the context ends first.
+func (c *Peer) Call(ctx context.Context, method string, args any, result any) error {
+	response := make(chan *RxPacket, 1)
+	id, err := c.rpcCall(ctx, method, args, func(r *RxPacket) {
+		if r.Opcode == "RPC_RESULT" {
+			select {
+			case response <- r:
+			default:
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	var r *RxPacket
+	select {
+	case r = <-response:
+		c.UnbindListener(id)
+	case <-ctx.Done():
+		c.cancelCall(id)
+		return ctx.Err()
+	case <-c.Closed():
+		c.UnbindListener(id)
+		return ErrPeerClosed
+	}
+
+	var reply RxRPCResult
+	if err := json.Unmarshal(r.Payload, &reply); err != nil {
+		return err
+	}
+	if reply.Error != nil {
+		reply.Error.Method = method
+		return reply.Error
+	}
+	if result != nil && len(reply.Result) > 0 {
+		return json.Unmarshal(reply.Result, result)
+	}
+	return nil
+}
+
+// Stream receives the results of a streaming call, in the order they were sent.
+type Stream struct {
+	peer    *Peer
+	id      string
+	method  string
+	mu      sync.Mutex
+	ready   chan struct{}
+	pending map[uint64]json.RawMessage // Items that arrived ahead of next
+	next    uint64
+	count   uint64 // Total items, known once the result arrives
+	ended   bool
+	err     error
+	done    chan struct{}
+	once    sync.Once
+}
+
+// CallStream invokes a remote streaming method. Results are read with Recv
+// until it returns io.EOF. Close cancels the call.
+func (c *Peer) CallStream(ctx context.Context, method string, args any) (*Stream, error) {
+	s := &Stream{
+		peer:    c,
+		method:  method,
+		ready:   make(chan struct{}, 1),
+		pending: make(map[uint64]json.RawMessage),
+		done:    make(chan struct{}),
+	}
+
+	id, err := c.rpcCall(ctx, method, args, s.receive)
+	if err != nil {
+		return nil, err
+	}
+	s.id = id
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.finish(ctx.Err(), true)
+		case <-c.Closed():
+			s.finish(ErrPeerClosed, false)
+		case <-s.done:
+		}
+	}()
+	return s, nil
+}
+
+// Packets are handled concurrently, so items are put back in order by index.
+func (s *Stream) receive(r *RxPacket) {
+	s.mu.Lock()
+	switch r.Opcode {
+	case "RPC_STREAM":
+		var item RxRPCStreamItem
+		if err := json.Unmarshal(r.Payload, &item); err != nil {
+			s.peer.Logger.Error().Err(err).Msg("failed to unmarshal stream item")
+			break
+		}
+		if item.Index >= s.next {
+			s.pending[item.Index] = item.Data
+		}
+
+	case "RPC_RESULT":
+		var reply RxRPCResult
+		if err := json.Unmarshal(r.Payload, &reply); err != nil {
+			s.peer.Logger.Error().Err(err).Msg("failed to unmarshal stream result")
+			break
+		}
+		s.ended = true
+		s.count = reply.Count
+		if reply.Error != nil {
+			reply.Error.Method = s.method
+			s.err = reply.Error
+		}
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Recv decodes the next result into v. It returns io.EOF once the stream has
+// ended, or the error the remote method failed with.
+func (s *Stream) Recv(v any) error {
+	for {
+		s.mu.Lock()
+		if data, ok := s.pending[s.next]; ok {
+			delete(s.pending, s.next)
+			s.next++
+			s.mu.Unlock()
+			return json.Unmarshal(data, v)
+		}
+		if s.ended && s.next >= s.count {
+			err := s.err
+			s.mu.Unlock()
+			s.finish(nil, false)
+			if err != nil {
+				return err
+			}
+			return io.EOF
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.ready:
+		case <-s.done:
+			s.mu.Lock()
+			err := s.err
+			s.mu.Unlock()
+			if err == nil {
+				err = ErrStreamClosed
+			}
+			return err
+		}
+	}
+}
+
+// Close stops receiving, and cancels the call if it has not ended.
+func (s *Stream) Close() {
+	s.mu.Lock()
+	ended := s.ended
+	s.mu.Unlock()
+	s.finish(nil, !ended)
+}
+
+func (s *Stream) finish(err error, cancel bool) {
+	s.once.Do(func() {
+		s.mu.Lock()
+		if s.err == nil {
+			s.err = err
+		}
+		s.mu.Unlock()
+		if cancel {
+			s.peer.cancelCall(s.id)
+		} else {
+			s.peer.UnbindListener(s.id)
+		}
+		close(s.done)
+	})
+}
+
+func rpcErrorOf(err error) *RPCError {
+	var rpc_err *RPCError
+	switch {
+	case errors.As(err, &rpc_err):
+		return &RPCError{Code: rpc_err.Code, Message: rpc_err.Message}
+	case errors.Is(err, context.DeadlineExceeded):
+		return &RPCError{Code: CodeDeadlineExceeded, Message: err.Error()}
+	case errors.Is(err, context.Canceled):
+		return &RPCError{Code: CodeCanceled, Message: err.Error()}
+	}
+	return &RPCError{Code: CodeInternal, Message: err.Error()}
+}
+
+func (conn *Peer) HandleRPCCall(r *RxPacket) {
+	i := conn.Parent
+	reply := func(result RPCResult) {
+		conn.Write(&TxPacket{
+			Packet:  Packet{Opcode: "RPC_RESULT", TTL: 1, Id: r.Id, Listener: r.Listener},
+			Payload: result,
+		})
+	}
+
+	var call RPCCall
+	if err := json.Unmarshal(r.Payload, &call); err != nil {
+		conn.Logger.Error().Err(err).Msg("failed to unmarshal rpc call")
+		reply(RPCResult{Error: &RPCError{Code: CodeInvalidArgument, Message: "malformed call"}})
+		return
+	}
+
+	i.rpc.mu.Lock()
+	method, ok := i.rpc.methods[r.Method]
+	i.rpc.mu.Unlock()
+	if !ok {
+		conn.Logger.Debug().Str("method", r.Method).Msg("rpc call to unknown method")
+		reply(RPCResult{Error: &RPCError{Code: CodeNotFound, Message: "method not found"}})
+		return
+	}
+
+	// The caller's deadline carries over as a timeout, since clocks may differ
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if call.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), time.Duration(call.Timeout)*time.Millisecond)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+
+	key := conn.GetPeerID() + ":" + r.Id
+	i.rpc.mu.Lock()
+	if _, early := i.rpc.canceled[key]; early {
+		delete(i.rpc.canceled, key)
+		i.rpc.mu.Unlock()
+		conn.Logger.Debug().Str("id", r.Id).Msg("rpc call canceled before it arrived")
+		reply(RPCResult{Error: &RPCError{Code: CodeCanceled, Message: context.Canceled.Error()}})
+		return
+	}
+	i.rpc.calls[key] = cancel
+	i.rpc.mu.Unlock()
+	defer func() {
+		i.rpc.mu.Lock()
+		delete(i.rpc.calls, key)
+		i.rpc.mu.Unlock()
+	}()
+
+	// Stop serving if the caller goes away
+	go func() {
+		select {
+		case <-conn.Closed():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if method.unary != nil {
+		result, err := method.unary(ctx, conn, call.Args)
+		if err != nil {
+			reply(RPCResult{Error: rpcErrorOf(err)})
+			return
+		}
+		reply(RPCResult{Result: result})
+		return
+	}
+
+	var count uint64
+	err := method.stream(ctx, conn, call.Args, func(item any) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		conn.Write(&TxPacket{
+			Packet:  Packet{Opcode: "RPC_STREAM", TTL: 1, Id: r.Id, Listener: r.Listener},
+			Payload: RPCStreamItem{Index: count, Data: item},
+		})
+		count++
+		return nil
+	})
+	if err != nil {
+		reply(RPCResult{Error: rpcErrorOf(err), Count: count})
+		return
+	}
+	reply(RPCResult{Count: count})
+}
+
+// HandleRPCCancel stops serving a call. If the call has not arrived yet, the
+// cancel is remembered for a while so that the call is refused when it does.
+func (conn *Peer) HandleRPCCancel(r *RxPacket) {
+	if r.Id == "" {
+		return
+	}
+
+	i := conn.Parent
+	key := conn.GetPeerID() + ":" + r.Id
+	now := time.Now()
+
+	i.rpc.mu.Lock()
+	cancel, ok := i.rpc.calls[key]
+	if !ok {
+		for k, at := range i.rpc.canceled {
+			if now.Sub(at) > rpc_early_cancel_window {
+				delete(i.rpc.canceled, k)
+			}
+		}
+		i.rpc.canceled[key] = now
+	}
+	i.rpc.mu.Unlock()
+
+	if ok {
+		conn.Logger.Debug().Str("id", r.Id).Msg("rpc call canceled by caller")
+		cancel()
+	}
+}
@@ -0,0 +1,198 @@
+package duplex
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog"
+)
+
+func rpcPacket(opcode, id, method string, payload any) *RxPacket {
+	raw, _ := json.Marshal(payload)
+	return &RxPacket{Packet: Packet{Opcode: opcode, TTL: 1, Id: id, Method: method, Listener: id}, Payload: raw}
+}
+
+// pendingCall returns the listener bound by an outgoing call on the peer. It
+// may be called from any goroutine.
+func pendingCall(t *testing.T, p *Peer) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.ListenerLock.Lock()
+		for id := range p.Listeners {
+			p.ListenerLock.Unlock()
+			return id
+		}
+		p.ListenerLock.Unlock()
+		if time.Now().After(deadline) {
+			t.Error("no call in flight")
+			return ""
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRPCErrors(t *testing.T) {
+	if !errors.Is(&RPCError{Code: CodeDeadlineExceeded}, context.DeadlineExceeded) {
+		t.Fatal("expired call does not match the context error")
+	}
+	if errors.Is(&RPCError{Code: CodeInternal}, context.Canceled) {
+		t.Fatal("internal error matches a canceled context")
+	}
+	for err, code := range map[error]string{
+		context.Canceled:         CodeCanceled,
+		context.DeadlineExceeded: CodeDeadlineExceeded,
+		errors.New("boom"):       CodeInternal,
+		&RPCError{Code: CodeNotFound, Message: "no widget"}: CodeNotFound,
+	} {
+		if got := rpcErrorOf(err).Code; got != code {
+			t.Errorf("%v reported as %s", err, got)
+		}
+	}
+}
+
+func TestServeRPCCall(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+
+	type args struct{ A, B int }
+	got := make(chan int, 1)
+	deadline := make(chan bool, 1)
+	RegisterMethod(i, "add", func(ctx context.Context, _ *Peer, a args) (int, error) {
+		_, ok := ctx.Deadline()
+		deadline <- ok
+		got <- a.A + a.B
+		return a.A + a.B, nil
+	})
+
+	raw, _ := json.Marshal(args{2, 3})
+	p.HandlePacket(rpcPacket("RPC_CALL", "1", "add", RPCCall{Args: raw, Timeout: 1000}))
+	if sum := <-got; sum != 5 || !<-deadline {
+		t.Fatalf("sum %d", sum)
+	}
+
+	i.UnregisterMethod("add")
+	p.HandlePacket(rpcPacket("RPC_CALL", "2", "add", RPCCall{Args: raw}))
+	if len(got) != 0 {
+		t.Fatal("unregistered method called")
+	}
+}
+
+func TestCancelServedCall(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+
+	started := make(chan struct{})
+	RegisterMethod(i, "wait", func(ctx context.Context, _ *Peer, _ struct{}) (any, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	served := make(chan struct{})
+	go func() {
+		p.HandlePacket(rpcPacket("RPC_CALL", "1", "wait", RPCCall{}))
+		close(served)
+	}()
+	<-started
+	p.HandlePacket(rpcPacket("RPC_CANCEL", "1", "", nil))
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("call kept running after RPC_CANCEL")
+	}
+	if len(i.rpc.calls) != 0 {
+		t.Fatal("finished call still tracked")
+	}
+}
+
+func TestCancelBeforeCall(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+
+	var called bool
+	RegisterMethod(i, "work", func(context.Context, *Peer, struct{}) (any, error) {
+		called = true
+		return nil, nil
+	})
+
+	p.HandlePacket(rpcPacket("RPC_CANCEL", "1", "", nil))
+	p.HandlePacket(rpcPacket("RPC_CALL", "1", "work", RPCCall{}))
+	if called {
+		t.Fatal("call served after its cancel arrived")
+	}
+	if len(i.rpc.canceled) != 0 {
+		t.Fatal("early cancel still remembered after its call")
+	}
+
+	// Cancels without an Id are meaningless
+	p.HandlePacket(rpcPacket("RPC_CANCEL", "", "", nil))
+	if len(i.rpc.canceled) != 0 {
+		t.Fatal("remembered a cancel without an Id")
+	}
+}
+
+func TestCallResult(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	go func() {
+		id := pendingCall(t, p)
+		p.HandlePacket(rpcPacket("RPC_RESULT", id, "", RPCResult{Result: 5}))
+	}()
+	var sum int
+	if err := p.Call(ctx, "add", nil, &sum); err != nil || sum != 5 {
+		t.Fatalf("result %d, %v", sum, err)
+	}
+
+	go func() {
+		id := pendingCall(t, p)
+		p.HandlePacket(rpcPacket("RPC_RESULT", id, "", RPCResult{Error: &RPCError{Code: CodeNotFound, Message: "method not found"}}))
+	}()
+	var rpc_err *RPCError
+	if err := p.Call(ctx, "missing", nil, nil); !errors.As(err, &rpc_err) || rpc_err.Method != "missing" || rpc_err.Code != CodeNotFound {
+		t.Fatalf("error %v", err)
+	}
+
+	short, cancel_short := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel_short()
+	if err := p.Call(short, "slow", nil, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expired call returned %v", err)
+	}
+	if len(p.Listeners) != 0 {
+		t.Fatal("listener left behind")
+	}
+}
+
+func TestStreamReordersItems(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+
+	s, err := p.CallStream(context.Background(), "count", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	id := pendingCall(t, p)
+
+	for _, n := range []uint64{2, 0, 1} {
+		p.HandlePacket(rpcPacket("RPC_STREAM", id, "", RPCStreamItem{Index: n, Data: n * 10}))
+	}
+	p.HandlePacket(rpcPacket("RPC_RESULT", id, "", RPCResult{Count: 3}))
+
+	for want := 0; want < 30; want += 10 {
+		var got int
+		if err := s.Recv(&got); err != nil || got != want {
+			t.Fatalf("received %d, %v; want %d", got, err, want)
+		}
+	}
+	if err := s.Recv(new(int)); err != io.EOF {
+		t.Fatalf("end of stream returned %v", err)
+	}
+}
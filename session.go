@@ -0,0 +1,461 @@
+package duplex
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+// ErrSessionOverflow is the error a session fails with when it would have to
+// drop a packet to stay within SessionReplaySize.
+var ErrSessionOverflow = errors.New("session replay buffer overflowed")
+
+// Opcodes that are never sequenced, since they manage the connection itself.
+var session_control_opcodes = []string{"NEGOTIATE", "PING", "PONG", "SESSION_ACK"}
+
+// SessionArgs is exchanged during negotiation to establish or resume a session.
+type SessionArgs struct {
+	Token    string `json:"token"`
+	Received uint64 `json:"received"`          // Highest sequence number delivered in order by the sender
+	Resumed  bool   `json:"resumed,omitempty"` // Set by the responder if the token matched a live session
+}
+
+type SessionAck struct {
+	Seq uint64 `json:"seq"`
+}
+
+type session_entry struct {
+	seq uint64
+	raw []byte
+}
+
+type session_delivery struct {
+	conn   *Peer
+	packet *RxPacket
+}
+
+// Session provides exactly-once, in-order delivery across reconnects. Each
+// outbound packet is numbered and kept in a bounded replay buffer until the
+// remote acknowledges it. When a connection with the same token comes back,
+// both sides resend whatever the other has not yet received.
+//
+// If the remote falls more than SessionReplaySize packets behind, in either
+// direction, exactly-once delivery can no longer be guaranteed. The session
+// then fails with ErrSessionOverflow and its connection is closed, so that the
+// next connection starts a new session.
+type Session struct {
+	Token    string
+	RemoteID string
+
+	mu       sync.Mutex
+	parent   *Instance
+	last_seq uint64               // Last sequence number assigned to an outbound packet
+	received uint64               // Highest inbound sequence number delivered in order
+	last_ack uint64               // Highest inbound sequence number we acknowledged
+	replay   []session_entry      // Outbound packets not yet acknowledged
+	pending  map[uint64]*RxPacket // Inbound packets that arrived out of order
+	inbox    []session_delivery   // Inbound packets waiting for dispatch
+	wake     chan struct{}        // Signals the dispatcher
+	closed   chan struct{}        // Closed when the session expires
+	expiry   *time.Timer          // Fires when a detached session was not resumed in time
+	attached *Peer                // Connection the session is currently bound to
+	err      error                // Why the session failed, if it did
+}
+
+func (i *Instance) newSession(token, remote string) *Session {
+	s := &Session{
+		Token:    token,
+		RemoteID: remote,
+		parent:   i,
+		pending:  make(map[uint64]*RxPacket),
+		wake:     make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+	go s.dispatch()
+
+	i.sessionsMu.Lock()
+	i.sessions[token] = s
+	i.sessionsMu.Unlock()
+	return s
+}
+
+// sessionByToken returns a live session with the given token.
+func (i *Instance) sessionByToken(token string) (*Session, bool) {
+	i.sessionsMu.Lock()
+	defer i.sessionsMu.Unlock()
+	s, ok := i.sessions[token]
+	return s, ok
+}
+
+// sessionByRemote returns a detached session previously established with the given peer ID.
+func (i *Instance) sessionByRemote(remote string) (*Session, bool) {
+	i.sessionsMu.Lock()
+	defer i.sessionsMu.Unlock()
+	for _, s := range i.sessions {
+		if s.RemoteID == remote && s.peer() == nil {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+// Session returns the session bound to this connection, if any.
+func (c *Peer) Session() *Session {
+	return c.session.Load()
+}
+
+// sessionOffer returns the session arguments sent by the initiator.
+func (c *Peer) sessionOffer() *SessionArgs {
+	i := c.Parent
+	if !i.EnableSessions {
+		return nil
+	}
+	s, ok := i.sessionByRemote(c.GetPeerID())
+	if !ok {
+		return &SessionArgs{Token: newRandomID()}
+	}
+	return &SessionArgs{Token: s.Token, Received: s.delivered()}
+}
+
+// acceptSession handles session arguments received by the responder. It
+// returns the arguments to reply with, and the session to attach once the
+// reply was sent.
+func (c *Peer) acceptSession(offer *SessionArgs) (*SessionArgs, *Session) {
+	i := c.Parent
+	token := offer.Token
+	if s, ok := i.sessionByToken(token); ok {
+		if s.RemoteID == c.GetPeerID() {
+			c.Logger.Info().Str("token", s.Token).Msg("resuming session")
+			return &SessionArgs{Token: s.Token, Received: s.delivered(), Resumed: true}, s
+		}
+		// Never hand another peer's session over
+		token = newRandomID()
+	}
+	s := i.newSession(token, c.GetPeerID())
+	c.Logger.Info().Str("token", s.Token).Msg("new session")
+	return &SessionArgs{Token: s.Token}, s
+}
+
+// completeSession handles the session arguments replied by the responder.
+func (c *Peer) completeSession(reply *SessionArgs) *Session {
+	i := c.Parent
+	s, ok := i.sessionByToken(reply.Token)
+	if ok && reply.Resumed {
+		c.Logger.Info().Str("token", s.Token).Msg("resuming session")
+		return s
+	}
+	if ok {
+		// The remote lost its end of the session, so whatever we had is gone.
+		c.Logger.Warn().Str("token", s.Token).Msg("remote did not resume session, starting over")
+		s.expire()
+	}
+	s = i.newSession(reply.Token, c.GetPeerID())
+	c.Logger.Info().Str("token", s.Token).Msg("new session")
+	return s
+}
+
+// attach binds the session to a connection and resends everything the remote
+// has not received yet.
+func (s *Session) attach(c *Peer, remote_received uint64) {
+	s.mu.Lock()
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+	s.attached = c
+	s.trim(remote_received)
+	replay := slices.Clone(s.replay)
+	s.last_ack = s.received
+	s.mu.Unlock()
+
+	c.Lock.Lock()
+	c.session.Store(s)
+	for _, entry := range replay {
+		c.send(entry.raw)
+	}
+	c.Lock.Unlock()
+
+	if len(replay) > 0 {
+		c.Logger.Info().Int("count", len(replay)).Msg("replayed unacknowledged packets")
+	}
+
+	go s.acknowledge(c)
+}
+
+// detach unbinds the session from a closed connection. If it is not resumed
+// within the session timeout, it expires.
+func (s *Session) detach(c *Peer) {
+	c.session.Store(nil)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attached != c {
+		return
+	}
+	s.attached = nil
+	s.expiry = time.AfterFunc(s.parent.SessionTimeout, s.expire)
+}
+
+func (s *Session) expire() {
+	i := s.parent
+	i.sessionsMu.Lock()
+	if i.sessions[s.Token] == s {
+		delete(i.sessions, s.Token)
+	}
+	i.sessionsMu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.closed:
+	default:
+		close(s.closed)
+	}
+}
+
+// fail ends a session that can no longer deliver exactly once, and closes its
+// connection so that the peers start over with a new session.
+func (s *Session) fail(c *Peer, err error) {
+	s.mu.Lock()
+	failed := s.err != nil
+	if !failed {
+		s.err = err
+	}
+	s.mu.Unlock()
+	if failed {
+		return
+	}
+
+	c.Logger.Error().Err(err).Str("token", s.Token).Msg("session failed, closing connection")
+	s.expire()
+	go c.Close()
+}
+
+// Err returns the error the session failed with, or nil.
+func (s *Session) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Session) peer() *Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attached
+}
+
+func (s *Session) delivered() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.received
+}
+
+// trim drops replay entries acknowledged by the remote. Must be called with s.mu held.
+func (s *Session) trim(acked uint64) {
+	n := 0
+	for n < len(s.replay) && s.replay[n].seq <= acked {
+		n++
+	}
+	s.replay = s.replay[n:]
+}
+
+// sequence numbers a packet, encodes it and keeps a copy for replay. If the
+// replay buffer is full, the packet is refused with ErrSessionOverflow.
+func (s *Session) sequence(packet *TxPacket) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return nil, s.err
+	}
+	if limit := s.parent.SessionReplaySize; limit > 0 && len(s.replay) >= limit {
+		return nil, ErrSessionOverflow
+	}
+
+	numbered := *packet
+	numbered.Seq = s.last_seq + 1
+	raw, err := json.Marshal(&numbered)
+	if err != nil {
+		return nil, err
+	}
+	s.last_seq = numbered.Seq
+	s.replay = append(s.replay, session_entry{seq: numbered.Seq, raw: raw})
+	return raw, nil
+}
+
+// receive accounts for a sequenced inbound packet and returns the packets
+// that can now be delivered in order. Duplicates are dropped. If more packets
+// arrive out of order than the session holds, it returns ErrSessionOverflow.
+func (s *Session) receive(packet *RxPacket) ([]*RxPacket, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return nil, s.err
+	}
+	if packet.Seq <= s.received {
+		return nil, nil
+	}
+	if packet.Seq != s.received+1 {
+		if _, ok := s.pending[packet.Seq]; ok {
+			return nil, nil
+		}
+		if limit := s.parent.SessionReplaySize; limit > 0 && len(s.pending) >= limit {
+			return nil, ErrSessionOverflow
+		}
+		s.pending[packet.Seq] = packet
+		return nil, nil
+	}
+
+	ready := []*RxPacket{packet}
+	s.received = packet.Seq
+	for {
+		next, ok := s.pending[s.received+1]
+		if !ok {
+			break
+		}
+		delete(s.pending, s.received+1)
+		s.received++
+		ready = append(ready, next)
+	}
+	return ready, nil
+}
+
+// enqueue hands packets to the dispatcher, which runs handlers one at a time.
+func (s *Session) enqueue(c *Peer, packets ...*RxPacket) {
+	s.mu.Lock()
+	for _, p := range packets {
+		s.inbox = append(s.inbox, session_delivery{conn: c, packet: p})
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Session) dispatch() {
+	for {
+		select {
+		case <-s.wake:
+		case <-s.closed:
+			return
+		}
+		for {
+			s.mu.Lock()
+			if len(s.inbox) == 0 {
+				s.mu.Unlock()
+				break
+			}
+			next := s.inbox[0]
+			s.inbox = s.inbox[1:]
+			s.mu.Unlock()
+
+			next.conn.handle(next.packet)
+		}
+	}
+}
+
+// acknowledge periodically tells the remote which packets were delivered.
+func (s *Session) acknowledge(c *Peer) {
+	done := c.Closed()
+	ticker := time.NewTicker(s.parent.SessionAckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.sendAck(c, false)
+		case <-done:
+			return
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// sendAck acknowledges delivered packets. Unless forced, nothing is sent if
+// there is nothing new to acknowledge.
+func (s *Session) sendAck(c *Peer, force bool) {
+	s.mu.Lock()
+	received := s.received
+	if received == s.last_ack && !force {
+		s.mu.Unlock()
+		return
+	}
+	s.last_ack = received
+	s.mu.Unlock()
+
+	c.Write(&TxPacket{
+		Packet: Packet{
+			Opcode: "SESSION_ACK",
+			TTL:    1,
+		},
+		Payload: SessionAck{Seq: received},
+	})
+}
+
+// HandleSessionAck releases acknowledged packets from the replay buffer.
+func (conn *Peer) HandleSessionAck(r *RxPacket) {
+	s := conn.Session()
+	if s == nil {
+		return
+	}
+
+	var ack SessionAck
+	if err := json.Unmarshal(r.Payload, &ack); err != nil {
+		conn.Logger.Error().Err(err).Msg("failed to unmarshal session ack")
+		return
+	}
+
+	s.mu.Lock()
+	s.trim(ack.Seq)
+	s.mu.Unlock()
+}
+
+// receiveSequenced routes a sequenced inbound packet through the session.
+// Replies to listeners skip the dispatcher, since the handler waiting for
+// them may be the one currently holding it.
+func (c *Peer) receiveSequenced(s *Session, packet *RxPacket) {
+	ready, err := s.receive(packet)
+	if err != nil {
+		s.fail(c, err)
+		return
+	}
+
+	var queued []*RxPacket
+	for _, p := range ready {
+		if _, ok := c.GetListener(p.Listener); ok {
+			c.handleAsync(p)
+			continue
+		}
+		queued = append(queued, p)
+	}
+	if len(queued) > 0 {
+		s.enqueue(c, queued...)
+	}
+
+	// Acknowledge early if the remote's replay buffer is filling up
+	s.mu.Lock()
+	unacked := s.received - s.last_ack
+	s.mu.Unlock()
+	if limit := c.Parent.SessionReplaySize; limit > 0 && unacked >= uint64(limit/2) {
+		go s.sendAck(c, false)
+	}
+}
+
+// encode marshals a packet, numbering it first if a session is attached.
+func (c *Peer) encode(packet *TxPacket) ([]byte, error) {
+	s := c.Session()
+	if s == nil || slices.Contains(session_control_opcodes, packet.Opcode) {
+		return json.Marshal(packet)
+	}
+	raw, err := s.sequence(packet)
+	if errors.Is(err, ErrSessionOverflow) {
+		s.fail(c, err)
+	}
+	return raw, err
+}
@@ -0,0 +1,177 @@
+package duplex
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/rs/zerolog"
+)
+
+func TestSessionReceivesInOrderOnce(t *testing.T) {
+	i := New("alpha", &Config{EnableSessions: true, LogLevel: zerolog.Disabled})
+	s := i.newSession("token", "beta")
+	defer s.expire()
+
+	var delivered []uint64
+	for _, seq := range []uint64{2, 1, 2, 3, 1} {
+		ready, err := s.receive(&RxPacket{Packet: Packet{Opcode: "DATA", Seq: seq}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range ready {
+			delivered = append(delivered, p.Seq)
+		}
+	}
+	if len(delivered) != 3 || delivered[0] != 1 || delivered[1] != 2 || delivered[2] != 3 {
+		t.Fatalf("delivered %v", delivered)
+	}
+	if s.delivered() != 3 {
+		t.Fatalf("received up to %d", s.delivered())
+	}
+}
+
+func TestSessionKeepsPacketsUntilAcked(t *testing.T) {
+	i := New("alpha", &Config{EnableSessions: true, SessionReplaySize: 2, LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+	s := i.newSession("token", "beta")
+	defer s.expire()
+	p.session.Store(s)
+
+	for want := uint64(1); want <= 2; want++ {
+		raw, err := p.encode(&TxPacket{Packet: Packet{Opcode: "DATA"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sent Packet
+		json.Unmarshal(raw, &sent)
+		if sent.Seq != want {
+			t.Fatalf("numbered %d, want %d", sent.Seq, want)
+		}
+	}
+
+	// Connection management is never sequenced
+	raw, _ := p.encode(&TxPacket{Packet: Packet{Opcode: "PING"}})
+	var ping Packet
+	json.Unmarshal(raw, &ping)
+	if ping.Seq != 0 {
+		t.Fatalf("PING numbered %d", ping.Seq)
+	}
+
+	payload, _ := json.Marshal(SessionAck{Seq: 1})
+	p.HandleSessionAck(&RxPacket{Packet: Packet{Opcode: "SESSION_ACK"}, Payload: payload})
+	if len(s.replay) != 1 || s.replay[0].seq != 2 {
+		t.Fatalf("replay buffer %v after ack", s.replay)
+	}
+
+	// A full buffer fails the session rather than dropping a packet
+	p.encode(&TxPacket{Packet: Packet{Opcode: "DATA"}})
+	if _, err := p.encode(&TxPacket{Packet: Packet{Opcode: "DATA"}}); !errors.Is(err, ErrSessionOverflow) {
+		t.Fatalf("encoded into a full replay buffer: %v", err)
+	}
+	if len(s.replay) != 2 || s.replay[0].seq != 2 {
+		t.Fatalf("replay buffer %v after overflow", s.replay)
+	}
+	if !errors.Is(s.Err(), ErrSessionOverflow) {
+		t.Fatalf("session error %v", s.Err())
+	}
+	if _, ok := i.sessionByToken("token"); ok {
+		t.Fatal("failed session can still be resumed")
+	}
+}
+
+func TestSessionFailsWhenTooFarOutOfOrder(t *testing.T) {
+	i := New("alpha", &Config{EnableSessions: true, SessionReplaySize: 2, LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+	s := i.newSession("token", "beta")
+	defer s.expire()
+	s.attach(p, 0)
+
+	delivered := make(chan struct{}, 4)
+	i.Bind("DATA", func(*Peer, *RxPacket) { delivered <- struct{}{} })
+	for _, seq := range []uint64{2, 3, 4} {
+		p.receiveSequenced(s, &RxPacket{Packet: Packet{Opcode: "DATA", Seq: seq, TTL: 1}})
+	}
+	if !errors.Is(s.Err(), ErrSessionOverflow) {
+		t.Fatalf("session error %v", s.Err())
+	}
+	if _, err := s.receive(&RxPacket{Packet: Packet{Opcode: "DATA", Seq: 1}}); err == nil {
+		t.Fatal("failed session still receives")
+	}
+	if len(delivered) > 0 {
+		t.Fatal("packets delivered out of order")
+	}
+}
+
+func TestSessionResumeMatchesRemote(t *testing.T) {
+	i := New("alpha", &Config{EnableSessions: true, LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+
+	// The test connection has no remote ID, so a session with an empty
+	// remote belongs to it
+	mine := i.newSession("mine", p.GetPeerID())
+	defer mine.expire()
+	mine.receive(&RxPacket{Packet: Packet{Seq: 1}})
+	reply, s := p.acceptSession(&SessionArgs{Token: "mine"})
+	if s != mine || !reply.Resumed || reply.Received != 1 {
+		t.Fatalf("reply %+v", reply)
+	}
+
+	theirs := i.newSession("theirs", "gamma")
+	defer theirs.expire()
+	reply, s = p.acceptSession(&SessionArgs{Token: "theirs"})
+	defer s.expire()
+	if s == theirs || reply.Resumed || reply.Token == "theirs" {
+		t.Fatalf("handed over another peer's session: %+v", reply)
+	}
+}
+
+func TestCompleteSessionStartsOverWhenNotResumed(t *testing.T) {
+	i := New("alpha", &Config{EnableSessions: true, LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+	old := i.newSession("token", p.GetPeerID())
+
+	s := p.completeSession(&SessionArgs{Token: "token"})
+	defer s.expire()
+	if s == old {
+		t.Fatal("kept a session the remote lost")
+	}
+	select {
+	case <-old.closed:
+	default:
+		t.Fatal("lost session not expired")
+	}
+	if found, _ := i.sessionByToken("token"); found != s {
+		t.Fatal("new session not registered")
+	}
+}
+
+func TestDetachedSessionExpires(t *testing.T) {
+	i := New("alpha", &Config{EnableSessions: true, SessionTimeout: 20, LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+	s := i.newSession("token", "beta")
+	s.attach(p, 0)
+	if p.Session() != s {
+		t.Fatal("session not attached")
+	}
+	if found, ok := i.sessionByRemote("beta"); ok {
+		t.Fatalf("attached session %v offered for resume", found.Token)
+	}
+
+	s.detach(p)
+	if p.Session() != nil {
+		t.Fatal("session still attached")
+	}
+	if _, ok := i.sessionByRemote("beta"); !ok {
+		t.Fatal("detached session cannot be resumed")
+	}
+	select {
+	case <-s.closed:
+	case <-time.After(time.Second):
+		t.Fatal("detached session never expired")
+	}
+	if _, ok := i.sessionByToken("token"); ok {
+		t.Fatal("expired session still registered")
+	}
+}
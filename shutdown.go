@@ -0,0 +1,230 @@
+package duplex
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+type GoodbyeArgs struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// inflight counts running packet handlers, so that shutdown can wait for them.
+type inflight struct {
+	mu   sync.Mutex
+	n    int
+	idle chan struct{}
+}
+
+func (f *inflight) add() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.n == 0 {
+		f.idle = make(chan struct{})
+	}
+	f.n++
+}
+
+func (f *inflight) done() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.n--
+	if f.n == 0 {
+		close(f.idle)
+	}
+}
+
+// wait blocks until no handlers are running, or the context ends.
+func (f *inflight) wait(ctx context.Context) error {
+	f.mu.Lock()
+	if f.n == 0 {
+		f.mu.Unlock()
+		return nil
+	}
+	idle := f.idle
+	f.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handle runs the handler for a packet, counting it as in flight.
+func (c *Peer) handle(packet *RxPacket) {
+	c.inflight.add()
+	c.Parent.inflight.add()
+	defer c.Parent.inflight.done()
+	defer c.inflight.done()
+	c.HandlePacket(packet)
+}
+
+// handleAsync is a variant of handle that runs the handler in a new goroutine.
+func (c *Peer) handleAsync(packet *RxPacket) {
+	c.inflight.add()
+	c.Parent.inflight.add()
+	go func() {
+		defer c.Parent.inflight.done()
+		defer c.inflight.done()
+		c.HandlePacket(packet)
+	}()
+}
+
+// Closing returns true once Shutdown has been called.
+func (i *Instance) Closing() bool {
+	return i.closing.Load()
+}
+
+// closingSignal returns a channel that is closed once Shutdown is called.
+func (i *Instance) closingSignal() <-chan struct{} {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.closing_signal == nil {
+		i.closing_signal = make(chan struct{})
+		if i.closing.Load() {
+			close(i.closing_signal)
+		}
+	}
+	return i.closing_signal
+}
+
+// Shutdown closes the instance gracefully. It stops accepting connections,
+// says GOODBYE to every peer, waits for queued writes and running handlers,
+// and then closes every connection and the signaling client. If the context
+// ends first, everything is closed immediately and the context's error is
+// returned.
+//
+// Since Shutdown waits for running handlers, a handler that calls it waits
+// for itself until the context ends. Handlers should call Stop instead.
+func (i *Instance) Shutdown(ctx context.Context) error {
+	return i.ShutdownWithReason(ctx, "shutting down")
+}
+
+// ShutdownWithReason is a variant of Shutdown that tells peers why we are leaving.
+func (i *Instance) ShutdownWithReason(ctx context.Context, reason string) error {
+	if !i.closing.CompareAndSwap(false, true) {
+		return nil
+	}
+	i.mu.Lock()
+	if i.closing_signal != nil {
+		close(i.closing_signal)
+	}
+	i.mu.Unlock()
+	i.Logger.Info().Str("reason", reason).Msg("Shutting down peer instance...")
+
+	i.StopMesh()
+	i.StopPEX()
+
+	peers := i.ConnectedPeers()
+	errs := make(chan error, len(peers))
+	for _, p := range peers {
+		go func() {
+			errs <- p.disconnect(ctx, reason)
+		}()
+	}
+
+	var shutdown_err error
+	for range peers {
+		if err := <-errs; err != nil && shutdown_err == nil {
+			shutdown_err = err
+		}
+	}
+
+	// Handlers of peers that closed on their own may still be running
+	if err := i.inflight.wait(ctx); err != nil && shutdown_err == nil {
+		shutdown_err = err
+	}
+	if shutdown_err != nil {
+		i.Logger.Warn().Err(shutdown_err).Msg("Shutdown deadline passed, closing immediately")
+	}
+
+	// Destroy emits "close" synchronously, and its handler takes the lock
+	i.mu.Lock()
+	handler := i.Handler
+	i.Handler = nil
+	i.mu.Unlock()
+	if handler != nil {
+		handler.Destroy()
+	}
+
+	return shutdown_err
+}
+
+// Disconnect says GOODBYE to the peer with the given reason and closes the
+// connection once queued writes are flushed and its running handlers have
+// returned, or after ShutdownTimeout. It does not block, so it is safe to
+// call from the peer's own handlers. The peer is not redialed.
+func (c *Peer) Disconnect(reason string) {
+	c.StopRedial()
+	c.sendGoodbye(reason)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), c.Parent.ShutdownTimeout)
+		defer cancel()
+		c.drain(ctx)
+		c.Close()
+	}()
+}
+
+// disconnect is a blocking variant of Disconnect, used by Shutdown.
+func (c *Peer) disconnect(ctx context.Context, reason string) error {
+	c.StopRedial()
+	c.sendGoodbye(reason)
+	err := c.drain(ctx)
+	c.Close()
+	return err
+}
+
+func (c *Peer) sendGoodbye(reason string) {
+	c.Logger.Info().Str("reason", reason).Msg("saying goodbye")
+	c.Write(&TxPacket{
+		Packet:  Packet{Opcode: "GOODBYE", TTL: 1},
+		Payload: GoodbyeArgs{Reason: reason},
+	})
+}
+
+// drain waits until the send buffer is empty and no handlers are running.
+func (c *Peer) drain(ctx context.Context) error {
+	if err := c.flush(ctx); err != nil {
+		return err
+	}
+	return c.inflight.wait(ctx)
+}
+
+// flush waits until everything written to the peer has left the send buffer.
+func (c *Peer) flush(ctx context.Context) error {
+	conn, done := c.connection(), c.Closed()
+	ticker := time.NewTicker(5 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		dc := conn.DataChannel
+		if dc == nil || dc.BufferedAmount() == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (conn *Peer) HandleGoodbye(r *RxPacket) {
+	var args GoodbyeArgs
+	if err := json.Unmarshal(r.Payload, &args); err != nil {
+		conn.Logger.Error().Err(err).Msg("failed to unmarshal goodbye")
+	}
+	conn.Logger.Info().Str("reason", args.Reason).Msg("peer said goodbye")
+
+	// The peer left on purpose, so there is nothing to redial
+	conn.StopRedial()
+	if fn := conn.Parent.OnGoodbye; fn != nil {
+		fn(conn, args.Reason)
+	}
+}
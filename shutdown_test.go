@@ -0,0 +1,150 @@
+package duplex
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestInflightWait(t *testing.T) {
+	var f inflight
+	if err := f.wait(context.Background()); err != nil {
+		t.Fatal("waiting with nothing in flight:", err)
+	}
+
+	f.add()
+	f.add()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := f.wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("wait returned %v with handlers running", err)
+	}
+
+	f.done()
+	f.done()
+	if err := f.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShutdownSaysGoodbye(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+	p.setPersistent(true)
+	i.Peers["beta"] = p
+
+	// The connection never opened, so the GOODBYE surfaces as a send error
+	sent := make(chan struct{}, 1)
+	p.On("error", func(any) {
+		select {
+		case sent <- struct{}{}:
+		default:
+		}
+	})
+
+	if err := i.ShutdownWithReason(context.Background(), "maintenance"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("nothing written to the peer")
+	}
+	if p.IsPersistent() {
+		t.Fatal("peer would be redialed after shutdown")
+	}
+	if !i.Closing() {
+		t.Fatal("instance not closing")
+	}
+	if err := i.Shutdown(context.Background()); err != nil {
+		t.Fatal("second shutdown:", err)
+	}
+}
+
+func TestShutdownWaitsForHandlers(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	release := make(chan struct{})
+	i.Bind("WORK", func(*Peer, *RxPacket) { <-release })
+	unopenedPeer(i).handleAsync(&RxPacket{Packet: Packet{Opcode: "WORK", TTL: 1}})
+
+	done := make(chan error, 1)
+	go func() { done <- i.Shutdown(context.Background()) }()
+	select {
+	case err := <-done:
+		t.Fatalf("shutdown returned %v while a handler was running", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	release := make(chan struct{})
+	defer close(release)
+	i.Bind("WORK", func(*Peer, *RxPacket) { <-release })
+	unopenedPeer(i).handleAsync(&RxPacket{Packet: Packet{Opcode: "WORK", TTL: 1}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := i.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("shutdown returned %v", err)
+	}
+}
+
+func TestDisconnectFromHandler(t *testing.T) {
+	// Far longer than the test timeout, so waiting on the handler would hang
+	i := New("alpha", &Config{ShutdownTimeout: 60000, LogLevel: zerolog.Disabled})
+	i.Bind("QUIT", func(p *Peer, _ *RxPacket) { p.Disconnect("done") })
+	p := unopenedPeer(i)
+	p.setPersistent(true)
+
+	if !returnsWithin(func() { p.handle(&RxPacket{Packet: Packet{Opcode: "QUIT", TTL: 1}}) }, time.Second) {
+		t.Fatal("Disconnect waited on its own handler")
+	}
+	if p.IsPersistent() {
+		t.Fatal("disconnected peer would be redialed")
+	}
+	if i.Closing() {
+		t.Fatal("disconnecting a peer shut the instance down")
+	}
+}
+
+func TestGoodbyeStopsRedial(t *testing.T) {
+	i := New("alpha", &Config{LogLevel: zerolog.Disabled})
+	p := unopenedPeer(i)
+	p.setPersistent(true)
+
+	var reason string
+	i.OnGoodbye = func(_ *Peer, r string) { reason = r }
+	p.HandleGoodbye(&RxPacket{Packet: Packet{Opcode: "GOODBYE"}, Payload: []byte(`{"reason":"bye"}`)})
+	if reason != "bye" {
+		t.Fatalf("OnGoodbye got %q", reason)
+	}
+	if p.IsPersistent() {
+		t.Fatal("peer that said goodbye would be redialed")
+	}
+}
+
+func TestStopFromHandler(t *testing.T) {
+	// Far longer than the test timeout, so waiting on the handler would hang
+	i := New("alpha", &Config{ShutdownTimeout: 60000, LogLevel: zerolog.Disabled})
+	i.Bind("QUIT", func(*Peer, *RxPacket) { i.Stop() })
+	p := unopenedPeer(i)
+
+	if !returnsWithin(func() { p.handle(&RxPacket{Packet: Packet{Opcode: "QUIT", TTL: 1}}) }, time.Second) {
+		t.Fatal("Stop waited on its own handler")
+	}
+	deadline := time.Now().Add(time.Second)
+	for !i.Closing() {
+		if time.Now().After(deadline) {
+			t.Fatal("instance not shut down")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
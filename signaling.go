@@ -0,0 +1,71 @@
+package duplex
+
+import (
+	"errors"
+
+	"github.com/cloudlink-delta/duplex/signaling"
+)
+
+var ErrSignalingNotListening = errors.New("signaling server is not listening")
+
+// UseSignaling points the instance at a signaling server running in this
+// process, instead of the configured Hostname. Several instances may share
+// one server. It takes effect the next time the instance connects to the
+// signaling server, so call it before Start.
+func (i *Instance) UseSignaling(s *signaling.Server) error {
+	host, port, ok := s.Endpoint()
+	if !ok {
+		return ErrSignalingNotListening
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.Signaling = s
+	i.setSignalingEndpoint(host, port, s.Key(), s.Path())
+	return nil
+}
+
+// setSignalingEndpoint points the signaling client at a plain WebSocket
+// server. The caller holds the lock.
+func (i *Instance) setSignalingEndpoint(host string, port int, key, path string) {
+	i.peerjs_config.Host = host
+	i.peerjs_config.Port = port
+	i.peerjs_config.Secure = false
+	i.peerjs_config.Key = key
+	i.peerjs_config.Path = path
+}
+
+// startSignaling runs the embedded signaling server configured with
+// SignalingListen, unless the instance already uses one.
+func (i *Instance) startSignaling() error {
+	if i.SignalingListen == "" || i.Signaling != nil {
+		return nil
+	}
+
+	s := signaling.New(signaling.Options{Logger: i.Logger})
+	if err := s.Listen(i.SignalingListen); err != nil {
+		s.Close()
+		return err
+	}
+	if err := i.UseSignaling(s); err != nil {
+		s.Close()
+		return err
+	}
+	i.owns_signaling = true
+	return nil
+}
+
+// stopSignaling closes the embedded signaling server if the instance started it.
+func (i *Instance) stopSignaling() {
+	i.mu.Lock()
+	s := i.Signaling
+	owned := i.owns_signaling
+	if owned {
+		i.Signaling = nil
+		i.owns_signaling = false
+	}
+	i.mu.Unlock()
+	if owned {
+		s.Close()
+	}
+}
@@ -0,0 +1,491 @@
+// Package signaling implements a PeerJS compatible signaling server. It
+// allocates peer IDs, relays OFFER, ANSWER and CANDIDATE messages between
+// peers over WebSockets, and drops peers that stop sending heartbeats.
+//
+// A Server can run standalone with Listen, be mounted on an existing HTTP
+// server as an http.Handler, or be embedded in a duplex instance so that
+// instances in the same process, or on the same LAN, need no external server.
+package signaling
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+)
+
+// Message types of the PeerJS signaling protocol.
+const (
+	TypeOpen       = "OPEN"
+	TypeError      = "ERROR"
+	TypeIDTaken    = "ID-TAKEN"
+	TypeInvalidKey = "INVALID-KEY"
+	TypeHeartbeat  = "HEARTBEAT"
+	TypeOffer      = "OFFER"
+	TypeAnswer     = "ANSWER"
+	TypeCandidate  = "CANDIDATE"
+	TypeLeave      = "LEAVE"
+	TypeExpire     = "EXPIRE"
+)
+
+var ErrServerClosed = errors.New("signaling server closed")
+
+// Message is a signaling message. Payloads are relayed as they are.
+type Message struct {
+	Type    string          `json:"type"`
+	Src     string          `json:"src,omitempty"`
+	Dst     string          `json:"dst,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type ErrorPayload struct {
+	Msg string `json:"msg"`
+}
+
+type Options struct {
+	Key             string          // API key clients must present (default "peerjs")
+	Path            string          // Path the server is mounted on (default "/")
+	AliveTimeout    time.Duration   // Peers that send no heartbeat for this long are dropped (default 60s)
+	ExpireTimeout   time.Duration   // How long messages to peers that are not connected yet are queued (default 5s)
+	ConcurrentLimit int             // Peers that may be connected at once (default 5000)
+	AllowDiscovery  bool            // Serve the list of connected peer IDs at <path>/<key>/peers
+	Logger          *zerolog.Logger // Defaults to a console logger at info level
+}
+
+type client struct {
+	id        string
+	token     string
+	conn      *websocket.Conn
+	mu        sync.Mutex // Serializes writes to conn
+	last_ping atomic.Int64
+}
+
+func (c *client) send(msg *Message) error {
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return c.conn.WriteMessage(websocket.TextMessage, raw)
+}
+
+type queued struct {
+	msg *Message
+	at  time.Time
+}
+
+// Server is a PeerJS signaling server.
+type Server struct {
+	opts     Options
+	logger   zerolog.Logger
+	upgrader websocket.Upgrader
+	mux      *http.ServeMux
+	mu       sync.Mutex
+	clients  map[string]*client
+	queues   map[string][]queued // Messages waiting for their destination to connect
+	listener net.Listener
+	http     *http.Server
+	stop     chan struct{}
+	closed   bool
+}
+
+// New creates a signaling server and starts its housekeeping. Close stops it.
+func New(opts Options) *Server {
+	if opts.Key == "" {
+		opts.Key = "peerjs"
+	}
+	if opts.Path == "" {
+		opts.Path = "/"
+	}
+	if opts.AliveTimeout <= 0 {
+		opts.AliveTimeout = time.Minute
+	}
+	if opts.ExpireTimeout <= 0 {
+		opts.ExpireTimeout = 5 * time.Second
+	}
+	if opts.ConcurrentLimit <= 0 {
+		opts.ConcurrentLimit = 5000
+	}
+
+	s := &Server{
+		opts:    opts,
+		clients: make(map[string]*client),
+		queues:  make(map[string][]queued),
+		stop:    make(chan struct{}),
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+	if opts.Logger != nil {
+		s.logger = opts.Logger.With().Str("component", "signaling").Logger()
+	} else {
+		output := zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}
+		s.logger = zerolog.New(output).With().Timestamp().Str("component", "signaling").Logger().Level(zerolog.InfoLevel)
+	}
+
+	prefix := strings.TrimSuffix(opts.Path, "/")
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("GET "+prefix+"/{$}", s.handleInfo)
+	s.mux.HandleFunc("GET "+prefix+"/peerjs", s.handleSocket)
+	s.mux.HandleFunc("GET "+prefix+"/{key}/id", s.handleID)
+	s.mux.HandleFunc("GET "+prefix+"/{key}/peers", s.handlePeers)
+
+	go s.housekeeping()
+	return s
+}
+
+// Key returns the API key clients must present.
+func (s *Server) Key() string {
+	return s.opts.Key
+}
+
+// Path returns the path the server is mounted on.
+func (s *Server) Path() string {
+	return s.opts.Path
+}
+
+// Listen starts serving on the given address, e.g. ":9000", and returns once
+// the server is listening.
+func (s *Server) Listen(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.listener = listener
+	s.mu.Unlock()
+	go s.Serve(listener)
+	return nil
+}
+
+// Serve serves signaling on a listener until the server is closed.
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	s.listener = listener
+	s.http = &http.Server{Handler: s, ReadHeaderTimeout: 10 * time.Second}
+	srv := s.http
+	s.mu.Unlock()
+
+	s.logger.Info().Str("addr", listener.Addr().String()).Msg("signaling server listening")
+	if err := srv.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return ErrServerClosed
+}
+
+// Addr returns the address the server is listening on, or nil if it is only
+// used as an http.Handler.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Endpoint returns the host and port that clients in this process or on
+// this machine should connect to.
+func (s *Server) Endpoint() (host string, port int, ok bool) {
+	addr, is_tcp := s.Addr().(*net.TCPAddr)
+	if !is_tcp {
+		return "", 0, false
+	}
+	switch {
+	case addr.IP == nil || addr.IP.IsUnspecified():
+		host = "127.0.0.1"
+	case addr.IP.To4() == nil:
+		host = "[" + addr.IP.String() + "]"
+	default:
+		host = addr.IP.String()
+	}
+	return host, addr.Port, true
+}
+
+// Peers returns the IDs of the connected peers.
+func (s *Server) Peers() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0, len(s.clients))
+	for id := range s.clients {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// Close disconnects every peer and stops the server.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.stop)
+	clients := s.clients
+	s.clients = make(map[string]*client)
+	s.queues = make(map[string][]queued)
+	srv := s.http
+	s.mu.Unlock()
+
+	for _, c := range clients {
+		c.conn.Close()
+	}
+	if srv != nil {
+		return srv.Close()
+	}
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) handleInfo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"name":        "PeerJS Server",
+		"description": "A server side element to broker connections between PeerJS clients.",
+	})
+}
+
+func (s *Server) handleID(w http.ResponseWriter, r *http.Request) {
+	if r.PathValue("key") != s.opts.Key {
+		http.Error(w, "Invalid key provided", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(s.newID()))
+}
+
+func (s *Server) handlePeers(w http.ResponseWriter, r *http.Request) {
+	if r.PathValue("key") != s.opts.Key || !s.opts.AllowDiscovery {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Peers())
+}
+
+// newID returns a random peer ID that is not in use.
+func (s *Server) newID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		b := make([]byte, 8)
+		rand.Read(b)
+		id := hex.EncodeToString(b)
+		if _, taken := s.clients[id]; !taken {
+			return id
+		}
+	}
+}
+
+func (s *Server) handleSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	query := r.URL.Query()
+	key, id, token := query.Get("key"), query.Get("id"), query.Get("token")
+	reject := func(msg_type, reason string) {
+		payload, _ := json.Marshal(ErrorPayload{Msg: reason})
+		c := &client{conn: conn}
+		c.send(&Message{Type: msg_type, Payload: payload})
+		conn.Close()
+	}
+
+	if id == "" || token == "" || key == "" {
+		reject(TypeError, "No id, token, or key supplied to websocket server")
+		return
+	}
+	if key != s.opts.Key {
+		reject(TypeInvalidKey, "Invalid key provided")
+		return
+	}
+
+	c := &client{id: id, token: token, conn: conn}
+	c.last_ping.Store(time.Now().UnixNano())
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		reject(TypeError, "Server is shutting down")
+		return
+	}
+	existing, taken := s.clients[id]
+	switch {
+	case taken && existing.token != token:
+		s.mu.Unlock()
+		reject(TypeIDTaken, "ID is taken")
+		return
+	case !taken && len(s.clients) >= s.opts.ConcurrentLimit:
+		s.mu.Unlock()
+		reject(TypeError, "Server has reached its concurrent user limit")
+		return
+	}
+	// A peer reconnecting with its token takes over its ID
+	s.clients[id] = c
+	pending := s.queues[id]
+	delete(s.queues, id)
+	s.mu.Unlock()
+	if taken {
+		existing.conn.Close()
+	}
+
+	s.logger.Debug().Str("peer_id", id).Msg("peer connected")
+	if err := c.send(&Message{Type: TypeOpen}); err != nil {
+		s.drop(c)
+		return
+	}
+	for _, q := range pending {
+		s.relay(q.msg)
+	}
+
+	s.read(c)
+}
+
+// read handles messages from a peer until its socket closes.
+func (s *Server) read(c *client) {
+	defer s.drop(c)
+	for {
+		_, raw, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var msg Message
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			s.logger.Debug().Err(err).Str("peer_id", c.id).Msg("invalid message")
+			continue
+		}
+		c.last_ping.Store(time.Now().UnixNano())
+
+		switch msg.Type {
+		case TypeHeartbeat:
+		case TypeOffer, TypeAnswer, TypeCandidate, TypeLeave, TypeExpire:
+			if msg.Dst == "" {
+				if msg.Type == TypeLeave {
+					return
+				}
+				continue
+			}
+			msg.Src = c.id
+			s.relay(&msg)
+		default:
+			s.logger.Debug().Str("peer_id", c.id).Str("type", msg.Type).Msg("unknown message type")
+		}
+	}
+}
+
+// relay delivers a message to its destination, or queues it until the
+// destination connects.
+func (s *Server) relay(msg *Message) {
+	s.mu.Lock()
+	dst, ok := s.clients[msg.Dst]
+	if !ok {
+		// LEAVE and EXPIRE are only useful to peers that are still connected
+		if msg.Type != TypeLeave && msg.Type != TypeExpire {
+			s.queues[msg.Dst] = append(s.queues[msg.Dst], queued{msg: msg, at: time.Now()})
+		}
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+
+	if err := dst.send(msg); err != nil {
+		s.drop(dst)
+
+		// Tell the sender that the destination is gone
+		s.mu.Lock()
+		src, ok := s.clients[msg.Src]
+		s.mu.Unlock()
+		if ok {
+			src.send(&Message{Type: TypeLeave, Src: msg.Dst, Dst: msg.Src})
+		}
+	}
+}
+
+// drop removes a peer, unless it has already been replaced by a reconnect.
+func (s *Server) drop(c *client) {
+	c.conn.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.clients[c.id] == c {
+		delete(s.clients, c.id)
+		s.logger.Debug().Str("peer_id", c.id).Msg("peer disconnected")
+	}
+}
+
+// housekeeping drops peers that stopped sending heartbeats and expires
+// queued messages.
+func (s *Server) housekeeping() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+
+		now := time.Now()
+		var dead []*client
+		type expiry struct{ src, dst string }
+		var expired []expiry
+
+		s.mu.Lock()
+		for _, c := range s.clients {
+			if now.Sub(time.Unix(0, c.last_ping.Load())) > s.opts.AliveTimeout {
+				dead = append(dead, c)
+			}
+		}
+		for dst, queue := range s.queues {
+			queue = slices.DeleteFunc(queue, func(q queued) bool {
+				if now.Sub(q.at) <= s.opts.ExpireTimeout {
+					return false
+				}
+				e := expiry{src: q.msg.Src, dst: dst}
+				if !slices.Contains(expired, e) {
+					expired = append(expired, e)
+				}
+				return true
+			})
+			if len(queue) == 0 {
+				delete(s.queues, dst)
+			} else {
+				s.queues[dst] = queue
+			}
+		}
+		s.mu.Unlock()
+
+		for _, c := range dead {
+			s.logger.Debug().Str("peer_id", c.id).Msg("peer stopped sending heartbeats")
+			s.drop(c)
+		}
+		for _, e := range expired {
+			s.relay(&Message{Type: TypeExpire, Src: e.dst, Dst: e.src})
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package signaling
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goccy/go-json"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog"
+)
+
+func newTestServer(t *testing.T, opts Options) (*Server, *httptest.Server) {
+	t.Helper()
+	logger := zerolog.Nop()
+	opts.Logger = &logger
+	s := New(opts)
+	ts := httptest.NewServer(s)
+	t.Cleanup(func() {
+		ts.Close()
+		s.Close()
+	})
+	return s, ts
+}
+
+// dial opens a signaling socket with the given query parameters.
+func dial(t *testing.T, ts *httptest.Server, key, id, token string) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/peerjs?key=" + key + "&id=" + id + "&token=" + token
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func receive(t *testing.T, conn *websocket.Conn) *Message {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	var msg Message
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	return &msg
+}
+
+// open connects a peer and waits for the server to accept it.
+func open(t *testing.T, ts *httptest.Server, id string) *websocket.Conn {
+	t.Helper()
+	conn := dial(t, ts, "peerjs", id, id+"-token")
+	if msg := receive(t, conn); msg.Type != TypeOpen {
+		t.Fatalf("%s: handshake ended with %+v", id, msg)
+	}
+	return conn
+}
+
+func TestHandshakeRejections(t *testing.T) {
+	_, ts := newTestServer(t, Options{})
+
+	if msg := receive(t, dial(t, ts, "wrong", "alpha", "token")); msg.Type != TypeInvalidKey {
+		t.Fatalf("wrong key: %+v", msg)
+	}
+	if msg := receive(t, dial(t, ts, "peerjs", "alpha", "")); msg.Type != TypeError {
+		t.Fatalf("missing token: %+v", msg)
+	}
+
+	open(t, ts, "alpha")
+	if msg := receive(t, dial(t, ts, "peerjs", "alpha", "other-token")); msg.Type != TypeIDTaken {
+		t.Fatalf("taken ID: %+v", msg)
+	}
+}
+
+func TestReconnectWithTokenTakesOverID(t *testing.T) {
+	s, ts := newTestServer(t, Options{})
+	old := open(t, ts, "alpha")
+	open(t, ts, "alpha")
+
+	old.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, _, err := old.ReadMessage(); err == nil {
+		t.Fatal("replaced socket left open")
+	}
+	if peers := s.Peers(); len(peers) != 1 || peers[0] != "alpha" {
+		t.Fatalf("peers %v", peers)
+	}
+}
+
+func TestConcurrentLimit(t *testing.T) {
+	_, ts := newTestServer(t, Options{ConcurrentLimit: 1})
+	open(t, ts, "alpha")
+	if msg := receive(t, dial(t, ts, "peerjs", "beta", "token")); msg.Type != TypeError {
+		t.Fatalf("over the limit: %+v", msg)
+	}
+}
+
+func TestRelayStampsSource(t *testing.T) {
+	_, ts := newTestServer(t, Options{})
+	alpha := open(t, ts, "alpha")
+	beta := open(t, ts, "beta")
+
+	offer := Message{Type: TypeOffer, Src: "mallory", Dst: "beta", Payload: json.RawMessage(`{"sdp":"offer"}`)}
+	if err := alpha.WriteJSON(offer); err != nil {
+		t.Fatal(err)
+	}
+	msg := receive(t, beta)
+	if msg.Type != TypeOffer || msg.Src != "alpha" || string(msg.Payload) != `{"sdp":"offer"}` {
+		t.Fatalf("relayed %+v", msg)
+	}
+
+	// Heartbeats are not relayed
+	alpha.WriteJSON(Message{Type: TypeHeartbeat})
+	beta.WriteJSON(Message{Type: TypeAnswer, Dst: "alpha", Payload: json.RawMessage(`{"sdp":"answer"}`)})
+	if msg := receive(t, alpha); msg.Type != TypeAnswer || msg.Src != "beta" {
+		t.Fatalf("relayed %+v", msg)
+	}
+}
+
+func TestQueuedUntilDestinationConnects(t *testing.T) {
+	_, ts := newTestServer(t, Options{})
+	alpha := open(t, ts, "alpha")
+
+	alpha.WriteJSON(Message{Type: TypeCandidate, Dst: "beta", Payload: json.RawMessage(`{"candidate":"c"}`)})
+	alpha.WriteJSON(Message{Type: TypeLeave, Dst: "beta"})
+
+	// Messages are handled in order, so once this comes back the others are queued
+	alpha.WriteJSON(Message{Type: TypeOffer, Dst: "alpha"})
+	receive(t, alpha)
+
+	beta := open(t, ts, "beta")
+	if msg := receive(t, beta); msg.Type != TypeCandidate || msg.Src != "alpha" {
+		t.Fatalf("queued %+v", msg)
+	}
+}
+
+func TestQueuedMessagesExpire(t *testing.T) {
+	_, ts := newTestServer(t, Options{ExpireTimeout: time.Millisecond})
+	alpha := open(t, ts, "alpha")
+
+	alpha.WriteJSON(Message{Type: TypeOffer, Dst: "beta"})
+	if msg := receive(t, alpha); msg.Type != TypeExpire || msg.Src != "beta" {
+		t.Fatalf("expiry %+v", msg)
+	}
+}
+
+func TestHTTPEndpoints(t *testing.T) {
+	_, ts := newTestServer(t, Options{Key: "secret", AllowDiscovery: true})
+	get := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if status, id := get("/secret/id"); status != http.StatusOK || len(id) != 16 {
+		t.Fatalf("id %d %q", status, id)
+	}
+	if status, _ := get("/peerjs/id"); status != http.StatusUnauthorized {
+		t.Fatalf("id with the wrong key: %d", status)
+	}
+
+	receive(t, dial(t, ts, "secret", "alpha", "token"))
+	if status, peers := get("/secret/peers"); status != http.StatusOK || strings.TrimSpace(peers) != `["alpha"]` {
+		t.Fatalf("peers %d %q", status, peers)
+	}
+}
@@ -0,0 +1,37 @@
+package duplex
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestEmbeddedSignaling(t *testing.T) {
+	i := New("alpha", &Config{SignalingListen: "127.0.0.1:0", LogLevel: zerolog.Disabled})
+	created := make(chan struct{}, 1)
+	i.OnCreate = func() { created <- struct{}{} }
+
+	if err := i.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	server := i.Signaling
+	select {
+	case <-created:
+	case <-time.After(5 * time.Second):
+		t.Fatal("never registered with the embedded signaling server")
+	}
+	if peers := server.Peers(); !slices.Contains(peers, "alpha") {
+		t.Fatalf("signaling peers %v", peers)
+	}
+
+	i.Stop()
+	if err := waitFor(t, i); err != nil {
+		t.Fatal(err)
+	}
+	if i.Signaling != nil || len(server.Peers()) != 0 {
+		t.Fatal("embedded signaling server left running")
+	}
+}
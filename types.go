@@ -1,14 +1,33 @@
 package duplex
 
 import (
+	"context"
+	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/cloudlink-delta/duplex/lan"
+	"github.com/cloudlink-delta/duplex/signaling"
 	peer "github.com/cloudlink-delta/peerjs-go"
 	"github.com/goccy/go-json"
 	"github.com/rs/zerolog"
 )
 
+var (
+	ErrPeerClosed = errors.New("peer connection closed")
+)
+
+// RemoteError is an error reported by the remote side of a request.
+type RemoteError struct {
+	Opcode  string // Opcode of the request that failed
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return e.Opcode + ": " + e.Message
+}
+
 type Listener func(*RxPacket)
 type OpcodeMatcher struct {
 	Opcodes  []string
@@ -23,33 +42,124 @@ type Peer struct {
 	KeyLock              *sync.Mutex
 	OpcodeMatchers       map[*Peer]*OpcodeMatcher // Map of key-value pairs to listen to specific opcodes from specific peers.
 	Listeners            map[string]Listener      // Map of key-value pairs to listeners.
-	Features             []string                 // List of features advertised by this peer
-	IsInitiator          bool                     // True if this peer initiated the connection
-	IsBridge             bool                     // True if this peer is a bridge
-	IsRelay              bool                     // True if this peer is a relay
-	IsDiscovery          bool                     // True if this peer is a discovery
-	Done                 chan bool                // Channel to signal connection closure
-	RTT                  int64                    // Round-trip time (in milliseconds)
+	ListenerLock         *sync.Mutex
+	Features             []string        // List of features advertised by this peer
+	Version              VersionArgs     // Implementation and version the peer reported during negotiation
+	SpecVersion          int             // Protocol spec version the peer reported during negotiation
+	Plugins              []string        // Plugins the peer reported during negotiation
+	IsInitiator          bool            // True if this peer initiated the connection
+	IsBridge             bool            // True if this peer is a bridge
+	IsRelay              bool            // True if this peer is a relay
+	IsDiscovery          bool            // True if this peer is a discovery
+	Done                 chan bool       // Channel to signal connection closure, replaced when a persistent peer is redialed (see Closed)
+	RTT                  int64           // Smoothed round-trip time (in milliseconds), copied from Latency after each PONG
+	Latency              *LatencyTracker // Round-trip time statistics
+	Clock                *ClockEstimator // Clock offset estimate relative to this peer
 	GiveNameRemapper     func() string
 	Logger               zerolog.Logger
+	negotiation_log      zerolog.Logger
+	packet_log           zerolog.Logger
+	last_rx              atomic.Int64 // Unix nanoseconds of the last inbound message
+	last_tx              atomic.Int64 // Unix nanoseconds of the last outbound message
+	session              atomic.Pointer[Session]
+	duplicate            bool         // True if the connection lost glare resolution before it was announced
+	id                   string       // Remote peer ID, fixed when the Peer is created
+	bind                 sync.RWMutex // Guards DataConnection and Done, which change when the peer is redialed
+	persistent           bool         // Guarded by KeyLock
+	redialing            bool         // Guarded by KeyLock
+	reconnects           int          // Guarded by KeyLock
+	sink                 func([]byte) // Receives written packets instead of the connection, for replayed peers
+	inflight             inflight
 	*peer.DataConnection // Pointer to the peer data connection
 }
 
 // Instance is a representation of a duplex instance.
 type Instance struct {
 	Name                             string
-	Pinger                           bool
-	PingInterval                     time.Duration
+	Pinger                           bool          // Ping peers we connected to
+	PingInterval                     time.Duration // Interval between pings to peers we connected to
+	IncomingPinger                   bool          // Ping peers that connected to us
+	IncomingPingInterval             time.Duration // Interval between pings to peers that connected to us
+	IdleTimeout                      time.Duration // Close peers that have sent nothing for this long (0 disables)
+	KeepaliveInterval                time.Duration // Ping peers we have not written to for this long (0 disables)
+	ClockSamples                     int           // Number of samples kept by each peer's clock filter
+	TimeSource                       string        // Peer ID used as the network time reference, elected if empty
+	MaxMissedPings                   int           // Consecutive unanswered pings before a peer is declared dead (0 disables)
 	Handler                          *peer.Peer
 	Close                            chan bool
 	Done                             chan bool
 	RetryCounter                     int
-	MaxRetries                       int
+	MaxRetries                       int           // Reconnect attempts before giving up (0 retries forever)
+	SetupTimeout                     time.Duration // How long a single reconnect attempt may take
+	ReconnectPolicy                  BackoffPolicy // Delay between reconnect attempts, DefaultBackoff if nil
+	OnReconnecting                   func(attempt int, delay time.Duration)
+	OnReconnected                    func(attempts int)
+	OnGiveUp                         func(attempts int)
+	RedialPolicy                     BackoffPolicy // Delay between redials of persistent peers
+	MaxRedials                       int           // Redial attempts per outage before a persistent peer is dropped (0 retries forever)
+	EnableSessions                   bool          // Sequence packets and resume sessions across reconnects
+	SessionReplaySize                int           // Unacknowledged packets kept for replay per session
+	SessionAckInterval               time.Duration // Interval between session acknowledgements
+	SessionTimeout                   time.Duration // How long a dropped session may be resumed
+	sessions                         map[string]*Session
+	sessionsMu                       sync.Mutex
+	DeliveryRetryPolicy              BackoffPolicy // Delay between resends of unacknowledged reliable packets
+	DeliveryTimeout                  time.Duration // Default deadline for reliable packets
+	DeliveryDedupWindow              time.Duration // How long received reliable packet Ids are remembered
+	deliveries                       map[string]*Delivery
+	deliveriesMu                     sync.Mutex
+	seen                             map[string]time.Time
+	seen_pruned                      time.Time
+	seenMu                           sync.Mutex
+	MaxSubscriptions                 int // Topic subscriptions allowed per peer (0 is unlimited)
+	topics                           subscriptions
+	OnRoomJoin                       func(*Room, *Peer)
+	OnRoomLeave                      func(*Room, *Peer)
+	OnRoomMessage                    func(peer *Peer, room string, data json.RawMessage)
+	rooms                            map[string]*Room
+	roomsMu                          sync.Mutex
+	announcement                     *Announcement
+	registry                         discovery_registry
+	MaxRelayClients                  int              // Clients a relay accepts (0 is unlimited)
+	RelayQuota                       RelayQuota       // Per-client forwarding quota applied by a relay
+	AuthorizeRelayClient             func(*Peer) bool // Decides whether a peer may register with this relay
+	AutoRegisterRelays               bool             // Register with every relay peer after negotiation
+	TrustedRelays                    []string         // Relay peer IDs allowed to forward packets on behalf of others, see Config.TrustedRelays
+	relay                            relay_state
+	names                            name_registry
+	EnableMesh                       bool          // Maintain connections to candidate peers automatically
+	MeshDegree                       int           // Client connections the mesh manager dials up to
+	MeshMaxDegree                    int           // Client connections above which the slowest are closed
+	MeshInterval                     time.Duration // Interval between mesh refreshes
+	mesh                             mesh_state
+	EnablePEX                        bool          // Periodically exchange known peers with connected peers
+	PEXInterval                      time.Duration // Interval between peer exchanges
+	PEXSampleSize                    int           // Known peers sent in each exchange
+	PEXMaxAge                        time.Duration // How long a peer nobody has seen stays known
+	MaxKnownPeers                    int           // Size of the known peers table and of the mesh candidate list
+	known                            known_peers
+	rpc                              rpc_state
+	ShutdownTimeout                  time.Duration // How long Run and Disconnect wait for peers to drain
+	OnGoodbye                        func(peer *Peer, reason string)
+	closing                          atomic.Bool
+	closing_signal                   chan struct{} // Closed by Shutdown, see closingSignal
+	running                          bool
+	stop                             context.CancelCauseFunc
+	stopped                          chan struct{}
+	run_err                          error
+	inflight                         inflight
+	username                         string             // Name claimed with name service peers
+	BridgeURL                        string             // CloudLink 4 server that client peers are bridged to
+	BridgePrefix                     string             // Prefix given to CloudLink 4 users on the duplex side (default "cl4:")
+	BridgeUsername                   func(*Peer) string // Name a peer is given on the CloudLink 4 server (default peer ID)
+	bridges                          map[*Peer]*bridge_link
+	bridgesMu                        sync.Mutex
 	Peers                            Peers
 	OnCreate                         func()
 	AfterNegotiation                 func(*Peer)
 	OnOpen                           func(*Peer)
 	OnClose                          func(*Peer)
+	OnPacket                         func(peer *Peer, packet *RxPacket) // Called with every packet received, before it is handled
 	CustomHandlersRequiredFeatures   map[string][]string
 	CustomHandlers                   map[string]func(*Peer, *RxPacket)
 	RemappedHandlersRequiredFeatures map[string][]string
@@ -61,10 +171,21 @@ type Instance struct {
 	OnRelayConnected                 func(*Peer)
 	OnDiscoveryConnected             func(*Peer)
 	isReconnecting                   bool
+	reconnect_now                    chan struct{}
 	mu                               sync.Mutex
+	peersMu                          sync.RWMutex
 	active_time_start                time.Time
 	peerjs_config                    *peer.Options
 	Logger                           *zerolog.Logger
+	logs                             instance_logs
+	Capture                          CaptureOptions // Capture started by Start, if Path is set
+	capture                          atomic.Pointer[packet_capture]
+	Signaling                        *signaling.Server // Signaling server in this process that the instance connects to, see UseSignaling
+	SignalingListen                  string            // Address the embedded signaling server listens on, if any
+	owns_signaling                   bool
+	LANAdvertise                     bool     // Advertise the instance on the local network while it runs
+	LANInterfaces                    []string // Network interfaces used for LAN discovery, see Config.LANInterfaces
+	lan_advertiser                   *lan.Advertiser
 }
 
 type PeerState struct {
@@ -80,6 +201,8 @@ type Packet struct {
 	Id       string `json:"id,omitempty"`
 	Method   string `json:"method,omitempty"`
 	Listener string `json:"listener,omitempty"`
+	Seq      uint64 `json:"seq,omitempty"`      // Session sequence number, zero if the packet is not sequenced
+	Reliable bool   `json:"reliable,omitempty"` // Asks the final recipient to acknowledge the Id
 }
 
 type RxPacket struct {
@@ -102,13 +225,24 @@ func (p *TxPacket) String() string {
 	return string(resp)
 }
 
+type PingRequest struct {
+	T1 int64 `json:"t1"`
+}
+
+type PongReply struct {
+	T1 int64 `json:"t1"`           // Time the ping was sent, in sender clock milliseconds
+	T2 int64 `json:"t2"`           // Time the ping was received, in responder clock milliseconds
+	T3 int64 `json:"t3,omitempty"` // Time the pong was sent, in responder clock milliseconds
+}
+
 type NegotiationArgs struct {
-	Version     VersionArgs `json:"version"`
-	SpecVersion int         `json:"spec_version"`
-	Plugins     []string    `json:"plugins"`
-	IsBridge    bool        `json:"is_bridge"`
-	IsRelay     bool        `json:"is_relay"`
-	IsDiscovery bool        `json:"is_discovery"`
+	Version     VersionArgs  `json:"version"`
+	SpecVersion int          `json:"spec_version"`
+	Plugins     []string     `json:"plugins"`
+	IsBridge    bool         `json:"is_bridge"`
+	IsRelay     bool         `json:"is_relay"`
+	IsDiscovery bool         `json:"is_discovery"`
+	Session     *SessionArgs `json:"session,omitempty"`
 }
 
 type VersionArgs struct {